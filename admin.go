@@ -0,0 +1,664 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+const adminUsage = `usage: virtual-student-report-card [flags] admin <command>
+
+commands:
+  create-admin -name <name> -email <email> [-phone <phone>] [-password-stdin]
+  add-student -name <name> -email <email> [-phone <phone>]
+  archive-student <facultyNumber>
+  add-teacher -name <name> -email <email> [-phone <phone>]
+  archive-teacher <email>
+  reset-password <email> [-password-stdin]
+  list-courses
+  export [-o <file>]
+  import [-invite] <file>
+  run-migrations
+
+Results are written to stdout as JSON, errors to stderr as {"error", "code"}.
+People created without a password get an email to create one, and reset-password
+emails a reset code unless the password is read from stdin.`
+
+// adminEnv is what admin commands run with. The database is only opened once
+// the arguments are parsed, so that usage errors don't need one.
+type adminEnv struct {
+	cfg   config
+	stdin io.Reader
+	out   io.Writer
+}
+
+// conn opens the database without migrating it, whatever the server does on
+// start. Commands refuse to run against a schema with pending migrations.
+func (e adminEnv) conn() (dbConnection, error) {
+	cfg := e.cfg
+	cfg.DB.MigrateOnStart = false
+	return createDatabaseConnection(cfg)
+}
+
+func (e adminEnv) db() (*sqlx.DB, error) {
+	return openDatabase(e.cfg.DB)
+}
+
+// readPassword reads the first line of stdin, so that it doesn't end up in
+// the shell history.
+func (e adminEnv) readPassword() (string, error) {
+	line, err := bufio.NewReader(e.stdin).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return "", fmt.Errorf("no password on stdin")
+	}
+	return password, nil
+}
+
+// adminCommand declares its flags and the number of arguments it takes, and
+// returns the function that runs it with them.
+type adminCommand struct {
+	args  int
+	flags func(fs *flag.FlagSet) func(e adminEnv, args []string) (any, error)
+}
+
+var adminCommands = map[string]adminCommand{
+	"create-admin": {0, func(fs *flag.FlagSet) func(adminEnv, []string) (any, error) {
+		p := personFlags(fs)
+		fromStdin := fs.Bool("password-stdin", false, "read the password from stdin instead of emailing an invitation")
+
+		return func(e adminEnv, _ []string) (any, error) {
+			if err := validate(Teacher{Name: p.Name, Email: p.Email, Phone: p.Phone}, true); err != nil {
+				return nil, err
+			}
+
+			var password string
+			if *fromStdin {
+				var err error
+				if password, err = e.readPassword(); err != nil {
+					return nil, err
+				}
+			}
+
+			conn, err := e.conn()
+			if err != nil {
+				return nil, err
+			}
+			id, err := conn.insertAdmin(*p, password)
+			if err != nil {
+				return nil, err
+			}
+			return map[string]string{"ID": id, "Email": p.Email}, nil
+		}
+	}},
+	"add-student": {0, func(fs *flag.FlagSet) func(adminEnv, []string) (any, error) {
+		p := personFlags(fs)
+
+		return func(e adminEnv, _ []string) (any, error) {
+			s := Student{Name: p.Name, Email: p.Email, Phone: p.Phone}
+			if err := validate(s, true); err != nil {
+				return nil, err
+			}
+
+			conn, err := e.conn()
+			if err != nil {
+				return nil, err
+			}
+			if err = conn.insertStudent(s); err != nil {
+				return nil, err
+			}
+			return conn.studentByEmail(s.Email)
+		}
+	}},
+	"archive-student": {1, func(fs *flag.FlagSet) func(adminEnv, []string) (any, error) {
+		return func(e adminEnv, args []string) (any, error) {
+			conn, err := e.conn()
+			if err != nil {
+				return nil, err
+			}
+			if err = conn.archiveStudent(args[0]); err != nil {
+				return nil, err
+			}
+			return map[string]string{"FacultyNumber": args[0]}, nil
+		}
+	}},
+	"add-teacher": {0, func(fs *flag.FlagSet) func(adminEnv, []string) (any, error) {
+		p := personFlags(fs)
+
+		return func(e adminEnv, _ []string) (any, error) {
+			t := Teacher{Name: p.Name, Email: p.Email, Phone: p.Phone}
+			if err := validate(t, true); err != nil {
+				return nil, err
+			}
+
+			conn, err := e.conn()
+			if err != nil {
+				return nil, err
+			}
+			if err = conn.insertTeacher(t); err != nil {
+				return nil, err
+			}
+			return conn.teacherByEmail(t.Email)
+		}
+	}},
+	"archive-teacher": {1, func(fs *flag.FlagSet) func(adminEnv, []string) (any, error) {
+		return func(e adminEnv, args []string) (any, error) {
+			conn, err := e.conn()
+			if err != nil {
+				return nil, err
+			}
+			id, err := conn.personIDByEmail(args[0])
+			if err != nil {
+				return nil, err
+			}
+			if err = conn.archiveTeacher(id); err != nil {
+				return nil, err
+			}
+			return map[string]string{"ID": id, "Email": args[0]}, nil
+		}
+	}},
+	"reset-password": {1, func(fs *flag.FlagSet) func(adminEnv, []string) (any, error) {
+		fromStdin := fs.Bool("password-stdin", false, "read the new password from stdin instead of emailing a reset code")
+
+		return func(e adminEnv, args []string) (any, error) {
+			var password string
+			if *fromStdin {
+				var err error
+				if password, err = e.readPassword(); err != nil {
+					return nil, err
+				}
+			}
+
+			conn, err := e.conn()
+			if err != nil {
+				return nil, err
+			}
+			id, err := conn.personIDByEmail(args[0])
+			if err != nil {
+				return nil, err
+			}
+
+			if !*fromStdin {
+				if err = conn.resendPassword(args[0]); err != nil {
+					return nil, err
+				}
+				return map[string]string{"ID": id, "Email": args[0], "Method": "email"}, nil
+			}
+
+			// The old password may be known to someone else, so their sessions end.
+			if err = conn.savePassword(id, password); err != nil {
+				return nil, err
+			}
+			if err = conn.revokePersonSessions(id); err != nil {
+				return nil, err
+			}
+			return map[string]string{"ID": id, "Email": args[0], "Method": "password"}, nil
+		}
+	}},
+	"list-courses": {0, func(fs *flag.FlagSet) func(adminEnv, []string) (any, error) {
+		return func(e adminEnv, _ []string) (any, error) {
+			conn, err := e.conn()
+			if err != nil {
+				return nil, err
+			}
+			courses, err := conn.getCourses(scope{})
+			if courses == nil {
+				courses = []Course{}
+			}
+			return courses, err
+		}
+	}},
+	"export": {0, func(fs *flag.FlagSet) func(adminEnv, []string) (any, error) {
+		file := fs.String("o", "", "write the export to the file instead of stdout")
+
+		return func(e adminEnv, _ []string) (any, error) {
+			conn, err := e.conn()
+			if err != nil {
+				return nil, err
+			}
+			data, err := conn.exportData()
+			if err != nil || *file == "" {
+				return data, err
+			}
+
+			b, err := json.MarshalIndent(data, "", "  ")
+			if err != nil {
+				return nil, err
+			}
+			if err = os.WriteFile(*file, b, 0o600); err != nil {
+				return nil, err
+			}
+			return data.counts(), nil
+		}
+	}},
+	"import": {1, func(fs *flag.FlagSet) func(adminEnv, []string) (any, error) {
+		invite := fs.Bool("invite", false, "email the people created an invitation to create a password")
+
+		return func(e adminEnv, args []string) (any, error) {
+			b, err := os.ReadFile(args[0])
+			if err != nil {
+				return nil, err
+			}
+
+			var data exportData
+			if err = json.Unmarshal(b, &data); err != nil {
+				return nil, fmt.Errorf("reading %s: %w", args[0], err)
+			}
+
+			conn, err := e.conn()
+			if err != nil {
+				return nil, err
+			}
+			return conn.importData(data, *invite)
+		}
+	}},
+	"run-migrations": {0, func(fs *flag.FlagSet) func(adminEnv, []string) (any, error) {
+		return func(e adminEnv, _ []string) (any, error) {
+			db, err := e.db()
+			if err != nil {
+				return nil, err
+			}
+			m, err := newMigrator(db)
+			if err != nil {
+				return nil, err
+			}
+
+			pending, err := m.pending()
+			if err != nil {
+				return nil, err
+			}
+			if err = m.up(-1); err != nil {
+				return nil, err
+			}
+
+			applied := []appliedMigration{}
+			for _, v := range pending {
+				applied = append(applied, appliedMigration{Version: v.version, Name: v.name})
+			}
+			return map[string][]appliedMigration{"Applied": applied}, nil
+		}
+	}},
+}
+
+func personFlags(fs *flag.FlagSet) *person {
+	var p person
+	fs.StringVar(&p.Name, "name", "", "full name")
+	fs.StringVar(&p.Email, "email", "", "email address")
+	fs.StringVar(&p.Phone, "phone", "", "phone number")
+	return &p
+}
+
+// runAdminCommand runs the admin command of args and writes its result as JSON.
+func runAdminCommand(e adminEnv, args []string) error {
+	if len(args) == 0 {
+		return errAdminUsage
+	}
+
+	cmd, ok := adminCommands[args[0]]
+	if !ok {
+		return fmt.Errorf("%w: unknown command %q", errAdminUsage, args[0])
+	}
+
+	fs := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	run := cmd.flags(fs)
+	if err := fs.Parse(args[1:]); err != nil {
+		return fmt.Errorf("%w: %v", errAdminUsage, err)
+	}
+	if fs.NArg() != cmd.args {
+		return fmt.Errorf("%w: %s takes %d arguments", errAdminUsage, args[0], cmd.args)
+	}
+
+	result, err := run(e, fs.Args())
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(e.out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(result)
+}
+
+var errAdminUsage = errors.New("invalid admin command")
+
+// writeAdminError writes the error as JSON, with the code the API would answer
+// it with.
+func writeAdminError(w io.Writer, err error) {
+	out := struct {
+		Error  string          `json:"error"`
+		Code   string          `json:"code,omitempty"`
+		Errors validationError `json:"errors,omitempty"`
+	}{Error: err.Error()}
+
+	if p, ok := knownProblem(err); ok {
+		out.Code, out.Errors = p.Code, p.Errors
+	} else if errors.Is(err, errAdminUsage) {
+		out.Code = "usage"
+	}
+
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+// insertAdmin creates a person with the Admin role. Without a password they are
+// emailed an invitation to create one. The password is checked and hashed before
+// anything is inserted, so a refused one leaves no admin behind.
+func (conn dbConnection) insertAdmin(p person, password string) (string, error) {
+	var hashedPassword string
+	if password != "" {
+		if err := conn.passwords.check(password); err != nil {
+			return "", err
+		}
+
+		var err error
+		if hashedPassword, err = conn.passwords.hash(password); err != nil {
+			return "", err
+		}
+	}
+
+	tx, err := conn.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	var personID string
+	if password == "" {
+		personID, err = conn.insertPerson(tx, p)
+	} else {
+		err = tx.QueryRow("INSERT INTO person(name, email, phone) VALUES ($1, $2, $3) RETURNING id", p.Name, p.Email, p.Phone).Scan(&personID)
+		if err == nil {
+			err = conn.storePasswordHash(tx, personID, hashedPassword)
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if _, err = tx.Exec("INSERT INTO admin(person_id) VALUES ($1)", personID); err != nil {
+		return "", err
+	}
+	if err = tx.Commit(); err != nil {
+		return "", err
+	}
+	return personID, nil
+}
+
+// studentByEmail returns the active student with the email.
+func (conn dbConnection) studentByEmail(email string) (Student, error) {
+	var st Student
+	err := conn.db.Get(&st, "SELECT p.id as ID, name as Name, phone as Phone, email as Email, faculty_number as FacultyNumber FROM student JOIN person p on p.id = student.person_id WHERE student.active=TRUE AND p.email=$1", email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Student{}, errPersonNotFound
+	}
+	return st, err
+}
+
+// teacherByEmail returns the active teacher with the email.
+func (conn dbConnection) teacherByEmail(email string) (Teacher, error) {
+	var t Teacher
+	err := conn.db.Get(&t, "SELECT p.id as ID, name as Name, phone as Phone, email as Email FROM teacher JOIN person p on p.id = teacher.person_id WHERE teacher.active=TRUE AND p.email=$1", email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Teacher{}, errPersonNotFound
+	}
+	return t, err
+}
+
+// exportData is the format of export and import. Courses refer to teachers by
+// their person ID and exams to students by their faculty number, which import
+// maps to the records it creates.
+type exportData struct {
+	Teachers []Teacher      `json:"Teachers"`
+	Students []Student      `json:"Students"`
+	Courses  []Course       `json:"Courses"`
+	Exams    []exportedExam `json:"Exams"`
+}
+
+// exportedExam names the teacher of the course, as teachers can have courses of
+// the same name.
+type exportedExam struct {
+	Exam
+	TeacherEmail string `json:"TeacherEmail"`
+}
+
+// teacherRowIDs maps the person IDs of teachers to the IDs of their teacher
+// rows, which courses refer to.
+func (conn dbConnection) teacherRowIDs() (map[string]string, error) {
+	var rows []struct {
+		PersonID string `db:"person_id"`
+		ID       string
+	}
+	if err := conn.db.Select(&rows, "SELECT person_id, id FROM teacher"); err != nil {
+		return nil, err
+	}
+
+	ids := map[string]string{}
+	for _, v := range rows {
+		ids[v.PersonID] = v.ID
+	}
+	return ids, nil
+}
+
+func (d exportData) counts() map[string]int {
+	return map[string]int{"Teachers": len(d.Teachers), "Students": len(d.Students), "Courses": len(d.Courses), "Exams": len(d.Exams)}
+}
+
+func (conn dbConnection) exportData() (d exportData, err error) {
+	if d.Teachers, err = conn.getAllTeachers(); err != nil {
+		return d, err
+	}
+	if d.Students, err = conn.getAllStudents(); err != nil {
+		return d, err
+	}
+	if d.Courses, err = conn.getCourses(scope{}); err != nil {
+		return d, err
+	}
+
+	teacherRows, err := conn.teacherRowIDs()
+	if err != nil {
+		return d, err
+	}
+	persons := map[string]string{}
+	for personID, id := range teacherRows {
+		persons[id] = personID
+	}
+	for i, v := range d.Courses {
+		d.Courses[i].TeacherId = persons[v.TeacherId]
+	}
+
+	if d.Exams, err = conn.exportedExams(); err != nil {
+		return d, err
+	}
+	return d, nil
+}
+
+func (conn dbConnection) exportedExams() (exams []exportedExam, err error) {
+	err = conn.db.Select(&exams, "SELECT c.name as CourseName, p.name as StudentName, e.student_faculty_number as StudentFacultyNumber, e.points as Points, tp.email as TeacherEmail FROM exam e JOIN student s on s.faculty_number = e.student_faculty_number JOIN person p on p.id = s.person_id JOIN course c on c.id = e.course_id JOIN teacher t on t.id = c.teacher_id JOIN person tp on tp.id = t.person_id WHERE e.deleted=FALSE AND c.deleted=FALSE")
+	return exams, err
+}
+
+// importPerson inserts the person of an import. They are only emailed an
+// invitation when asked to, otherwise they can reset their password to log in.
+func (conn dbConnection) importPerson(tx *sql.Tx, p person, invite bool) (string, error) {
+	if invite {
+		return conn.insertPerson(tx, p)
+	}
+
+	var personID string
+	err := tx.QueryRow("INSERT INTO person(name, email, phone) VALUES ($1, $2, $3) RETURNING id", p.Name, p.Email, p.Phone).Scan(&personID)
+	return personID, err
+}
+
+// importStudent creates the student with the faculty number of the export, or a
+// new one when it has none.
+func (conn dbConnection) importStudent(s Student, invite bool) error {
+	tx, err := conn.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	personID, err := conn.importPerson(tx, person{s.Name, s.Email, s.Phone}, invite)
+	if err != nil {
+		return err
+	}
+
+	facultyNumber := s.FacultyNumber
+	if facultyNumber == "" {
+		facultyNumber = generateFacultyNumber()
+	}
+	if _, err = tx.Exec("INSERT INTO student(faculty_number, person_id) VALUES ($1,$2)", facultyNumber, personID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (conn dbConnection) importTeacher(t Teacher, invite bool) error {
+	tx, err := conn.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	personID, err := conn.importPerson(tx, person{t.Name, t.Email, t.Phone}, invite)
+	if err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec("INSERT INTO teacher(person_id) VALUES ($1)", personID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// importData creates the records of an export. People whose email already
+// exists are kept as they are, and so are courses and exams that exist, so an
+// export can be imported again. New students keep their faculty number. Import
+// stops at the first error, the result tells how far it got.
+func (conn dbConnection) importData(d exportData, invite bool) (map[string]int, error) {
+	created := map[string]int{"Teachers": 0, "Students": 0, "Courses": 0, "Exams": 0}
+
+	teacherIDs := map[string]string{}
+	for _, v := range d.Teachers {
+		t, err := conn.teacherByEmail(v.Email)
+		if errors.Is(err, errPersonNotFound) {
+			if err = validate(v, true); err == nil {
+				err = conn.importTeacher(v, invite)
+			}
+			if err != nil {
+				return created, fmt.Errorf("teacher %s: %w", v.Email, err)
+			}
+			created["Teachers"]++
+			t, err = conn.teacherByEmail(v.Email)
+		}
+		if err != nil {
+			return created, fmt.Errorf("teacher %s: %w", v.Email, err)
+		}
+		teacherIDs[v.ID] = t.ID
+	}
+
+	facultyNumbers := map[string]string{}
+	for _, v := range d.Students {
+		s, err := conn.studentByEmail(v.Email)
+		if errors.Is(err, errPersonNotFound) {
+			if err = validate(v, true); err == nil {
+				err = conn.importStudent(v, invite)
+			}
+			if err != nil {
+				return created, fmt.Errorf("student %s: %w", v.Email, err)
+			}
+			created["Students"]++
+			s, err = conn.studentByEmail(v.Email)
+		}
+		if err != nil {
+			return created, fmt.Errorf("student %s: %w", v.Email, err)
+		}
+		facultyNumbers[v.FacultyNumber] = s.FacultyNumber
+	}
+
+	teacherRows, err := conn.teacherRowIDs()
+	if err != nil {
+		return created, err
+	}
+	for _, v := range d.Courses {
+		v.TeacherId = teacherRows[teacherIDs[v.TeacherId]]
+
+		err = conn.insertCourse(v)
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			continue
+		} else if err != nil {
+			return created, fmt.Errorf("course %s: %w", v.Name, err)
+		}
+		created["Courses"]++
+	}
+
+	exams := make([]exportedExam, len(d.Exams))
+	for i, v := range d.Exams {
+		if fn, ok := facultyNumbers[v.StudentFacultyNumber]; ok {
+			v.StudentFacultyNumber = fn
+		}
+		exams[i] = v
+	}
+
+	existing, err := conn.exportedExams()
+	if err != nil {
+		return created, err
+	}
+	for _, v := range newExams(existing, exams) {
+		t, err := conn.teacherByEmail(v.TeacherEmail)
+		if err != nil {
+			return created, fmt.Errorf("exam of %s in %s: teacher %s: %w", v.StudentFacultyNumber, v.CourseName, v.TeacherEmail, err)
+		}
+		if err = conn.insertExam(scope{teacherID: t.ID}, v.Exam); err != nil {
+			return created, fmt.Errorf("exam of %s in %s: %w", v.StudentFacultyNumber, v.CourseName, err)
+		}
+		created["Exams"]++
+	}
+	return created, nil
+}
+
+// newExams returns the imported exams that don't exist yet. Exams have no key
+// of their own, so they are told apart by course, teacher, student and points,
+// and a student can have the same result in a course as many times as they were
+// imported.
+func newExams(existing, imported []exportedExam) []exportedExam {
+	type examKey struct {
+		course, teacher, facultyNumber string
+		points                         int
+	}
+
+	count := map[examKey]int{}
+	for _, v := range existing {
+		count[examKey{v.CourseName, v.TeacherEmail, v.StudentFacultyNumber, v.Points}]++
+	}
+
+	var exams []exportedExam
+	for _, v := range imported {
+		k := examKey{v.CourseName, v.TeacherEmail, v.StudentFacultyNumber, v.Points}
+		if count[k] > 0 {
+			count[k]--
+			continue
+		}
+		exams = append(exams, v)
+	}
+	return exams
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_runAdminCommand(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		err  error
+	}{
+		{"No command", nil, errAdminUsage},
+		{"Unknown command", []string{"drop-everything"}, errAdminUsage},
+		{"Unknown flag", []string{"list-courses", "-all"}, errAdminUsage},
+		{"Missing argument", []string{"archive-student"}, errAdminUsage},
+		{"Extra argument", []string{"list-courses", "now"}, errAdminUsage},
+		{"Invalid person", []string{"add-student", "-name", "Ivan", "-email", "ivan@"}, validationError{{"Email", "must be a valid email"}}},
+		{"Invalid admin", []string{"create-admin", "-email", "admin@test.com"}, validationError{{"Name", "is required"}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var out bytes.Buffer
+			err := runAdminCommand(adminEnv{cfg: defaultConfig(), out: &out}, test.args)
+
+			var invalid validationError
+			if errors.As(test.err, &invalid) {
+				if err == nil || err.Error() != test.err.Error() {
+					t.Fatalf("Expected %v, but got %v", test.err, err)
+				}
+			} else if !errors.Is(err, test.err) {
+				t.Fatalf("Expected %v, but got %v", test.err, err)
+			}
+			if out.Len() != 0 {
+				t.Fatalf("Expected no output, but got %s", out.String())
+			}
+		})
+	}
+}
+
+func Test_writeAdminError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"Known error", errPersonNotFound, `{"error":"person not found","code":"person_not_found"}`},
+		{"Invalid fields", validationError{{"Name", "is required"}}, `{"error":"Name is required","code":"validation_failed","errors":[{"field":"Name","message":"is required"}]}`},
+		{"Usage", errAdminUsage, `{"error":"invalid admin command","code":"usage"}`},
+		{"Other error", errors.New("connection refused"), `{"error":"connection refused"}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var out bytes.Buffer
+			writeAdminError(&out, test.err)
+
+			if got := strings.TrimSpace(out.String()); got != test.want {
+				t.Fatalf("Expected %s, but got %s", test.want, got)
+			}
+		})
+	}
+}
+
+func Test_adminEnv_readPassword(t *testing.T) {
+	tests := []struct {
+		name     string
+		stdin    string
+		password string
+		fails    bool
+	}{
+		{"Line", "s3cret pass\nrest\n", "s3cret pass", false},
+		{"Windows line", "s3cret\r\n", "s3cret", false},
+		{"Without newline", "s3cret", "s3cret", false},
+		{"Empty", "\n", "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			password, err := adminEnv{stdin: strings.NewReader(test.stdin)}.readPassword()
+			if (err != nil) != test.fails || password != test.password {
+				t.Fatalf("Expected %q, but got %q %v", test.password, password, err)
+			}
+		})
+	}
+}
+
+func Test_newExams(t *testing.T) {
+	exam := func(course, teacher, facultyNumber string, points int) exportedExam {
+		return exportedExam{Exam{CourseName: course, StudentFacultyNumber: facultyNumber, Points: points}, teacher}
+	}
+	existing := []exportedExam{
+		exam("Math", "test2@test.com", "12312312", 56),
+		exam("Physics", "test2@test.com", "12312312", 88),
+	}
+
+	tests := []struct {
+		name     string
+		imported []exportedExam
+		expected []exportedExam
+	}{
+		{"Import again", existing, nil},
+		{
+			"New exam",
+			append([]exportedExam{exam("Math", "test2@test.com", "12312313", 56)}, existing...),
+			[]exportedExam{exam("Math", "test2@test.com", "12312313", 56)},
+		},
+		{
+			"Same result twice",
+			[]exportedExam{existing[0], existing[0]},
+			[]exportedExam{existing[0]},
+		},
+		{
+			"Other points",
+			[]exportedExam{exam("Math", "test2@test.com", "12312312", 57)},
+			[]exportedExam{exam("Math", "test2@test.com", "12312312", 57)},
+		},
+		{
+			"Other teacher",
+			[]exportedExam{exam("Math", "other@test.com", "12312312", 56)},
+			[]exportedExam{exam("Math", "other@test.com", "12312312", 56)},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := newExams(existing, test.imported); !reflect.DeepEqual(got, test.expected) {
+				t.Fatalf("Expected %v, but got %v", test.expected, got)
+			}
+		})
+	}
+}
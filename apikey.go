@@ -0,0 +1,150 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// apiKeyHeader carries the API key of a service account.
+	apiKeyHeader = "X-API-Key"
+	apiKeyPrefix = "vsr_"
+	// apiKeyMaxTTL is the longest a key can be valid, so that forgotten keys expire.
+	apiKeyMaxTTL = 365 * 24 * time.Hour
+)
+
+var (
+	errInvalidAPIKey          = errors.New("API key is invalid, expired or revoked")
+	errAPIKeyDenied           = errors.New("API keys can't be used for this endpoint")
+	errServiceAccountNotFound = errors.New("service account not found")
+	errAPIKeyNotFound         = errors.New("API key not found")
+	errInvalidAPIKeyExpiry    = errors.New("ExpiresAt must be in the future and within a year")
+)
+
+// personScopedPermissions only give access to the records of the person holding
+// them, which a service account has none of.
+var personScopedPermissions = permissionList{permExamReadOwn, permExamReadLed, permExamWrite, permCourseReadOwn}
+
+// validateScopes checks the permissions an API key is scoped to. Impersonation
+// needs a login session and person scoped permissions a person, so a key can't
+// be granted them.
+func validateScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return fmt.Errorf("%w: an API key needs at least one scope", errUnknownPermission)
+	}
+	if err := validatePermissions(scopes); err != nil {
+		return err
+	}
+	for _, v := range scopes {
+		if v == permImpersonate || personScopedPermissions.contains(v) {
+			return fmt.Errorf("%w %q for API keys", errUnknownPermission, v)
+		}
+	}
+	return nil
+}
+
+func (conn dbConnection) getServiceAccounts() ([]ServiceAccount, error) {
+	accounts := []ServiceAccount{}
+	if err := conn.db.Select(&accounts, "SELECT id, name, created_at FROM service_account ORDER BY name"); err != nil {
+		return nil, err
+	}
+
+	var keys []struct {
+		APIKey
+		ServiceAccountID string `db:"service_account_id"`
+	}
+	if err := conn.db.Select(&keys, "SELECT id, service_account_id, prefix, scopes, expires_at, last_used_at, revoked, created_at FROM api_key ORDER BY created_at"); err != nil {
+		return nil, err
+	}
+
+	for i := range accounts {
+		accounts[i].Keys = []APIKey{}
+		for _, v := range keys {
+			if v.ServiceAccountID == accounts[i].ID {
+				accounts[i].Keys = append(accounts[i].Keys, v.APIKey)
+			}
+		}
+	}
+	return accounts, nil
+}
+
+func (conn dbConnection) insertServiceAccount(name string) (string, error) {
+	var id string
+	err := conn.db.Get(&id, "INSERT INTO service_account(name) VALUES ($1) RETURNING id", name)
+	return id, err
+}
+
+// deleteServiceAccount deletes the account together with its keys.
+func (conn dbConnection) deleteServiceAccount(id string) error {
+	res, err := conn.db.Exec("DELETE FROM service_account WHERE id::text=$1", id)
+	if err != nil {
+		return err
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errServiceAccountNotFound
+	}
+	return nil
+}
+
+// createAPIKey creates a key for the service account and returns it. The key
+// itself is never stored, it can't be shown again.
+func (conn dbConnection) createAPIKey(serviceAccountID string, scopes []string, expiresAt time.Time) (string, error) {
+	key, prefix, err := newAPIKey()
+	if err != nil {
+		return "", err
+	}
+
+	res, err := conn.db.Exec("INSERT INTO api_key(service_account_id, prefix, key_hash, scopes, expires_at) SELECT id, $2, $3, $4, $5 FROM service_account WHERE id::text=$1",
+		serviceAccountID, prefix, hashToken(key), pq.Array(scopes), expiresAt)
+	if err != nil {
+		return "", err
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return "", errServiceAccountNotFound
+	}
+	return key, nil
+}
+
+// newAPIKey returns a new key and the prefix it is listed with.
+func newAPIKey() (key, prefix string, err error) {
+	token, err := newOpaqueToken()
+	if err != nil {
+		return "", "", err
+	}
+	key = apiKeyPrefix + token
+	return key, key[:len(apiKeyPrefix)+6], nil
+}
+
+func (conn dbConnection) revokeAPIKey(id string) error {
+	res, err := conn.db.Exec("UPDATE api_key SET revoked=TRUE WHERE id::text=$1", id)
+	if err != nil {
+		return err
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errAPIKeyNotFound
+	}
+	return nil
+}
+
+// authenticateAPIKey returns the service account and the scopes of a valid key
+// and records that it was used.
+func (conn dbConnection) authenticateAPIKey(key string) (serviceAccountID string, scopes permissionList, err error) {
+	var k struct {
+		ServiceAccountID string         `db:"service_account_id"`
+		Scopes           pq.StringArray `db:"scopes"`
+	}
+	err = conn.db.Get(&k, "UPDATE api_key SET last_used_at=NOW() WHERE key_hash=$1 AND NOT revoked AND expires_at > NOW() RETURNING service_account_id, scopes", hashToken(key))
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil, errInvalidAPIKey
+	} else if err != nil {
+		return "", nil, err
+	}
+	return k.ServiceAccountID, permissionList(k.Scopes), nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_validateScopes(t *testing.T) {
+	tests := []struct {
+		name   string
+		scopes []string
+		valid  bool
+	}{
+		{"Known permissions", []string{permStudentManage, permCourseManage}, true},
+		{"No scopes", nil, false},
+		{"Unknown permission", []string{"student:delete"}, false},
+		{"Impersonation", []string{permStudentRead, permImpersonate}, false},
+		{"Person scoped permission", []string{permExamWrite}, false},
+		{"Unscoped exam writes", []string{permExamRead, permExamWriteAny}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := validateScopes(test.scopes)
+			if test.valid && err != nil {
+				t.Fatalf("Expected %v to be valid, but got %v", test.scopes, err)
+			}
+			if !test.valid && !errors.Is(err, errUnknownPermission) {
+				t.Fatalf("Expected %v to be rejected, but got %v", test.scopes, err)
+			}
+		})
+	}
+}
+
+func Test_apiKey_insertExam(t *testing.T) {
+	s := newTestServer(t, testConfig())
+
+	var account struct{ ID string }
+	if status := s.do(http.MethodPost, "/service-accounts", `{"Name":"registrar-sync"}`, demoAdminID, &account); status != http.StatusOK {
+		t.Fatalf("Expected the service account to be created, but got %d", status)
+	}
+
+	expiresAt := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	var key struct{ Key string }
+	body := `{"Scopes":["exam:read","exam:write-any"],"ExpiresAt":"` + expiresAt + `"}`
+	if status := s.do(http.MethodPost, "/service-accounts/"+account.ID+"/api-keys", body, demoAdminID, &key); status != http.StatusOK {
+		t.Fatalf("Expected the key to be created, but got %d", status)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/exams", strings.NewReader(`{"CourseName":"Math","StudentFacultyNumber":"12312312","Points":34}`))
+	r.Header.Set(apiKeyHeader, key.Key)
+	if status := s.serve(r, nil); status != http.StatusOK {
+		t.Fatalf("Expected the key to record the exam, but got %d", status)
+	}
+
+	var exams []Exam
+	r = httptest.NewRequest(http.MethodGet, "/exams", nil)
+	r.Header.Set(apiKeyHeader, key.Key)
+	if status := s.serve(r, &exams); status != http.StatusOK || len(exams) != 4 {
+		t.Fatalf("Expected the recorded exam to be listed, but got %d %v", status, exams)
+	}
+}
@@ -0,0 +1,79 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+// Login logs in with email and password. An account with 2FA gets a
+// *TwoFactorError, whose challenge is completed with LoginSecondFactor.
+func (c *Client) Login(ctx context.Context, email, password string) error {
+	var resp json.RawMessage
+	in := map[string]string{"Email": email, "Password": password}
+	if err := c.doPublic(ctx, http.MethodPost, "/login", in, &resp); err != nil {
+		return err
+	}
+	return c.completeLogin(resp)
+}
+
+// LoginMagicLink logs in with the code of a magic link.
+func (c *Client) LoginMagicLink(ctx context.Context, code string) error {
+	var resp json.RawMessage
+	if err := c.doPublic(ctx, http.MethodPost, "/login/magic-link/verify", map[string]string{"Code": code}, &resp); err != nil {
+		return err
+	}
+	return c.completeLogin(resp)
+}
+
+// RequestMagicLink emails a login link, if one of the person's roles allows it.
+func (c *Client) RequestMagicLink(ctx context.Context, email string) error {
+	return c.doPublic(ctx, http.MethodPost, "/login/magic-link", map[string]string{"Email": email}, nil)
+}
+
+// LoginSecondFactor completes a login with the challenge of its TwoFactorError
+// and a TOTP or recovery code. The recovery codes are only returned when the
+// code confirmed a new enrollment.
+func (c *Client) LoginSecondFactor(ctx context.Context, challenge, code string) ([]string, error) {
+	var t Tokens
+	in := map[string]string{"Challenge": challenge, "Code": code}
+	if err := c.doPublic(ctx, http.MethodPost, "/login/2fa", in, &t); err != nil {
+		return nil, err
+	}
+
+	c.SetTokens(t)
+	return t.RecoveryCodes, nil
+}
+
+// Logout revokes the session and forgets the tokens.
+func (c *Client) Logout(ctx context.Context) error {
+	c.mu.Lock()
+	refreshToken := c.refreshToken
+	c.mu.Unlock()
+
+	if refreshToken == "" {
+		return ErrNotLoggedIn
+	}
+	if err := c.doPublic(ctx, http.MethodPost, "/logout", map[string]string{"RefreshToken": refreshToken}, nil); err != nil {
+		return err
+	}
+
+	c.SetTokens(Tokens{})
+	return nil
+}
+
+// completeLogin keeps the tokens of a login response, or returns the challenge
+// it carries instead.
+func (c *Client) completeLogin(resp json.RawMessage) error {
+	var ch challenge
+	if err := json.Unmarshal(resp, &ch); err == nil && ch.Challenge != "" {
+		return &TwoFactorError{Challenge: ch.Challenge, Enrolled: ch.TwoFactorEnrolled}
+	}
+
+	var t Tokens
+	if err := json.Unmarshal(resp, &t); err != nil {
+		return err
+	}
+	c.SetTokens(t)
+	return nil
+}
@@ -0,0 +1,246 @@
+// Package client calls the virtual student report card API.
+//
+// A Client acts as one person, after Login, or as a service account with
+// WithAPIKey. Access tokens are refreshed before they expire, and once more when
+// the server rejects one. The client expects the server to return tokens in the
+// body, it doesn't support cookie sessions.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// refreshMargin is how long before it expires an access token is refreshed.
+const refreshMargin = 30 * time.Second
+
+type Client struct {
+	baseURL string
+	http    *http.Client
+	apiKey  string
+
+	// mu guards the tokens, and is held while refreshing them so that the
+	// refresh token is only used once.
+	mu           sync.Mutex
+	token        string
+	refreshToken string
+}
+
+type Option func(*Client)
+
+// WithHTTPClient sends the requests with c instead of http.DefaultClient.
+func WithHTTPClient(c *http.Client) Option {
+	return func(client *Client) {
+		client.http = c
+	}
+}
+
+// WithAPIKey authenticates as the service account the key belongs to.
+func WithAPIKey(key string) Option {
+	return func(client *Client) {
+		client.apiKey = key
+	}
+}
+
+// New returns a client of the API at baseURL, like https://api.example.com.
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		http:    http.DefaultClient,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// SetTokens resumes a session, with tokens of an earlier Login.
+func (c *Client) SetTokens(t Tokens) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.token, c.refreshToken = t.Token, t.RefreshToken
+}
+
+// Tokens returns the current tokens, to resume the session later.
+func (c *Client) Tokens() Tokens {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return Tokens{Token: c.token, RefreshToken: c.refreshToken}
+}
+
+// do sends a request that needs the caller to be logged in, and decodes the
+// response into out unless it is nil.
+func (c *Client) do(ctx context.Context, method, path string, in, out any) error {
+	body, err := marshal(in)
+	if err != nil {
+		return err
+	}
+
+	if c.apiKey != "" {
+		return c.send(ctx, method, path, body, out, func(r *http.Request) {
+			r.Header.Set("X-API-Key", c.apiKey)
+		})
+	}
+
+	token, err := c.accessToken(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = c.send(ctx, method, path, body, out, bearer(token))
+	if !errors.Is(err, ErrInvalidToken) {
+		return err
+	}
+
+	// The token may have been revoked or expired on the way.
+	if token, err = c.refresh(ctx, token); err != nil {
+		return err
+	}
+	return c.send(ctx, method, path, body, out, bearer(token))
+}
+
+// doPublic sends a request that doesn't need a login.
+func (c *Client) doPublic(ctx context.Context, method, path string, in, out any) error {
+	body, err := marshal(in)
+	if err != nil {
+		return err
+	}
+	return c.send(ctx, method, path, body, out, nil)
+}
+
+func (c *Client) send(ctx context.Context, method, path string, body []byte, out any, auth func(*http.Request)) error {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if auth != nil {
+		auth(req)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return responseError(resp)
+	}
+
+	if out == nil {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	if err = json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("client: decoding the response of %s %s: %w", method, path, err)
+	}
+	return nil
+}
+
+// responseError reads the problem the server answered with.
+func responseError(resp *http.Response) error {
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+
+	e := &Error{}
+	if err := json.Unmarshal(b, e); err != nil || e.Code == "" {
+		e = &Error{Title: http.StatusText(resp.StatusCode), Detail: strings.TrimSpace(string(b))}
+	}
+	e.Status = resp.StatusCode
+
+	if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		e.RetryAfter = time.Duration(s) * time.Second
+	}
+	return e
+}
+
+// accessToken returns the access token, refreshed first if it is about to
+// expire.
+func (c *Client) accessToken(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	token := c.token
+	c.mu.Unlock()
+
+	if token == "" {
+		return "", ErrNotLoggedIn
+	}
+	if claims(token).expiresWithin(refreshMargin) {
+		return c.refresh(ctx, token)
+	}
+	return token, nil
+}
+
+// refresh exchanges the refresh token for new tokens, unless the access token
+// was already replaced since stale was read.
+func (c *Client) refresh(ctx context.Context, stale string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.token != stale {
+		return c.token, nil
+	}
+	if c.refreshToken == "" {
+		return "", ErrNotLoggedIn
+	}
+
+	body, _ := marshal(map[string]string{"RefreshToken": c.refreshToken})
+	var t Tokens
+	if err := c.send(ctx, http.MethodPost, "/token/refresh", body, &t, nil); err != nil {
+		return "", fmt.Errorf("client: refreshing the token: %w", err)
+	}
+
+	c.token, c.refreshToken = t.Token, t.RefreshToken
+	return c.token, nil
+}
+
+func bearer(token string) func(*http.Request) {
+	return func(r *http.Request) {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+}
+
+// claims reads the claims of a JWT without verifying it, the server does that.
+func claims(token string) accessClaims {
+	var c accessClaims
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return c
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return c
+	}
+	_ = json.Unmarshal(b, &c)
+	return c
+}
+
+func marshal(v any) ([]byte, error) {
+	if v == nil {
+		return nil, nil
+	}
+	return json.Marshal(v)
+}
+
+// pathf formats a path, escaping the arguments as path segments.
+func pathf(format string, args ...string) string {
+	escaped := make([]any, len(args))
+	for i, v := range args {
+		escaped[i] = url.PathEscape(v)
+	}
+	return fmt.Sprintf(format, escaped...)
+}
@@ -0,0 +1,269 @@
+package client
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeAPI answers like the server, for one account with the password "secret"
+// and one with 2FA.
+type fakeAPI struct {
+	mu           sync.Mutex
+	token        string
+	refreshToken string
+	refreshes    int32
+	rejected     int32
+}
+
+func newFakeAPI(t *testing.T) (*fakeAPI, *httptest.Server) {
+	api := &fakeAPI{token: testToken(time.Hour, 1), refreshToken: "refresh-1"}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		var body struct{ Email, Password string }
+		_ = json.NewDecoder(r.Body).Decode(&body)
+
+		switch {
+		case body.Email == "2fa@test.com":
+			writeJSON(w, http.StatusOK, map[string]any{"Challenge": "challenge", "TwoFactorEnrolled": true})
+		case body.Password != "secret":
+			writeProblem(w, http.StatusUnauthorized, "login_failed", "Incorrect email or password")
+		default:
+			writeJSON(w, http.StatusOK, api.tokens())
+		}
+	})
+	mux.HandleFunc("/login/2fa", func(w http.ResponseWriter, r *http.Request) {
+		var body struct{ Challenge, Code string }
+		_ = json.NewDecoder(r.Body).Decode(&body)
+
+		if body.Challenge != "challenge" || body.Code != "123456" {
+			writeProblem(w, http.StatusUnauthorized, "invalid_second_factor", "invalid code")
+			return
+		}
+		writeJSON(w, http.StatusOK, api.tokens())
+	})
+	mux.HandleFunc("/token/refresh", func(w http.ResponseWriter, r *http.Request) {
+		var body struct{ RefreshToken string }
+		_ = json.NewDecoder(r.Body).Decode(&body)
+
+		api.mu.Lock()
+		defer api.mu.Unlock()
+		if body.RefreshToken != api.refreshToken {
+			writeProblem(w, http.StatusUnauthorized, "invalid_refresh_token", "unauthorized")
+			return
+		}
+
+		n := atomic.AddInt32(&api.refreshes, 1)
+		api.token, api.refreshToken = testToken(time.Hour, int(n)+1), fmt.Sprintf("refresh-%d", n+1)
+		writeJSON(w, http.StatusOK, map[string]string{"Token": api.token, "RefreshToken": api.refreshToken})
+	})
+	mux.HandleFunc("/courses", func(w http.ResponseWriter, r *http.Request) {
+		if !api.authorized(r) {
+			atomic.AddInt32(&api.rejected, 1)
+			writeProblem(w, http.StatusUnauthorized, "invalid_token", "unauthorized")
+			return
+		}
+		writeJSON(w, http.StatusOK, []Course{{Id: "c1", Name: "Math", NumberOfSeats: 30}})
+	})
+	mux.HandleFunc("/students", func(w http.ResponseWriter, r *http.Request) {
+		p := map[string]any{
+			"type": "about:blank", "title": "Bad Request", "status": 400, "code": "validation_failed",
+			"detail": "the request has invalid fields", "instance": "/students",
+			"errors": []FieldError{{"Name", "is required"}, {"Email", "must be a valid email"}},
+		}
+		writeJSON(w, http.StatusBadRequest, p)
+	})
+	mux.HandleFunc("/students/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.EscapedPath() != "/students/a%2Fb" {
+			writeProblem(w, http.StatusNotFound, "person_not_found", "person not found")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"message": "success"})
+	})
+	mux.HandleFunc("/teachers", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-API-Key") != "vsrc_key" {
+			writeProblem(w, http.StatusUnauthorized, "invalid_api_key", "unauthorized")
+			return
+		}
+		writeJSON(w, http.StatusOK, []Teacher{{ID: "t1", Name: "Ivan"}})
+	})
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return api, srv
+}
+
+func (api *fakeAPI) tokens() map[string]string {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	return map[string]string{"Token": api.token, "RefreshToken": api.refreshToken}
+}
+
+func (api *fakeAPI) authorized(r *http.Request) bool {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	return r.Header.Get("Authorization") == "Bearer "+api.token
+}
+
+// testToken returns an unsigned JWT that expires in ttl, numbered to tell them apart.
+func testToken(ttl time.Duration, n int) string {
+	claims, _ := json.Marshal(map[string]any{"exp": time.Now().Add(ttl).Unix(), "n": n})
+	return "eyJhbGciOiJub25lIn0." + base64.RawURLEncoding.EncodeToString(claims) + ".sig"
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeProblem(w http.ResponseWriter, status int, code, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]any{"status": status, "code": code, "detail": detail})
+}
+
+func Test_Login(t *testing.T) {
+	api, srv := newFakeAPI(t)
+	ctx := context.Background()
+
+	t.Run("Password", func(t *testing.T) {
+		c := New(srv.URL)
+		if err := c.Login(ctx, "admin@test.com", "secret"); err != nil {
+			t.Fatal(err)
+		}
+
+		if c.Tokens().Token != api.tokens()["Token"] {
+			t.Fatalf("Expected the tokens to be kept, but got %+v", c.Tokens())
+		}
+		if courses, err := c.Courses(ctx); err != nil || len(courses) != 1 || courses[0].Name != "Math" {
+			t.Fatalf("Expected the courses, but got %v %v", courses, err)
+		}
+	})
+
+	t.Run("Wrong password", func(t *testing.T) {
+		err := New(srv.URL).Login(ctx, "admin@test.com", "wrong")
+		if !errors.Is(err, ErrLoginFailed) || !errors.Is(err, ErrUnauthorized) {
+			t.Fatalf("Expected a failed login, but got %v", err)
+		}
+	})
+
+	t.Run("Second factor", func(t *testing.T) {
+		c := New(srv.URL)
+		err := c.Login(ctx, "2fa@test.com", "secret")
+
+		var twoFactor *TwoFactorError
+		if !errors.Is(err, ErrTwoFactorRequired) || !errors.As(err, &twoFactor) || !twoFactor.Enrolled {
+			t.Fatalf("Expected a challenge, but got %v", err)
+		}
+		if _, err = c.Courses(ctx); !errors.Is(err, ErrNotLoggedIn) {
+			t.Fatalf("Expected to not be logged in yet, but got %v", err)
+		}
+
+		if _, err = c.LoginSecondFactor(ctx, twoFactor.Challenge, "123456"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = c.Courses(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func Test_refresh(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Rejected token", func(t *testing.T) {
+		api, srv := newFakeAPI(t)
+		c := New(srv.URL)
+		c.SetTokens(Tokens{Token: testToken(time.Hour, 0), RefreshToken: "refresh-1"})
+
+		if _, err := c.Courses(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if rejected, refreshes := atomic.LoadInt32(&api.rejected), atomic.LoadInt32(&api.refreshes); rejected != 1 || refreshes != 1 {
+			t.Fatalf("Expected one rejection and one refresh, but got %d and %d", rejected, refreshes)
+		}
+		if c.Tokens().RefreshToken != "refresh-2" {
+			t.Fatalf("Expected the rotated refresh token, but got %s", c.Tokens().RefreshToken)
+		}
+	})
+
+	t.Run("Expiring token", func(t *testing.T) {
+		api, srv := newFakeAPI(t)
+		c := New(srv.URL)
+		c.SetTokens(Tokens{Token: testToken(10*time.Second, 0), RefreshToken: "refresh-1"})
+
+		var wg sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := c.Courses(ctx); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		if rejected, refreshes := atomic.LoadInt32(&api.rejected), atomic.LoadInt32(&api.refreshes); rejected != 0 || refreshes != 1 {
+			t.Fatalf("Expected one refresh ahead of the requests, but got %d rejections and %d refreshes", rejected, refreshes)
+		}
+	})
+
+	t.Run("Revoked session", func(t *testing.T) {
+		_, srv := newFakeAPI(t)
+		c := New(srv.URL)
+		c.SetTokens(Tokens{Token: testToken(time.Hour, 0), RefreshToken: "revoked"})
+
+		if _, err := c.Courses(ctx); !errors.Is(err, ErrUnauthorized) {
+			t.Fatalf("Expected the failed refresh, but got %v", err)
+		}
+	})
+}
+
+func Test_errors(t *testing.T) {
+	_, srv := newFakeAPI(t)
+	ctx := context.Background()
+	c := New(srv.URL)
+	c.SetTokens(Tokens{Token: testToken(time.Hour, 1), RefreshToken: "refresh-1"})
+
+	err := c.CreateStudent(ctx, Student{Email: "ivan@"})
+	var apiErr *Error
+	if !errors.Is(err, ErrValidation) || !errors.As(err, &apiErr) {
+		t.Fatalf("Expected a validation error, but got %v", err)
+	}
+	if apiErr.Status != http.StatusBadRequest || len(apiErr.Errors) != 2 || apiErr.Errors[1].Field != "Email" {
+		t.Fatalf("Expected the invalid fields, but got %+v", apiErr)
+	}
+
+	if err = c.DeleteCourse(ctx, "c1"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected a 404 without a problem body to be an error, but got %v", err)
+	}
+
+	if err = c.ArchiveStudent(ctx, "a/b"); err != nil {
+		t.Fatalf("Expected the path parameter to be escaped, but got %v", err)
+	}
+}
+
+func Test_WithAPIKey(t *testing.T) {
+	_, srv := newFakeAPI(t)
+	ctx := context.Background()
+
+	teachers, err := New(srv.URL, WithAPIKey("vsrc_key")).Teachers(ctx)
+	if err != nil || len(teachers) != 1 {
+		t.Fatalf("Expected the teachers, but got %v %v", teachers, err)
+	}
+
+	if _, err = New(srv.URL, WithAPIKey("other")).Teachers(ctx); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("Expected the key to be refused, but got %v", err)
+	}
+}
@@ -0,0 +1,95 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Error is a problem the API answered a request with. Code is the stable
+// machine-readable reason, see errorResponses in the server's errors.go.
+type Error struct {
+	Status   int          `json:"status"`
+	Code     string       `json:"code"`
+	Title    string       `json:"title"`
+	Detail   string       `json:"detail"`
+	Instance string       `json:"instance"`
+	Field    string       `json:"field"`
+	Errors   []FieldError `json:"errors"`
+	// RetryAfter is how long a throttled login has to wait.
+	RetryAfter time.Duration `json:"-"`
+}
+
+// FieldError is a field of the request that failed validation.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("client: %d %s", e.Status, e.Code)
+	if e.Detail != "" {
+		msg += ": " + e.Detail
+	}
+
+	var fields []string
+	for _, v := range e.Errors {
+		fields = append(fields, v.Field+" "+v.Message)
+	}
+	if len(fields) > 0 {
+		msg += " (" + strings.Join(fields, ", ") + ")"
+	}
+	return msg
+}
+
+// Is matches the errors below by their code, or by their status when they have
+// no code.
+func (e *Error) Is(target error) bool {
+	var t *Error
+	if !errors.As(target, &t) {
+		return false
+	}
+	if t.Code != "" {
+		return t.Code == e.Code
+	}
+	return t.Status == e.Status
+}
+
+// Errors to match an *Error with errors.Is.
+var (
+	ErrUnauthorized = &Error{Status: 401}
+	ErrForbidden    = &Error{Status: 403}
+	ErrNotFound     = &Error{Status: 404}
+	ErrConflict     = &Error{Status: 409}
+	ErrValidation   = &Error{Code: "validation_failed"}
+	ErrLoginFailed  = &Error{Code: "login_failed"}
+	ErrThrottled    = &Error{Code: "login_throttled"}
+	ErrInvalidToken = &Error{Code: "invalid_token"}
+)
+
+var (
+	// ErrNotLoggedIn is returned for requests that need a login before Login
+	// or SetTokens was called.
+	ErrNotLoggedIn = errors.New("client: not logged in")
+	// ErrTwoFactorRequired matches the *TwoFactorError of a login that needs a
+	// second factor.
+	ErrTwoFactorRequired = errors.New("client: second factor required")
+)
+
+// TwoFactorError is returned by a login whose account has or has to enroll
+// 2FA. The challenge completes the login with LoginSecondFactor.
+type TwoFactorError struct {
+	Challenge string
+	// Enrolled is false when a role requires 2FA that the account doesn't have
+	// yet, which the server's /login/2fa/enroll starts.
+	Enrolled bool
+}
+
+func (e *TwoFactorError) Error() string {
+	return ErrTwoFactorRequired.Error()
+}
+
+func (e *TwoFactorError) Is(target error) bool {
+	return target == ErrTwoFactorRequired
+}
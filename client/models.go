@@ -0,0 +1,71 @@
+package client
+
+import "time"
+
+// The models mirror the schemas of openapi.json.
+
+type Student struct {
+	// ID is the id of the person.
+	ID            string `json:"ID,omitempty"`
+	FacultyNumber string `json:"FacultyNumber,omitempty"`
+	Name          string `json:"Name"`
+	Phone         string `json:"Phone"`
+	// Email is only changed once the new address is verified.
+	Email string `json:"Email"`
+}
+
+type Teacher struct {
+	// ID is the id of the person.
+	ID    string `json:"ID,omitempty"`
+	Name  string `json:"Name"`
+	Phone string `json:"Phone"`
+	// Email is only changed once the new address is verified.
+	Email string `json:"Email"`
+}
+
+type Course struct {
+	Id            string `json:"Id,omitempty"`
+	TeacherId     string `json:"TeacherId"`
+	TeacherName   string `json:"TeacherName,omitempty"`
+	Name          string `json:"Name"`
+	NumberOfSeats int    `json:"NumberOfSeats"`
+}
+
+type Exam struct {
+	StudentName          string `json:"StudentName,omitempty"`
+	StudentFacultyNumber string `json:"StudentFacultyNumber"`
+	CourseName           string `json:"CourseName"`
+	Points               int    `json:"Points"`
+}
+
+type Role struct {
+	Name           string   `json:"Name"`
+	Builtin        bool     `json:"Builtin,omitempty"`
+	Require2FA     bool     `json:"Require2FA"`
+	AllowMagicLink bool     `json:"AllowMagicLink"`
+	Permissions    []string `json:"Permissions"`
+}
+
+// Tokens are the credentials of a logged in person.
+type Tokens struct {
+	Token        string `json:"Token"`
+	RefreshToken string `json:"RefreshToken"`
+	// RecoveryCodes are only set when the login confirmed a 2FA enrollment.
+	RecoveryCodes []string `json:"RecoveryCodes,omitempty"`
+}
+
+// challenge is the answer to a login that needs a second factor.
+type challenge struct {
+	Challenge         string `json:"Challenge"`
+	TwoFactorEnrolled bool   `json:"TwoFactorEnrolled"`
+}
+
+// accessClaims are the claims of the access token the client reads to refresh
+// it before it expires.
+type accessClaims struct {
+	ExpiresAt int64 `json:"exp"`
+}
+
+func (c accessClaims) expiresWithin(d time.Duration) bool {
+	return c.ExpiresAt != 0 && time.Until(time.Unix(c.ExpiresAt, 0)) < d
+}
@@ -0,0 +1,104 @@
+package client
+
+import (
+	"context"
+	"net/http"
+)
+
+// Exams lists the exams the caller may read: all of them, those of the courses
+// a teacher leads or a student's own.
+func (c *Client) Exams(ctx context.Context) ([]Exam, error) {
+	var exams []Exam
+	if err := c.do(ctx, http.MethodGet, "/exams", nil, &exams); err != nil {
+		return nil, err
+	}
+	return exams, nil
+}
+
+// StudentExams lists the exams of one student.
+func (c *Client) StudentExams(ctx context.Context, facultyNumber string) ([]Exam, error) {
+	var exams []Exam
+	if err := c.do(ctx, http.MethodGet, pathf("/students/%s/exams", facultyNumber), nil, &exams); err != nil {
+		return nil, err
+	}
+	return exams, nil
+}
+
+func (c *Client) CreateExam(ctx context.Context, e Exam) error {
+	return c.do(ctx, http.MethodPost, "/exams", e, nil)
+}
+
+func (c *Client) Courses(ctx context.Context) ([]Course, error) {
+	var courses []Course
+	if err := c.do(ctx, http.MethodGet, "/courses", nil, &courses); err != nil {
+		return nil, err
+	}
+	return courses, nil
+}
+
+func (c *Client) CreateCourse(ctx context.Context, course Course) error {
+	return c.do(ctx, http.MethodPost, "/courses", course, nil)
+}
+
+// UpdateCourse replaces the course with the Id of course.
+func (c *Client) UpdateCourse(ctx context.Context, course Course) error {
+	return c.do(ctx, http.MethodPatch, pathf("/courses/%s", course.Id), course, nil)
+}
+
+func (c *Client) DeleteCourse(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, pathf("/courses/%s", id), nil, nil)
+}
+
+// Students lists the active students, it needs student:manage.
+func (c *Client) Students(ctx context.Context) ([]Student, error) {
+	var students []Student
+	if err := c.do(ctx, http.MethodGet, "/students", nil, &students); err != nil {
+		return nil, err
+	}
+	return students, nil
+}
+
+// StudentFacultyNumbers lists the faculty numbers of the active students, which
+// is all that callers with only student:read, like teachers, get.
+func (c *Client) StudentFacultyNumbers(ctx context.Context) ([]string, error) {
+	var facultyNumbers []string
+	if err := c.do(ctx, http.MethodGet, "/students", nil, &facultyNumbers); err != nil {
+		return nil, err
+	}
+	return facultyNumbers, nil
+}
+
+func (c *Client) CreateStudent(ctx context.Context, s Student) error {
+	return c.do(ctx, http.MethodPost, "/students", s, nil)
+}
+
+// UpdateStudent updates the student with the FacultyNumber of s.
+func (c *Client) UpdateStudent(ctx context.Context, s Student) error {
+	return c.do(ctx, http.MethodPatch, pathf("/students/%s", s.FacultyNumber), s, nil)
+}
+
+func (c *Client) ArchiveStudent(ctx context.Context, facultyNumber string) error {
+	return c.do(ctx, http.MethodDelete, pathf("/students/%s", facultyNumber), nil, nil)
+}
+
+func (c *Client) Teachers(ctx context.Context) ([]Teacher, error) {
+	var teachers []Teacher
+	if err := c.do(ctx, http.MethodGet, "/teachers", nil, &teachers); err != nil {
+		return nil, err
+	}
+	return teachers, nil
+}
+
+func (c *Client) CreateTeacher(ctx context.Context, t Teacher) error {
+	return c.do(ctx, http.MethodPost, "/teachers", t, nil)
+}
+
+// UpdateTeacher updates the teacher with the ID of t.
+func (c *Client) UpdateTeacher(ctx context.Context, t Teacher) error {
+	return c.do(ctx, http.MethodPatch, pathf("/teachers/%s", t.ID), t, nil)
+}
+
+// ArchiveTeacher archives the teacher with the person ID.
+func (c *Client) ArchiveTeacher(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, pathf("/teachers/%s", id), nil, nil)
+}
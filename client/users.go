@@ -0,0 +1,54 @@
+package client
+
+import (
+	"context"
+	"net/http"
+)
+
+func (c *Client) Roles(ctx context.Context) ([]Role, error) {
+	var roles []Role
+	if err := c.do(ctx, http.MethodGet, "/roles", nil, &roles); err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+// AssignRole gives the person with the ID the role.
+func (c *Client) AssignRole(ctx context.Context, personID, role string) error {
+	return c.do(ctx, http.MethodPut, pathf("/people/%s/roles/%s", personID, role), nil, nil)
+}
+
+// UnassignRole takes the role from the person with the ID.
+func (c *Client) UnassignRole(ctx context.Context, personID, role string) error {
+	return c.do(ctx, http.MethodDelete, pathf("/people/%s/roles/%s", personID, role), nil, nil)
+}
+
+// ChangeEmail sends a code to the new address, the email changes once it is
+// passed to VerifyEmail.
+func (c *Client) ChangeEmail(ctx context.Context, email string) error {
+	return c.do(ctx, http.MethodPost, "/change-email", map[string]string{"Email": email}, nil)
+}
+
+func (c *Client) VerifyEmail(ctx context.Context, code string) error {
+	return c.doPublic(ctx, http.MethodPost, "/verify-email", map[string]string{"Code": code}, nil)
+}
+
+func (c *Client) ChangePassword(ctx context.Context, oldPassword, newPassword string) error {
+	in := map[string]string{"OldPassword": oldPassword, "NewPassword": newPassword}
+	return c.do(ctx, http.MethodPost, "/change-password", in, nil)
+}
+
+// ForgottenPassword emails a code to reset the password with ResetPassword.
+func (c *Client) ForgottenPassword(ctx context.Context, email string) error {
+	return c.doPublic(ctx, http.MethodPost, "/forgotten-password", map[string]string{"Email": email}, nil)
+}
+
+func (c *Client) ResetPassword(ctx context.Context, code, password string) error {
+	return c.doPublic(ctx, http.MethodPost, "/reset-password", map[string]string{"Code": code, "Password": password}, nil)
+}
+
+// CreatePassword sets the first password of a new account, with the code of
+// its invitation.
+func (c *Client) CreatePassword(ctx context.Context, code, password string) error {
+	return c.doPublic(ctx, http.MethodPost, "/createPassword", map[string]string{"Code": code, "Password": password}, nil)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/go-redis/redis/v8"
+	"github.com/jmoiron/sqlx"
+)
+
+// codePurpose tags a one-time code with the flow it was issued for, so that a
+// code of one flow can't be used in another.
+type codePurpose string
+
+const (
+	purposePasswordCreate codePurpose = "password-create"
+	purposePasswordReset  codePurpose = "password-reset"
+	purposeEmailVerify    codePurpose = "email-verify"
+	purposeLoginChallenge codePurpose = "login-challenge"
+	purposeMagicLink      codePurpose = "magic-link"
+)
+
+var errCodeNotFound = errors.New("code not found")
+
+// CodeStore keeps one-time codes until they are used or expire. Codes are only
+// stored hashed. The backend is picked by codes.backend in the config.
+type CodeStore interface {
+	// Save stores the code for the subject, usually an email.
+	Save(purpose codePurpose, code, subject string, ttl time.Duration) error
+	// Peek returns the subject of a code without using it up.
+	Peek(purpose codePurpose, code string) (string, error)
+	// Consume returns the subject of a code and deletes it, so every code can
+	// be used once.
+	Consume(purpose codePurpose, code string) (string, error)
+}
+
+func newCodeStore(cfg config, db *sqlx.DB) (CodeStore, error) {
+	switch cfg.Codes.Backend {
+	case "redis":
+		return redisCodeStore{client: redis.NewClient(&redis.Options{
+			Addr:     cfg.Redis.Addr,
+			Password: cfg.Redis.Password,
+			DB:       cfg.Redis.DB,
+			PoolSize: cfg.Redis.PoolSize,
+		})}, nil
+	case "postgres":
+		return postgresCodeStore{db: db}, nil
+	case "memory":
+		return newMemoryCodeStore(), nil
+	}
+	return nil, fmt.Errorf("unknown code store backend %q", cfg.Codes.Backend)
+}
+
+// issueCode creates and stores a new code for the subject.
+func (conn dbConnection) issueCode(purpose codePurpose, subject string, ttl time.Duration) (string, error) {
+	code := uniuri.NewLen(codeLength)
+	return code, conn.codes.Save(purpose, code, subject, ttl)
+}
+
+// peekCode returns the subject of a code without using it up.
+func (conn dbConnection) peekCode(purpose codePurpose, code string) (string, error) {
+	return conn.codes.Peek(purpose, code)
+}
+
+// consumeCode returns the subject of a code and uses it up.
+func (conn dbConnection) consumeCode(purpose codePurpose, code string) (string, error) {
+	return conn.codes.Consume(purpose, code)
+}
+
+type redisCodeStore struct {
+	client *redis.Client
+}
+
+func (s redisCodeStore) key(purpose codePurpose, code string) string {
+	return fmt.Sprintf("code:%s:%s", purpose, hashToken(code))
+}
+
+func (s redisCodeStore) Save(purpose codePurpose, code, subject string, ttl time.Duration) error {
+	return s.client.Set(context.Background(), s.key(purpose, code), subject, ttl).Err()
+}
+
+func (s redisCodeStore) Peek(purpose codePurpose, code string) (string, error) {
+	subject, err := s.client.Get(context.Background(), s.key(purpose, code)).Result()
+	if err == redis.Nil {
+		return "", errCodeNotFound
+	}
+	return subject, err
+}
+
+func (s redisCodeStore) Consume(purpose codePurpose, code string) (string, error) {
+	subject, err := s.client.GetDel(context.Background(), s.key(purpose, code)).Result()
+	if err == redis.Nil {
+		return "", errCodeNotFound
+	}
+	return subject, err
+}
+
+type postgresCodeStore struct {
+	db *sqlx.DB
+}
+
+func (s postgresCodeStore) Save(purpose codePurpose, code, subject string, ttl time.Duration) error {
+	// Expired codes are cleaned up here, there are few enough of them.
+	if _, err := s.db.Exec("DELETE FROM one_time_code WHERE expires_at <= NOW()"); err != nil {
+		return err
+	}
+
+	_, err := s.db.Exec("INSERT INTO one_time_code(purpose, code_hash, subject, expires_at) VALUES ($1, $2, $3, NOW() + make_interval(secs => $4))",
+		purpose, hashToken(code), subject, ttl.Seconds())
+	return err
+}
+
+func (s postgresCodeStore) Peek(purpose codePurpose, code string) (string, error) {
+	var subject string
+	err := s.db.Get(&subject, "SELECT subject FROM one_time_code WHERE purpose=$1 AND code_hash=$2 AND expires_at > NOW()", purpose, hashToken(code))
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", errCodeNotFound
+	}
+	return subject, err
+}
+
+func (s postgresCodeStore) Consume(purpose codePurpose, code string) (string, error) {
+	var subject string
+	err := s.db.Get(&subject, "DELETE FROM one_time_code WHERE purpose=$1 AND code_hash=$2 AND expires_at > NOW() RETURNING subject", purpose, hashToken(code))
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", errCodeNotFound
+	}
+	return subject, err
+}
+
+// memoryCodeStore keeps codes in memory, for tests and single instance setups.
+type memoryCodeStore struct {
+	mu    sync.Mutex
+	codes map[string]memoryCode
+}
+
+type memoryCode struct {
+	subject   string
+	expiresAt time.Time
+}
+
+func newMemoryCodeStore() *memoryCodeStore {
+	return &memoryCodeStore{codes: map[string]memoryCode{}}
+}
+
+func (s *memoryCodeStore) Save(purpose codePurpose, code, subject string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for k, v := range s.codes {
+		if !now.Before(v.expiresAt) {
+			delete(s.codes, k)
+		}
+	}
+
+	s.codes[string(purpose)+":"+hashToken(code)] = memoryCode{subject: subject, expiresAt: now.Add(ttl)}
+	return nil
+}
+
+func (s *memoryCodeStore) Peek(purpose codePurpose, code string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.codes[string(purpose)+":"+hashToken(code)]
+	if !ok || !time.Now().Before(c.expiresAt) {
+		return "", errCodeNotFound
+	}
+	return c.subject, nil
+}
+
+func (s *memoryCodeStore) Consume(purpose codePurpose, code string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := string(purpose) + ":" + hashToken(code)
+	c, ok := s.codes[key]
+	if !ok || !time.Now().Before(c.expiresAt) {
+		return "", errCodeNotFound
+	}
+
+	delete(s.codes, key)
+	return c.subject, nil
+}
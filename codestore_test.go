@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func Test_memoryCodeStore(t *testing.T) {
+	s := newMemoryCodeStore()
+
+	if err := s.Save(purposePasswordReset, "reset-code", "student@example.com", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Consume(purposePasswordCreate, "reset-code"); !errors.Is(err, errCodeNotFound) {
+		t.Fatalf("Expected a reset code to be rejected for another purpose, but got %v", err)
+	}
+
+	if email, err := s.Peek(purposePasswordReset, "reset-code"); err != nil || email != "student@example.com" {
+		t.Fatalf("Expected to peek at the code of student@example.com, but got %q, %v", email, err)
+	}
+
+	email, err := s.Consume(purposePasswordReset, "reset-code")
+	if err != nil || email != "student@example.com" {
+		t.Fatalf("Expected the code to belong to student@example.com, but got %q, %v", email, err)
+	}
+
+	if _, err = s.Consume(purposePasswordReset, "reset-code"); !errors.Is(err, errCodeNotFound) {
+		t.Fatalf("Expected a used code to be rejected, but got %v", err)
+	}
+	if _, err = s.Peek(purposePasswordReset, "reset-code"); !errors.Is(err, errCodeNotFound) {
+		t.Fatalf("Expected a used code to be gone, but got %v", err)
+	}
+
+	if err = s.Save(purposeEmailVerify, "expired-code", "student@example.com", -time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Consume(purposeEmailVerify, "expired-code"); !errors.Is(err, errCodeNotFound) {
+		t.Fatalf("Expected an expired code to be rejected, but got %v", err)
+	}
+}
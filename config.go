@@ -0,0 +1,502 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"net/mail"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const redactedValue = "REDACTED"
+
+// config holds every setting of the service. Settings are read, in increasing
+// order of precedence, from the defaults, an optional JSON file, the environment
+// (the env tag, the first set variable wins) and the command line, where every
+// field is a flag named after its JSON path, e.g. -db.host. Fields tagged with
+// secret are redacted when the config is printed.
+type config struct {
+	Env         string         `json:"env" env:"APP_ENV"`
+	FrontendURL string         `json:"frontend_url" env:"FRONTEND_URL"`
+	Server      serverConfig   `json:"server"`
+	DB          dbConfig       `json:"db"`
+	Redis       redisConfig    `json:"redis"`
+	Codes       codesConfig    `json:"codes"`
+	Mail        mailConfig     `json:"mail"`
+	SMTP        smtpConfig     `json:"smtp"`
+	Outbox      outboxConfig   `json:"outbox"`
+	Auth        authConfig     `json:"auth"`
+	Session     sessionConfig  `json:"session"`
+	Login       loginConfig    `json:"login"`
+	Password    passwordConfig `json:"password"`
+}
+
+type serverConfig struct {
+	Addr string `json:"addr" env:"LISTEN_ADDR"`
+	// TrustProxy takes the client IP from X-Forwarded-For, only enable it
+	// behind a proxy that sets the header.
+	TrustProxy bool `json:"trust_proxy" env:"TRUST_PROXY"`
+	// CORSOrigins may call the API from a browser, "*" allows any origin without
+	// credentials. When empty only the origin of frontend_url may.
+	CORSOrigins stringList `json:"cors_origins" env:"CORS_ORIGINS"`
+	// MaxBodyBytes limits the size of request bodies.
+	MaxBodyBytes int `json:"max_body_bytes" env:"MAX_BODY_BYTES"`
+}
+
+type dbConfig struct {
+	Host           string `json:"host" env:"DB_HOST"`
+	Port           int    `json:"port" env:"DB_PORT"`
+	User           string `json:"user" env:"DB_USER"`
+	Password       string `json:"password" env:"DB_PASSWORD" secret:"true"`
+	Name           string `json:"name" env:"DB_NAME"`
+	SSLMode        string `json:"sslmode" env:"DB_SSLMODE"`
+	MigrateOnStart bool   `json:"migrate_on_start" env:"DB_MIGRATE_ON_START"`
+}
+
+type redisConfig struct {
+	Addr     string `json:"addr" env:"REDIS_ADDR"`
+	Password string `json:"password" env:"REDIS_PASSWORD" secret:"true"`
+	DB       int    `json:"db" env:"REDIS_DB"`
+	PoolSize int    `json:"pool_size" env:"REDIS_POOL_SIZE"`
+}
+
+type codesConfig struct {
+	Backend string `json:"backend" env:"CODE_STORE"`
+}
+
+type mailConfig struct {
+	Backend string `json:"backend" env:"MAIL_BACKEND"`
+	From    string `json:"from" env:"MAIL_FROM,SMTP_FROM,MAIL"`
+	Dir     string `json:"dir" env:"MAIL_DIR"`
+}
+
+type smtpConfig struct {
+	Host     string `json:"host" env:"SMTP_HOST"`
+	Port     int    `json:"port" env:"SMTP_PORT"`
+	TLS      string `json:"tls" env:"SMTP_TLS"`
+	Username string `json:"username" env:"SMTP_USERNAME,MAIL"`
+	Password string `json:"password" env:"SMTP_PASSWORD,PASSWD" secret:"true"`
+}
+
+type outboxConfig struct {
+	PollInterval duration `json:"poll_interval" env:"OUTBOX_POLL_INTERVAL"`
+	MaxAttempts  int      `json:"max_attempts" env:"OUTBOX_MAX_ATTEMPTS"`
+	BaseDelay    duration `json:"base_delay" env:"OUTBOX_BASE_DELAY"`
+	MaxDelay     duration `json:"max_delay" env:"OUTBOX_MAX_DELAY"`
+}
+
+type authConfig struct {
+	JWTAlgorithm   string   `json:"jwt_algorithm" env:"JWT_ALGORITHM"`
+	JWTKeyDir      string   `json:"jwt_key_dir" env:"JWT_KEY_DIR"`
+	JWTKeyRotation duration `json:"jwt_key_rotation" env:"JWT_KEY_ROTATION"`
+	TOTPIssuer     string   `json:"totp_issuer" env:"TOTP_ISSUER"`
+}
+
+// sessionConfig sets how browsers keep their tokens.
+type sessionConfig struct {
+	// Cookies makes logins set HttpOnly cookies instead of returning the tokens,
+	// requests authenticated by the cookie then need a CSRF token.
+	Cookies        bool   `json:"cookies" env:"SESSION_COOKIES"`
+	CookieSecure   bool   `json:"cookie_secure" env:"SESSION_COOKIE_SECURE"`
+	CookieSameSite string `json:"cookie_same_site" env:"SESSION_COOKIE_SAME_SITE"`
+	CookieDomain   string `json:"cookie_domain" env:"SESSION_COOKIE_DOMAIN"`
+}
+
+type loginConfig struct {
+	FreeAttempts           int      `json:"free_attempts" env:"LOGIN_FREE_ATTEMPTS"`
+	BaseDelay              duration `json:"base_delay" env:"LOGIN_BASE_DELAY"`
+	MaxDelay               duration `json:"max_delay" env:"LOGIN_MAX_DELAY"`
+	AccountLockoutAttempts int      `json:"account_lockout_attempts" env:"LOGIN_ACCOUNT_LOCKOUT_ATTEMPTS"`
+	IPLockoutAttempts      int      `json:"ip_lockout_attempts" env:"LOGIN_IP_LOCKOUT_ATTEMPTS"`
+	LockoutDuration        duration `json:"lockout_duration" env:"LOGIN_LOCKOUT_DURATION"`
+	Window                 duration `json:"window" env:"LOGIN_WINDOW"`
+}
+
+type passwordConfig struct {
+	MinLength  int `json:"min_length" env:"PASSWORD_MIN_LENGTH"`
+	MinClasses int `json:"min_classes" env:"PASSWORD_MIN_CLASSES"`
+	// HistorySize is how many of the last passwords can't be used again.
+	HistorySize      int          `json:"history_size" env:"PASSWORD_HISTORY_SIZE"`
+	BreachedListFile string       `json:"breached_list_file" env:"PASSWORD_BREACHED_LIST_FILE"`
+	Algorithm        string       `json:"algorithm" env:"PASSWORD_ALGORITHM"`
+	BcryptCost       int          `json:"bcrypt_cost" env:"PASSWORD_BCRYPT_COST"`
+	Argon2           argon2Config `json:"argon2"`
+}
+
+type argon2Config struct {
+	MemoryKiB   uint32 `json:"memory_kib" env:"PASSWORD_ARGON2_MEMORY_KIB"`
+	Iterations  uint32 `json:"iterations" env:"PASSWORD_ARGON2_ITERATIONS"`
+	Parallelism uint8  `json:"parallelism" env:"PASSWORD_ARGON2_PARALLELISM"`
+}
+
+// duration is a time.Duration written as a string like "720h" in JSON.
+type duration time.Duration
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	return d.Set(s)
+}
+
+func (d duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d *duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+// stringList is a list written as a comma separated string in the environment
+// and on the command line.
+type stringList []string
+
+func (l stringList) String() string {
+	return strings.Join(l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = nil
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+func defaultConfig() config {
+	return config{
+		Env:         "production",
+		FrontendURL: "http://localhost:5173",
+		Server: serverConfig{
+			Addr:         ":8080",
+			MaxBodyBytes: 1 << 20,
+		},
+		DB: dbConfig{
+			Host:           "localhost",
+			Port:           5432,
+			SSLMode:        "disable",
+			MigrateOnStart: true,
+		},
+		Redis: redisConfig{
+			Addr:     "localhost:6379",
+			PoolSize: 10,
+		},
+		Codes: codesConfig{
+			Backend: "redis",
+		},
+		Mail: mailConfig{
+			Backend: "smtp",
+			Dir:     "maildir",
+		},
+		SMTP: smtpConfig{
+			Host: "smtp.gmail.com",
+			Port: 587,
+			TLS:  "starttls",
+		},
+		Outbox: outboxConfig{
+			PollInterval: duration(5 * time.Second),
+			MaxAttempts:  8,
+			BaseDelay:    duration(30 * time.Second),
+			MaxDelay:     duration(time.Hour),
+		},
+		Auth: authConfig{
+			JWTAlgorithm:   "EdDSA",
+			JWTKeyRotation: duration(30 * 24 * time.Hour),
+			TOTPIssuer:     "Virtual Student Report Card",
+		},
+		Session: sessionConfig{
+			CookieSecure:   true,
+			CookieSameSite: "lax",
+		},
+		Login: loginConfig{
+			FreeAttempts:           3,
+			BaseDelay:              duration(time.Second),
+			MaxDelay:               duration(time.Minute),
+			AccountLockoutAttempts: 10,
+			IPLockoutAttempts:      100,
+			LockoutDuration:        duration(15 * time.Minute),
+			Window:                 duration(time.Hour),
+		},
+		Password: passwordConfig{
+			MinLength:   10,
+			MinClasses:  3,
+			HistorySize: 5,
+			Algorithm:   "bcrypt",
+			BcryptCost:  bcrypt.DefaultCost,
+			Argon2: argon2Config{
+				MemoryKiB:   64 * 1024,
+				Iterations:  3,
+				Parallelism: 2,
+			},
+		},
+	}
+}
+
+// loadConfig builds the config from all sources and validates it. It returns
+// the command line arguments left after the flags.
+func loadConfig(args []string) (config, []string, error) {
+	if err := godotenv.Load(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return config{}, nil, fmt.Errorf("failed to load .env file: %w", err)
+	}
+
+	cfg := defaultConfig()
+
+	flags := flag.NewFlagSet("virtual-student-report-card", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), usage)
+		fmt.Fprintln(flags.Output())
+		flags.PrintDefaults()
+	}
+	configFile := flags.String("config", os.Getenv("CONFIG_FILE"), "path to a JSON config file")
+	printConfig := flags.Bool("print-config", false, "print the config with secrets redacted and exit")
+
+	// Flags are parsed into a scratch copy, so that they can be applied after the
+	// file and the environment.
+	var fromFlags config
+	flagValues := map[string]reflect.Value{}
+	walkConfig(&fromFlags, func(path string, field reflect.StructField, v reflect.Value) {
+		flagValues[path] = v
+		flags.Var(fieldFlag{v}, path, fmt.Sprintf("%s (env %s)", path, field.Tag.Get("env")))
+	})
+
+	if err := flags.Parse(args); err != nil {
+		return config{}, nil, err
+	}
+
+	if *configFile != "" {
+		f, err := os.Open(*configFile)
+		if err != nil {
+			return config{}, nil, err
+		}
+
+		// A misspelled key would silently leave its setting at the default.
+		dec := json.NewDecoder(f)
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&cfg)
+		_ = f.Close()
+		if err != nil && strings.HasPrefix(err.Error(), "json: unknown field ") {
+			return config{}, nil, fmt.Errorf("failed to parse %s: unknown key %s", *configFile, strings.TrimPrefix(err.Error(), "json: unknown field "))
+		} else if err != nil {
+			return config{}, nil, fmt.Errorf("failed to parse %s: %w", *configFile, err)
+		}
+	}
+
+	var err error
+	walkConfig(&cfg, func(path string, field reflect.StructField, v reflect.Value) {
+		for _, name := range strings.Split(field.Tag.Get("env"), ",") {
+			if s, ok := os.LookupEnv(name); ok && err == nil {
+				if setErr := (fieldFlag{v}).Set(s); setErr != nil {
+					err = fmt.Errorf("invalid value for %s: %w", name, setErr)
+				}
+				break
+			}
+		}
+	})
+	if err != nil {
+		return config{}, nil, err
+	}
+
+	setByFlag := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) {
+		setByFlag[f.Name] = true
+	})
+	walkConfig(&cfg, func(path string, _ reflect.StructField, v reflect.Value) {
+		if setByFlag[path] {
+			v.Set(flagValues[path])
+		}
+	})
+
+	if err = cfg.validate(); err != nil {
+		return config{}, nil, err
+	}
+
+	if *printConfig {
+		b, _ := json.MarshalIndent(cfg.redacted(), "", "  ")
+		fmt.Println(string(b))
+		os.Exit(0)
+	}
+
+	return cfg, flags.Args(), nil
+}
+
+func (c config) validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(c.Env == "development" || c.Env == "staging" || c.Env == "production", "env must be development, staging or production")
+	check(c.Server.Addr != "", "server.addr must be set")
+	check(c.Server.MaxBodyBytes > 0, "server.max_body_bytes must be positive")
+	check(c.DB.Host != "", "db.host must be set")
+	check(c.DB.Port > 0 && c.DB.Port < 65536, "db.port must be a valid port")
+	check(c.DB.User != "", "db.user must be set")
+	check(c.DB.Name != "", "db.name must be set")
+	check(strings.Contains(" disable allow prefer require verify-ca verify-full ", " "+c.DB.SSLMode+" "), "db.sslmode %q is not a valid sslmode", c.DB.SSLMode)
+	check(c.Codes.Backend == "redis" || c.Codes.Backend == "postgres" || c.Codes.Backend == "memory", "codes.backend must be redis, postgres or memory")
+	if c.Codes.Backend == "redis" {
+		check(c.Redis.Addr != "", "redis.addr must be set")
+		check(c.Redis.DB >= 0, "redis.db must not be negative")
+		check(c.Redis.PoolSize > 0, "redis.pool_size must be positive")
+	}
+	check(c.Mail.Backend == "smtp" || c.Mail.Backend == "file" || c.Mail.Backend == "console" || c.Mail.Backend == "memory", "mail.backend must be smtp, file, console or memory")
+	_, err := mail.ParseAddress(c.Mail.From)
+	check(err == nil, "mail.from must be an email address")
+	check(c.Mail.Backend != "file" || c.Mail.Dir != "", "mail.dir must be set for the file backend")
+	if c.Mail.Backend == "smtp" {
+		check(c.SMTP.Host != "", "smtp.host must be set")
+		check(c.SMTP.Port > 0 && c.SMTP.Port < 65536, "smtp.port must be a valid port")
+		check(c.SMTP.TLS == "starttls" || c.SMTP.TLS == "tls" || c.SMTP.TLS == "none", "smtp.tls must be starttls, tls or none")
+	}
+	check(c.Auth.TOTPIssuer != "" && !strings.Contains(c.Auth.TOTPIssuer, ":"), "auth.totp_issuer must be set and not contain a colon")
+	check(c.Outbox.PollInterval > 0, "outbox.poll_interval must be positive")
+	check(c.Outbox.MaxAttempts > 0, "outbox.max_attempts must be positive")
+	check(c.Outbox.BaseDelay > 0 && c.Outbox.BaseDelay <= c.Outbox.MaxDelay, "outbox.base_delay must be positive and at most outbox.max_delay")
+	check(c.Auth.JWTAlgorithm == "EdDSA" || c.Auth.JWTAlgorithm == "RS256", "auth.jwt_algorithm must be EdDSA or RS256")
+	// A key is retired before the key after its successor is generated, so at most
+	// two are kept.
+	check(time.Duration(c.Auth.JWTKeyRotation) > keyPublishDelay+longestTokenTTL(), "auth.jwt_key_rotation must be longer than %s", keyPublishDelay+longestTokenTTL())
+	check(c.Session.CookieSameSite == "strict" || c.Session.CookieSameSite == "lax" || c.Session.CookieSameSite == "none", "session.cookie_same_site must be strict, lax or none")
+	check(c.Session.CookieSameSite != "none" || c.Session.CookieSecure, "session.cookie_secure must be set when session.cookie_same_site is none")
+	for _, v := range c.Server.CORSOrigins {
+		u, err := url.Parse(v)
+		check(v == "*" || (err == nil && u.Scheme != "" && u.Host != "" && u.Path == ""), "server.cors_origins must be origins like https://example.com, but got %q", v)
+	}
+	check(c.Login.FreeAttempts >= 0, "login.free_attempts must not be negative")
+	check(c.Login.BaseDelay > 0 && c.Login.BaseDelay <= c.Login.MaxDelay, "login.base_delay must be positive and at most login.max_delay")
+	check(c.Login.AccountLockoutAttempts > c.Login.FreeAttempts, "login.account_lockout_attempts must be more than login.free_attempts")
+	check(c.Login.IPLockoutAttempts > c.Login.FreeAttempts, "login.ip_lockout_attempts must be more than login.free_attempts")
+	check(c.Login.LockoutDuration > 0, "login.lockout_duration must be positive")
+	check(c.Login.Window > 0, "login.window must be positive")
+	check(c.Password.MinLength > 0, "password.min_length must be positive")
+	check(c.Password.MinClasses >= 0 && c.Password.MinClasses <= 4, "password.min_classes must be between 0 and 4")
+	check(c.Password.HistorySize >= 0, "password.history_size must not be negative")
+	check(c.Password.Algorithm == "bcrypt" || c.Password.Algorithm == "argon2id", "password.algorithm must be bcrypt or argon2id")
+	check(c.Password.BcryptCost >= bcrypt.MinCost && c.Password.BcryptCost <= bcrypt.MaxCost, "password.bcrypt_cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+	check(c.Password.Argon2.Iterations > 0 && c.Password.Argon2.Parallelism > 0, "password.argon2.iterations and password.argon2.parallelism must be positive")
+	check(c.Password.Argon2.MemoryKiB >= 8*uint32(c.Password.Argon2.Parallelism), "password.argon2.memory_kib must be at least 8 times password.argon2.parallelism")
+
+	u, err := url.Parse(c.FrontendURL)
+	check(err == nil && u.Scheme != "" && u.Host != "", "frontend_url must be an absolute URL")
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid config:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// redacted returns a copy of the config that is safe to print.
+func (c config) redacted() config {
+	walkConfig(&c, func(_ string, field reflect.StructField, v reflect.Value) {
+		if field.Tag.Get("secret") == "true" && v.String() != "" {
+			v.SetString(redactedValue)
+		}
+	})
+	return c
+}
+
+// dsn returns the connection string for lib/pq.
+func (c dbConfig) dsn() string {
+	quote := func(s string) string {
+		return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+	}
+
+	dsn := fmt.Sprintf("host=%s port=%d user=%s dbname=%s sslmode=%s", quote(c.Host), c.Port, quote(c.User), quote(c.Name), quote(c.SSLMode))
+	if c.Password != "" {
+		dsn += " password=" + quote(c.Password)
+	}
+	return dsn
+}
+
+// walkConfig calls fn for every leaf field of the config with its JSON path.
+func walkConfig(c *config, fn func(path string, field reflect.StructField, v reflect.Value)) {
+	var walk func(prefix string, v reflect.Value)
+	walk = func(prefix string, v reflect.Value) {
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			path := prefix + strings.Split(field.Tag.Get("json"), ",")[0]
+
+			if field.Type.Kind() == reflect.Struct {
+				walk(path+".", v.Field(i))
+				continue
+			}
+			fn(path, field, v.Field(i))
+		}
+	}
+	walk("", reflect.ValueOf(c).Elem())
+}
+
+// fieldFlag sets a config field from its string form.
+type fieldFlag struct {
+	v reflect.Value
+}
+
+func (f fieldFlag) String() string {
+	if !f.v.IsValid() {
+		return ""
+	}
+	return fmt.Sprint(f.v.Interface())
+}
+
+func (f fieldFlag) Set(s string) error {
+	if d, ok := f.v.Addr().Interface().(*duration); ok {
+		return d.Set(s)
+	}
+	if l, ok := f.v.Addr().Interface().(*stringList); ok {
+		return l.Set(s)
+	}
+
+	switch f.v.Kind() {
+	case reflect.String:
+		f.v.SetString(s)
+	case reflect.Int:
+		i, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		f.v.SetInt(int64(i))
+	case reflect.Uint8, reflect.Uint32:
+		i, err := strconv.ParseUint(s, 10, f.v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		f.v.SetUint(i)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		f.v.SetBool(b)
+	default:
+		return fmt.Errorf("unsupported config type %s", f.v.Type())
+	}
+	return nil
+}
+
+func (f fieldFlag) IsBoolFlag() bool {
+	return f.v.IsValid() && f.v.Kind() == reflect.Bool
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_loadConfig(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(file, []byte(`{"db": {"host": "file-host", "port": 6000, "user": "file-user", "name": "report_card", "password": "s3cret"}, "auth": {"jwt_key_rotation": "48h"}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("DB_USER", "env-user")
+	t.Setenv("DB_PORT", "7000")
+	t.Setenv("MAIL_FROM", "no-reply@example.com")
+
+	cfg, args, err := loadConfig([]string{"-config", file, "-db.port", "8000", "migrate", "status"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Join(args, " ") != "migrate status" {
+		t.Fatalf("Expected the command to be left, but got %v", args)
+	}
+	if cfg.DB.Host != "file-host" || cfg.DB.User != "env-user" || cfg.DB.Port != 8000 {
+		t.Fatalf("Expected file < env < flag precedence, but got %+v", cfg.DB)
+	}
+	if time.Duration(cfg.Auth.JWTKeyRotation) != 48*time.Hour {
+		t.Fatalf("Expected a rotation of 48h, but got %s", cfg.Auth.JWTKeyRotation)
+	}
+	if cfg.Server.Addr != ":8080" {
+		t.Fatalf("Expected the default address, but got %s", cfg.Server.Addr)
+	}
+
+	b, err := json.Marshal(cfg.redacted())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "s3cret") || cfg.DB.Password != "s3cret" {
+		t.Fatalf("Expected only the printed config to be redacted, but got %s", b)
+	}
+}
+
+func Test_loadConfig_unknownKey(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(file, []byte(`{"db": {"hots": "file-host"}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err := loadConfig([]string{"-config", file})
+	if err == nil || !strings.Contains(err.Error(), `unknown key "hots"`) {
+		t.Fatalf("Expected the unknown key to be reported, but got %v", err)
+	}
+}
+
+func Test_config_validate(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Env = "test"
+	cfg.DB.Port = 0
+	cfg.Auth.JWTKeyRotation = duration(30 * time.Minute)
+
+	err := cfg.validate()
+	if err == nil {
+		t.Fatal("Expected an invalid config")
+	}
+
+	for _, want := range []string{"env must be", "db.port", "db.user", "db.name", "auth.jwt_key_rotation"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("Expected %q in %s", want, err)
+		}
+	}
+}
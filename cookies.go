@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// In cookie mode the tokens live in HttpOnly cookies the frontend can't read.
+// The CSRF token is a double-submit cookie: the frontend reads it and sends it
+// back in the X-CSRF-Token header, which other sites can't do.
+const (
+	accessCookieName  = "access_token"
+	refreshCookieName = "refresh_token"
+	csrfCookieName    = "csrf_token"
+	csrfHeader        = "X-CSRF-Token"
+)
+
+var errInvalidCSRFToken = errors.New("missing or invalid CSRF token")
+
+// tokenFromRequest returns the access token of the Authorization header, with or
+// without a "Bearer " prefix, or else of the access cookie.
+func tokenFromRequest(r *http.Request) (token string, fromCookie bool) {
+	if header := r.Header.Get("Authorization"); header != "" {
+		if len(header) > len("Bearer ") && strings.EqualFold(header[:len("Bearer ")], "Bearer ") {
+			return header[len("Bearer "):], false
+		}
+		return header, false
+	}
+
+	if c, err := r.Cookie(accessCookieName); err == nil && c.Value != "" {
+		return c.Value, true
+	}
+	return "", false
+}
+
+// validCSRFToken reports whether the CSRF header matches the CSRF cookie.
+func validCSRFToken(r *http.Request) bool {
+	c, err := r.Cookie(csrfCookieName)
+	if err != nil || c.Value == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(c.Value), []byte(r.Header.Get(csrfHeader))) == 1
+}
+
+// setSessionCookies puts the tokens into cookies and returns the new CSRF token.
+func (h handler) setSessionCookies(w http.ResponseWriter, accessToken, refreshToken string) (string, error) {
+	csrfToken, err := newOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	http.SetCookie(w, h.sessionCookie(accessCookieName, accessToken, accessTokenTTL, true))
+	http.SetCookie(w, h.sessionCookie(refreshCookieName, refreshToken, refreshTokenTTL, true))
+	http.SetCookie(w, h.sessionCookie(csrfCookieName, csrfToken, refreshTokenTTL, false))
+	return csrfToken, nil
+}
+
+func (h handler) clearSessionCookies(w http.ResponseWriter) {
+	for _, name := range []string{accessCookieName, refreshCookieName, csrfCookieName} {
+		http.SetCookie(w, h.sessionCookie(name, "", -1, name != csrfCookieName))
+	}
+}
+
+func (h handler) sessionCookie(name, value string, ttl time.Duration, httpOnly bool) *http.Cookie {
+	sameSite := http.SameSiteLaxMode
+	switch h.session.CookieSameSite {
+	case "strict":
+		sameSite = http.SameSiteStrictMode
+	case "none":
+		sameSite = http.SameSiteNoneMode
+	}
+
+	c := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		Domain:   h.session.CookieDomain,
+		MaxAge:   int(ttl.Seconds()),
+		Secure:   h.session.CookieSecure,
+		HttpOnly: httpOnly,
+		SameSite: sameSite,
+	}
+	if ttl < 0 {
+		c.MaxAge = -1
+	}
+	return c
+}
+
+// refreshTokenFromRequest returns the refresh token of the body or, in cookie
+// mode, of the refresh cookie. The cookie is only used with a valid CSRF token.
+func (h handler) refreshTokenFromRequest(r *http.Request, fromBody string) (string, error) {
+	if fromBody != "" || !h.session.Cookies {
+		return fromBody, nil
+	}
+
+	c, err := r.Cookie(refreshCookieName)
+	if err != nil || c.Value == "" {
+		return "", nil
+	}
+	if !validCSRFToken(r) {
+		return "", errInvalidCSRFToken
+	}
+	return c.Value, nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_tokenFromRequest(t *testing.T) {
+	tests := []struct {
+		name       string
+		header     string
+		cookie     string
+		token      string
+		fromCookie bool
+	}{
+		{"Bearer header", "Bearer abc", "", "abc", false},
+		{"Lowercase bearer", "bearer abc", "", "abc", false},
+		{"Raw header", "abc", "", "abc", false},
+		{"Header before cookie", "Bearer abc", "def", "abc", false},
+		{"Cookie", "", "def", "def", true},
+		{"Nothing", "", "", "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if test.header != "" {
+				r.Header.Set("Authorization", test.header)
+			}
+			if test.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: accessCookieName, Value: test.cookie})
+			}
+
+			token, fromCookie := tokenFromRequest(r)
+			if token != test.token || fromCookie != test.fromCookie {
+				t.Fatalf("Expected %q from cookie %v, but got %q from cookie %v", test.token, test.fromCookie, token, fromCookie)
+			}
+		})
+	}
+}
+
+func Test_validCSRFToken(t *testing.T) {
+	tests := []struct {
+		name   string
+		cookie string
+		header string
+		valid  bool
+	}{
+		{"Matching", "abc", "abc", true},
+		{"Different", "abc", "abd", false},
+		{"Missing header", "abc", "", false},
+		{"Missing cookie", "", "abc", false},
+		{"Missing both", "", "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/", nil)
+			if test.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: csrfCookieName, Value: test.cookie})
+			}
+			if test.header != "" {
+				r.Header.Set(csrfHeader, test.header)
+			}
+
+			if valid := validCSRFToken(r); valid != test.valid {
+				t.Fatalf("Expected %v, but got %v", test.valid, valid)
+			}
+		})
+	}
+}
+
+func Test_corsHandler(t *testing.T) {
+	tests := []struct {
+		name        string
+		origins     []string
+		origin      string
+		allowOrigin string
+		credentials bool
+	}{
+		{"Allowed origin", []string{"https://app.example.com"}, "https://app.example.com", "https://app.example.com", true},
+		{"Other origin", []string{"https://app.example.com"}, "https://evil.example.com", "", false},
+		{"Any origin", []string{"*"}, "https://evil.example.com", "*", false},
+		{"No origin", []string{"https://app.example.com"}, "", "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := corsHandler(test.origins, []string{http.MethodGet, http.MethodPut})(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusTeapot)
+			})
+
+			for _, method := range []string{http.MethodOptions, http.MethodGet} {
+				r := httptest.NewRequest(method, "/", nil)
+				if test.origin != "" {
+					r.Header.Set("Origin", test.origin)
+				}
+				w := httptest.NewRecorder()
+				h(w, r)
+
+				if got := w.Header().Get("Access-Control-Allow-Origin"); got != test.allowOrigin {
+					t.Fatalf("Expected %s to allow origin %q, but got %q", method, test.allowOrigin, got)
+				}
+				if got := w.Header().Get("Access-Control-Allow-Credentials") == "true"; got != test.credentials {
+					t.Fatalf("Expected %s to allow credentials %v, but got %v", method, test.credentials, got)
+				}
+				if got := w.Header().Get("Access-Control-Allow-Methods"); method == http.MethodOptions && got != "GET, PUT, OPTIONS" {
+					t.Fatalf("Expected the given methods to be allowed, but got %q", got)
+				}
+				if method == http.MethodGet && w.Code != http.StatusTeapot {
+					t.Fatalf("Expected the request to be handled, but got %d", w.Code)
+				}
+			}
+		})
+	}
+}
+
+// Test_corsHandler_methods checks that preflight requests allow every method the
+// API has routes for.
+func Test_corsHandler_methods(t *testing.T) {
+	s := newTestServer(t, testConfig())
+
+	r := httptest.NewRequest(http.MethodOptions, "/people/"+demoStudentID+"/roles/Registrar", nil)
+	r.Header.Set("Origin", "http://localhost:5173")
+	w := httptest.NewRecorder()
+	s.http.ServeHTTP(w, r)
+
+	if got := w.Header().Get("Access-Control-Allow-Methods"); got != "DELETE, GET, PATCH, POST, PUT, OPTIONS" {
+		t.Fatalf("Expected every method of the API to be allowed, but got %q", got)
+	}
+}
@@ -1,264 +1,168 @@
 package main
 
 import (
-	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
-	"net/smtp"
-	"os"
 	"time"
 
-	"github.com/dchest/uniuri"
-	"github.com/go-redis/redis/v8"
 	"github.com/jmoiron/sqlx"
-	"golang.org/x/crypto/bcrypt"
 )
 
-//TODO: Update teacher and student insert and update strategies
+var (
+	errCourseNotInScope = errors.New("course not found or not led by that teacher")
+	errCourseNotFound   = errors.New("course not found")
+)
 
 const (
-	dropTables = `
-DROP TABLE IF EXISTS exam;
-DROP TABLE IF EXISTS course;
-DROP TABLE IF EXISTS admin;
-DROP TABLE IF EXISTS student;
-DROP TABLE IF EXISTS teacher;
-DROP TABLE IF EXISTS person;`
-
-	schema = `
-CREATE TABLE IF NOT EXISTS person (
-    email TEXT NOT NULL PRIMARY KEY UNIQUE CHECK (email ~ '^[A-Za-z0-9._%-]+@[A-Za-z0-9.-]+[.][A-Za-z]+$'),
-    name TEXT NOT NULL CHECK (name <> ''),
-    phone TEXT,
-    password TEXT
-);
-
-CREATE TABLE IF NOT EXISTS admin (
-    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
-    person_id TEXT UNIQUE REFERENCES person(email) NOT NULL,
-    active BOOLEAN DEFAULT TRUE
-);
-
-CREATE TABLE IF NOT EXISTS student (
-    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
-	faculty_number TEXT UNIQUE NOT NULL CHECK ( faculty_number ~ '^\d{8}$'),
-    person_id TEXT UNIQUE REFERENCES person(email) NOT NULL,
-    active BOOLEAN DEFAULT TRUE
-);
-
-CREATE TABLE IF NOT EXISTS teacher (
-    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
-    person_id TEXT UNIQUE REFERENCES person(email) NOT NULL,
-    active BOOLEAN DEFAULT TRUE
-);
-
--- Given subject of study e.g. math
-CREATE TABLE IF NOT EXISTS course (
-    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
-    teacher_id UUID REFERENCES teacher(id) NOT NULL,
-    name TEXT NOT NULL CHECK (name <> ''),
-    number_of_seats INT DEFAULT 50 CHECK (number_of_seats > 0),
-    deleted BOOL DEFAULT FALSE,
-    UNIQUE(name, teacher_id)
-);
-
-CREATE TABLE IF NOT EXISTS exam (
-    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
-    course_id UUID REFERENCES course(id) NOT NULL,
-    student_faculty_number TEXT REFERENCES student(faculty_number) NOT NULL,
-    points INT CHECK (points > 0),
-  	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
-    deleted BOOL DEFAULT FALSE
-);`
-
-	addExampleData = `
-INSERT INTO person(name, phone, email, password) VALUES 
-    ('ivan', '0881234563', 'test@test.com', '$2a$10$hk6NfxXSkNUzEd7fiqGyxOGUjimPR/jtdmRf0yrbB/eKfh5HwKe4q'),
-    ('ivan1', '0881234564', 'test1@test.com', '$2a$10$hk6NfxXSkNUzEd7fiqGyxOGUjimPR/jtdmRf0yrbB/eKfh5HwKe4q'),
-    ('ivan2', '0881234565', 'test2@test.com', '$2a$10$hk6NfxXSkNUzEd7fiqGyxOGUjimPR/jtdmRf0yrbB/eKfh5HwKe4q');
-
-INSERT INTO admin(person_id) VALUES 
-    ((SELECT email FROM person WHERE name='ivan'));
-
-INSERT INTO student(faculty_number, person_id) VALUES 
-    ('12312312',(SELECT email FROM person WHERE name='ivan1'));
-
-INSERT INTO teacher(person_id) VALUES 
-    ((SELECT email FROM person WHERE name='ivan2'));
-
-INSERT INTO course(teacher_id, name) VALUES 
-    ((SELECT id FROM teacher LIMIT 1), 'Math'), 
-    ((SELECT id FROM teacher LIMIT 1), 'Programming Basics'),
-    ((SELECT id FROM teacher LIMIT 1), 'Physics');
-
-INSERT INTO exam(course_id, student_faculty_number, points) VALUES 
-    ((SELECT id FROM course WHERE name='Math' LIMIT 1),(SELECT faculty_number FROM student LIMIT 1), 56),
-    ((SELECT id FROM course WHERE name='Physics' LIMIT 1),(SELECT faculty_number FROM student LIMIT 1), 88),
-    ((SELECT id FROM course WHERE name='Programming Basics' LIMIT 1),(SELECT faculty_number FROM student LIMIT 1), 67);
-`
+	codeLength      = 32
+	passwordCodeTTL = time.Hour
 )
 
 type dbConnection struct {
-	db *sqlx.DB
+	db          *sqlx.DB
+	codes       CodeStore
+	frontendURL string
+	login       loginConfig
+	passwords   passwordPolicy
 }
 
-func createDatabaseConnection() (dbConnection, error) {
-	connString := fmt.Sprintf("user=%s dbname=%s sslmode=disable", os.Getenv("DB_USER"), os.Getenv("DB_NAME"))
-	db, err := sqlx.Connect("postgres", connString)
+func openDatabase(cfg dbConfig) (*sqlx.DB, error) {
+	db, err := sqlx.Connect("postgres", cfg.dsn())
 	if err != nil {
-		return dbConnection{}, err
+		return nil, err
 	}
 	log.Println("DB connection successfully")
 
-	db.MustExec(dropTables)
-	log.Println("DB drop old tables")
-
-	db.MustExec(schema)
-	log.Println("DB schema created successfully")
-
-	db.MustExec(addExampleData)
-	log.Println("DB populated with example data")
-
-	return dbConnection{
-		db: db,
-	}, nil
+	return db, nil
 }
 
-func (conn dbConnection) validateUserLogin(email string, password []byte) bool {
-	var u User
-	if err := conn.db.Get(&u, "SELECT email, password FROM person WHERE email=$1", email); err != nil {
-		log.Printf("Failed to query db,\n %e", err)
-		return false
+func createDatabaseConnection(cfg config) (dbConnection, error) {
+	db, err := openDatabase(cfg.DB)
+	if err != nil {
+		return dbConnection{}, err
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(u.Password), password); err != nil {
-		log.Printf("Password did not match \n%e", err)
-		return false
+	m, err := newMigrator(db)
+	if err != nil {
+		return dbConnection{}, err
 	}
 
-	return true
-}
-
-func (conn dbConnection) getUserRoles(uuid string) (roles []string) {
-	dest := ""
-	if err := conn.db.Get(&dest, "SELECT id FROM admin WHERE person_id=$1", uuid); err == nil {
-		roles = append(roles, "Admin")
+	// Pending migrations are applied on start unless disabled, but a dirty or
+	// unknown migration state always keeps the server from starting.
+	if cfg.DB.MigrateOnStart {
+		err = m.up(-1)
+	} else {
+		var pending []migration
+		if pending, err = m.pending(); err == nil && len(pending) > 0 {
+			err = fmt.Errorf("database schema is not up to date, run migrate up first")
+		}
 	}
-
-	if err := conn.db.Get(&dest, "SELECT id FROM student WHERE person_id=$1", uuid); err == nil {
-		roles = append(roles, "Student")
+	if err != nil {
+		return dbConnection{}, err
 	}
+	log.Println("DB schema is up to date")
 
-	if err := conn.db.Get(&dest, "SELECT id FROM teacher WHERE person_id=$1", uuid); err == nil {
-		roles = append(roles, "Teacher")
+	codes, err := newCodeStore(cfg, db)
+	if err != nil {
+		return dbConnection{}, err
 	}
 
-	return roles
-}
-
-func (conn dbConnection) getStudentExams(studentEmail string) (exams []Exam, err error) {
-	var studentFacultyNumber string
-	if err = conn.db.Get(&studentFacultyNumber, "SELECT faculty_number FROM student WHERE person_id=$1", studentEmail); err != nil {
-		return exams, err
+	passwords, err := newPasswordPolicy(cfg.Password)
+	if err != nil {
+		return dbConnection{}, err
 	}
 
-	if err = conn.db.Select(&exams, "SELECT p.name as StudentName, c.name as CourseName, points FROM exam e JOIN course c ON c.id = e.course_id JOIN student s ON s.faculty_number = e.student_faculty_number JOIN person p ON p.email = s.person_id WHERE faculty_number=$1 AND c.deleted=FALSE", studentFacultyNumber); err != nil {
-		return exams, err
-	}
-	return exams, nil
+	return dbConnection{
+		db:          db,
+		codes:       codes,
+		frontendURL: cfg.FrontendURL,
+		login:       cfg.Login,
+		passwords:   passwords,
+	}, nil
 }
 
-func (conn dbConnection) insertExam(teacherEmail string, e Exam) error {
-	courses, err := conn.getTeacherCourses(teacherEmail)
-	if err != nil {
-		return err
-	}
-
-	if !courseList(courses).contains(e.CourseName) {
-		return fmt.Errorf("course not led by that teacher")
+// validateUserLogin returns the id of the person when the password matches.
+func (conn dbConnection) validateUserLogin(email string, password []byte) (string, bool) {
+	var u struct {
+		ID       string
+		Password string
 	}
-
-	teacherId, err := conn.getTeacherIdFromEmail(teacherEmail)
-	if err != nil {
-		return err
+	if err := conn.db.Get(&u, "SELECT id, password FROM person WHERE email=$1", email); err != nil {
+		log.Printf("Failed to query db,\n %e", err)
+		return "", false
 	}
 
-	var courseID string
-	if err = conn.db.Get(&courseID, "SELECT id FROM course WHERE name = $1 AND teacher_id = $2", e.CourseName, teacherId); err != nil {
-		return err
+	ok, rehash := conn.passwords.verify(u.Password, string(password))
+	if !ok {
+		log.Printf("Password did not match")
+		return "", false
 	}
 
-	if _, err = conn.db.Exec("INSERT INTO exam(course_id, student_faculty_number, points) VALUES ($1, $2, $3)", courseID, e.StudentFacultyNumber, e.Points); err != nil {
-		return err
-	}
-	return nil
-}
-
-type courseList []Course
-
-func (c courseList) contains(name string) bool {
-	for _, v := range c {
-		if v.Name == name {
-			return true
+	// The hash is upgraded while the plain password is at hand, when the
+	// algorithm or its cost changed since it was saved.
+	if rehash {
+		hashedPassword, err := conn.passwords.hash(string(password))
+		if err == nil {
+			_, err = conn.db.Exec("UPDATE person SET password=$1 WHERE id=$2", hashedPassword, u.ID)
+		}
+		if err != nil {
+			log.Printf("Failed to rehash password \n%v", err)
 		}
 	}
-	return false
+
+	return u.ID, true
 }
 
-func (conn dbConnection) getTeacherCourses(email string) ([]Course, error) {
-	id, err := conn.getTeacherIdFromEmail(email)
-	if err != nil {
-		return nil, err
+func (conn dbConnection) getUserRoles(uuid string) (roles []string) {
+	dest := ""
+	if err := conn.db.Get(&dest, "SELECT id FROM admin WHERE person_id=$1 AND active=TRUE", uuid); err == nil {
+		roles = append(roles, "Admin")
 	}
 
-	var courses []Course
-	if err = conn.db.Select(&courses, "SELECT id, teacher_id as TeacherId, name, number_of_seats as NumberOfSeats FROM course WHERE teacher_id = $1 AND deleted=FALSE", id); err != nil {
-		log.Printf("Failed to get teacher courses")
-		return nil, err
+	if err := conn.db.Get(&dest, "SELECT id FROM student WHERE person_id=$1 AND active=TRUE", uuid); err == nil {
+		roles = append(roles, "Student")
 	}
 
-	return courses, nil
-}
-
-func (conn dbConnection) getTeacherCourseNames(email string) ([]string, error) {
-	courses, err := conn.getTeacherCourses(email)
-	if err != nil {
-		return nil, err
+	if err := conn.db.Get(&dest, "SELECT id FROM teacher WHERE person_id=$1 AND active=TRUE", uuid); err == nil {
+		roles = append(roles, "Teacher")
 	}
 
-	var result []string
-	for _, v := range courses {
-		result = append(result, v.Name)
+	var assigned []string
+	if err := conn.db.Select(&assigned, "SELECT role_name FROM person_role WHERE person_id=$1", uuid); err == nil {
+		roles = append(roles, assigned...)
 	}
 
-	return result, nil
+	return roles
 }
 
-func (conn dbConnection) getStudentFacultyNumbers() ([]string, error) {
-	students, err := conn.getAllStudents()
-	if err != nil {
+func (conn dbConnection) getExams(s scope) (exams []Exam, err error) {
+	if err = conn.db.Select(&exams, "SELECT c.name as CourseName, p.name as StudentName, e.student_faculty_number as StudentFacultyNumber, e.points as Points FROM exam e JOIN student s on s.faculty_number = e.student_faculty_number JOIN person p on p.id = s.person_id JOIN course c on c.id = e.course_id JOIN teacher t on t.id = c.teacher_id WHERE e.deleted=FALSE AND c.deleted=FALSE AND ($1 = '' OR s.person_id::text = $1) AND ($2 = '' OR t.person_id::text = $2) AND ($3 = '' OR e.student_faculty_number = $3)", s.studentID, s.teacherID, s.facultyNumber); err != nil {
+		log.Printf("Failed to get exams")
 		return nil, err
 	}
+	return exams, nil
+}
 
-	var result []string
-	for _, v := range students {
-		result = append(result, v.FacultyNumber)
+func (conn dbConnection) insertExam(s scope, e Exam) error {
+	var courseID string
+	if err := conn.db.Get(&courseID, "SELECT c.id FROM course c JOIN teacher t on t.id = c.teacher_id WHERE c.name = $1 AND c.deleted=FALSE AND ($2 = '' OR t.person_id::text = $2)", e.CourseName, s.teacherID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return errCourseNotInScope
+		}
+		return err
 	}
 
-	return result, nil
-}
-
-func (conn dbConnection) getTeacherIdFromEmail(email string) (id string, err error) {
-	if err = conn.db.Get(&id, "SELECT id FROM teacher WHERE person_id=$1", email); err != nil {
-		return "", err
+	if _, err := conn.db.Exec("INSERT INTO exam(course_id, student_faculty_number, points) VALUES ($1, $2, $3)", courseID, e.StudentFacultyNumber, e.Points); err != nil {
+		return err
 	}
-	return id, nil
+	return nil
 }
 
-func (conn dbConnection) getAllCourses() (courses []Course, err error) {
-	if err = conn.db.Select(&courses, "SELECT c.id, teacher_id as TeacherId, c.name, number_of_seats as NumberOfSeats, p.name as TeacherName FROM course c JOIN teacher t on t.id = c.teacher_id JOIN person p on p.email = t.person_id WHERE deleted=FALSE"); err != nil {
+func (conn dbConnection) getCourses(s scope) (courses []Course, err error) {
+	if err = conn.db.Select(&courses, "SELECT c.id, teacher_id as TeacherId, c.name, number_of_seats as NumberOfSeats, p.name as TeacherName FROM course c JOIN teacher t on t.id = c.teacher_id JOIN person p on p.id = t.person_id WHERE deleted=FALSE AND ($1 = '' OR t.person_id::text = $1)", s.teacherID); err != nil {
 		log.Printf("Failed to get courses")
 		return nil, err
 	}
@@ -274,14 +178,19 @@ func (conn dbConnection) insertCourse(c Course) error {
 }
 
 func (conn dbConnection) updateCourse(c Course) error {
-	if _, err := conn.db.Exec("UPDATE course SET teacher_id=$1, name=$2, number_of_seats=$3 WHERE id=$4", c.TeacherId, c.Name, c.NumberOfSeats, c.Id); err != nil {
+	res, err := conn.db.Exec("UPDATE course SET teacher_id=$1, name=$2, number_of_seats=$3 WHERE id::text=$4 AND deleted=FALSE", c.TeacherId, c.Name, c.NumberOfSeats, c.Id)
+	if err != nil {
 		return err
 	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errCourseNotFound
+	}
 	return nil
 }
 
 func (conn dbConnection) getAllStudents() (students []Student, err error) {
-	if err = conn.db.Select(&students, "SELECT name as Name, phone as Phone, email as Email, faculty_number as FacultyNumber FROM student JOIN person p on p.email = student.person_id WHERE student.active=TRUE"); err != nil {
+	if err = conn.db.Select(&students, "SELECT p.id as ID, name as Name, phone as Phone, email as Email, faculty_number as FacultyNumber FROM student JOIN person p on p.id = student.person_id WHERE student.active=TRUE"); err != nil {
 		log.Printf("Failed to get students")
 		return nil, err
 	}
@@ -299,11 +208,12 @@ func (conn dbConnection) insertStudent(s Student) error {
 		return err
 	}
 
-	if err = insertPerson(tx, person{s.Name, s.Email, s.Phone}); err != nil {
+	personID, err := conn.insertPerson(tx, person{s.Name, s.Email, s.Phone})
+	if err != nil {
 		return err
 	}
 
-	if _, err = tx.Exec("INSERT INTO student(faculty_number, person_id) VALUES ($1,$2)", generateFacultyNumber(), s.Email); err != nil {
+	if _, err = tx.Exec("INSERT INTO student(faculty_number, person_id) VALUES ($1,$2)", generateFacultyNumber(), personID); err != nil {
 		return err
 	}
 
@@ -329,12 +239,19 @@ func (conn dbConnection) updateStudent(s Student) error {
 		return err
 	}
 
-	if err = insertPerson(tx, person{s.Name, s.Email, s.Phone}); err != nil {
+	var personID string
+	err = tx.QueryRow("UPDATE person p SET name=$1, phone=$2 FROM student s WHERE s.person_id = p.id AND s.faculty_number=$3 RETURNING p.id", s.Name, s.Phone, s.FacultyNumber).Scan(&personID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errPersonNotFound
+	} else if err != nil {
 		return err
 	}
 
-	if _, err = tx.Exec("UPDATE student SET person_id=$1 WHERE faculty_number=$2", s.Email, s.FacultyNumber); err != nil {
-		return err
+	// A new email is only taken over once it is verified.
+	if s.Email != "" {
+		if err = conn.requestEmailChange(tx, personID, s.Email); err != nil {
+			return err
+		}
 	}
 
 	if err = tx.Commit(); err != nil {
@@ -345,27 +262,13 @@ func (conn dbConnection) updateStudent(s Student) error {
 }
 
 func (conn dbConnection) getAllTeachers() (teachers []Teacher, err error) {
-	if err = conn.db.Select(&teachers, "SELECT name as Name, phone as Phone, email as Email FROM teacher JOIN person p on p.email = teacher.person_id WHERE teacher.active=TRUE"); err != nil {
+	if err = conn.db.Select(&teachers, "SELECT p.id as ID, name as Name, phone as Phone, email as Email FROM teacher JOIN person p on p.id = teacher.person_id WHERE teacher.active=TRUE"); err != nil {
 		log.Printf("Failed to get teachers")
 		return nil, err
 	}
 	return teachers, nil
 }
 
-func (conn dbConnection) getTeacherEmails() ([]string, error) {
-	teachers, err := conn.getAllTeachers()
-	if err != nil {
-		return nil, err
-	}
-
-	var result []string
-	for _, v := range teachers {
-		result = append(result, v.Email)
-	}
-
-	return result, nil
-}
-
 func (conn dbConnection) insertTeacher(t Teacher) error {
 	tx, err := conn.db.Begin()
 
@@ -377,11 +280,12 @@ func (conn dbConnection) insertTeacher(t Teacher) error {
 		return err
 	}
 
-	if err = insertPerson(tx, person{t.Name, t.Email, t.Phone}); err != nil {
+	personID, err := conn.insertPerson(tx, person{t.Name, t.Email, t.Phone})
+	if err != nil {
 		return err
 	}
 
-	if _, err = tx.Exec("INSERT INTO teacher(person_id) VALUES ($1)", t.Email); err != nil {
+	if _, err = tx.Exec("INSERT INTO teacher(person_id) VALUES ($1)", personID); err != nil {
 		return err
 	}
 
@@ -403,13 +307,19 @@ func (conn dbConnection) updateTeacher(t Teacher) error {
 		return err
 	}
 
-	if err = insertPerson(tx, person{t.Name, t.Email, t.Phone}); err != nil {
+	res, err := tx.Exec("UPDATE person p SET name=$1, phone=$2 FROM teacher t WHERE t.person_id = p.id AND p.id::text=$3", t.Name, t.Phone, t.ID)
+	if err != nil {
 		return err
 	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errPersonNotFound
+	}
 
-	//TODO: Fix
-	if _, err = tx.Exec("UPDATE teacher SET person_id=$1 WHERE id=$2", t.Email, "fix"); err != nil {
-		return err
+	// A new email is only taken over once it is verified.
+	if t.Email != "" {
+		if err = conn.requestEmailChange(tx, t.ID, t.Email); err != nil {
+			return err
+		}
 	}
 
 	if err = tx.Commit(); err != nil {
@@ -420,9 +330,10 @@ func (conn dbConnection) updateTeacher(t Teacher) error {
 }
 
 func (conn dbConnection) delete(table, uuid string) (err error) {
+	var res sql.Result
 	switch table {
 	case "course":
-		_, err = conn.db.Exec("UPDATE course SET deleted=TRUE WHERE name=$1", uuid)
+		res, err = conn.db.Exec("UPDATE course SET deleted=TRUE WHERE id::text=$1 AND deleted=FALSE", uuid)
 	default:
 		err = fmt.Errorf("unknown table")
 	}
@@ -431,158 +342,235 @@ func (conn dbConnection) delete(table, uuid string) (err error) {
 		log.Printf("Failed to delete %s with id %s", table, uuid)
 		return err
 	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errCourseNotFound
+	}
 	return nil
 }
 
-func (conn dbConnection) getUsers(role string) (any, error) {
-	switch role {
-	case "student":
-		return conn.getAllStudents()
-	case "teacher":
-		return conn.getAllTeachers()
-	default:
-		return nil, fmt.Errorf("unknown role")
+// archiveStudent deactivates the student and ends their sessions.
+func (conn dbConnection) archiveStudent(facultyNumber string) error {
+	var personID string
+	err := conn.db.Get(&personID, "UPDATE student SET active=FALSE WHERE faculty_number=$1 AND active=TRUE RETURNING person_id", facultyNumber)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errPersonNotFound
+	} else if err != nil {
+		return err
 	}
+
+	return conn.revokePersonSessions(personID)
 }
 
-func (conn dbConnection) getTeacherExams() (exams []Exam, err error) {
-	if err = conn.db.Select(&exams, "SELECT c.name as CourseName, p.name as StudentName, student_faculty_number as StudentFacultyNumber, points as Points FROM exam JOIN student s on s.faculty_number = exam.student_faculty_number JOIN person p on p.email = s.person_id JOIN course c on c.id = exam.course_id WHERE exam.deleted=FALSE"); err != nil {
-		log.Printf("Failed to get exams")
-		return nil, err
+// archiveTeacher deactivates the teacher and ends their sessions.
+func (conn dbConnection) archiveTeacher(personID string) error {
+	res, err := conn.db.Exec("UPDATE teacher SET active=FALSE WHERE person_id::text=$1 AND active=TRUE", personID)
+	if err != nil {
+		return err
 	}
-	return exams, nil
-}
 
-func (conn dbConnection) archiveUser(email, role string) (err error) {
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errPersonNotFound
+	}
 
-	switch role {
-	case "student":
-		_, err = conn.db.Exec("UPDATE student SET active=FALSE WHERE person_id=$1", email)
-	case "teacher":
-		_, err = conn.db.Exec("UPDATE teacher SET active=FALSE WHERE person_id=$1", email)
-	default:
-		err = fmt.Errorf("unknown table")
+	return conn.revokePersonSessions(personID)
+}
+
+// insertPerson inserts the person and returns their id.
+func (conn dbConnection) insertPerson(tx *sql.Tx, p person) (string, error) {
+	var personID string
+	if err := tx.QueryRow("INSERT INTO person(name, email, phone) VALUES ($1, $2, $3) RETURNING id", p.Name, p.Email, p.Phone).Scan(&personID); err != nil {
+		return "", err
 	}
 
-	if err != nil {
-		log.Printf("Failed to delete %s with id %s", role, email)
-		return err
+	if err := conn.sendPasswordCodeEmail(tx, purposePasswordCreate, personID, p.Email); err != nil {
+		return "", err
 	}
-	return nil
+	return personID, nil
 }
 
-func insertPerson(tx *sql.Tx, p person) error {
-	if _, err := tx.Exec("INSERT INTO person(name, email, phone) VALUES ($1, $2, $3)", p.Name, p.Email, p.Phone); err != nil {
+// resendPassword sends a reset code to the email. Unknown emails are ignored, so
+// that the endpoint doesn't tell which emails have an account.
+func (conn dbConnection) resendPassword(email string) error {
+	personID, err := conn.personIDByEmail(email)
+	if errors.Is(err, errPersonNotFound) {
+		return nil
+	} else if err != nil {
 		return err
 	}
 
-	if err := sendPasswordCodeEmail(tx, p.Email); err != nil {
-		if err = tx.Rollback(); err != nil {
-			return err
-		}
+	tx, err := conn.db.Begin()
+	if err != nil {
 		return err
 	}
-	return nil
-}
 
-func (conn dbConnection) resendPassword(email string) error {
-	tx, _ := conn.db.Begin()
-
-	defer func(tx *sql.Tx) {
-		_ = tx.Commit()
-	}(tx)
+	defer func() {
+		_ = tx.Rollback()
+	}()
 
-	return sendPasswordCodeEmail(tx, email)
+	if err = conn.sendPasswordCodeEmail(tx, purposePasswordReset, personID, email); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
-func sendPasswordCodeEmail(tx *sql.Tx, email string) error {
+func (conn dbConnection) sendPasswordCodeEmail(tx *sql.Tx, purpose codePurpose, personID, email string) error {
 	//if row := tx.QueryRow("SELECT name FROM person WHERE email=$1", email); row.Err() != nil {
 	//	_ = tx.Rollback()
 	//	return row.Err()
 	//}
 
-	code := uniuri.NewLen(7)
-
-	if err := saveCodeAndEmail(code, email); err != nil {
-		_ = tx.Rollback()
+	code, err := conn.issueCode(purpose, personID, passwordCodeTTL)
+	if err != nil {
 		log.Println(err)
 		return err
 	}
 
-	if err := sendCode(code, email); err != nil {
+	if err = conn.sendCode(tx, purpose, code, email); err != nil {
 		log.Println(err)
 		return err
 	}
 	return nil
 }
 
-func sendCode(code, email string) error {
-	from := os.Getenv("MAIL")
-	emailCred := os.Getenv("PASSWD")
-
-	urlAndCode := fmt.Sprintf("http://localhost:5173?code=%s", code)
+// sendCode queues the email with the code in the outbox, it is sent once tx commits.
+func (conn dbConnection) sendCode(tx *sql.Tx, purpose codePurpose, code, email string) error {
+	return enqueueEmail(tx, passwordCodeMessage(conn.frontendURL, purpose, code, email))
+}
 
-	toList := []string{"ilianbb4@gmail.com"}
-	host := "smtp.gmail.com"
-	port := "587"
-	body := []byte(fmt.Sprintf("To: %s\r\n"+"Subject: Technical university password!\r\n"+"\r\n"+"Please create your password at: %s\r\n", email, urlAndCode))
+// passwordCodeMessage is the email with a code to create or reset a password.
+func passwordCodeMessage(frontendURL string, purpose codePurpose, code, email string) Message {
+	if purpose == purposePasswordReset {
+		return Message{
+			To:      email,
+			Subject: "Technical university password reset",
+			Body:    fmt.Sprintf("Please reset your password at: %s/reset-password?code=%s\n", frontendURL, code),
+		}
+	}
 
-	auth := smtp.PlainAuth("", from, emailCred, host)
+	urlAndCode := fmt.Sprintf("%s?code=%s", frontendURL, code)
 
-	return smtp.SendMail(host+":"+port, auth, from, toList, body)
+	return Message{
+		To:      email,
+		Subject: "Technical university password!",
+		Body:    fmt.Sprintf("Please create your password at: %s\n", urlAndCode),
+	}
 }
 
-func (conn dbConnection) changePassword(email, oldPassword, newPassword string) error {
+// changePassword sets the new password and ends the person's other sessions,
+// the one the change is made in stays.
+func (conn dbConnection) changePassword(personID, sessionID, oldPassword, newPassword string) error {
+	email, err := conn.getPersonEmail(personID)
+	if err != nil {
+		return err
+	}
 
-	if !conn.validateUserLogin(email, []byte(oldPassword)) {
-		return fmt.Errorf("old password doesn't match")
+	if _, ok := conn.validateUserLogin(email, []byte(oldPassword)); !ok {
+		return errOldPasswordMismatch
 	}
 
-	return conn.bcryptAndSavePassword(email, newPassword)
+	if err = conn.savePassword(personID, newPassword); err != nil {
+		return err
+	}
+	return conn.revokeOtherSessions(personID, sessionID)
 }
 
 func (conn dbConnection) createPassword(code, password string) error {
-	email, err := getEmailFromCode(code)
+	_, err := conn.usePasswordCode(purposePasswordCreate, code, password)
+	return err
+}
+
+// resetPassword sets the password of the person the code was sent to and ends
+// all their sessions, as the old password may be known to someone else.
+func (conn dbConnection) resetPassword(code, password string) error {
+	personID, err := conn.usePasswordCode(purposePasswordReset, code, password)
 	if err != nil {
 		return err
 	}
+	return conn.revokePersonSessions(personID)
+}
 
-	return conn.bcryptAndSavePassword(email, password)
+// usePasswordCode sets the password of the person the code was sent to. The
+// password is checked before the code is used up, so that a rejected password
+// doesn't cost the code.
+func (conn dbConnection) usePasswordCode(purpose codePurpose, code, password string) (string, error) {
+	personID, err := conn.codes.Peek(purpose, code)
+	if err != nil {
+		return "", err
+	}
+
+	if err = conn.checkNewPassword(personID, password); err != nil {
+		return "", err
+	}
+
+	if personID, err = conn.codes.Consume(purpose, code); err != nil {
+		return "", err
+	}
+	return personID, conn.storePassword(personID, password)
 }
 
-func getEmailFromCode(code string) (string, error) {
-	client := redis.NewClient(&redis.Options{
-		Addr:     "localhost:6379",
-		Password: "",
-		DB:       0,
-	})
-	res := client.Get(context.Background(), code)
-	if res.Err() == redis.Nil {
-		return "", fmt.Errorf("code not found")
+// savePassword checks the new password of the person, then hashes and saves it.
+func (conn dbConnection) savePassword(personID, password string) error {
+	if err := conn.checkNewPassword(personID, password); err != nil {
+		return err
 	}
-	return res.Val(), nil
+	return conn.storePassword(personID, password)
 }
 
-func saveCodeAndEmail(code string, email string) error {
-	client := redis.NewClient(&redis.Options{
-		Addr:     "localhost:6379",
-		Password: "",
-		DB:       0,
-	})
-	res := client.Set(context.Background(), code, email, time.Hour)
-	return res.Err()
+// checkNewPassword checks the password against the policy, the breached
+// passwords and the person's recent passwords.
+func (conn dbConnection) checkNewPassword(personID, password string) error {
+	if err := conn.passwords.check(password); err != nil {
+		return err
+	}
+
+	var history []string
+	if err := conn.db.Select(&history, "SELECT password_hash FROM password_history WHERE person_id=$1 ORDER BY id DESC LIMIT $2", personID, conn.passwords.cfg.HistorySize); err != nil {
+		return err
+	}
+	for _, v := range history {
+		if ok, _ := conn.passwords.verify(v, password); ok {
+			return errPasswordReused
+		}
+	}
+	return nil
 }
 
-func (conn dbConnection) bcryptAndSavePassword(email, password string) error {
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+// storePassword hashes and saves a checked password and keeps it in the history.
+func (conn dbConnection) storePassword(personID, password string) error {
+	hashedPassword, err := conn.passwords.hash(password)
 	if err != nil {
 		log.Println(err)
 		return err
 	}
 
-	if _, err = conn.db.Exec("UPDATE person SET password=$1 WHERE email=$2", hashedPassword, email); err != nil {
+	tx, err := conn.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if err = conn.storePasswordHash(tx, personID, hashedPassword); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// storePasswordHash sets the person's password hash in the transaction and keeps
+// it in the history.
+func (conn dbConnection) storePasswordHash(tx *sql.Tx, personID, hashedPassword string) error {
+	if _, err := tx.Exec("UPDATE person SET password=$1 WHERE id=$2", hashedPassword, personID); err != nil {
 		log.Println(err)
 		return err
 	}
-	return nil
+
+	if _, err := tx.Exec("INSERT INTO password_history(person_id, password_hash) VALUES ($1, $2)", personID, hashedPassword); err != nil {
+		return err
+	}
+
+	_, err := tx.Exec("DELETE FROM password_history WHERE person_id=$1 AND id NOT IN (SELECT id FROM password_history WHERE person_id=$1 ORDER BY id DESC LIMIT $2)", personID, conn.passwords.cfg.HistorySize)
+	return err
 }
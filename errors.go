@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+var (
+	errEmptyBody    = errors.New("content must be provided in request body")
+	errInvalidBody  = errors.New("Invalid body")
+	errBodyTooLarge = errors.New("request body is too large")
+	errUnauthorized = errors.New("unauthorized")
+	errEmptyLogin   = errors.New("Email or password is empty")
+	errWrongLogin   = errors.New("Incorrect email or password")
+)
+
+// errorResponses maps the errors handlers return to the status and the code they
+// are answered with. The caller sees the message of the error, unless the entry
+// replaces it. Codes are part of the API, the frontend matches on them, so they
+// never change once released.
+//
+// 401 means the caller couldn't be authenticated: the credentials, token or key
+// are missing or wrong. 403 means they were, but may not make the request. A
+// malformed request is 400 either way.
+var errorResponses = []struct {
+	err     error
+	status  int
+	code    string
+	message string
+	logged  bool
+}{
+	{errRouteNotFound, http.StatusNotFound, "not_found", "", false},
+	{errMethodNotAllowed, http.StatusMethodNotAllowed, "method_not_allowed", "", false},
+	{errEmptyBody, http.StatusBadRequest, "empty_body", "", false},
+	{errInvalidBody, http.StatusBadRequest, "invalid_body", "", false},
+	{errBodyTooLarge, http.StatusRequestEntityTooLarge, "body_too_large", "", false},
+	{errUnauthorized, http.StatusUnauthorized, "unauthorized", "", false},
+	{errEmptyLogin, http.StatusBadRequest, "login_empty", "", false},
+	{errWrongLogin, http.StatusUnauthorized, "login_failed", "", false},
+	{errValidatingJWT, http.StatusUnauthorized, "invalid_token", "unauthorized", false},
+	{errMissingPermission, http.StatusForbidden, "missing_permission", "unauthorized", true},
+	{errInvalidCSRFToken, http.StatusForbidden, "invalid_csrf_token", "", false},
+	{errInvalidAPIKey, http.StatusUnauthorized, "invalid_api_key", "unauthorized", false},
+	{errAPIKeyDenied, http.StatusForbidden, "api_key_denied", "", false},
+	{errImpersonationReadOnly, http.StatusForbidden, "impersonation_read_only", "", false},
+	{errImpersonationDenied, http.StatusForbidden, "impersonation_denied", "", false},
+	{errCannotImpersonate, http.StatusForbidden, "cannot_impersonate", "", false},
+	{errInvalidRefreshToken, http.StatusUnauthorized, "invalid_refresh_token", "unauthorized", false},
+	{errRefreshTokenReused, http.StatusUnauthorized, "invalid_refresh_token", "unauthorized", false},
+	{errLoginThrottled, http.StatusTooManyRequests, "login_throttled", "", false},
+	{errRequestThrottled, http.StatusTooManyRequests, "request_throttled", "", false},
+	{errInvalidSecondFactor, http.StatusUnauthorized, "invalid_second_factor", "", false},
+	{errTOTPNotEnrolled, http.StatusBadRequest, "totp_not_enrolled", "", false},
+	{errTOTPAlreadyEnabled, http.StatusBadRequest, "totp_already_enabled", "", false},
+	{errTwoFactorRequired, http.StatusBadRequest, "two_factor_required", "", false},
+	{errMagicLinkNotAllowed, http.StatusForbidden, "magic_link_not_allowed", "", false},
+	{errCodeNotFound, http.StatusBadRequest, "invalid_code", "invalid or expired code", false},
+	{errWeakPassword, http.StatusBadRequest, "weak_password", "", false},
+	{errPasswordReused, http.StatusBadRequest, "password_reused", "", false},
+	{errPasswordBreached, http.StatusBadRequest, "password_breached", "", false},
+	{errOldPasswordMismatch, http.StatusBadRequest, "old_password_mismatch", "", false},
+	{errInvalidEmail, http.StatusBadRequest, "invalid_email", "", false},
+	{errEmailTaken, http.StatusConflict, "email_taken", "", false},
+	{errPersonNotFound, http.StatusNotFound, "person_not_found", "", false},
+	{errCourseNotFound, http.StatusNotFound, "course_not_found", "", false},
+	{errCourseNotInScope, http.StatusForbidden, "course_not_in_scope", "", false},
+	{errRoleNotFound, http.StatusNotFound, "role_not_found", "", false},
+	{errBuiltinRole, http.StatusBadRequest, "builtin_role", "", false},
+	{errUnknownPermission, http.StatusBadRequest, "unknown_permission", "", false},
+	{errEmailNotFound, http.StatusNotFound, "email_not_found", "", false},
+	{errLockoutNotFound, http.StatusNotFound, "lockout_not_found", "", false},
+	{errServiceAccountNotFound, http.StatusNotFound, "service_account_not_found", "", false},
+	{errAPIKeyNotFound, http.StatusNotFound, "api_key_not_found", "", false},
+	{errInvalidAPIKeyExpiry, http.StatusBadRequest, "invalid_api_key_expiry", "", false},
+}
+
+// problem is an RFC 7807 problem details response. Code is the machine-readable
+// reason and Field names the offending field of the request, if known. Errors
+// lists every invalid field when the request failed validation.
+type problem struct {
+	Type     string          `json:"type"`
+	Title    string          `json:"title"`
+	Status   int             `json:"status"`
+	Detail   string          `json:"detail,omitempty"`
+	Instance string          `json:"instance,omitempty"`
+	Code     string          `json:"code"`
+	Field    string          `json:"field,omitempty"`
+	Errors   validationError `json:"errors,omitempty"`
+}
+
+func newProblem(status int, code, detail string) problem {
+	return problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+		Code:   code,
+	}
+}
+
+func respondWithProblem(w http.ResponseWriter, p problem) {
+	resp, _ := json.Marshal(p)
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	_, _ = w.Write(resp)
+}
+
+// respondWithError writes the problem response for an error a handler returned.
+// Errors that aren't known are logged and answered with 500.
+func respondWithError(w http.ResponseWriter, r *http.Request, err error) {
+	p, ok := knownProblem(err)
+	if !ok {
+		log.Printf("%s %s failed with \n%v", r.Method, r.URL.Path, err)
+		p = newProblem(http.StatusInternalServerError, "internal_error", "something went wrong")
+	}
+
+	// Unauthenticated requests name the scheme to authenticate with (RFC 9110).
+	if p.Status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+	}
+
+	p.Instance = r.URL.Path
+	respondWithProblem(w, p)
+}
+
+func knownProblem(err error) (problem, bool) {
+	for _, v := range errorResponses {
+		if !errors.Is(err, v.err) {
+			continue
+		}
+
+		if v.logged {
+			log.Printf("Request refused with \n%v", err)
+		}
+
+		message := v.message
+		if message == "" {
+			message = err.Error()
+		}
+		return newProblem(v.status, v.code, message), true
+	}
+
+	var invalid validationError
+	if errors.As(err, &invalid) {
+		p := newProblem(http.StatusBadRequest, "validation_failed", "the request has invalid fields")
+		p.Errors = invalid
+		return p, true
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return constraintProblem(pqErr)
+	}
+	return problem{}, false
+}
+
+// constraintProblem explains a violated database constraint in terms of the
+// request fields, which are the columns in CamelCase.
+func constraintProblem(err *pq.Error) (problem, bool) {
+	switch err.Code {
+	case "23505": // unique_violation
+		field := keyFields(err.Detail)
+		p := newProblem(http.StatusConflict, "already_exists", fmt.Sprintf("a record with this %s already exists", field))
+		p.Field = field
+		return p, true
+	case "23503": // foreign_key_violation
+		field := keyFields(err.Detail)
+		p := newProblem(http.StatusUnprocessableEntity, "unknown_reference", fmt.Sprintf("%s refers to a record that doesn't exist", field))
+		p.Field = field
+		return p, true
+	case "23514": // check_violation
+		// Postgres names column checks <table>_<column>_check.
+		field := fieldName(strings.TrimSuffix(strings.TrimPrefix(err.Constraint, err.Table+"_"), "_check"))
+		p := newProblem(http.StatusBadRequest, "invalid_field", fmt.Sprintf("%s has an invalid value", field))
+		p.Field = field
+		return p, true
+	}
+	return problem{}, false
+}
+
+// keyDetail matches the columns in the detail of a key violation, like
+// "Key (name, teacher_id)=(Math, ...) already exists.".
+var keyDetail = regexp.MustCompile(`^Key \(([^)]+)\)=`)
+
+func keyFields(detail string) string {
+	m := keyDetail.FindStringSubmatch(detail)
+	if m == nil {
+		return "value"
+	}
+
+	var fields []string
+	for _, v := range strings.Split(m[1], ",") {
+		fields = append(fields, fieldName(strings.TrimSpace(v)))
+	}
+	return strings.Join(fields, ", ")
+}
+
+// fieldName turns a column like number_of_seats into the field NumberOfSeats.
+func fieldName(column string) string {
+	parts := strings.Split(column, "_")
+	for i, v := range parts {
+		if v != "" {
+			parts[i] = strings.ToUpper(v[:1]) + v[1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
+
+// decodeBody decodes the JSON body of the request into v. Fields v doesn't have
+// and values of the wrong type are reported as a validationError.
+func decodeBody(r *http.Request, v any) error {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+
+	var tooLarge *http.MaxBytesError
+	var wrongType *json.UnmarshalTypeError
+	switch true {
+	case errors.Is(err, io.EOF):
+		return errEmptyBody
+	case errors.As(err, &tooLarge):
+		return fmt.Errorf("%w, the limit is %d bytes", errBodyTooLarge, tooLarge.Limit)
+	case errors.As(err, &wrongType) && wrongType.Field != "":
+		return validationError{{Field: wrongType.Field, Message: "must be " + jsonType(wrongType.Type)}}
+	case err != nil && strings.HasPrefix(err.Error(), "json: unknown field "):
+		// The decoder has no error type for unknown fields.
+		field, _ := strconv.Unquote(strings.TrimPrefix(err.Error(), "json: unknown field "))
+		return validationError{{Field: field, Message: "is not a known field"}}
+	case err != nil:
+		return errInvalidBody
+	}
+	return nil
+}
+
+var textUnmarshaler = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+// jsonType describes the JSON value a Go type is decoded from.
+func jsonType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Struct:
+		if reflect.PointerTo(t).Implements(textUnmarshaler) {
+			return "a string"
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	}
+	return "an object"
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+func Test_respondWithError(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		code   string
+		detail string
+		field  string
+	}{
+		{"Hidden message", fmt.Errorf("%w exam:read", errMissingPermission), http.StatusForbidden, "missing_permission", "unauthorized", ""},
+		{"Shown message", errEmailTaken, http.StatusConflict, "email_taken", "email address is already in use", ""},
+		{"Domain error", errOldPasswordMismatch, http.StatusBadRequest, "old_password_mismatch", "old password doesn't match", ""},
+		{"Unknown error", errors.New("connection reset"), http.StatusInternalServerError, "internal_error", "something went wrong", ""},
+		{
+			"Unique violation",
+			&pq.Error{Code: "23505", Table: "course", Constraint: "course_name_teacher_id_key", Detail: "Key (name, teacher_id)=(Math, 00000000-0000-0000-0000-00000000c001) already exists."},
+			http.StatusConflict, "already_exists", "a record with this Name, TeacherId already exists", "Name, TeacherId",
+		},
+		{
+			"Foreign key violation",
+			&pq.Error{Code: "23503", Table: "course", Constraint: "course_teacher_id_fkey", Detail: `Key (teacher_id)=(00000000-0000-0000-0000-000000000000) is not present in table "teacher".`},
+			http.StatusUnprocessableEntity, "unknown_reference", "TeacherId refers to a record that doesn't exist", "TeacherId",
+		},
+		{
+			"Check violation",
+			&pq.Error{Code: "23514", Table: "course", Constraint: "course_number_of_seats_check"},
+			http.StatusBadRequest, "invalid_field", "NumberOfSeats has an invalid value", "NumberOfSeats",
+		},
+		{"Other database error", &pq.Error{Code: "57014"}, http.StatusInternalServerError, "internal_error", "something went wrong", ""},
+		{"Invalid fields", validationError{{"Name", "is required"}}, http.StatusBadRequest, "validation_failed", "the request has invalid fields", ""},
+		{"Invalid token", fmt.Errorf("%w: token is expired", errValidatingJWT), http.StatusUnauthorized, "invalid_token", "unauthorized", ""},
+		{"Wrong login", errWrongLogin, http.StatusUnauthorized, "login_failed", "Incorrect email or password", ""},
+		{"Empty login", errEmptyLogin, http.StatusBadRequest, "login_empty", "Email or password is empty", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			respondWithError(w, httptest.NewRequest(http.MethodPost, "/courses", nil), test.err)
+
+			if w.Code != test.status {
+				t.Fatalf("Expected status %d, but got %d", test.status, w.Code)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "application/problem+json" {
+				t.Fatalf("Expected a problem response, but got %s", ct)
+			}
+			if challenge := w.Header().Get("WWW-Authenticate"); (test.status == http.StatusUnauthorized) != (challenge != "") {
+				t.Fatalf("Expected a WWW-Authenticate header only on 401, but got %q", challenge)
+			}
+
+			var p problem
+			if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+				t.Fatal(err)
+			}
+			if p.Status != test.status || p.Code != test.code || p.Detail != test.detail || p.Field != test.field || p.Instance != "/courses" {
+				t.Fatalf("Expected %d %s %q on %s, but got %+v", test.status, test.code, test.detail, test.field, p)
+			}
+		})
+	}
+}
+
+func Test_decodeBody(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		err  error
+	}{
+		{"Valid", `{"Name":"Math","NumberOfSeats":30}`, nil},
+		{"Empty", ``, errEmptyBody},
+		{"Malformed", `{"Name":`, errInvalidBody},
+		{"Unknown field", `{"Name":"Math","Seats":30}`, validationError{{"Seats", "is not a known field"}}},
+		{"Wrong type", `{"NumberOfSeats":"30"}`, validationError{{"NumberOfSeats", "must be an integer"}}},
+		{"Too large", `{"Name":"` + strings.Repeat("a", 64) + `"}`, errBodyTooLarge},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/courses", strings.NewReader(test.body))
+			r.Body = http.MaxBytesReader(w, r.Body, 64)
+
+			var c Course
+			err := decodeBody(r, &c)
+
+			var invalid validationError
+			if errors.As(test.err, &invalid) {
+				if !reflect.DeepEqual(err, test.err) {
+					t.Fatalf("Expected %v, but got %v", test.err, err)
+				}
+			} else if !errors.Is(err, test.err) {
+				t.Fatalf("Expected %v, but got %v", test.err, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,30 @@
+-- One admin, student and teacher with a few courses and exams. Every password is test_pas_123.
+INSERT INTO person(id, name, phone, email, password) VALUES
+    ('00000000-0000-0000-0000-00000000f001', 'ivan', '0881234563', 'test@test.com', '$2a$10$hk6NfxXSkNUzEd7fiqGyxOGUjimPR/jtdmRf0yrbB/eKfh5HwKe4q'),
+    ('00000000-0000-0000-0000-00000000f002', 'ivan1', '0881234564', 'test1@test.com', '$2a$10$hk6NfxXSkNUzEd7fiqGyxOGUjimPR/jtdmRf0yrbB/eKfh5HwKe4q'),
+    ('00000000-0000-0000-0000-00000000f003', 'ivan2', '0881234565', 'test2@test.com', '$2a$10$hk6NfxXSkNUzEd7fiqGyxOGUjimPR/jtdmRf0yrbB/eKfh5HwKe4q')
+ON CONFLICT DO NOTHING;
+
+INSERT INTO admin(id, person_id) VALUES
+    ('00000000-0000-0000-0000-00000000a001', '00000000-0000-0000-0000-00000000f001')
+ON CONFLICT DO NOTHING;
+
+INSERT INTO student(id, faculty_number, person_id) VALUES
+    ('00000000-0000-0000-0000-00000000b001', '12312312', '00000000-0000-0000-0000-00000000f002')
+ON CONFLICT DO NOTHING;
+
+INSERT INTO teacher(id, person_id) VALUES
+    ('00000000-0000-0000-0000-00000000c001', '00000000-0000-0000-0000-00000000f003')
+ON CONFLICT DO NOTHING;
+
+INSERT INTO course(id, teacher_id, name) VALUES
+    ('00000000-0000-0000-0000-00000000d001', '00000000-0000-0000-0000-00000000c001', 'Math'),
+    ('00000000-0000-0000-0000-00000000d002', '00000000-0000-0000-0000-00000000c001', 'Programming Basics'),
+    ('00000000-0000-0000-0000-00000000d003', '00000000-0000-0000-0000-00000000c001', 'Physics')
+ON CONFLICT DO NOTHING;
+
+INSERT INTO exam(id, course_id, student_faculty_number, points) VALUES
+    ('00000000-0000-0000-0000-00000000e001', '00000000-0000-0000-0000-00000000d001', '12312312', 56),
+    ('00000000-0000-0000-0000-00000000e002', '00000000-0000-0000-0000-00000000d003', '12312312', 88),
+    ('00000000-0000-0000-0000-00000000e003', '00000000-0000-0000-0000-00000000d002', '12312312', 67)
+ON CONFLICT DO NOTHING;
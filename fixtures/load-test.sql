@@ -0,0 +1,43 @@
+-- 20 teachers leading 5 courses each, 2000 students with 10 exams each and one admin.
+-- Ids are derived from the row number, so loading the set again changes nothing.
+-- Every password is test_pas_123.
+INSERT INTO person(id, name, phone, email, password) VALUES
+    (md5('load-test-person-admin-1')::uuid, 'admin', NULL, 'admin@load.test', '$2a$10$hk6NfxXSkNUzEd7fiqGyxOGUjimPR/jtdmRf0yrbB/eKfh5HwKe4q')
+ON CONFLICT DO NOTHING;
+
+INSERT INTO admin(id, person_id) VALUES
+    (md5('load-test-admin-1')::uuid, md5('load-test-person-admin-1')::uuid)
+ON CONFLICT DO NOTHING;
+
+INSERT INTO person(id, name, phone, email, password)
+SELECT md5('load-test-person-teacher-' || t)::uuid, 'teacher ' || t, '088' || lpad(t::text, 7, '0'), 'teacher' || t || '@load.test', '$2a$10$hk6NfxXSkNUzEd7fiqGyxOGUjimPR/jtdmRf0yrbB/eKfh5HwKe4q'
+FROM generate_series(1, 20) t
+ON CONFLICT DO NOTHING;
+
+INSERT INTO teacher(id, person_id)
+SELECT md5('load-test-teacher-' || t)::uuid, md5('load-test-person-teacher-' || t)::uuid
+FROM generate_series(1, 20) t
+ON CONFLICT DO NOTHING;
+
+INSERT INTO course(id, teacher_id, name, number_of_seats)
+SELECT md5('load-test-course-' || c)::uuid, md5('load-test-teacher-' || ((c - 1) / 5 + 1))::uuid, 'Course ' || c, 200
+FROM generate_series(1, 100) c
+ON CONFLICT DO NOTHING;
+
+INSERT INTO person(id, name, phone, email, password)
+SELECT md5('load-test-person-student-' || s)::uuid, 'student ' || s, '089' || lpad(s::text, 7, '0'), 'student' || s || '@load.test', '$2a$10$hk6NfxXSkNUzEd7fiqGyxOGUjimPR/jtdmRf0yrbB/eKfh5HwKe4q'
+FROM generate_series(1, 2000) s
+ON CONFLICT DO NOTHING;
+
+INSERT INTO student(id, faculty_number, person_id)
+SELECT md5('load-test-student-' || s)::uuid, '2' || lpad(s::text, 7, '0'), md5('load-test-person-student-' || s)::uuid
+FROM generate_series(1, 2000) s
+ON CONFLICT DO NOTHING;
+
+INSERT INTO exam(id, course_id, student_faculty_number, points)
+SELECT md5('load-test-exam-' || s || '-' || k)::uuid,
+       md5('load-test-course-' || ((s + k * 7) % 100 + 1))::uuid,
+       '2' || lpad(s::text, 7, '0'),
+       1 + (s * 7 + k * 13) % 100
+FROM generate_series(1, 2000) s, generate_series(1, 10) k
+ON CONFLICT DO NOTHING;
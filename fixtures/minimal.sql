@@ -0,0 +1,8 @@
+-- A single admin account to log in with. The password is test_pas_123.
+INSERT INTO person(id, name, phone, email, password) VALUES
+    ('00000000-0000-0000-0000-00000000f001', 'admin', NULL, 'admin@example.com', '$2a$10$hk6NfxXSkNUzEd7fiqGyxOGUjimPR/jtdmRf0yrbB/eKfh5HwKe4q')
+ON CONFLICT DO NOTHING;
+
+INSERT INTO admin(id, person_id) VALUES
+    ('00000000-0000-0000-0000-00000000a001', '00000000-0000-0000-0000-00000000f001')
+ON CONFLICT DO NOTHING;
@@ -1,836 +1,1156 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"log"
+	"math"
 	"net/http"
-	"os"
+	"net/url"
+	"strconv"
 	"time"
-
-	"github.com/golang-jwt/jwt/v4"
 )
 
 type handler struct {
-	secretKet string
-	db        interface {
-		validateUserLogin(email string, password []byte) bool
-		getUserRoles(email string) []string
-		getStudentExams(email string) ([]Exam, error)
-		insertExam(email string, e Exam) error
-		getTeacherCourseNames(email string) ([]string, error)
-		getStudentFacultyNumbers() ([]string, error)
-		delete(table, uuid string) error
-		getAllCourses() ([]Course, error)
-		insertCourse(Course) error
-		updateCourse(Course) error
-		getAllStudents() ([]Student, error)
-		insertStudent(Student) error
-		updateStudent(Student) error
-		getTeacherEmails() ([]string, error)
-		insertTeacher(Teacher) error
-		updateTeacher(Teacher) error
-		getUsers(role string) (any, error)
-		getTeacherExams() ([]Exam, error)
-		archiveUser(email, role string) error
-		resendPassword(email string) error
-		changePassword(email, oldPassword, NewPassword string) error
-		createPassword(code, password string) error
-	}
-}
-
-func setupHandler(db dbConnection) *http.ServeMux {
+	keys       *keySet
+	trustProxy bool
+	totpIssuer string
+	session    sessionConfig
+	db         storage
+}
+
+func setupHandler(db storage, keys *keySet, cfg config) http.Handler {
 	h := handler{
-		secretKet: os.Getenv("SECRET_KEY"),
-		db:        db,
+		keys:       keys,
+		trustProxy: cfg.Server.TrustProxy,
+		totpIssuer: cfg.Auth.TOTPIssuer,
+		session:    cfg.Session,
+		db:         db,
 	}
 
-	mainHandler := http.NewServeMux()
-	mainHandler.HandleFunc("/login", corsHandler(h.handleLogin))
-	mainHandler.HandleFunc("/student/exams", corsHandler(h.getStudentExams))
-	mainHandler.HandleFunc("/teacher/exams", corsHandler(h.teacherExams))
-	mainHandler.HandleFunc("/teacher/courses", corsHandler(h.getTeacherCourses))
-	mainHandler.HandleFunc("/teacher/students", corsHandler(h.getStudentFacultyNumbers))
-	mainHandler.HandleFunc("/admin/courses", corsHandler(h.courses))
-	//mainHandler.HandleFunc("/admin/exams", corsHandler(h.getExams))
-	mainHandler.HandleFunc("/admin/students", corsHandler(h.students))
-	mainHandler.HandleFunc("/admin/teachers", corsHandler(h.teachers))
-	mainHandler.HandleFunc("/admin/users", corsHandler(h.users))
-	mainHandler.HandleFunc("/forgotten-password", corsHandler(h.forgottenPassword))
-	mainHandler.HandleFunc("/change-password", corsHandler(h.changePassword))
-	mainHandler.HandleFunc("/createPassword", corsHandler(h.createPassword))
+	origins := cfg.Server.CORSOrigins
+	if len(origins) == 0 {
+		u, _ := url.Parse(cfg.FrontendURL)
+		origins = []string{u.Scheme + "://" + u.Host}
+	}
 
-	return mainHandler
+	rt := h.routes()
+	return corsHandler(origins, rt.methods())(limitBody(int64(cfg.Server.MaxBodyBytes))(rt.ServeHTTP))
 }
 
-func (h handler) handleLogin(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		respondWithMessage(w, "Only POST method is allowed", http.StatusBadRequest)
-		return
-	}
+// routes registers every endpoint of the API. They are documented in
+// openapi.json, which has to be updated along with them.
+func (h handler) routes() *router {
+	rt := newRouter()
+	rt.handle(http.MethodGet, "/openapi.json", serveOpenAPI)
+	rt.handle(http.MethodGet, "/docs", serveDocs)
+
+	rt.handle(http.MethodPost, "/login", h.handleLogin)
+	rt.handle(http.MethodPost, "/login/magic-link", h.requestMagicLink)
+	rt.handle(http.MethodPost, "/login/magic-link/verify", h.magicLinkLogin)
+	rt.handle(http.MethodPost, "/login/2fa", h.loginSecondFactor)
+	rt.handle(http.MethodPost, "/login/2fa/enroll", h.loginEnroll)
+	rt.handle(http.MethodPost, "/token/refresh", h.refreshToken)
+	rt.handle(http.MethodPost, "/logout", h.logout)
+	rt.handle(http.MethodGet, "/.well-known/jwks.json", h.jwks)
+	rt.handle(http.MethodPost, "/forgotten-password", h.forgottenPassword)
+	rt.handle(http.MethodPost, "/createPassword", h.createPassword)
+	rt.handle(http.MethodPost, "/reset-password", h.resetPassword)
+	rt.handle(http.MethodPost, "/verify-email", h.verifyEmail)
+
+	rt.handle(http.MethodPost, "/2fa/enroll", h.twoFactorEnroll, h.requireLogin)
+	rt.handle(http.MethodPost, "/2fa/confirm", h.twoFactorConfirm, h.requireLogin)
+	rt.handle(http.MethodPost, "/2fa/recovery-codes", h.twoFactorRecoveryCodes, h.requireLogin)
+	rt.handle(http.MethodPost, "/2fa/disable", h.twoFactorDisable, h.requireLogin)
+	rt.handle(http.MethodPost, "/change-password", h.changePassword, h.requireLogin)
+	rt.handle(http.MethodPost, "/change-email", h.changeEmail, h.requireLogin)
+
+	readExams := h.requirePermission(permExamRead, permExamReadLed, permExamReadOwn)
+	rt.handle(http.MethodGet, "/exams", h.getExams, readExams)
+	rt.handle(http.MethodPost, "/exams", h.insertExam, h.requirePermission(permExamWriteAny, permExamWrite))
+
+	manageCourses := h.requirePermission(permCourseManage)
+	rt.handle(http.MethodGet, "/courses", h.getCourses, h.requirePermission(permCourseManage, permCourseReadOwn))
+	rt.handle(http.MethodPost, "/courses", h.insertCourse, manageCourses)
+	rt.handle(http.MethodPatch, "/courses/{id}", h.updateCourse, manageCourses)
+	rt.handle(http.MethodDelete, "/courses/{id}", h.deleteCourse, manageCourses)
+
+	manageStudents := h.requirePermission(permStudentManage)
+	rt.handle(http.MethodGet, "/students", h.getStudents, h.requirePermission(permStudentManage, permStudentRead))
+	rt.handle(http.MethodPost, "/students", h.insertStudent, manageStudents)
+	rt.handle(http.MethodPatch, "/students/{facultyNumber}", h.updateStudent, manageStudents)
+	rt.handle(http.MethodDelete, "/students/{facultyNumber}", h.archiveStudent, h.requirePermission(permUserArchive))
+	rt.handle(http.MethodGet, "/students/{facultyNumber}/exams", h.getExams, readExams)
+
+	manageTeachers := h.requirePermission(permTeacherManage)
+	rt.handle(http.MethodGet, "/teachers", h.getTeachers, manageTeachers)
+	rt.handle(http.MethodPost, "/teachers", h.insertTeacher, manageTeachers)
+	rt.handle(http.MethodPatch, "/teachers/{id}", h.updateTeacher, manageTeachers)
+	rt.handle(http.MethodDelete, "/teachers/{id}", h.archiveTeacher, h.requirePermission(permUserArchive))
+
+	manageRoles := h.requirePermission(permRoleManage)
+	rt.handle(http.MethodGet, "/permissions", h.getPermissions, manageRoles)
+	rt.handle(http.MethodGet, "/roles", h.getRoles, manageRoles)
+	rt.handle(http.MethodPost, "/roles", h.insertRole, manageRoles)
+	rt.handle(http.MethodPatch, "/roles/{name}", h.updateRole, manageRoles)
+	rt.handle(http.MethodDelete, "/roles/{name}", h.deleteRole, manageRoles)
+	rt.handle(http.MethodPut, "/people/{id}/roles/{role}", h.assignRole, manageRoles)
+	rt.handle(http.MethodDelete, "/people/{id}/roles/{role}", h.unassignRole, manageRoles)
+
+	manageMail := h.requirePermission(permMailManage)
+	rt.handle(http.MethodGet, "/outbox", h.getDeadEmails, manageMail)
+	rt.handle(http.MethodPost, "/outbox/{id}/retry", h.retryEmail, manageMail)
+
+	unlockLogin := h.requirePermission(permLoginUnlock)
+	rt.handle(http.MethodGet, "/lockouts", h.getLockouts, unlockLogin)
+	rt.handle(http.MethodDelete, "/lockouts/{kind}/{key}", h.unlockLogin, unlockLogin)
+
+	readAudit := h.requirePermission(permAuditRead)
+	rt.handle(http.MethodPost, "/impersonations", h.impersonate, h.requirePermission(permImpersonate))
+	rt.handle(http.MethodGet, "/impersonations", h.getImpersonations, readAudit)
+	rt.handle(http.MethodGet, "/impersonations/{id}/requests", h.getImpersonatedRequests, readAudit)
+
+	manageServices := h.requirePermission(permServiceManage)
+	rt.handle(http.MethodGet, "/service-accounts", h.getServiceAccounts, manageServices)
+	rt.handle(http.MethodPost, "/service-accounts", h.insertServiceAccount, manageServices)
+	rt.handle(http.MethodDelete, "/service-accounts/{id}", h.deleteServiceAccount, manageServices)
+	rt.handle(http.MethodPost, "/service-accounts/{id}/api-keys", h.createAPIKey, manageServices)
+	rt.handle(http.MethodDelete, "/api-keys/{id}", h.revokeAPIKey, manageServices)
+
+	return rt
+}
 
+func (h handler) handleLogin(w http.ResponseWriter, r *http.Request) error {
 	var u User
-	if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
-		respondWithMessage(w, "Invalid body", http.StatusBadRequest)
-		return
+	if err := decodeBody(r, &u); err != nil {
+		return err
 	}
 
 	if u.Email == "" || u.Password == "" {
-		respondWithMessage(w, "Email or password is empty", http.StatusForbidden)
-		return
+		return errEmptyLogin
 	}
 
-	if !h.db.validateUserLogin(u.Email, []byte(u.Password)) {
-		respondWithMessage(w, "Incorrect email or password", http.StatusForbidden)
-		return
+	var personID string
+	err := h.attemptLogin(w, r, u.Email, func() error {
+		var valid bool
+		if personID, valid = h.db.validateUserLogin(u.Email, []byte(u.Password)); !valid {
+			return errWrongLogin
+		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
-	token := jwt.New(jwt.SigningMethodHS256)
-	claims := token.Claims.(jwt.MapClaims)
-
-	claims["roles"] = h.db.getUserRoles(u.Email)
-	claims["email"] = u.Email
-	claims["exp"] = time.Now().Add(time.Minute * 43830).Unix()
+	return h.completeLogin(w, personID, u.Email)
+}
 
-	tokenString, err := token.SignedString([]byte(h.secretKet))
+// completeLogin finishes a login whose first factor passed by writing the tokens.
+// Accounts with 2FA get a challenge that is exchanged for tokens at /login/2fa,
+// their failed logins are only cleared once that succeeds.
+func (h handler) completeLogin(w http.ResponseWriter, personID, email string) error {
+	enabled, required, err := h.db.twoFactorStatus(personID)
 	if err != nil {
-		log.Printf("Failed generating token, \n%e", err)
-		respondWithMessage(w, "Something went wrong", http.StatusInternalServerError)
-		return
+		return err
+	}
+	if enabled || required {
+		return h.respondWithChallenge(w, personID, map[string]any{"TwoFactorEnrolled": enabled})
 	}
 
-	resp, err := json.Marshal(map[string]string{
-		"Token": tokenString,
-	})
-	if err != nil {
-		fmt.Printf("Failed to marshall response \n%e", err)
-		respondWithMessage(w, "something went wrong", http.StatusInternalServerError)
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	if _, err = w.Write(resp); err != nil {
-		fmt.Printf("Failed to write response \n%e", err)
-	}
-}
-
-func (h handler) getStudentExams(w http.ResponseWriter, r *http.Request) {
-	email, err := h.performChecks([]string{http.MethodGet}, "Student", r)
-
-	switch true {
-	case errors.Is(err, errForbiddenMethod):
-		respondWithMessage(w, "Only GET method is allowed", http.StatusBadRequest)
-		return
-	case errors.Is(err, errValidatingJWT):
-		respondWithMessage(w, "unauthorized", http.StatusForbidden)
-		return
-	case errors.Is(err, errMissingRole):
-		log.Printf("Roles list doesn't contain student")
-		respondWithMessage(w, "unauthorized", http.StatusForbidden)
-		return
-	case errors.Is(err, jwt.ErrTokenInvalidClaims):
-		log.Printf("Couldn't parse claims")
-		respondWithMessage(w, "something went wrong", http.StatusInternalServerError)
-		return
-	case errors.Is(err, jwt.ErrTokenInvalidId):
-		log.Printf("Couldn't parse uuid")
-		respondWithMessage(w, "something went wrong", http.StatusInternalServerError)
-		return
+	if err = h.db.clearLoginFailures(email); err != nil {
+		return err
 	}
 
-	exams, err := h.db.getStudentExams(email)
+	sessionID, refreshToken, err := h.db.createSession(personID)
 	if err != nil {
-		log.Printf("Failed to get student exams \n%e", err)
-		respondWithMessage(w, "something went wrong", http.StatusInternalServerError)
-		return
+		return err
+	}
+
+	return h.respondWithTokens(w, personID, sessionID, refreshToken, nil)
+}
+
+// requestMagicLink emails a login link when one of the person's roles allows it.
+// The response is the same either way.
+func (h handler) requestMagicLink(w http.ResponseWriter, r *http.Request) error {
+	var body struct {
+		Email string
+	}
+	if err := decodeBody(r, &body); err != nil {
+		return err
+	}
+	if body.Email == "" {
+		return errInvalidBody
 	}
 
-	resp, err := json.Marshal(exams)
+	if err := h.checkLogin(w, body.Email, clientIP(r, h.trustProxy)); err != nil {
+		return err
+	}
+
+	if err := h.db.sendMagicLink(body.Email); err != nil {
+		return err
+	}
+
+	respondWithMessage(w, "success", http.StatusOK)
+	return nil
+}
+
+// magicLinkLogin exchanges the code of a magic link for the same response as
+// /login gives for a correct password.
+func (h handler) magicLinkLogin(w http.ResponseWriter, r *http.Request) error {
+	var body struct {
+		Code string
+	}
+	if err := decodeBody(r, &body); err != nil {
+		return err
+	}
+	if body.Code == "" {
+		return errInvalidBody
+	}
+
+	// The code is only used up once the login isn't throttled.
+	personID, err := h.db.peekCode(purposeMagicLink, body.Code)
+	if errors.Is(err, errCodeNotFound) {
+		return errUnauthorized
+	} else if err != nil {
+		return err
+	}
+
+	email, err := h.db.getPersonEmail(personID)
 	if err != nil {
-		fmt.Printf("Failed to marshall exams \n%e", err)
-		respondWithMessage(w, "something went wrong", http.StatusInternalServerError)
-		return
+		return err
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	if _, err = w.Write(resp); err != nil {
-		fmt.Printf("Failed to write exams \n%e", err)
-	}
-}
-
-func (h handler) teacherExams(w http.ResponseWriter, r *http.Request) {
-	email, err := h.performChecks([]string{http.MethodPost, http.MethodGet}, "Teacher", r)
+	err = h.attemptLogin(w, r, email, func() error {
+		_, err := h.db.consumeMagicLink(body.Code)
+		return err
+	})
+	if errors.Is(err, errCodeNotFound) {
+		return errUnauthorized
+	} else if err != nil {
+		return err
+	}
+
+	return h.completeLogin(w, personID, email)
+}
+
+// checkLogin returns errLoginThrottled, and sets when to retry, when the login
+// attempt has to wait.
+func (h handler) checkLogin(w http.ResponseWriter, email, ip string) error {
+	wait, err := h.db.checkLogin(email, ip)
+	return retryAfter(w, wait, err)
+}
 
-	switch true {
-	case errors.Is(err, errForbiddenMethod):
-		respondWithMessage(w, "Only POST method is allowed", http.StatusBadRequest)
-		return
-	case errors.Is(err, errValidatingJWT):
-		respondWithMessage(w, "unauthorized", http.StatusForbidden)
-		return
-	case errors.Is(err, errMissingRole):
-		log.Printf("Roles list doesn't contain teacher")
-		respondWithMessage(w, "unauthorized", http.StatusForbidden)
-		return
-	case errors.Is(err, jwt.ErrTokenInvalidClaims):
-		log.Printf("Couldn't parse claims")
-		respondWithMessage(w, "something went wrong", http.StatusInternalServerError)
-		return
-	case errors.Is(err, jwt.ErrTokenInvalidId):
-		log.Printf("Couldn't parse uuid")
-		respondWithMessage(w, "something went wrong", http.StatusInternalServerError)
-		return
+// attemptLogin runs and records a login attempt of the email from the caller's
+// IP. It returns errLoginThrottled, and sets when to retry, without running the
+// attempt when the login has to wait.
+func (h handler) attemptLogin(w http.ResponseWriter, r *http.Request, email string, attempt func() error) error {
+	wait, err := h.db.attemptLogin(email, clientIP(r, h.trustProxy), attempt)
+	return retryAfter(w, wait, err)
+}
+
+// retryAfter sets when to retry on a throttled response and returns err.
+func retryAfter(w http.ResponseWriter, wait time.Duration, err error) error {
+	if errors.Is(err, errLoginThrottled) || errors.Is(err, errRequestThrottled) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
 	}
+	return err
+}
 
-	switch r.Method {
-	case http.MethodGet:
-		h.getExams(w)
-	case http.MethodPost:
-		h.insertExam(w, r, email)
-	default:
-		respondWithMessage(w, "method not allowed", 400)
+// respondWithChallenge issues a pending 2FA login challenge and writes it along
+// with the other fields of body.
+func (h handler) respondWithChallenge(w http.ResponseWriter, personID string, body map[string]any) error {
+	challenge, err := h.db.issueCode(purposeLoginChallenge, personID, loginChallengeTTL)
+	if err != nil {
+		return err
 	}
+
+	body["Challenge"] = challenge
+	respondWithJSON(w, body)
+	return nil
 }
 
-func (h handler) getTeacherCourses(w http.ResponseWriter, r *http.Request) {
-	email, err := h.performChecks([]string{http.MethodGet}, "Teacher", r)
+// loginSecondFactor completes a login with the challenge and a TOTP or recovery
+// code. For an account that is still enrolling, the code confirms the new secret
+// and the response carries the recovery codes.
+func (h handler) loginSecondFactor(w http.ResponseWriter, r *http.Request) error {
+	var body struct {
+		Challenge string
+		Code      string
+	}
+	if err := decodeBody(r, &body); err != nil {
+		return err
+	}
+	if body.Challenge == "" || body.Code == "" {
+		return errInvalidBody
+	}
 
-	switch true {
-	case errors.Is(err, errForbiddenMethod):
-		respondWithMessage(w, "Only POST method is allowed", http.StatusBadRequest)
-		return
-	case errors.Is(err, errValidatingJWT):
-		respondWithMessage(w, "unauthorized", http.StatusForbidden)
-		return
-	case errors.Is(err, errMissingRole):
-		log.Printf("Roles list doesn't contain teacher")
-		respondWithMessage(w, "unauthorized", http.StatusForbidden)
-		return
-	case errors.Is(err, jwt.ErrTokenInvalidClaims):
-		log.Printf("Couldn't parse claims")
-		respondWithMessage(w, "something went wrong", http.StatusInternalServerError)
-		return
-	case errors.Is(err, jwt.ErrTokenInvalidId):
-		log.Printf("Couldn't parse uuid")
-		respondWithMessage(w, "something went wrong", http.StatusInternalServerError)
-		return
-	}
-
-	courses, err := h.db.getTeacherCourseNames(email)
-	if err != nil {
-		log.Printf("Failed to get student courses \n%e", err)
-		respondWithMessage(w, "something went wrong", http.StatusInternalServerError)
-		return
-	}
-
-	resp, err := json.Marshal(courses)
-	if err != nil {
-		fmt.Printf("Failed to marshall courses \n%e", err)
-		respondWithMessage(w, "something went wrong", http.StatusInternalServerError)
-		return
+	// Failed codes are throttled like failed passwords, by the account's email, and
+	// the challenge is only used up once the login isn't throttled.
+	personID, err := h.db.peekCode(purposeLoginChallenge, body.Challenge)
+	if errors.Is(err, errCodeNotFound) {
+		return errUnauthorized
+	} else if err != nil {
+		return err
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	if _, err = w.Write(resp); err != nil {
-		fmt.Printf("Failed to write courses \n%e", err)
+	email, err := h.db.getPersonEmail(personID)
+	if err != nil {
+		return err
+	}
+
+	var recoveryCodes []string
+	err = h.attemptLogin(w, r, email, func() error {
+		if _, err := h.consumeChallenge(body.Challenge); err != nil {
+			return err
+		}
+
+		enabled, _, err := h.db.twoFactorStatus(personID)
+		if err != nil {
+			return err
+		}
+		if enabled {
+			return h.db.verifySecondFactor(personID, body.Code)
+		}
+		recoveryCodes, err = h.db.confirmTOTP(personID, body.Code)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if err = h.db.clearLoginFailures(email); err != nil {
+		return err
 	}
+
+	sessionID, refreshToken, err := h.db.createSession(personID)
+	if err != nil {
+		return err
+	}
+
+	return h.respondWithTokens(w, personID, sessionID, refreshToken, recoveryCodes)
 }
 
-func (h handler) getStudentFacultyNumbers(w http.ResponseWriter, r *http.Request) {
-	_, err := h.performChecks([]string{http.MethodGet}, "Teacher", r)
+// loginEnroll starts the TOTP enrollment of an account whose role requires 2FA.
+// It returns the secret and a new challenge to confirm it with at /login/2fa.
+func (h handler) loginEnroll(w http.ResponseWriter, r *http.Request) error {
+	var body struct {
+		Challenge string
+	}
+	if err := decodeBody(r, &body); err != nil {
+		return err
+	}
+	if body.Challenge == "" {
+		return errInvalidBody
+	}
 
-	switch true {
-	case errors.Is(err, errForbiddenMethod):
-		respondWithMessage(w, "Only POST method is allowed", http.StatusBadRequest)
-		return
-	case errors.Is(err, errValidatingJWT):
-		respondWithMessage(w, "unauthorized", http.StatusForbidden)
-		return
-	case errors.Is(err, errMissingRole):
-		log.Printf("Roles list doesn't contain teacher")
-		respondWithMessage(w, "unauthorized", http.StatusForbidden)
-		return
-	case errors.Is(err, jwt.ErrTokenInvalidClaims):
-		log.Printf("Couldn't parse claims")
-		respondWithMessage(w, "something went wrong", http.StatusInternalServerError)
-		return
-	case errors.Is(err, jwt.ErrTokenInvalidId):
-		log.Printf("Couldn't parse uuid")
-		respondWithMessage(w, "something went wrong", http.StatusInternalServerError)
-		return
+	personID, err := h.consumeChallenge(body.Challenge)
+	if err != nil {
+		return err
 	}
 
-	courses, err := h.db.getStudentFacultyNumbers()
+	secret, err := h.db.startTOTPEnrollment(personID)
 	if err != nil {
-		log.Printf("Failed to get student courses \n%e", err)
-		respondWithMessage(w, "something went wrong", http.StatusInternalServerError)
-		return
+		return err
 	}
 
-	resp, err := json.Marshal(courses)
+	uri, err := h.totpURI(personID, secret)
 	if err != nil {
-		fmt.Printf("Failed to marshall courses \n%e", err)
-		respondWithMessage(w, "something went wrong", http.StatusInternalServerError)
-		return
+		return err
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	if _, err = w.Write(resp); err != nil {
-		fmt.Printf("Failed to write courses \n%e", err)
+	return h.respondWithChallenge(w, personID, map[string]any{
+		"Secret": secret,
+		"URI":    uri,
+	})
+}
+
+// totpURI returns the otpauth URI of the secret, labeled with the person's email.
+func (h handler) totpURI(personID, secret string) (string, error) {
+	email, err := h.db.getPersonEmail(personID)
+	if err != nil {
+		return "", err
 	}
+	return totpURI(h.totpIssuer, email, secret), nil
+}
 
+func (h handler) consumeChallenge(challenge string) (string, error) {
+	personID, err := h.db.consumeCode(purposeLoginChallenge, challenge)
+	if errors.Is(err, errCodeNotFound) {
+		return "", errUnauthorized
+	}
+	return personID, err
 }
 
-func (h handler) courses(w http.ResponseWriter, r *http.Request) {
-	_, err := h.performChecks([]string{http.MethodGet, http.MethodPost, http.MethodPatch, http.MethodDelete}, "Admin", r)
+func (h handler) twoFactorEnroll(w http.ResponseWriter, r *http.Request) error {
+	personID := requestPrincipal(r).id
 
-	switch true {
-	case errors.Is(err, errForbiddenMethod):
-		respondWithMessage(w, "Only GET,POST,PATCH and DELETE methods are allowed", http.StatusBadRequest)
-		return
-	case errors.Is(err, errValidatingJWT):
-		respondWithMessage(w, "unauthorized", http.StatusForbidden)
-		return
-	case errors.Is(err, errMissingRole):
-		log.Printf("Roles list doesn't contain admin")
-		respondWithMessage(w, "unauthorized", http.StatusForbidden)
-		return
-	case errors.Is(err, jwt.ErrTokenInvalidClaims):
-		log.Printf("Couldn't parse claims")
-		respondWithMessage(w, "something went wrong", http.StatusInternalServerError)
-		return
-	case errors.Is(err, jwt.ErrTokenInvalidId):
-		log.Printf("Couldn't parse uuid")
-		respondWithMessage(w, "something went wrong", http.StatusInternalServerError)
-		return
+	secret, err := h.db.startTOTPEnrollment(personID)
+	if err != nil {
+		return err
 	}
 
-	switch r.Method {
-	case http.MethodGet:
-		h.getCourses(w)
-	case http.MethodPost:
-		h.upsertCourses(w, r, true)
-	case http.MethodPatch:
-		h.upsertCourses(w, r, false)
-	case http.MethodDelete:
-		h.deleteCourse(w, r)
-	default:
-		respondWithMessage(w, "method not allowed", 400)
+	uri, err := h.totpURI(personID, secret)
+	if err != nil {
+		return err
 	}
+
+	respondWithJSON(w, map[string]string{
+		"Secret": secret,
+		"URI":    uri,
+	})
+	return nil
 }
 
-func (h handler) getCourses(w http.ResponseWriter) {
-	courses, err := h.db.getAllCourses()
+func (h handler) twoFactorConfirm(w http.ResponseWriter, r *http.Request) error {
+	code, err := readTwoFactorCode(r)
 	if err != nil {
-		log.Printf("Failed to get courses \n%e", err)
-		respondWithMessage(w, "something went wrong", http.StatusInternalServerError)
-		return
+		return err
 	}
 
-	resp, err := json.Marshal(courses)
+	recoveryCodes, err := h.db.confirmTOTP(requestPrincipal(r).id, code)
 	if err != nil {
-		fmt.Printf("Failed to marshall courses \n%e", err)
-		respondWithMessage(w, "something went wrong", http.StatusInternalServerError)
-		return
+		return err
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	if _, err = w.Write(resp); err != nil {
-		fmt.Printf("Failed to write courses \n%e", err)
+	respondWithJSON(w, map[string][]string{"RecoveryCodes": recoveryCodes})
+	return nil
+}
+
+func (h handler) twoFactorRecoveryCodes(w http.ResponseWriter, r *http.Request) error {
+	code, err := readTwoFactorCode(r)
+	if err != nil {
+		return err
+	}
+
+	recoveryCodes, err := h.db.regenerateRecoveryCodes(requestPrincipal(r).id, code)
+	if err != nil {
+		return err
 	}
+
+	respondWithJSON(w, map[string][]string{"RecoveryCodes": recoveryCodes})
+	return nil
 }
 
-func (h handler) upsertCourses(w http.ResponseWriter, r *http.Request, insert bool) {
-	b, err := io.ReadAll(r.Body)
+func (h handler) twoFactorDisable(w http.ResponseWriter, r *http.Request) error {
+	code, err := readTwoFactorCode(r)
 	if err != nil {
-		msg := "failed to read request body"
-		log.Printf(msg)
-		respondWithMessage(w, msg, http.StatusBadRequest)
-		return
+		return err
 	}
 
-	if len(b) == 0 {
-		log.Printf("request body must not be empty")
-		respondWithMessage(w, "content must be provided in request body", http.StatusBadRequest)
-		return
+	if err = h.db.disableTOTP(requestPrincipal(r).id, code); err != nil {
+		return err
 	}
 
-	var c Course
-	if err = json.Unmarshal(b, &c); err != nil {
-		log.Printf("Couldn't unmarshall courses")
-		respondWithMessage(w, "something went wrong", http.StatusInternalServerError)
-		return
+	respondWithMessage(w, "success", http.StatusOK)
+	return nil
+}
+
+// readTwoFactorCode reads the code of the body.
+func readTwoFactorCode(r *http.Request) (string, error) {
+	var body struct {
+		Code string
 	}
+	if err := decodeBody(r, &body); err != nil {
+		return "", err
+	}
+	if body.Code == "" {
+		return "", errInvalidBody
+	}
+	return body.Code, nil
+}
 
-	if insert {
-		err = h.db.insertCourse(c)
-	} else {
-		err = h.db.updateCourse(c)
+func (h handler) refreshToken(w http.ResponseWriter, r *http.Request) error {
+	oldRefreshToken, err := h.readRefreshToken(r)
+	if err != nil {
+		return err
 	}
 
+	personID, sessionID, refreshToken, err := h.db.rotateRefreshToken(oldRefreshToken)
 	if err != nil {
-		log.Printf("Course insert failed with \n%e", err)
-		respondWithMessage(w, "something went wrong", http.StatusBadRequest)
-		return
+		return err
 	}
 
-	respondWithMessage(w, "success", http.StatusOK)
+	return h.respondWithTokens(w, personID, sessionID, refreshToken, nil)
 }
 
-func (h handler) deleteCourse(w http.ResponseWriter, r *http.Request) {
-	courseName := r.URL.Query().Get("CourseName")
+func (h handler) logout(w http.ResponseWriter, r *http.Request) error {
+	refreshToken, err := h.readRefreshToken(r)
+	if err != nil {
+		return err
+	}
 
-	if err := h.db.delete("course", courseName); err != nil {
-		log.Printf("Course delete failed with \n%e", err)
-		respondWithMessage(w, "something went wrong", http.StatusInternalServerError)
-		return
+	if err = h.db.revokeSessionByRefreshToken(refreshToken); err != nil {
+		return err
 	}
 
+	if h.session.Cookies {
+		h.clearSessionCookies(w)
+	}
 	respondWithMessage(w, "success", http.StatusOK)
+	return nil
 }
 
-//func (h handler) getExams(w http.ResponseWriter, r *http.Request) {
-//	_, err := performChecks([]string{http.MethodGet, http.MethodPost}, "Admin", r)
-//
-//	switch true {
-//	case errors.Is(err, errForbiddenMethod):
-//		respondWithMessage(w, "Only GET and POST methods are allowed", http.StatusBadRequest)
-//		return
-//	case errors.Is(err, errValidatingJWT):
-//		respondWithMessage(w, "unauthorized", http.StatusForbidden)
-//		return
-//	case errors.Is(err, errMissingRole):
-//		log.Printf("Roles list doesn't contain admin")
-//		respondWithMessage(w, "unauthorized", http.StatusForbidden)
-//		return
-//	case errors.Is(err, jwt.ErrTokenInvalidClaims):
-//		log.Printf("Couldn't parse claims")
-//		respondWithMessage(w, "something went wrong", http.StatusInternalServerError)
-//		return
-//	case errors.Is(err, jwt.ErrTokenInvalidId):
-//		log.Printf("Couldn't parse uuid")
-//		respondWithMessage(w, "something went wrong", http.StatusInternalServerError)
-//		return
-//	}
-//
-//	exams, err := h.db.getAllExams()
-//	if err != nil {
-//		log.Printf("Failed to get courses \n%e", err)
-//		respondWithMessage(w, "something went wrong", http.StatusInternalServerError)
-//		return
-//	}
-//
-//	resp, err := json.Marshal(exams)
-//	if err != nil {
-//		fmt.Printf("Failed to marshall courses \n%e", err)
-//		respondWithMessage(w, "something went wrong", http.StatusInternalServerError)
-//		return
-//	}
-//
-//	w.Header().Set("Content-Type", "application/json")
-//	if _, err = w.Write(resp); err != nil {
-//		fmt.Printf("Failed to write courses \n%e", err)
-//	}
-//}
-
-func (h handler) students(w http.ResponseWriter, r *http.Request) {
-	_, err := h.performChecks([]string{http.MethodGet, http.MethodPost, http.MethodPatch}, "Admin", r)
-
-	switch true {
-	case errors.Is(err, errForbiddenMethod):
-		respondWithMessage(w, "Only GET,POST and PATCH methods are allowed", http.StatusBadRequest)
-		return
-	case errors.Is(err, errValidatingJWT):
-		respondWithMessage(w, "unauthorized", http.StatusForbidden)
-		return
-	case errors.Is(err, errMissingRole):
-		log.Printf("Roles list doesn't contain admin")
-		respondWithMessage(w, "unauthorized", http.StatusForbidden)
-		return
-	case errors.Is(err, jwt.ErrTokenInvalidClaims):
-		log.Printf("Couldn't parse claims")
-		respondWithMessage(w, "something went wrong", http.StatusInternalServerError)
-		return
-	case errors.Is(err, jwt.ErrTokenInvalidId):
-		log.Printf("Couldn't parse uuid")
-		respondWithMessage(w, "something went wrong", http.StatusInternalServerError)
-		return
-	}
-
-	switch r.Method {
-	case http.MethodGet:
-		h.getStudents(w)
-	case http.MethodPost:
-		h.upsertStudents(w, r, true)
-	case http.MethodPatch:
-		h.upsertStudents(w, r, false)
-	default:
-		respondWithMessage(w, "method not allowed", 400)
-	}
-}
-
-func (h handler) getStudents(w http.ResponseWriter) {
+// readRefreshToken reads the refresh token of the body or the cookie.
+func (h handler) readRefreshToken(r *http.Request) (string, error) {
+	var body struct {
+		RefreshToken string
+	}
+	if err := decodeBody(r, &body); err != nil && !(h.session.Cookies && errors.Is(err, errEmptyBody)) {
+		return "", errInvalidBody
+	}
 
-	students, err := h.db.getAllStudents()
+	refreshToken, err := h.refreshTokenFromRequest(r, body.RefreshToken)
 	if err != nil {
-		log.Printf("Failed to get students \n%e", err)
-		respondWithMessage(w, "something went wrong", http.StatusInternalServerError)
-		return
+		return "", err
+	}
+	if refreshToken == "" {
+		return "", errInvalidBody
 	}
+	return refreshToken, nil
+}
 
-	resp, err := json.Marshal(students)
+// respondWithTokens writes a new token pair, or sets it as cookies in cookie
+// mode, and the recovery codes of a just confirmed 2FA enrollment.
+func (h handler) respondWithTokens(w http.ResponseWriter, personID, sessionID, refreshToken string, recoveryCodes []string) error {
+	tokenString, err := h.issueAccessToken(personID, sessionID)
 	if err != nil {
-		fmt.Printf("Failed to marshall students \n%e", err)
-		respondWithMessage(w, "something went wrong", http.StatusInternalServerError)
-		return
+		return fmt.Errorf("generating token: %w", err)
+	}
+
+	body := map[string]any{
+		"Token":        tokenString,
+		"RefreshToken": refreshToken,
+	}
+
+	// In cookie mode the tokens never reach the frontend's JavaScript.
+	if h.session.Cookies {
+		csrfToken, err := h.setSessionCookies(w, tokenString, refreshToken)
+		if err != nil {
+			return fmt.Errorf("generating CSRF token: %w", err)
+		}
+		body = map[string]any{"CSRFToken": csrfToken}
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	if _, err = w.Write(resp); err != nil {
-		fmt.Printf("Failed to write students \n%e", err)
+	if recoveryCodes != nil {
+		body["RecoveryCodes"] = recoveryCodes
 	}
+
+	respondWithJSON(w, body)
+	return nil
+}
+
+func (h handler) jwks(w http.ResponseWriter, _ *http.Request) error {
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(keyPublishDelay.Seconds())))
+	respondWithJSON(w, map[string][]jwk{
+		"keys": h.keys.jwks(),
+	})
+	return nil
 }
 
-func (h handler) upsertStudents(w http.ResponseWriter, r *http.Request, insert bool) {
-	b, err := io.ReadAll(r.Body)
+// getExams lists the exams the caller may read, only the student's on
+// /students/{facultyNumber}/exams.
+func (h handler) getExams(w http.ResponseWriter, r *http.Request) error {
+	s, err := examScope(requestPrincipal(r))
 	if err != nil {
-		msg := "failed to read request body"
-		log.Printf(msg)
-		respondWithMessage(w, msg, http.StatusBadRequest)
-		return
+		return err
 	}
+	s.facultyNumber = pathParam(r, "facultyNumber")
 
-	if len(b) == 0 {
-		log.Printf("request body must not be empty")
-		respondWithMessage(w, "content must be provided in request body", http.StatusBadRequest)
-		return
+	exams, err := h.db.getExams(s)
+	if err != nil {
+		return err
 	}
 
-	var s Student
-	if err = json.Unmarshal(b, &s); err != nil {
-		log.Printf("Couldn't unmarshall students")
-		respondWithMessage(w, "something went wrong", http.StatusInternalServerError)
-		return
+	respondWithJSON(w, exams)
+	return nil
+}
+
+func (h handler) insertExam(w http.ResponseWriter, r *http.Request) error {
+	var e Exam
+	if err := decodeBody(r, &e); err != nil {
+		return err
+	}
+	if err := validate(e, true); err != nil {
+		return err
 	}
 
-	if insert {
-		err = h.db.insertStudent(s)
-	} else {
-		err = h.db.updateStudent(s)
+	s, err := examScope(requestPrincipal(r))
+	if err != nil {
+		return err
 	}
 
+	if err = h.db.insertExam(s, e); err != nil {
+		return err
+	}
+
+	respondWithMessage(w, "success", http.StatusOK)
+	return nil
+}
+
+func (h handler) getCourses(w http.ResponseWriter, r *http.Request) error {
+	s, err := courseScope(requestPrincipal(r))
 	if err != nil {
-		log.Printf("Student insert failed with \n%e", err)
-		respondWithMessage(w, "something went wrong", http.StatusBadRequest)
-		return
+		return err
+	}
+
+	courses, err := h.db.getCourses(s)
+	if err != nil {
+		return err
+	}
+
+	respondWithJSON(w, courses)
+	return nil
+}
+
+func (h handler) insertCourse(w http.ResponseWriter, r *http.Request) error {
+	var c Course
+	if err := decodeBody(r, &c); err != nil {
+		return err
+	}
+	if err := validate(c, true); err != nil {
+		return err
+	}
+
+	if err := h.db.insertCourse(c); err != nil {
+		return err
 	}
 
 	respondWithMessage(w, "success", http.StatusOK)
+	return nil
 }
 
-func (h handler) teachers(w http.ResponseWriter, r *http.Request) {
-	_, err := h.performChecks([]string{http.MethodGet, http.MethodPost, http.MethodPatch}, "Admin", r)
+func (h handler) updateCourse(w http.ResponseWriter, r *http.Request) error {
+	var c Course
+	if err := decodeBody(r, &c); err != nil {
+		return err
+	}
+	if err := validate(c, false); err != nil {
+		return err
+	}
+	c.Id = pathParam(r, "id")
 
-	switch true {
-	case errors.Is(err, errForbiddenMethod):
-		respondWithMessage(w, "Only GET,POST and PATCH methods are allowed", http.StatusBadRequest)
-		return
-	case errors.Is(err, errValidatingJWT):
-		respondWithMessage(w, "unauthorized", http.StatusForbidden)
-		return
-	case errors.Is(err, errMissingRole):
-		log.Printf("Roles list doesn't contain admin")
-		respondWithMessage(w, "unauthorized", http.StatusForbidden)
-		return
-	case errors.Is(err, jwt.ErrTokenInvalidClaims):
-		log.Printf("Couldn't parse claims")
-		respondWithMessage(w, "something went wrong", http.StatusInternalServerError)
-		return
-	case errors.Is(err, jwt.ErrTokenInvalidId):
-		log.Printf("Couldn't parse uuid")
-		respondWithMessage(w, "something went wrong", http.StatusInternalServerError)
-		return
+	if err := h.db.updateCourse(c); err != nil {
+		return err
 	}
 
-	switch r.Method {
-	case http.MethodGet:
-		h.getTeachers(w)
-	case http.MethodPost:
-		h.upsertTeachers(w, r, true)
-	case http.MethodPatch:
-		h.upsertTeachers(w, r, false)
-	default:
-		respondWithMessage(w, "method not allowed", 400)
+	respondWithMessage(w, "success", http.StatusOK)
+	return nil
+}
+
+func (h handler) deleteCourse(w http.ResponseWriter, r *http.Request) error {
+	if err := h.db.delete("course", pathParam(r, "id")); err != nil {
+		return err
 	}
+
+	respondWithMessage(w, "success", http.StatusOK)
+	return nil
 }
 
-func (h handler) getTeachers(w http.ResponseWriter) {
-	teacherEmails, err := h.db.getTeacherEmails()
+// getStudents lists the active students. Callers that can't manage students,
+// like teachers, only get their faculty numbers.
+func (h handler) getStudents(w http.ResponseWriter, r *http.Request) error {
+	students, err := h.db.getAllStudents()
 	if err != nil {
-		log.Printf("Failed to get teacherEmails \n%e", err)
-		respondWithMessage(w, "something went wrong", http.StatusInternalServerError)
-		return
+		return err
 	}
 
-	resp, err := json.Marshal(teacherEmails)
-	if err != nil {
-		fmt.Printf("Failed to marshall teacherEmails \n%e", err)
-		respondWithMessage(w, "something went wrong", http.StatusInternalServerError)
-		return
+	if requestPrincipal(r).permission == permStudentRead {
+		facultyNumbers := []string{}
+		for _, v := range students {
+			facultyNumbers = append(facultyNumbers, v.FacultyNumber)
+		}
+		respondWithJSON(w, facultyNumbers)
+		return nil
+	}
+
+	respondWithJSON(w, students)
+	return nil
+}
+
+func (h handler) insertStudent(w http.ResponseWriter, r *http.Request) error {
+	var s Student
+	if err := decodeBody(r, &s); err != nil {
+		return err
+	}
+	if err := validate(s, true); err != nil {
+		return err
+	}
+
+	if err := h.db.insertStudent(s); err != nil {
+		return err
+	}
+
+	respondWithMessage(w, "success", http.StatusOK)
+	return nil
+}
+
+func (h handler) updateStudent(w http.ResponseWriter, r *http.Request) error {
+	var s Student
+	if err := decodeBody(r, &s); err != nil {
+		return err
+	}
+	if err := validate(s, false); err != nil {
+		return err
+	}
+	s.FacultyNumber = pathParam(r, "facultyNumber")
+
+	if err := h.db.updateStudent(s); err != nil {
+		return err
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	if _, err = w.Write(resp); err != nil {
-		fmt.Printf("Failed to write teacherEmails \n%e", err)
+	respondWithMessage(w, "success", http.StatusOK)
+	return nil
+}
+
+func (h handler) archiveStudent(w http.ResponseWriter, r *http.Request) error {
+	if err := h.db.archiveStudent(pathParam(r, "facultyNumber")); err != nil {
+		return err
 	}
+
+	respondWithMessage(w, "success", http.StatusOK)
+	return nil
 }
 
-func (h handler) upsertTeachers(w http.ResponseWriter, r *http.Request, insert bool) {
-	b, err := io.ReadAll(r.Body)
+func (h handler) getTeachers(w http.ResponseWriter, _ *http.Request) error {
+	teachers, err := h.db.getAllTeachers()
 	if err != nil {
-		msg := "failed to read request body"
-		log.Printf(msg)
-		respondWithMessage(w, msg, http.StatusBadRequest)
-		return
+		return err
 	}
 
-	if len(b) == 0 {
-		log.Printf("request body must not be empty")
-		respondWithMessage(w, "content must be provided in request body", http.StatusBadRequest)
-		return
+	respondWithJSON(w, teachers)
+	return nil
+}
+
+func (h handler) insertTeacher(w http.ResponseWriter, r *http.Request) error {
+	var t Teacher
+	if err := decodeBody(r, &t); err != nil {
+		return err
+	}
+	if err := validate(t, true); err != nil {
+		return err
 	}
 
+	if err := h.db.insertTeacher(t); err != nil {
+		return err
+	}
+
+	respondWithMessage(w, "success", http.StatusOK)
+	return nil
+}
+
+func (h handler) updateTeacher(w http.ResponseWriter, r *http.Request) error {
 	var t Teacher
-	if err = json.Unmarshal(b, &t); err != nil {
-		log.Printf("Couldn't unmarshall teachers")
-		respondWithMessage(w, "something went wrong", http.StatusInternalServerError)
-		return
+	if err := decodeBody(r, &t); err != nil {
+		return err
 	}
+	if err := validate(t, false); err != nil {
+		return err
+	}
+	t.ID = pathParam(r, "id")
 
-	if insert {
-		err = h.db.insertTeacher(t)
-	} else {
-		err = h.db.updateTeacher(t)
+	if err := h.db.updateTeacher(t); err != nil {
+		return err
 	}
 
-	if err != nil {
-		log.Printf("Teacher insert failed with \n%e", err)
-		respondWithMessage(w, "something went wrong", http.StatusBadRequest)
-		return
+	respondWithMessage(w, "success", http.StatusOK)
+	return nil
+}
+
+func (h handler) archiveTeacher(w http.ResponseWriter, r *http.Request) error {
+	if err := h.db.archiveTeacher(pathParam(r, "id")); err != nil {
+		return err
 	}
 
 	respondWithMessage(w, "success", http.StatusOK)
+	return nil
 }
 
-func (h handler) getUserData(w http.ResponseWriter, r *http.Request) {
-	role := r.URL.Query().Get("role")
+// forgottenPassword emails a password reset code. Requests are throttled per IP
+// like failed logins, so the endpoint can't be used to flood inboxes.
+func (h handler) forgottenPassword(w http.ResponseWriter, r *http.Request) error {
+	var body struct {
+		Email string
+	}
+	if err := decodeBody(r, &body); err != nil {
+		return err
+	}
+	if body.Email == "" {
+		return errInvalidBody
+	}
 
-	users, err := h.db.getUsers(role)
-	if err != nil {
-		log.Printf("Failed to get users \n%e", err)
-		respondWithMessage(w, "something went wrong", http.StatusInternalServerError)
-		return
+	wait, err := h.db.throttleRequest(throttlePasswordReset, clientIP(r, h.trustProxy))
+	if err = retryAfter(w, wait, err); err != nil {
+		return err
 	}
 
-	resp, err := json.Marshal(users)
-	if err != nil {
-		fmt.Printf("Failed to marshall users \n%e", err)
-		respondWithMessage(w, "something went wrong", http.StatusInternalServerError)
-		return
+	if err := h.db.resendPassword(body.Email); err != nil {
+		return err
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	if _, err = w.Write(resp); err != nil {
-		fmt.Printf("Failed to write users \n%e", err)
+	respondWithMessage(w, "success", http.StatusOK)
+	return nil
+}
+
+func (h handler) changePassword(w http.ResponseWriter, r *http.Request) error {
+	var passwords struct {
+		OldPassword string
+		NewPassword string
+	}
+	if err := decodeBody(r, &passwords); err != nil {
+		return err
+	}
+
+	p := requestPrincipal(r)
+	if err := h.db.changePassword(p.id, p.sessionID, passwords.OldPassword, passwords.NewPassword); err != nil {
+		return err
 	}
+
+	respondWithMessage(w, "success", http.StatusOK)
+	return nil
 }
 
-func (h handler) insertExam(w http.ResponseWriter, r *http.Request, email string) {
-	b, err := io.ReadAll(r.Body)
-	if err != nil {
-		msg := "failed to read request body"
-		log.Printf(msg)
-		respondWithMessage(w, msg, http.StatusBadRequest)
-		return
+func (h handler) createPassword(w http.ResponseWriter, r *http.Request) error {
+	var body struct {
+		Code     string
+		Password string
+	}
+	if err := decodeBody(r, &body); err != nil {
+		return err
 	}
 
-	if len(b) == 0 {
-		log.Printf("request body must not be empty")
-		respondWithMessage(w, "content must be provided in request body", http.StatusBadRequest)
-		return
+	if err := h.db.createPassword(body.Code, body.Password); err != nil {
+		return err
 	}
 
-	var e Exam
-	if err = json.Unmarshal(b, &e); err != nil {
-		log.Printf("Couldn't unmarshall exams")
-		respondWithMessage(w, "something went wrong", http.StatusInternalServerError)
-		return
+	respondWithMessage(w, "success", http.StatusOK)
+	return nil
+}
+
+func (h handler) resetPassword(w http.ResponseWriter, r *http.Request) error {
+	var body struct {
+		Code     string
+		Password string
+	}
+	if err := decodeBody(r, &body); err != nil {
+		return err
 	}
 
-	if err = h.db.insertExam(email, e); err != nil {
-		log.Printf("Exams insert failed with \n%e", err)
-		respondWithMessage(w, "something went wrong", http.StatusBadRequest)
-		return
+	if err := h.db.resetPassword(body.Code, body.Password); err != nil {
+		return err
 	}
 
 	respondWithMessage(w, "success", http.StatusOK)
+	return nil
 }
 
-func (h handler) getExams(w http.ResponseWriter) {
-	exams, err := h.db.getTeacherExams()
-	if err != nil {
-		log.Printf("Failed to get exams \n%e", err)
-		respondWithMessage(w, "something went wrong", http.StatusInternalServerError)
-		return
+func (h handler) changeEmail(w http.ResponseWriter, r *http.Request) error {
+	var body struct {
+		Email string
+	}
+	if err := decodeBody(r, &body); err != nil {
+		return err
+	}
+	if body.Email == "" {
+		return errInvalidBody
 	}
 
-	resp, err := json.Marshal(exams)
+	if err := h.db.changeEmail(requestPrincipal(r).id, body.Email); err != nil {
+		return err
+	}
+
+	respondWithMessage(w, "success", http.StatusOK)
+	return nil
+}
+
+func (h handler) verifyEmail(w http.ResponseWriter, r *http.Request) error {
+	var body struct {
+		Code string
+	}
+	if err := decodeBody(r, &body); err != nil {
+		return err
+	}
+	if body.Code == "" {
+		return errInvalidBody
+	}
+
+	if err := h.db.verifyEmailChange(body.Code); err != nil {
+		return err
+	}
+
+	respondWithMessage(w, "success", http.StatusOK)
+	return nil
+}
+
+func (h handler) getRoles(w http.ResponseWriter, _ *http.Request) error {
+	roles, err := h.db.getRoles()
 	if err != nil {
-		fmt.Printf("Failed to marshall exams \n%e", err)
-		respondWithMessage(w, "something went wrong", http.StatusInternalServerError)
-		return
+		return err
+	}
+
+	respondWithJSON(w, roles)
+	return nil
+}
+
+func (h handler) insertRole(w http.ResponseWriter, r *http.Request) error {
+	var role Role
+	if err := decodeBody(r, &role); err != nil {
+		return err
+	}
+	if role.Name == "" {
+		return errInvalidBody
+	}
+
+	if err := validatePermissions(role.Permissions); err != nil {
+		return err
+	}
+
+	if err := h.db.insertRole(role); err != nil {
+		return err
+	}
+
+	respondWithMessage(w, "success", http.StatusOK)
+	return nil
+}
+
+func (h handler) updateRole(w http.ResponseWriter, r *http.Request) error {
+	var role Role
+	if err := decodeBody(r, &role); err != nil {
+		return err
+	}
+	role.Name = pathParam(r, "name")
+
+	if err := validatePermissions(role.Permissions); err != nil {
+		return err
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	if _, err = w.Write(resp); err != nil {
-		fmt.Printf("Failed to write exams \n%e", err)
+	if err := h.db.updateRole(role); err != nil {
+		return err
 	}
+
+	respondWithMessage(w, "success", http.StatusOK)
+	return nil
 }
 
-func (h handler) users(w http.ResponseWriter, r *http.Request) {
-	_, err := h.performChecks([]string{http.MethodGet, http.MethodDelete}, "Admin", r)
+func (h handler) deleteRole(w http.ResponseWriter, r *http.Request) error {
+	if err := h.db.deleteRole(pathParam(r, "name")); err != nil {
+		return err
+	}
 
-	switch true {
-	case errors.Is(err, errForbiddenMethod):
-		respondWithMessage(w, "Only GET and DELETE methods are allowed", http.StatusBadRequest)
-		return
-	case errors.Is(err, errValidatingJWT):
-		respondWithMessage(w, "unauthorized", http.StatusForbidden)
-		return
-	case errors.Is(err, errMissingRole):
-		log.Printf("Roles list doesn't contain admin")
-		respondWithMessage(w, "unauthorized", http.StatusForbidden)
-		return
-	case errors.Is(err, jwt.ErrTokenInvalidClaims):
-		log.Printf("Couldn't parse claims")
-		respondWithMessage(w, "something went wrong", http.StatusInternalServerError)
-		return
-	case errors.Is(err, jwt.ErrTokenInvalidId):
-		log.Printf("Couldn't parse uuid")
-		respondWithMessage(w, "something went wrong", http.StatusInternalServerError)
-		return
+	respondWithMessage(w, "success", http.StatusOK)
+	return nil
+}
+
+func (h handler) assignRole(w http.ResponseWriter, r *http.Request) error {
+	if err := h.db.assignRole(pathParam(r, "id"), pathParam(r, "role")); err != nil {
+		return err
 	}
 
-	switch r.Method {
-	case http.MethodGet:
-		h.getUserData(w, r)
-	case http.MethodDelete:
-		h.archiveUser(w, r)
-	default:
-		respondWithMessage(w, "method not allowed", 400)
+	respondWithMessage(w, "success", http.StatusOK)
+	return nil
+}
+
+func (h handler) unassignRole(w http.ResponseWriter, r *http.Request) error {
+	if err := h.db.unassignRole(pathParam(r, "id"), pathParam(r, "role")); err != nil {
+		return err
 	}
+
+	respondWithMessage(w, "success", http.StatusOK)
+	return nil
+}
+
+func (h handler) getPermissions(w http.ResponseWriter, _ *http.Request) error {
+	respondWithJSON(w, knownPermissions)
+	return nil
 }
 
-func (h handler) archiveUser(w http.ResponseWriter, r *http.Request) {
-	email := r.URL.Query().Get("email")
-	role := r.URL.Query().Get("role")
+func (h handler) getDeadEmails(w http.ResponseWriter, _ *http.Request) error {
+	emails, err := h.db.getDeadEmails()
+	if err != nil {
+		return err
+	}
+
+	respondWithJSON(w, emails)
+	return nil
+}
 
-	if email == "" {
-		log.Printf("email must not be empty")
-		respondWithMessage(w, "content must be provided in request body", http.StatusBadRequest)
-		return
+func (h handler) retryEmail(w http.ResponseWriter, r *http.Request) error {
+	id, err := strconv.ParseInt(pathParam(r, "id"), 10, 64)
+	if err != nil {
+		return errEmailNotFound
 	}
 
-	if err := h.db.archiveUser(email, role); err != nil {
-		log.Printf("Exams insert failed with \n%e", err)
-		respondWithMessage(w, "something went wrong", http.StatusBadRequest)
-		return
+	if err = h.db.retryEmail(id); err != nil {
+		return err
 	}
 
 	respondWithMessage(w, "success", http.StatusOK)
+	return nil
 }
 
-func (h handler) forgottenPassword(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		respondWithMessage(w, "Only POST method is allowed", http.StatusBadRequest)
-		return
+func (h handler) getLockouts(w http.ResponseWriter, _ *http.Request) error {
+	lockouts, err := h.db.getLockouts()
+	if err != nil {
+		return err
 	}
 
-	email := r.URL.Query().Get("email")
+	respondWithJSON(w, lockouts)
+	return nil
+}
+
+// unlockLogin lifts the lockout of an account (/lockouts/account/{email}), an
+// IP (/lockouts/ip/{ip}) or the password resets of an IP
+// (/lockouts/password_reset/{ip}).
+func (h handler) unlockLogin(w http.ResponseWriter, r *http.Request) error {
+	kind := pathParam(r, "kind")
+	if kind != throttleAccount && kind != throttleIP && kind != throttlePasswordReset {
+		return errLockoutNotFound
+	}
 
-	if err := h.db.resendPassword(email); err != nil {
-		log.Printf("Failed to resend password with \n%e", err)
-		respondWithMessage(w, "something went wrong", http.StatusBadRequest)
-		return
+	if err := h.db.unlockLogin(kind, pathParam(r, "key")); err != nil {
+		return err
 	}
 
 	respondWithMessage(w, "success", http.StatusOK)
+	return nil
 }
 
-func (h handler) changePassword(w http.ResponseWriter, r *http.Request) {
-	email, err := h.performChecksWithoutRoles([]string{http.MethodPost}, r)
+// impersonate issues a token to act as another person, for support staff to see
+// what they see. The token only allows reads unless AllowWrites is set.
+func (h handler) impersonate(w http.ResponseWriter, r *http.Request) error {
+	var body struct {
+		Email       string
+		Reason      string
+		AllowWrites bool
+	}
+	if err := decodeBody(r, &body); err != nil {
+		return err
+	}
+	if body.Email == "" || body.Reason == "" {
+		return errInvalidBody
+	}
 
-	switch true {
-	case errors.Is(err, errForbiddenMethod):
-		respondWithMessage(w, "Only POST methods are allowed", http.StatusBadRequest)
-		return
-	case errors.Is(err, errValidatingJWT):
-		respondWithMessage(w, "unauthorized", http.StatusForbidden)
-		return
-	case errors.Is(err, jwt.ErrTokenInvalidClaims):
-		log.Printf("Couldn't parse claims")
-		respondWithMessage(w, "something went wrong", http.StatusInternalServerError)
-		return
-	case errors.Is(err, jwt.ErrTokenInvalidId):
-		log.Printf("Couldn't parse uuid")
-		respondWithMessage(w, "something went wrong", http.StatusInternalServerError)
-		return
+	subjectID, err := h.db.personIDByEmail(body.Email)
+	if err != nil {
+		return err
 	}
 
-	var passwords struct {
-		OldPassword string
-		NewPassword string
+	// People who can impersonate can't be impersonated, so that it can't be chained.
+	p := requestPrincipal(r)
+	if subjectID == p.id || h.db.getUserPermissions(subjectID).contains(permImpersonate) {
+		return errCannotImpersonate
 	}
-	byteValue, _ := io.ReadAll(r.Body)
-	if err = json.Unmarshal(byteValue, &passwords); err != nil {
-		log.Printf("Failed to unmarshal password with \n%e", err)
-		respondWithMessage(w, "something went wrong", http.StatusBadRequest)
-		return
+
+	impersonationID, err := h.db.startImpersonation(p.id, subjectID, body.Reason, body.AllowWrites)
+	if err != nil {
+		return err
 	}
 
-	if err = h.db.changePassword(email, passwords.OldPassword, passwords.NewPassword); err != nil {
-		log.Printf("Failed to change password with \n%e", err)
-		respondWithMessage(w, "something went wrong", http.StatusBadRequest)
-		return
+	token, err := h.issueImpersonationToken(p, subjectID, impersonationID)
+	if err != nil {
+		return fmt.Errorf("generating token: %w", err)
+	}
+
+	log.Printf("Person %s started impersonating %s, writes allowed: %t", p.id, subjectID, body.AllowWrites)
+	respondWithJSON(w, map[string]any{
+		"Token":           token,
+		"ImpersonationID": impersonationID,
+		"ExpiresAt":       time.Now().Add(impersonationTTL),
+	})
+	return nil
+}
+
+func (h handler) getImpersonations(w http.ResponseWriter, _ *http.Request) error {
+	impersonations, err := h.db.getImpersonations()
+	if err != nil {
+		return err
+	}
+
+	respondWithJSON(w, impersonations)
+	return nil
+}
+
+func (h handler) getImpersonatedRequests(w http.ResponseWriter, r *http.Request) error {
+	requests, err := h.db.getImpersonatedRequests(pathParam(r, "id"))
+	if err != nil {
+		return err
+	}
+
+	respondWithJSON(w, requests)
+	return nil
+}
+
+func (h handler) getServiceAccounts(w http.ResponseWriter, _ *http.Request) error {
+	accounts, err := h.db.getServiceAccounts()
+	if err != nil {
+		return err
+	}
+
+	respondWithJSON(w, accounts)
+	return nil
+}
+
+func (h handler) insertServiceAccount(w http.ResponseWriter, r *http.Request) error {
+	var body struct {
+		Name string
+	}
+	if err := decodeBody(r, &body); err != nil {
+		return err
+	}
+	if body.Name == "" {
+		return errInvalidBody
+	}
+
+	id, err := h.db.insertServiceAccount(body.Name)
+	if err != nil {
+		return err
+	}
+
+	respondWithJSON(w, map[string]string{"ID": id})
+	return nil
+}
+
+func (h handler) deleteServiceAccount(w http.ResponseWriter, r *http.Request) error {
+	if err := h.db.deleteServiceAccount(pathParam(r, "id")); err != nil {
+		return err
 	}
 
 	respondWithMessage(w, "success", http.StatusOK)
+	return nil
 }
 
-func (h handler) createPassword(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		respondWithMessage(w, "Only POST method is allowed", http.StatusBadRequest)
-		return
+// createAPIKey returns a new key of the service account. It is only shown in
+// this response.
+func (h handler) createAPIKey(w http.ResponseWriter, r *http.Request) error {
+	var body struct {
+		Scopes    []string
+		ExpiresAt time.Time
+	}
+	if err := decodeBody(r, &body); err != nil {
+		return err
 	}
 
-	var Body struct {
-		Code     string
-		Password string
+	if err := validateScopes(body.Scopes); err != nil {
+		return err
 	}
-	byteValue, _ := io.ReadAll(r.Body)
-	if err := json.Unmarshal(byteValue, &Body); err != nil {
-		log.Printf("Failed to unmarshal password with \n%e", err)
-		respondWithMessage(w, "something went wrong", http.StatusBadRequest)
-		return
+
+	if !body.ExpiresAt.After(time.Now()) || body.ExpiresAt.After(time.Now().Add(apiKeyMaxTTL)) {
+		return errInvalidAPIKeyExpiry
 	}
 
-	if err := h.db.createPassword(Body.Code, Body.Password); err != nil {
-		log.Printf("Failed to change password with \n%e", err)
-		respondWithMessage(w, "something went wrong", http.StatusBadRequest)
-		return
+	key, err := h.db.createAPIKey(pathParam(r, "id"), body.Scopes, body.ExpiresAt)
+	if err != nil {
+		return err
+	}
+
+	respondWithJSON(w, map[string]string{"Key": key})
+	return nil
+}
+
+func (h handler) revokeAPIKey(w http.ResponseWriter, r *http.Request) error {
+	if err := h.db.revokeAPIKey(pathParam(r, "id")); err != nil {
+		return err
 	}
 
 	respondWithMessage(w, "success", http.StatusOK)
+	return nil
 }
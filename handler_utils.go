@@ -1,91 +1,231 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
 	"net/http"
-	"os"
+	"strings"
+	"time"
 
 	"github.com/golang-jwt/jwt/v4"
 )
 
 var (
-	errForbiddenMethod = errors.New("method not allowed")
-	errValidatingJWT   = errors.New("failed to validate jwt token")
-	errMissingRole     = errors.New("role is not present in token")
+	errValidatingJWT     = errors.New("failed to validate jwt token")
+	errMissingPermission = errors.New("caller does not have the required permission")
 )
 
-type Roles []string
+type principalKey struct{}
 
-func (r Roles) contains(s string) bool {
-	for _, v := range r {
-		if v == s {
-			return true
+// requirePermission only lets callers through that hold one of the permissions.
+// The first one they hold authorizes the request and decides which records it
+// may touch, so the broadest permission goes first.
+func (h handler) requirePermission(permissions ...string) middleware {
+	return func(next apiFunc) apiFunc {
+		return func(w http.ResponseWriter, r *http.Request) error {
+			p, err := h.performChecks(permissions, r)
+			if err != nil {
+				return err
+			}
+			return next(w, withPrincipal(r, p))
 		}
 	}
-	return false
 }
 
-func (h handler) performChecks(methods []string, role string, r *http.Request) (string, error) {
-	if !isMethodAllowed(methods, r.Method) {
-		return "", errForbiddenMethod
+// requireLogin lets any logged in person through, for the endpoints that change
+// their own account.
+func (h handler) requireLogin(next apiFunc) apiFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		p, err := h.performChecksWithoutRoles(r)
+		if err != nil {
+			return err
+		}
+		return next(w, withPrincipal(r, p))
 	}
+}
+
+func withPrincipal(r *http.Request, p principal) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), principalKey{}, p))
+}
+
+// requestPrincipal returns the caller that requirePermission or requireLogin let through.
+func requestPrincipal(r *http.Request) principal {
+	p, _ := r.Context().Value(principalKey{}).(principal)
+	return p
+}
+
+// tokenClaims is what a verified access token says about the caller.
+type tokenClaims struct {
+	personID  string
+	sessionID string
+	// actorID and impersonationID are set when an admin impersonates the person.
+	actorID         string
+	impersonationID string
+	// scopes are set instead of a person and session for a service account's
+	// API key, personID then holds the service account.
+	scopes permissionList
+}
 
-	token, err := validateToken(r.Header)
+func (h handler) performChecks(permissions []string, r *http.Request) (principal, error) {
+	c, err := h.authenticate(r)
 	if err != nil {
-		return "", errValidatingJWT
+		return principal{}, err
 	}
 
-	claims, ok := token.Claims.(jwt.MapClaims)
-	if !ok {
-		return "", jwt.ErrTokenInvalidClaims
+	if c.impersonationID != "" {
+		if err = h.checkImpersonation(c, r, false); err != nil {
+			return principal{}, err
+		}
+	}
+
+	p := principal{
+		id:          c.personID,
+		sessionID:   c.sessionID,
+		actorID:     c.actorID,
+		permissions: c.scopes,
+	}
+	if c.scopes == nil {
+		p.permissions = h.db.getUserPermissions(c.personID)
 	}
 
-	email := claims["email"].(string)
-	if email == "" {
-		return "", jwt.ErrTokenInvalidId
+	for _, v := range permissions {
+		if p.permissions.contains(v) {
+			p.permission = v
+			return p, nil
+		}
 	}
 
-	roleClaims := Roles(h.db.getUserRoles(email))
+	return principal{}, fmt.Errorf("%w %s", errMissingPermission, strings.Join(permissions, " or "))
+}
 
-	if !roleClaims.contains(role) {
-		return "", errMissingRole
+// performChecksWithoutRoles authenticates the caller and returns them with
+// their session. It guards endpoints that change the account itself, which an
+// impersonating admin can never use.
+func (h handler) performChecksWithoutRoles(r *http.Request) (principal, error) {
+	c, err := h.authenticate(r)
+	if err != nil {
+		return principal{}, err
+	}
+
+	if c.scopes != nil {
+		return principal{}, errAPIKeyDenied
+	}
+
+	if c.impersonationID != "" {
+		if err = h.checkImpersonation(c, r, true); err != nil {
+			return principal{}, err
+		}
 	}
 
-	return email, nil
+	return principal{id: c.personID, sessionID: c.sessionID}, nil
 }
 
-func (h handler) performChecksWithoutRoles(methods []string, r *http.Request) (string, error) {
-	if !isMethodAllowed(methods, r.Method) {
-		return "", errForbiddenMethod
+// authenticate checks the access token or, for a service account, the API key of
+// the request.
+func (h handler) authenticate(r *http.Request) (tokenClaims, error) {
+	if key := r.Header.Get(apiKeyHeader); key != "" {
+		serviceAccountID, scopes, err := h.db.authenticateAPIKey(key)
+		if err != nil {
+			return tokenClaims{}, err
+		}
+		return tokenClaims{personID: serviceAccountID, scopes: scopes}, nil
 	}
 
-	token, err := validateToken(r.Header)
+	token, fromCookie, err := h.validateToken(r)
 	if err != nil {
-		return "", errValidatingJWT
+		return tokenClaims{}, errValidatingJWT
+	}
+
+	// Browsers send cookies along with requests other sites make, so writes
+	// authenticated by the cookie must prove they come from the frontend.
+	if fromCookie && !isReadOnlyMethod(r.Method) && !validCSRFToken(r) {
+		return tokenClaims{}, errInvalidCSRFToken
 	}
 
 	claims, ok := token.Claims.(jwt.MapClaims)
 	if !ok {
-		return "", jwt.ErrTokenInvalidClaims
+		return tokenClaims{}, jwt.ErrTokenInvalidClaims
 	}
 
-	email := claims["email"].(string)
-	if email == "" {
-		return "", jwt.ErrTokenInvalidId
+	var c tokenClaims
+	c.personID, _ = claims["sub"].(string)
+	if c.personID == "" {
+		return tokenClaims{}, jwt.ErrTokenInvalidId
 	}
 
-	return email, nil
-}
+	if c.sessionID, _ = claims["sid"].(string); !h.db.isSessionActive(c.sessionID) {
+		return tokenClaims{}, errValidatingJWT
+	}
 
-func isMethodAllowed(methods []string, method string) bool {
-	for _, v := range methods {
-		if v == method {
-			return true
+	if act, ok := claims["act"].(map[string]any); ok {
+		c.actorID, _ = act["sub"].(string)
+		c.impersonationID, _ = claims["imp"].(string)
+		if c.actorID == "" || c.impersonationID == "" {
+			return tokenClaims{}, jwt.ErrTokenInvalidClaims
 		}
 	}
-	return false
+
+	return c, nil
+}
+
+// checkImpersonation logs a request made with an impersonation token and refuses
+// it when it writes without the impersonation allowing writes, or when it is
+// for an account endpoint. A request that can't be logged is refused too.
+func (h handler) checkImpersonation(c tokenClaims, r *http.Request, accountEndpoint bool) error {
+	allowWrites, err := h.db.impersonationAllowsWrites(c.impersonationID)
+	if errors.Is(err, errImpersonationNotFound) {
+		return errValidatingJWT
+	} else if err != nil {
+		return err
+	}
+
+	var refused error
+	switch true {
+	case accountEndpoint:
+		refused = errImpersonationDenied
+	case !isReadOnlyMethod(r.Method) && !allowWrites:
+		refused = errImpersonationReadOnly
+	}
+
+	err = h.db.recordImpersonatedRequest(c.impersonationID, r.Method, r.URL.Path, refused != nil)
+	if errors.Is(err, errImpersonationNotFound) {
+		return errValidatingJWT
+	} else if err != nil {
+		return err
+	}
+
+	log.Printf("Impersonated request %s %s by %s as %s, refused: %t", r.Method, r.URL.Path, c.actorID, c.personID, refused != nil)
+	return refused
+}
+
+// issueAccessToken signs a short-lived token bound to a login session, so that
+// revoking the session also stops the token from being accepted. The subject is
+// the person id, which stays the same when the email changes.
+func (h handler) issueAccessToken(personID, sessionID string) (string, error) {
+	return h.keys.sign(jwt.MapClaims{
+		"roles": h.db.getUserRoles(personID),
+		"sub":   personID,
+		"sid":   sessionID,
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(accessTokenTTL).Unix(),
+	})
+}
+
+// issueImpersonationToken signs a token for the subject that names the actor in
+// an act claim (RFC 8693). It is bound to the actor's session.
+func (h handler) issueImpersonationToken(actor principal, subjectID, impersonationID string) (string, error) {
+	return h.keys.sign(jwt.MapClaims{
+		"roles": h.db.getUserRoles(subjectID),
+		"sub":   subjectID,
+		"act":   map[string]string{"sub": actor.id},
+		"imp":   impersonationID,
+		"sid":   actor.sessionID,
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(impersonationTTL).Unix(),
+	})
 }
 
 func respondWithMessage(w http.ResponseWriter, messageTxt string, statusCode int) {
@@ -102,43 +242,89 @@ func respondWithMessage(w http.ResponseWriter, messageTxt string, statusCode int
 	_, _ = w.Write(resp)
 }
 
-func validateToken(reqHeader http.Header) (*jwt.Token, error) {
+func respondWithJSON(w http.ResponseWriter, v any) {
+	resp, err := json.Marshal(v)
+	if err != nil {
+		fmt.Printf("Failed to marshall response \n%v", err)
+		respondWithProblem(w, newProblem(http.StatusInternalServerError, "internal_error", "something went wrong"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if _, err = w.Write(resp); err != nil {
+		fmt.Printf("Failed to write response \n%v", err)
+	}
+}
+
+// validateToken parses the access token of the request and reports whether it
+// came from the cookie.
+func (h handler) validateToken(r *http.Request) (*jwt.Token, bool, error) {
+	tokenString, fromCookie := tokenFromRequest(r)
+	if tokenString == "" {
+		return nil, false, fmt.Errorf("can not find token in header")
+	}
 
-	if reqHeader.Get("Authorization") == "" {
-		return nil, fmt.Errorf("can not find token in header")
+	// Cookies are only accepted in cookie mode, so that an old cookie can't
+	// authenticate once the mode is turned off.
+	if fromCookie && !h.session.Cookies {
+		return nil, false, fmt.Errorf("session cookies are disabled")
 	}
 
-	token, err := jwt.Parse(reqHeader.Get("Authorization"), func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("there was an error in parsing")
-		}
-		return []byte(os.Getenv("SECRET_KEY")), nil
-	})
+	token, err := h.keys.parse(tokenString)
 
-	if token.Valid {
-		return token, nil
+	if err == nil && token.Valid {
+		return token, fromCookie, nil
 	} else if errors.Is(err, jwt.ErrTokenMalformed) {
-		return nil, fmt.Errorf("that's not even a token")
+		return nil, false, fmt.Errorf("that's not even a token")
 	} else if errors.Is(err, jwt.ErrTokenExpired) || errors.Is(err, jwt.ErrTokenNotValidYet) { // Token is either expired or not active yet
-		return nil, fmt.Errorf("token is either expired or not active yet")
+		return nil, false, fmt.Errorf("token is either expired or not active yet")
 	} else {
-		return nil, fmt.Errorf("couldn't handle this token \n%e", err)
+		return nil, false, fmt.Errorf("couldn't handle this token \n%e", err)
 	}
 }
 
-func corsHandler(h http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == "OPTIONS" {
+// corsHandler lets the origins call the API from a browser with the methods. The
+// allowed origin is echoed back, so that cookies can be sent along; "*" allows
+// any origin, but without cookies.
+func corsHandler(origins, methods []string) func(http.HandlerFunc) http.HandlerFunc {
+	allowMethods := strings.Join(methods, ", ") + ", " + http.MethodOptions
+	allowed := map[string]bool{}
+	for _, v := range origins {
+		allowed[v] = true
+	}
+
+	return func(h http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
 			headers := w.Header()
-			headers.Add("Access-Control-Allow-Origin", "*")
-			headers.Add("Access-Control-Allow-Headers", "Origin, X-Requested-With, Content-Type, Accept, Authorization")
-			headers.Add("Access-Control-Allow-Credentials", "true")
-			headers.Add("Access-Control-Allow-Methods", "GET, POST, PATCH, DELETE, OPTIONS")
-			w.WriteHeader(http.StatusOK)
-			return
-		} else {
+			headers.Add("Vary", "Origin")
+
+			origin := r.Header.Get("Origin")
+			switch true {
+			case origin != "" && allowed[origin]:
+				headers.Set("Access-Control-Allow-Origin", origin)
+				headers.Set("Access-Control-Allow-Credentials", "true")
+			case allowed["*"]:
+				headers.Set("Access-Control-Allow-Origin", "*")
+			}
+
+			if r.Method == http.MethodOptions {
+				headers.Set("Access-Control-Allow-Headers", "Origin, X-Requested-With, Content-Type, Accept, Authorization, X-API-Key, X-CSRF-Token")
+				headers.Set("Access-Control-Allow-Methods", allowMethods)
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+
 			h(w, r)
-			return
+		}
+	}
+}
+
+// limitBody refuses to read more than limit bytes of a request body.
+func limitBody(limit int64) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+			next(w, r)
 		}
 	}
 }
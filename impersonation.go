@@ -0,0 +1,79 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// impersonationTTL is how long an impersonation token is valid. It can't be
+// refreshed, the admin has to start a new impersonation.
+const impersonationTTL = 30 * time.Minute
+
+var (
+	errImpersonationNotFound = errors.New("impersonation not found or expired")
+	errImpersonationReadOnly = errors.New("write requests are not allowed while impersonating")
+	errImpersonationDenied   = errors.New("this request can't be made while impersonating")
+	errCannotImpersonate     = errors.New("this person can't be impersonated")
+)
+
+// startImpersonation records that the actor impersonates the subject and returns
+// the id of the impersonation, which its token carries.
+func (conn dbConnection) startImpersonation(actorID, subjectID, reason string, allowWrites bool) (string, error) {
+	var id string
+	err := conn.db.Get(&id, "INSERT INTO impersonation(actor_id, subject_id, reason, allow_writes, expires_at) VALUES ($1, $2, $3, $4, NOW() + make_interval(secs => $5)) RETURNING id",
+		actorID, subjectID, reason, allowWrites, impersonationTTL.Seconds())
+	return id, err
+}
+
+// recordImpersonatedRequest logs a request made with an impersonation token.
+// Expired impersonations are refused.
+func (conn dbConnection) recordImpersonatedRequest(impersonationID, method, path string, blocked bool) error {
+	res, err := conn.db.Exec("INSERT INTO impersonation_request(impersonation_id, method, path, blocked) SELECT id, $2, $3, $4 FROM impersonation WHERE id=$1 AND expires_at > NOW()",
+		impersonationID, method, path, blocked)
+	if err != nil {
+		return err
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errImpersonationNotFound
+	}
+	return nil
+}
+
+// impersonationAllowsWrites reports whether the impersonation was started with writes allowed.
+func (conn dbConnection) impersonationAllowsWrites(impersonationID string) (bool, error) {
+	var allowWrites bool
+	err := conn.db.Get(&allowWrites, "SELECT allow_writes FROM impersonation WHERE id=$1 AND expires_at > NOW()", impersonationID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, errImpersonationNotFound
+	}
+	return allowWrites, err
+}
+
+// getImpersonations returns every impersonation, the latest first.
+func (conn dbConnection) getImpersonations() ([]Impersonation, error) {
+	impersonations := []Impersonation{}
+	if err := conn.db.Select(&impersonations, `
+		SELECT i.id, a.email AS actor_email, s.email AS subject_email, i.reason, i.allow_writes, i.created_at, i.expires_at
+		FROM impersonation i JOIN person a ON a.id = i.actor_id JOIN person s ON s.id = i.subject_id
+		ORDER BY i.created_at DESC`); err != nil {
+		return nil, err
+	}
+	return impersonations, nil
+}
+
+// getImpersonatedRequests returns the requests made during an impersonation in order.
+func (conn dbConnection) getImpersonatedRequests(impersonationID string) ([]ImpersonatedRequest, error) {
+	requests := []ImpersonatedRequest{}
+	if err := conn.db.Select(&requests, "SELECT method, path, blocked, created_at FROM impersonation_request WHERE impersonation_id::text=$1 ORDER BY id", impersonationID); err != nil {
+		return nil, err
+	}
+	return requests, nil
+}
+
+// isReadOnlyMethod reports whether requests with the method never change data.
+func isReadOnlyMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
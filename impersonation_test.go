@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// impersonate starts an impersonation of the person with the email as the demo
+// admin and returns its token and id.
+func impersonate(t *testing.T, s testServer, email string, allowWrites bool) (string, string) {
+	t.Helper()
+
+	var body struct {
+		Token           string
+		ImpersonationID string
+	}
+	writes := "false"
+	if allowWrites {
+		writes = "true"
+	}
+	if status := s.do(http.MethodPost, "/impersonations", `{"Email":"`+email+`","Reason":"support ticket","AllowWrites":`+writes+`}`, demoAdminID, &body); status != http.StatusOK {
+		t.Fatalf("Expected the impersonation to start, but got %d", status)
+	}
+	return body.Token, body.ImpersonationID
+}
+
+func Test_impersonation_requests(t *testing.T) {
+	const exam = `{"CourseName":"Math","StudentFacultyNumber":"12312312","Points":34}`
+
+	type request struct {
+		method, target, body string
+		status               int
+		code                 string
+	}
+	tests := []struct {
+		name        string
+		allowWrites bool
+		requests    []request
+	}{
+		{
+			"Read only",
+			false,
+			[]request{
+				{http.MethodGet, "/exams", "", http.StatusOK, ""},
+				{http.MethodPost, "/exams", exam, http.StatusForbidden, "impersonation_read_only"},
+				{http.MethodPost, "/change-password", `{"OldPassword":"test_pas_123","NewPassword":"new_test_pas_123"}`, http.StatusForbidden, "impersonation_denied"},
+			},
+		},
+		{
+			"Writes allowed",
+			true,
+			[]request{
+				{http.MethodPost, "/exams", exam, http.StatusOK, ""},
+				{http.MethodPost, "/change-password", `{"OldPassword":"test_pas_123","NewPassword":"new_test_pas_123"}`, http.StatusForbidden, "impersonation_denied"},
+				{http.MethodPost, "/2fa/enroll", "", http.StatusForbidden, "impersonation_denied"},
+				{http.MethodGet, "/students", "", http.StatusOK, ""},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestServer(t, testConfig())
+			token, id := impersonate(t, s, "test2@test.com", test.allowWrites)
+
+			for _, v := range test.requests {
+				var p problem
+				var out any = &p
+				if v.code == "" {
+					out = nil
+				}
+				if status := s.withToken(v.method, v.target, v.body, token, out); status != v.status || p.Code != v.code {
+					t.Fatalf("Expected %s %s to answer %d %s, but got %d %s", v.method, v.target, v.status, v.code, status, p.Code)
+				}
+			}
+
+			// Every request is logged, the blocked ones too.
+			var logged []ImpersonatedRequest
+			if status := s.do(http.MethodGet, "/impersonations/"+id+"/requests", "", demoAdminID, &logged); status != http.StatusOK {
+				t.Fatalf("Expected the requests to be listed, but got %d", status)
+			}
+			if len(logged) != len(test.requests) {
+				t.Fatalf("Expected %d logged requests, but got %v", len(test.requests), logged)
+			}
+			for i, v := range test.requests {
+				if logged[i].Method != v.method || logged[i].Path != v.target || logged[i].Blocked != (v.code != "") {
+					t.Fatalf("Expected %s %s blocked %t to be logged, but got %+v", v.method, v.target, v.code != "", logged[i])
+				}
+			}
+		})
+	}
+}
+
+func Test_impersonation_expired(t *testing.T) {
+	s := newTestServer(t, testConfig())
+	token, _ := impersonate(t, s, "test1@test.com", false)
+
+	s.db.impersonations[0].ExpiresAt = time.Now().Add(-time.Second)
+
+	var p problem
+	if status := s.withToken(http.MethodGet, "/exams", "", token, &p); status == http.StatusOK || p.Code != "invalid_token" {
+		t.Fatalf("Expected an expired impersonation to be refused, but got %d %s", status, p.Code)
+	}
+	if len(s.db.impersonations[0].requests) != 0 {
+		t.Fatalf("Expected no requests logged after expiry, but got %v", s.db.impersonations[0].requests)
+	}
+}
+
+func Test_impersonation_denied(t *testing.T) {
+	s := newTestServer(t, testConfig())
+
+	const otherAdminID = "00000000-0000-0000-0000-00000000f004"
+	s.db.people = append(s.db.people, &memoryPerson{id: otherAdminID, name: "ivan3", email: "test3@test.com"})
+	s.db.admins = append(s.db.admins, &memoryMember{id: "00000000-0000-0000-0000-00000000a002", personID: otherAdminID, active: true})
+
+	tests := []struct {
+		name  string
+		email string
+	}{
+		{"Themselves", "test@test.com"},
+		{"Holder of user:impersonate", "test3@test.com"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var p problem
+			body := `{"Email":"` + test.email + `","Reason":"support ticket"}`
+			if status := s.do(http.MethodPost, "/impersonations", body, demoAdminID, &p); status != http.StatusForbidden || p.Code != "cannot_impersonate" {
+				t.Fatalf("Expected %d cannot_impersonate, but got %d %s", http.StatusForbidden, status, p.Code)
+			}
+		})
+	}
+
+	if len(s.db.impersonations) != 0 {
+		t.Fatalf("Expected no impersonations, but got %d", len(s.db.impersonations))
+	}
+}
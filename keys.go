@@ -0,0 +1,340 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	// keyPublishDelay is how long a new key is only published in the JWKS before
+	// it is used for signing, so verifiers caching the key set can pick it up.
+	keyPublishDelay = 10 * time.Minute
+	// keyRotationCheckInterval is how often the rotation schedule is evaluated.
+	keyRotationCheckInterval = time.Hour
+)
+
+// longestTokenTTL is how long the longest lived token signed with a key stays
+// valid, which the key has to outlive.
+func longestTokenTTL() time.Duration {
+	if impersonationTTL > accessTokenTTL {
+		return impersonationTTL
+	}
+	return accessTokenTTL
+}
+
+var errUnknownSigningKey = errors.New("token is signed with an unknown key")
+
+type signingKey struct {
+	id        string
+	method    jwt.SigningMethod
+	private   crypto.Signer
+	createdAt time.Time
+}
+
+func (k *signingKey) signingFrom() time.Time {
+	return k.createdAt.Add(keyPublishDelay)
+}
+
+// keySet holds the asymmetric keys tokens are signed with. Every key is
+// identified by its RFC 7638 thumbprint, which is sent as the "kid" header.
+type keySet struct {
+	mu        sync.RWMutex
+	algorithm string
+	dir       string
+	rotation  time.Duration
+	keys      []*signingKey
+}
+
+// loadKeySet reads the PEM encoded private keys from dir and makes sure there is
+// a key to sign with. When dir is empty the keys only live in memory.
+func loadKeySet(dir, algorithm string, rotation time.Duration) (*keySet, error) {
+	if algorithm != jwt.SigningMethodRS256.Alg() && algorithm != jwt.SigningMethodEdDSA.Alg() {
+		return nil, fmt.Errorf("unsupported signing algorithm %q", algorithm)
+	}
+
+	ks := &keySet{
+		algorithm: algorithm,
+		dir:       dir,
+		rotation:  rotation,
+	}
+
+	if dir != "" {
+		files, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, f := range files {
+			k, err := readSigningKey(f)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read key %s: %w", f, err)
+			}
+			ks.keys = append(ks.keys, k)
+		}
+	}
+
+	sort.Slice(ks.keys, func(i, j int) bool {
+		return ks.keys[i].createdAt.Before(ks.keys[j].createdAt)
+	})
+
+	if len(ks.keys) == 0 {
+		// Nobody can have cached the key set yet, so the first key signs right away.
+		k, err := ks.generateKey(time.Now().Add(-keyPublishDelay))
+		if err != nil {
+			return nil, err
+		}
+		ks.keys = append(ks.keys, k)
+	}
+
+	return ks, nil
+}
+
+func readSigningKey(path string) (*signingKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found")
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return newSigningKey(parsed, info.ModTime())
+}
+
+func newSigningKey(private any, createdAt time.Time) (*signingKey, error) {
+	k := &signingKey{createdAt: createdAt}
+
+	switch key := private.(type) {
+	case *rsa.PrivateKey:
+		k.method, k.private = jwt.SigningMethodRS256, key
+	case ed25519.PrivateKey:
+		k.method, k.private = jwt.SigningMethodEdDSA, key
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", private)
+	}
+
+	thumbprint, err := json.Marshal(publicJWK(k.private.Public()))
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(thumbprint)
+	k.id = base64.RawURLEncoding.EncodeToString(sum[:])
+
+	return k, nil
+}
+
+// generateKey creates a new key for the configured algorithm and stores it in
+// the key directory, if there is one. The creation time is kept as the file's
+// modification time.
+func (ks *keySet) generateKey(createdAt time.Time) (*signingKey, error) {
+	var private any
+	var err error
+	switch ks.algorithm {
+	case jwt.SigningMethodRS256.Alg():
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	default:
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	k, err := newSigningKey(private, createdAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if ks.dir != "" {
+		der, err := x509.MarshalPKCS8PrivateKey(private)
+		if err != nil {
+			return nil, err
+		}
+
+		path := filepath.Join(ks.dir, k.id+".pem")
+		if err = os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+			return nil, err
+		}
+
+		if err = os.Chtimes(path, createdAt, createdAt); err != nil {
+			return nil, err
+		}
+	}
+
+	log.Printf("Generated signing key %s", k.id)
+	return k, nil
+}
+
+// rotate generates a new key once the newest one is older than the rotation
+// period and drops keys which can no longer have valid tokens signed with them.
+func (ks *keySet) rotate() error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	now := time.Now()
+
+	if newest := ks.keys[len(ks.keys)-1]; now.Sub(newest.createdAt) >= ks.rotation {
+		k, err := ks.generateKey(now)
+		if err != nil {
+			return err
+		}
+		ks.keys = append(ks.keys, k)
+	}
+
+	// A key is retired once a newer key has been signing for longer than any
+	// token lives.
+	var kept []*signingKey
+	for i, k := range ks.keys {
+		if i+1 < len(ks.keys) && now.Sub(ks.keys[i+1].signingFrom()) > longestTokenTTL() {
+			if ks.dir != "" {
+				if err := os.Remove(filepath.Join(ks.dir, k.id+".pem")); err != nil && !errors.Is(err, os.ErrNotExist) {
+					log.Printf("Failed to remove retired key %s \n%v", k.id, err)
+				}
+			}
+			log.Printf("Retired signing key %s", k.id)
+			continue
+		}
+		kept = append(kept, k)
+	}
+	ks.keys = kept
+
+	return nil
+}
+
+// startRotation runs the rotation schedule in the background.
+func (ks *keySet) startRotation() {
+	go func() {
+		for range time.Tick(keyRotationCheckInterval) {
+			if err := ks.rotate(); err != nil {
+				log.Printf("Failed to rotate signing keys \n%v", err)
+			}
+		}
+	}()
+}
+
+// currentKey returns the newest key which is past its publish delay.
+func (ks *keySet) currentKey() *signingKey {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	now := time.Now()
+	for i := len(ks.keys) - 1; i > 0; i-- {
+		if !now.Before(ks.keys[i].signingFrom()) {
+			return ks.keys[i]
+		}
+	}
+	return ks.keys[0]
+}
+
+func (ks *keySet) lookup(kid string) *signingKey {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	for _, k := range ks.keys {
+		if k.id == kid {
+			return k
+		}
+	}
+	return nil
+}
+
+func (ks *keySet) sign(claims jwt.Claims) (string, error) {
+	k := ks.currentKey()
+
+	token := jwt.NewWithClaims(k.method, claims)
+	token.Header["kid"] = k.id
+
+	return token.SignedString(k.private)
+}
+
+func (ks *keySet) parse(tokenString string) (*jwt.Token, error) {
+	return jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+
+		k := ks.lookup(kid)
+		if k == nil {
+			return nil, errUnknownSigningKey
+		}
+
+		if token.Method.Alg() != k.method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+		}
+		return k.private.Public(), nil
+	})
+}
+
+// jwk is a public key in JSON Web Key format. The members are kept in
+// lexicographic order, so that marshalling only the required members of a key
+// gives the input of its RFC 7638 thumbprint.
+type jwk struct {
+	Alg string `json:"alg,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	E   string `json:"e,omitempty"`
+	Kid string `json:"kid,omitempty"`
+	Kty string `json:"kty"`
+	N   string `json:"n,omitempty"`
+	Use string `json:"use,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// publicJWK returns the required members of the key.
+func publicJWK(public crypto.PublicKey) jwk {
+	switch key := public.(type) {
+	case *rsa.PublicKey:
+		return jwk{
+			Kty: "RSA",
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		}
+	case ed25519.PublicKey:
+		return jwk{
+			Kty: "OKP",
+			Crv: "Ed25519",
+			X:   base64.RawURLEncoding.EncodeToString(key),
+		}
+	}
+	return jwk{}
+}
+
+// jwks returns the public part of every key that tokens may be signed with.
+func (ks *keySet) jwks() []jwk {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	keys := make([]jwk, 0, len(ks.keys))
+	for _, k := range ks.keys {
+		j := publicJWK(k.private.Public())
+		j.Kid, j.Use, j.Alg = k.id, "sig", k.method.Alg()
+		keys = append(keys, j)
+	}
+	return keys
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+func Test_keySet(t *testing.T) {
+	for _, algorithm := range []string{"EdDSA", "RS256"} {
+		t.Run(algorithm, func(t *testing.T) {
+			ks, err := loadKeySet(t.TempDir(), algorithm, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			signed, err := ks.sign(jwt.MapClaims{"email": "test@test.com"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Force a rotation, the old key must keep verifying until it is retired.
+			ks.rotation = 0
+			if err = ks.rotate(); err != nil {
+				t.Fatal(err)
+			}
+
+			if len(ks.jwks()) != 2 {
+				t.Fatalf("Expected 2 published keys, but got %d", len(ks.jwks()))
+			}
+
+			if ks.currentKey() != ks.keys[0] {
+				t.Fatalf("Expected the new key to wait for its publish delay")
+			}
+
+			token, err := ks.parse(signed)
+			if err != nil || !token.Valid {
+				t.Fatalf("Expected token to be valid, but got %v", err)
+			}
+
+			reloaded, err := loadKeySet(ks.dir, algorithm, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i, k := range reloaded.jwks() {
+				if k.Kid != ks.jwks()[i].Kid {
+					t.Fatalf("Expected key ids to survive a restart, but got %s and %s", k.Kid, ks.jwks()[i].Kid)
+				}
+			}
+		})
+	}
+}
+
+// Test_keySet_retire checks that a key keeps verifying until the longest lived
+// token signed with it has expired.
+func Test_keySet_retire(t *testing.T) {
+	ks, err := loadKeySet("", "EdDSA", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ks.rotate(); err != nil {
+		t.Fatal(err)
+	}
+	old := ks.keys[0]
+
+	// The new key has signed for longer than an access token lives.
+	ks.keys[1].createdAt = time.Now().Add(-keyPublishDelay - accessTokenTTL - time.Minute)
+	ks.rotation = time.Hour
+	if err = ks.rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if len(ks.keys) != 2 || ks.keys[0] != old {
+		t.Fatalf("Expected the old key to outlive impersonation tokens, but got %d keys", len(ks.keys))
+	}
+
+	ks.keys[1].createdAt = time.Now().Add(-keyPublishDelay - impersonationTTL - time.Minute)
+	if err = ks.rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if len(ks.keys) != 1 || ks.keys[0] == old {
+		t.Fatalf("Expected the old key to be retired, but got %d keys", len(ks.keys))
+	}
+}
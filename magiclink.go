@@ -0,0 +1,85 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// magicLinkTTL is how long an emailed login link is valid.
+const magicLinkTTL = 15 * time.Minute
+
+var errMagicLinkNotAllowed = errors.New("magic link login is not enabled for any of your roles")
+
+// magicLinkAllowed reports whether one of the person's roles allows logging in
+// with a magic link.
+func (conn dbConnection) magicLinkAllowed(personID string) (bool, error) {
+	var allowed bool
+	err := conn.db.Get(&allowed, "SELECT EXISTS(SELECT 1 FROM role WHERE name = ANY($1) AND allow_magic_link)", pq.Array(conn.getUserRoles(personID)))
+	return allowed, err
+}
+
+// sendMagicLink emails a single-use login link to the person. Unknown emails and
+// people whose roles don't allow magic links are ignored, so that the endpoint
+// doesn't tell which emails have an account.
+func (conn dbConnection) sendMagicLink(email string) error {
+	personID, err := conn.personIDByEmail(email)
+	if errors.Is(err, errPersonNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if allowed, err := conn.magicLinkAllowed(personID); err != nil || !allowed {
+		return err
+	}
+
+	code, err := conn.issueCode(purposeMagicLink, personID, magicLinkTTL)
+	if err != nil {
+		return err
+	}
+
+	tx, err := conn.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer func(tx *sql.Tx) {
+		_ = tx.Rollback()
+	}(tx)
+
+	if err = enqueueEmail(tx, magicLinkMessage(conn.frontendURL, email, code)); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func magicLinkMessage(frontendURL, email, code string) Message {
+	return Message{
+		To:      email,
+		Subject: "Technical university login link",
+		Body:    fmt.Sprintf("Log in at: %s/magic-link?code=%s\nThe link works once and expires in %d minutes.\n", frontendURL, code, int(magicLinkTTL.Minutes())),
+	}
+}
+
+// consumeMagicLink uses up the code of a magic link and returns the person it
+// was sent to. The role is checked again, it may have been changed since.
+func (conn dbConnection) consumeMagicLink(code string) (string, error) {
+	personID, err := conn.consumeCode(purposeMagicLink, code)
+	if err != nil {
+		return "", err
+	}
+
+	allowed, err := conn.magicLinkAllowed(personID)
+	if err != nil {
+		return "", err
+	}
+	if !allowed {
+		return "", errMagicLinkNotAllowed
+	}
+	return personID, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// requestMagicLink asks for a magic link for the email and returns the code
+// emailed to it.
+func requestMagicLink(t *testing.T, s testServer, email string) string {
+	t.Helper()
+
+	if status := s.do(http.MethodPost, "/login/magic-link", `{"Email":"`+email+`"}`, "", nil); status != http.StatusOK {
+		t.Fatalf("Expected the magic link to be requested, but got %d", status)
+	}
+	return emailedCode(t, s.db, email)
+}
+
+func Test_magicLink_roles(t *testing.T) {
+	s := newTestServer(t, testConfig())
+
+	// The student role doesn't allow magic links, so nothing is sent, but the
+	// answer is the same.
+	if status := s.do(http.MethodPost, "/login/magic-link", `{"Email":"test1@test.com"}`, "", nil); status != http.StatusOK {
+		t.Fatalf("Expected the same answer as for allowed roles, but got %d", status)
+	}
+	for _, v := range s.db.outbox {
+		if v.Recipient == "test1@test.com" {
+			t.Fatalf("Expected no magic link for a role without AllowMagicLink, but got %s", v.body)
+		}
+	}
+
+	s.db.roles["Student"].AllowMagicLink = true
+	code := requestMagicLink(t, s, "test1@test.com")
+
+	// The role is checked again when the link is used.
+	s.db.roles["Student"].AllowMagicLink = false
+	var p problem
+	if status := s.do(http.MethodPost, "/login/magic-link/verify", `{"Code":"`+code+`"}`, "", &p); status != http.StatusForbidden || p.Code != "magic_link_not_allowed" {
+		t.Fatalf("Expected the link to be refused after the role changed, but got %d %s", status, p.Code)
+	}
+}
+
+func Test_magicLink_singleUse(t *testing.T) {
+	s := newTestServer(t, testConfig())
+	s.db.roles["Student"].AllowMagicLink = true
+	code := requestMagicLink(t, s, "test1@test.com")
+
+	var tokens tokenPair
+	if status := s.do(http.MethodPost, "/login/magic-link/verify", `{"Code":"`+code+`"}`, "", &tokens); status != http.StatusOK || tokens.Token == "" {
+		t.Fatalf("Expected the link to log in, but got %d", status)
+	}
+
+	var p problem
+	if status := s.do(http.MethodPost, "/login/magic-link/verify", `{"Code":"`+code+`"}`, "", &p); status != http.StatusUnauthorized {
+		t.Fatalf("Expected a used link to be refused, but got %d %s", status, p.Code)
+	}
+}
+
+// Test_magicLink_throttled checks that a throttled account doesn't use up the
+// code of its link.
+func Test_magicLink_throttled(t *testing.T) {
+	cfg := testConfig()
+	s := newTestServer(t, cfg)
+	s.db.roles["Student"].AllowMagicLink = true
+	code := requestMagicLink(t, s, "test1@test.com")
+
+	for i := 0; i <= cfg.Login.FreeAttempts; i++ {
+		s.do(http.MethodPost, "/login", `{"Email":"test1@test.com","Password":"wrong_pas_123"}`, "", nil)
+	}
+
+	var p problem
+	if status := s.do(http.MethodPost, "/login/magic-link/verify", `{"Code":"`+code+`"}`, "", &p); status != http.StatusTooManyRequests {
+		t.Fatalf("Expected the login to be throttled, but got %d %s", status, p.Code)
+	}
+
+	if err := s.db.unlockLogin(throttleAccount, "test1@test.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.db.unlockLogin(throttleIP, "192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+	if status := s.do(http.MethodPost, "/login/magic-link/verify", `{"Code":"`+code+`"}`, "", nil); status != http.StatusOK {
+		t.Fatalf("Expected the link to still work, but got %d", status)
+	}
+}
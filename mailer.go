@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dchest/uniuri"
+)
+
+// Message is a plain text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers messages. The backend is picked by mail.backend in the config.
+type Mailer interface {
+	Send(m Message) error
+}
+
+func newMailer(cfg mailConfig, smtpCfg smtpConfig) (Mailer, error) {
+	switch cfg.Backend {
+	case "smtp":
+		return smtpMailer{from: cfg.From, cfg: smtpCfg}, nil
+	case "file":
+		return newFileMailer(cfg.Dir, cfg.From)
+	case "console":
+		return consoleMailer{from: cfg.From}, nil
+	case "memory":
+		return &memoryMailer{}, nil
+	}
+	return nil, fmt.Errorf("unknown mail backend %q", cfg.Backend)
+}
+
+// render returns the message in RFC 5322 format. The recipient is parsed, so a
+// malformed address can't inject headers.
+func (m Message) render(from string) ([]byte, error) {
+	to, err := mail.ParseAddress(m.To)
+	if err != nil {
+		return nil, fmt.Errorf("invalid recipient %q: %w", m.To, err)
+	}
+
+	fromAddr, err := mail.ParseAddress(from)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sender %q: %w", from, err)
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", fromAddr)
+	fmt.Fprintf(&b, "To: %s\r\n", to)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <%s@%s>\r\n", uniuri.NewLen(24), domain(fromAddr.Address))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(strings.ReplaceAll(m.Body, "\r\n", "\n"), "\n", "\r\n"))
+	return b.Bytes(), nil
+}
+
+func domain(address string) string {
+	return address[strings.LastIndex(address, "@")+1:]
+}
+
+// smtpMailer sends through an SMTP server. With the starttls mode the connection
+// is upgraded before authenticating, tls connects over TLS right away (usually
+// port 465) and none never encrypts, which is only meant for local relays.
+type smtpMailer struct {
+	from string
+	cfg  smtpConfig
+}
+
+func (s smtpMailer) Send(m Message) error {
+	msg, err := m.render(s.from)
+	if err != nil {
+		return err
+	}
+	to, _ := mail.ParseAddress(m.To)
+	from, _ := mail.ParseAddress(s.from)
+
+	addr := net.JoinHostPort(s.cfg.Host, strconv.Itoa(s.cfg.Port))
+	tlsConfig := &tls.Config{ServerName: s.cfg.Host}
+
+	var conn net.Conn
+	if s.cfg.TLS == "tls" {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: 30 * time.Second}, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = net.DialTimeout("tcp", addr, 30*time.Second)
+	}
+	if err != nil {
+		return err
+	}
+
+	c, err := smtp.NewClient(conn, s.cfg.Host)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	defer func() {
+		_ = c.Close()
+	}()
+
+	if s.cfg.TLS == "starttls" {
+		if err = c.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+
+	if s.cfg.Username != "" {
+		if err = c.Auth(smtp.PlainAuth("", s.cfg.Username, s.cfg.Password, s.cfg.Host)); err != nil {
+			return err
+		}
+	}
+
+	if err = c.Mail(from.Address); err != nil {
+		return err
+	}
+	if err = c.Rcpt(to.Address); err != nil {
+		return err
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// fileMailer drops every message into a maildir, so that local mail clients can
+// read them. Files are written to tmp and moved to new once complete.
+type fileMailer struct {
+	dir  string
+	from string
+}
+
+func newFileMailer(dir, from string) (fileMailer, error) {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o700); err != nil {
+			return fileMailer{}, err
+		}
+	}
+	return fileMailer{dir: dir, from: from}, nil
+}
+
+func (f fileMailer) Send(m Message) error {
+	msg, err := m.render(f.from)
+	if err != nil {
+		return err
+	}
+
+	host, _ := os.Hostname()
+	name := fmt.Sprintf("%d.%s.%s", time.Now().UnixNano(), uniuri.NewLen(8), host)
+
+	tmp := filepath.Join(f.dir, "tmp", name)
+	if err = os.WriteFile(tmp, msg, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(f.dir, "new", name))
+}
+
+// consoleMailer writes messages to the log instead of sending them.
+type consoleMailer struct {
+	from string
+}
+
+func (c consoleMailer) Send(m Message) error {
+	msg, err := m.render(c.from)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Mail to %s:\n%s", m.To, msg)
+	return nil
+}
+
+// memoryMailer keeps sent messages in memory for tests.
+type memoryMailer struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+func (mm *memoryMailer) Send(m Message) error {
+	if _, err := mail.ParseAddress(m.To); err != nil {
+		return fmt.Errorf("invalid recipient %q: %w", m.To, err)
+	}
+
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+
+	mm.messages = append(mm.messages, m)
+	return nil
+}
+
+// sent returns the messages sent so far.
+func (mm *memoryMailer) sent() []Message {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+
+	return append([]Message(nil), mm.messages...)
+}
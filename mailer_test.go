@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_Message_render(t *testing.T) {
+	msg, err := Message{To: "student@example.com", Subject: "Hi\r\nBcc: evil@example.com", Body: "line 1\nline 2"}.render("Report Card <no-reply@example.com>")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := string(msg)
+	for _, want := range []string{"From: \"Report Card\" <no-reply@example.com>\r\n", "To: <student@example.com>\r\n", "\r\n\r\nline 1\r\nline 2"} {
+		if !strings.Contains(s, want) {
+			t.Fatalf("Expected %q in %s", want, s)
+		}
+	}
+	if strings.Contains(s, "\r\nBcc:") {
+		t.Fatalf("Expected the subject to be encoded, but got %s", s)
+	}
+
+	if _, err = (Message{To: "a@b.c\r\nBcc: evil@example.com"}).render("no-reply@example.com"); err == nil {
+		t.Fatal("Expected an invalid recipient to be rejected")
+	}
+}
+
+func Test_fileMailer(t *testing.T) {
+	dir := t.TempDir()
+	m, err := newMailer(mailConfig{Backend: "file", Dir: dir, From: "no-reply@example.com"}, smtpConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = m.Send(Message{To: "student@example.com", Subject: "Password", Body: "code"}); err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "new", "*"))
+	if len(files) != 1 {
+		t.Fatalf("Expected one message in the maildir, but got %d", len(files))
+	}
+	b, _ := os.ReadFile(files[0])
+	if !strings.Contains(string(b), "To: <student@example.com>") {
+		t.Fatalf("Expected the message to be addressed to the student, but got %s", b)
+	}
+}
+
+func Test_smtpMailer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	received := make(chan []string, 1)
+	go fakeSMTPServer(l, received)
+
+	port := l.Addr().(*net.TCPAddr).Port
+	m := smtpMailer{from: "no-reply@example.com", cfg: smtpConfig{Host: "127.0.0.1", Port: port, TLS: "none"}}
+	if err = m.Send(Message{To: "student@example.com", Subject: "Password", Body: "code"}); err != nil {
+		t.Fatal(err)
+	}
+
+	commands := strings.Join(<-received, "\n")
+	if !strings.Contains(commands, "RCPT TO:<student@example.com>") {
+		t.Fatalf("Expected the message to go to the student, but got %s", commands)
+	}
+}
+
+// fakeSMTPServer accepts one session and reports the commands it received.
+func fakeSMTPServer(l net.Listener, received chan<- []string) {
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	reply := func(s string) {
+		_, _ = conn.Write([]byte(s + "\r\n"))
+	}
+
+	var commands []string
+	reply("220 localhost ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			break
+		}
+		line = strings.TrimRight(line, "\r\n")
+		commands = append(commands, line)
+
+		switch cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); cmd {
+		case "EHLO", "HELO", "MAIL", "RCPT":
+			reply("250 OK")
+		case "DATA":
+			reply("354 go ahead")
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil || l == ".\r\n" {
+					break
+				}
+			}
+			reply("250 queued")
+		case "QUIT":
+			reply("221 bye")
+			received <- commands
+			return
+		default:
+			reply("502 not implemented")
+		}
+	}
+	received <- commands
+}
@@ -1,25 +1,110 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"time"
 
-	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
 )
 
+const usage = `usage: virtual-student-report-card [flags] [command]
+
+commands:
+  serve                    start the API server (default)
+  migrate up [n]           apply all or the next n pending migrations
+  migrate down [n]         roll back the last n migrations (default 1)
+  migrate status           list migrations and their state
+  migrate force <version>  clear the dirty flag of a fixed migration
+  seed <set|file.sql>      load a fixture set (minimal, demo, load-test) or file
+  admin <command>          manage people and data from scripts, see admin help
+
+flags:
+  -config <file>           JSON config file (env CONFIG_FILE)
+  -print-config            print the config with secrets redacted and exit
+  -<path> <value>          override a config setting, e.g. -db.host, -server.addr`
+
 func main() {
-	if err := godotenv.Load(); err != nil {
-		log.Fatalf("Error loading .env file \n%e", err)
+	cfg, args, err := loadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	command := "serve"
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
+
+	switch command {
+	case "serve":
+		serve(cfg)
+	case "migrate":
+		db, err := openDatabase(cfg.DB)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err = runMigrateCommand(db, args); err != nil {
+			log.Fatal(err)
+		}
+	case "seed":
+		if len(args) != 1 {
+			fmt.Println(usage)
+			os.Exit(2)
+		}
+
+		db, err := openDatabase(cfg.DB)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err = seed(db, cfg.Env, args[0]); err != nil {
+			log.Fatal(err)
+		}
+	case "admin":
+		if len(args) > 0 && args[0] == "help" {
+			fmt.Println(adminUsage)
+			return
+		}
+
+		err = runAdminCommand(adminEnv{cfg: cfg, stdin: os.Stdin, out: os.Stdout}, args)
+		if err != nil {
+			writeAdminError(os.Stderr, err)
+			if errors.Is(err, errAdminUsage) {
+				fmt.Fprintln(os.Stderr, adminUsage)
+				os.Exit(2)
+			}
+			os.Exit(1)
+		}
+	default:
+		fmt.Println(usage)
+		os.Exit(2)
+	}
+}
+
+func serve(cfg config) {
+	db, err := createDatabaseConnection(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	keys, err := loadKeySet(cfg.Auth.JWTKeyDir, cfg.Auth.JWTAlgorithm, time.Duration(cfg.Auth.JWTKeyRotation))
+	if err != nil {
+		log.Fatal(err)
 	}
+	keys.startRotation()
 
-	db, err := createDatabaseConnection()
+	mailer, err := newMailer(cfg.Mail, cfg.SMTP)
 	if err != nil {
 		log.Fatal(err)
 	}
+	outboxDispatcher{db: db.db, mailer: mailer, cfg: cfg.Outbox}.start()
 
-	mainHandler := setupHandler(db)
-	if err = http.ListenAndServe(":8080", mainHandler); err != nil {
+	mainHandler := setupHandler(db, keys, cfg)
+	if err = http.ListenAndServe(cfg.Server.Addr, mainHandler); err != nil {
 		panic(err)
 	}
 }
@@ -2,179 +2,312 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"io"
-	"log"
 	"net/http"
 	"net/http/httptest"
-	"os"
 	"strings"
 	"testing"
+	"time"
 
-	"github.com/joho/godotenv"
+	"golang.org/x/crypto/bcrypt"
 )
 
+// The people of the demo fixtures.
+const (
+	demoAdminID   = "00000000-0000-0000-0000-00000000f001"
+	demoStudentID = "00000000-0000-0000-0000-00000000f002"
+	demoTeacherID = "00000000-0000-0000-0000-00000000f003"
+)
+
+func testConfig() config {
+	cfg := defaultConfig()
+	// The lowest cost keeps hashing the passwords fast.
+	cfg.Password.BcryptCost = bcrypt.MinCost
+	return cfg
+}
+
+// newDemoStore returns a memory store with the records of fixtures/demo.sql.
+// Every password is test_pas_123.
+func newDemoStore(t *testing.T, cfg config) *memoryStore {
+	s, err := newMemoryStore(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.people = []*memoryPerson{
+		{id: demoAdminID, name: "ivan", phone: "0881234563", email: "test@test.com"},
+		{id: demoStudentID, name: "ivan1", phone: "0881234564", email: "test1@test.com"},
+		{id: demoTeacherID, name: "ivan2", phone: "0881234565", email: "test2@test.com"},
+	}
+	s.admins = []*memoryMember{{id: "00000000-0000-0000-0000-00000000a001", personID: demoAdminID, active: true}}
+	s.students = []*memoryMember{{id: "00000000-0000-0000-0000-00000000b001", personID: demoStudentID, facultyNumber: "12312312", active: true}}
+	s.teachers = []*memoryMember{{id: "00000000-0000-0000-0000-00000000c001", personID: demoTeacherID, active: true}}
+	s.courses = []*memoryCourse{
+		{Course: Course{Id: "00000000-0000-0000-0000-00000000d001", TeacherId: "00000000-0000-0000-0000-00000000c001", Name: "Math", NumberOfSeats: 50}},
+		{Course: Course{Id: "00000000-0000-0000-0000-00000000d002", TeacherId: "00000000-0000-0000-0000-00000000c001", Name: "Programming Basics", NumberOfSeats: 50}},
+		{Course: Course{Id: "00000000-0000-0000-0000-00000000d003", TeacherId: "00000000-0000-0000-0000-00000000c001", Name: "Physics", NumberOfSeats: 50}},
+	}
+	s.exams = []*memoryExam{
+		{courseID: "00000000-0000-0000-0000-00000000d001", facultyNumber: "12312312", points: 56},
+		{courseID: "00000000-0000-0000-0000-00000000d003", facultyNumber: "12312312", points: 88},
+		{courseID: "00000000-0000-0000-0000-00000000d002", facultyNumber: "12312312", points: 67},
+	}
+
+	for _, v := range s.people {
+		if err = s.savePassword(v.id, "test_pas_123"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s
+}
+
+// authenticate gives the request the access token of a new session of the person.
+func authenticate(t *testing.T, h handler, r *http.Request, personID string) {
+	sessionID, _, err := h.db.createSession(personID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := h.issueAccessToken(personID, sessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Authorization", "Bearer "+token)
+}
+
+// testServer serves the API from a demo store.
+type testServer struct {
+	t    *testing.T
+	db   *memoryStore
+	keys *keySet
+	http http.Handler
+}
+
+func newTestServer(t *testing.T, cfg config) testServer {
+	keys, err := loadKeySet(t.TempDir(), cfg.Auth.JWTAlgorithm, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := newDemoStore(t, cfg)
+	return testServer{t: t, db: db, keys: keys, http: setupHandler(db, keys, cfg)}
+}
+
+// do serves a request with the JSON body, authenticated as the person unless
+// personID is empty. The response is decoded into v unless it is nil.
+func (s testServer) do(method, target, body, personID string, v any) int {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if personID != "" {
+		authenticate(s.t, handler{keys: s.keys, db: s.db}, r, personID)
+	}
+	return s.serve(r, v)
+}
+
+// serve serves the request and decodes the JSON response into v unless it is nil.
+func (s testServer) serve(r *http.Request, v any) int {
+	w := httptest.NewRecorder()
+	s.http.ServeHTTP(w, r)
+
+	if v != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			s.t.Fatalf("%s %s answered %d with %s: %v", r.Method, r.URL.Path, w.Code, w.Body, err)
+		}
+	}
+	return w.Code
+}
+
+// withToken serves a request with the access token.
+func (s testServer) withToken(method, target, body, token string, v any) int {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+token)
+	return s.serve(r, v)
+}
+
 func Test_main(t *testing.T) {
-	if err := godotenv.Load(); err != nil {
-		log.Fatalf("Error loading .env file \n%e", err)
+	cfg := testConfig()
+	keys, err := loadKeySet(t.TempDir(), cfg.Auth.JWTAlgorithm, time.Hour)
+	if err != nil {
+		t.Fatal(err)
 	}
+	people := map[string]string{"admin": demoAdminID, "student": demoStudentID, "teacher": demoTeacherID}
 
 	tests := []struct {
 		name               string
 		req                *http.Request
+		auth               string // admin, student, teacher or "" for none
 		expectedStatusCode int
 		expectedBody       []byte
 	}{
 		{
 			"Unsuccessful auth",
 			httptest.NewRequest(http.MethodPost, "/login", nil),
+			"",
+			http.StatusBadRequest,
+			[]byte(`{"type":"about:blank","title":"Bad Request","status":400,"detail":"content must be provided in request body","instance":"/login","code":"empty_body"}`),
+		},
+		{
+			"Empty password",
+			httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(`{ "Email":"test@test.com", "Password": ""}`)),
+			"",
 			http.StatusBadRequest,
-			[]byte(`{"message":"Invalid body"}`),
+			[]byte(`{"type":"about:blank","title":"Bad Request","status":400,"detail":"Email or password is empty","instance":"/login","code":"login_empty"}`),
+		},
+		{
+			"Wrong password",
+			httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(`{ "Email":"test@test.com", "Password": "wrong_pas_123"}`)),
+			"",
+			http.StatusUnauthorized,
+			[]byte(`{"type":"about:blank","title":"Unauthorized","status":401,"detail":"Incorrect email or password","instance":"/login","code":"login_failed"}`),
 		},
 		{
 			"Successful auth",
 			httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(`{ "Email":"test@test.com", "Password": "test_pas_123"}`)),
+			"",
 			http.StatusOK,
 			nil,
 		},
 		{
 			"Get student exams without auth",
-			httptest.NewRequest(http.MethodGet, "/student/exams", nil),
-			http.StatusForbidden,
-			[]byte(`{"message":"unauthorized"}`),
+			httptest.NewRequest(http.MethodGet, "/exams", nil),
+			"",
+			http.StatusUnauthorized,
+			[]byte(`{"type":"about:blank","title":"Unauthorized","status":401,"detail":"unauthorized","instance":"/exams","code":"invalid_token"}`),
 		},
 		{
 			"Get student exams",
-			requestWithAuth(http.MethodGet, "/student/exams", nil, "student"),
+			httptest.NewRequest(http.MethodGet, "/students/12312312/exams", nil),
+			"student",
 			http.StatusOK,
-			[]byte(`[{"StudentName":"ivan1","StudentFacultyNumber":"","CourseName":"Math","Points":56},{"StudentName":"ivan1","StudentFacultyNumber":"","CourseName":"Programming Basics","Points":67},{"StudentName":"ivan1","StudentFacultyNumber":"","CourseName":"Physics","Points":88}]`),
+			[]byte(`[{"StudentName":"ivan1","StudentFacultyNumber":"12312312","CourseName":"Math","Points":56},{"StudentName":"ivan1","StudentFacultyNumber":"12312312","CourseName":"Physics","Points":88},{"StudentName":"ivan1","StudentFacultyNumber":"12312312","CourseName":"Programming Basics","Points":67}]`),
 		},
 		{
 			"Unauthorised access teacher",
-			requestWithAuth(http.MethodGet, "/teacher/courses", nil, "student"),
+			httptest.NewRequest(http.MethodGet, "/courses", nil),
+			"student",
 			http.StatusForbidden,
-			[]byte(`{"message":"unauthorized"}`),
+			[]byte(`{"type":"about:blank","title":"Forbidden","status":403,"detail":"unauthorized","instance":"/courses","code":"missing_permission"}`),
 		},
 		{
 			"Unauthorised access teacher",
-			requestWithAuth(http.MethodGet, "/teacher/students", nil, "student"),
+			httptest.NewRequest(http.MethodGet, "/students", nil),
+			"student",
 			http.StatusForbidden,
-			[]byte(`{"message":"unauthorized"}`),
+			[]byte(`{"type":"about:blank","title":"Forbidden","status":403,"detail":"unauthorized","instance":"/students","code":"missing_permission"}`),
 		},
 		{
 			"Get teacher courses",
-			requestWithAuth(http.MethodGet, "/teacher/courses", nil, "teacher"),
+			httptest.NewRequest(http.MethodGet, "/courses", nil),
+			"teacher",
 			http.StatusOK,
-			[]byte(`["Math","Programming Basics","Physics"]`),
+			[]byte(`[{"Id":"00000000-0000-0000-0000-00000000d001","TeacherId":"00000000-0000-0000-0000-00000000c001","TeacherName":"ivan2","Name":"Math","NumberOfSeats":50},{"Id":"00000000-0000-0000-0000-00000000d002","TeacherId":"00000000-0000-0000-0000-00000000c001","TeacherName":"ivan2","Name":"Programming Basics","NumberOfSeats":50},{"Id":"00000000-0000-0000-0000-00000000d003","TeacherId":"00000000-0000-0000-0000-00000000c001","TeacherName":"ivan2","Name":"Physics","NumberOfSeats":50}]`),
 		},
 		{
 			"Get teacher students",
-			requestWithAuth(http.MethodGet, "/teacher/students", nil, "teacher"),
+			httptest.NewRequest(http.MethodGet, "/students", nil),
+			"teacher",
 			http.StatusOK,
 			[]byte(`["12312312"]`),
 		},
+		{
+			"Get admin students",
+			httptest.NewRequest(http.MethodGet, "/students", nil),
+			"admin",
+			http.StatusOK,
+			[]byte(`[{"ID":"00000000-0000-0000-0000-00000000f002","FacultyNumber":"12312312","Name":"ivan1","Phone":"0881234564","Email":"test1@test.com"}]`),
+		},
 		{
 			"Post exam with empty body",
-			requestWithAuth(http.MethodPost, "/teacher/exams", nil, "teacher"),
+			httptest.NewRequest(http.MethodPost, "/exams", nil),
+			"teacher",
 			http.StatusBadRequest,
-			[]byte(`{"message":"content must be provided in request body"}`),
+			[]byte(`{"type":"about:blank","title":"Bad Request","status":400,"detail":"content must be provided in request body","instance":"/exams","code":"empty_body"}`),
 		},
 		{
 			"Post exam success",
-			requestWithAuth(http.MethodPost, "/teacher/exams", strings.NewReader(`{ "StudentFacultyNumber":"12312312", "CourseName": "Math", "Points": 42}`), "teacher"),
+			httptest.NewRequest(http.MethodPost, "/exams", strings.NewReader(`{ "StudentFacultyNumber":"12312312", "CourseName": "Math", "Points": 42}`)),
+			"teacher",
 			http.StatusOK,
 			[]byte(`{"message":"success"}`),
 		},
 		{
 			"Post exam success1",
-			requestWithAuth(http.MethodPost, "/teacher/exams", strings.NewReader(`{"CourseName":"Math","StudentFacultyNumber":"12312312","Points":34}`), "teacher"),
+			httptest.NewRequest(http.MethodPost, "/exams", strings.NewReader(`{"CourseName":"Math","StudentFacultyNumber":"12312312","Points":34}`)),
+			"teacher",
 			http.StatusOK,
 			[]byte(`{"message":"success"}`),
 		},
 		{
 			"Post student success",
-			requestWithAuth(http.MethodPost, "/admin/students", strings.NewReader(`{"Name": "ivan3", "Email": "test3@test.com", "Phone": "0881234567"}`), "admin"),
+			httptest.NewRequest(http.MethodPost, "/students", strings.NewReader(`{"Name": "ivan3", "Email": "test3@test.com", "Phone": "0881234567"}`)),
+			"admin",
 			http.StatusOK,
 			[]byte(`{"message":"success"}`),
 		},
 		{
 			"Post teacher success",
-			requestWithAuth(http.MethodPost, "/admin/teachers", strings.NewReader(`{"Name": "ivan3", "Email": "test3@test.com", "Phone": "0881234567"}`), "admin"),
+			httptest.NewRequest(http.MethodPost, "/teachers", strings.NewReader(`{"Name": "ivan3", "Email": "test3@test.com", "Phone": "0881234567"}`)),
+			"admin",
 			http.StatusOK,
 			[]byte(`{"message":"success"}`),
 		},
 		{
 			"Get teachers",
-			requestWithAuth(http.MethodGet, "/admin/teachers", nil, "admin"),
+			httptest.NewRequest(http.MethodGet, "/teachers", nil),
+			"admin",
 			http.StatusOK,
-			[]byte(`["test2@test.com"]`),
+			[]byte(`[{"ID":"00000000-0000-0000-0000-00000000f003","Name":"ivan2","Phone":"0881234565","Email":"test2@test.com"}]`),
 		},
 		{
 			"Post student with empty data",
-			requestWithAuth(http.MethodPost, "/admin/students", strings.NewReader(`{"Name":"","Email":"","Phone":""}`), "admin"),
+			httptest.NewRequest(http.MethodPost, "/students", strings.NewReader(`{"Name":"","Email":"","Phone":""}`)),
+			"admin",
 			http.StatusBadRequest,
-			[]byte(`{"message":"something went wrong"}`),
-		},
-		{
-			"Get user basic info based on role",
-			requestWithAuth(http.MethodGet, "/admin/users?role=teacher", nil, "admin"),
-			http.StatusOK,
-			[]byte(`[{"Name":"ivan2","Phone":"0881234565","Email":"test2@test.com"}]`),
-		},
-		{
-			"Get user basic info based on role",
-			requestWithAuth(http.MethodGet, "/admin/users?role=student", nil, "admin"),
-			http.StatusOK,
-			[]byte(`[{"FacultyNumber":"12312312","Name":"ivan1","Phone":"0881234564","Email":"test1@test.com"}]`),
+			[]byte(`{"type":"about:blank","title":"Bad Request","status":400,"detail":"the request has invalid fields","instance":"/students","code":"validation_failed","errors":[{"field":"Name","message":"is required"},{"field":"Email","message":"is required"}]}`),
 		},
 		{
 			"Archive student",
-			requestWithAuth(http.MethodDelete, "/admin/users?role=student&email=test1%40test.com", nil, "admin"),
+			httptest.NewRequest(http.MethodDelete, "/students/12312312", nil),
+			"admin",
 			http.StatusOK,
 			[]byte(`{"message":"success"}`),
 		},
 		{
 			"Archive course",
-			requestWithAuth(http.MethodDelete, "/admin/courses?CourseName=Math", nil, "admin"),
+			httptest.NewRequest(http.MethodDelete, "/courses/00000000-0000-0000-0000-00000000d001", nil),
+			"admin",
 			http.StatusOK,
 			[]byte(`{"message":"success"}`),
 		},
 		{
 			"Forgotten password",
-			httptest.NewRequest(http.MethodPost, "/forgotten-password?email=test1%40test.com", nil),
+			httptest.NewRequest(http.MethodPost, "/forgotten-password", strings.NewReader(`{"Email":"test1@test.com"}`)),
+			"",
 			http.StatusOK,
 			[]byte(`{"message":"success"}`),
 		},
 		{
 			"Change password",
-			requestWithAuth(http.MethodPost, "/change-password", strings.NewReader(`{"OldPassword":"test_pas_123","NewPassword":"new_test_pas_123"}`), "admin"),
+			httptest.NewRequest(http.MethodPost, "/change-password", strings.NewReader(`{"OldPassword":"test_pas_123","NewPassword":"new_test_pas_123"}`)),
+			"admin",
 			http.StatusOK,
 			[]byte(`{"message":"success"}`),
 		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			db, err := createDatabaseConnection()
-			if err != nil {
-				log.Fatal(err)
+			db := newDemoStore(t, cfg)
+			if test.auth != "" {
+				authenticate(t, handler{keys: keys, db: db}, test.req, people[test.auth])
 			}
 
-			h := setupHandler(db)
-
 			respRec := httptest.NewRecorder()
-
-			h.ServeHTTP(respRec, test.req)
+			setupHandler(db, keys, cfg).ServeHTTP(respRec, test.req)
 
 			if respRec.Result().StatusCode != test.expectedStatusCode {
 				t.Fatalf("Expected response %d, but got %d", test.expectedStatusCode, respRec.Result().StatusCode)
 			}
 
-			defer func(Body io.ReadCloser) {
-				err = Body.Close()
-				if err != nil {
-
-				}
-			}(respRec.Result().Body)
-
 			if test.expectedBody == nil {
 				return
 			}
@@ -184,22 +317,9 @@ func Test_main(t *testing.T) {
 				t.Fatal(err)
 			}
 
-			if bytes.Compare(body, test.expectedBody) != 0 {
+			if !bytes.Equal(body, test.expectedBody) {
 				t.Fatalf("Expected response %s, but got %s", test.expectedBody, body)
 			}
 		})
 	}
 }
-
-func requestWithAuth(method, target string, body io.Reader, authLevel string) *http.Request {
-	r := httptest.NewRequest(method, target, body)
-	switch authLevel {
-	case "student":
-		r.Header.Add("Authorization", os.Getenv("TOKEN_STUDENT"))
-	case "teacher":
-		r.Header.Add("Authorization", os.Getenv("TOKEN_TEACHER"))
-	default:
-		r.Header.Add("Authorization", os.Getenv("TOKEN_ADMIN"))
-	}
-	return r
-}
@@ -0,0 +1,1647 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+	"net/mail"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/lib/pq"
+)
+
+// memoryStore keeps every record in memory with the semantics of dbConnection:
+// courses and exams are soft deleted, archived students and teachers keep their
+// records but lose their role, and violated constraints return the errors
+// Postgres would. It lets the handler be tested without Postgres or Redis.
+type memoryStore struct {
+	codes       CodeStore
+	frontendURL string
+	login       loginConfig
+	passwords   passwordPolicy
+
+	mu       sync.Mutex
+	people   []*memoryPerson
+	admins   []*memoryMember
+	students []*memoryMember
+	teachers []*memoryMember
+	courses  []*memoryCourse
+	exams    []*memoryExam
+	roles    map[string]*Role
+	sessions map[string]*memorySession
+	// refreshTokens and throttles are keyed like their unique columns, the
+	// hash of the token and the kind and key of the throttle.
+	refreshTokens   map[string]*memoryRefreshToken
+	throttles       map[string]*memoryThrottle
+	outbox          []*memoryEmail
+	impersonations  []*memoryImpersonation
+	serviceAccounts []*memoryServiceAccount
+}
+
+type memoryPerson struct {
+	id       string
+	name     string
+	email    string
+	phone    string
+	password string
+	// passwordHistory holds the hashes of the recent passwords, the latest last.
+	passwordHistory []string
+	totpSecret      string
+	totpEnabled     bool
+	totpLastStep    int64
+	// recoveryCodes maps the hashes of the recovery codes to whether they were used.
+	recoveryCodes map[string]bool
+	// roles are the assigned custom roles.
+	roles []string
+}
+
+// memoryMember is an admin, student or teacher record of a person.
+type memoryMember struct {
+	id            string
+	personID      string
+	facultyNumber string
+	active        bool
+}
+
+// memoryCourse refers to its teacher by the id of the teacher record, as the
+// course table does. TeacherName is filled in when it is read.
+type memoryCourse struct {
+	Course
+	deleted bool
+}
+
+type memoryExam struct {
+	courseID      string
+	facultyNumber string
+	points        int
+	deleted       bool
+}
+
+type memorySession struct {
+	personID string
+	revoked  bool
+}
+
+type memoryRefreshToken struct {
+	sessionID string
+	used      bool
+	expiresAt time.Time
+}
+
+type memoryThrottle struct {
+	Lockout
+	lastFailureAt time.Time
+}
+
+type memoryEmail struct {
+	OutboxEmail
+	body string
+}
+
+type memoryImpersonation struct {
+	Impersonation
+	actorID   string
+	subjectID string
+	requests  []ImpersonatedRequest
+}
+
+type memoryServiceAccount struct {
+	ServiceAccount
+	keys []*memoryAPIKey
+}
+
+type memoryAPIKey struct {
+	APIKey
+	hash string
+}
+
+func newMemoryStore(cfg config) (*memoryStore, error) {
+	passwords, err := newPasswordPolicy(cfg.Password)
+	if err != nil {
+		return nil, err
+	}
+
+	return &memoryStore{
+		codes:       newMemoryCodeStore(),
+		frontendURL: cfg.FrontendURL,
+		login:       cfg.Login,
+		passwords:   passwords,
+		// The built-in roles with the permissions the migrations grant them.
+		roles: map[string]*Role{
+			"Admin": {Name: "Admin", Builtin: true, Permissions: []string{
+				permExamRead, permExamWriteAny, permCourseManage, permStudentRead, permStudentManage, permTeacherManage, permUserRead, permUserArchive,
+				permRoleManage, permMailManage, permLoginUnlock, permImpersonate, permAuditRead, permServiceManage,
+			}},
+			"Teacher": {Name: "Teacher", Builtin: true, Permissions: []string{permExamReadLed, permExamWrite, permCourseReadOwn, permStudentRead}},
+			"Student": {Name: "Student", Builtin: true, Permissions: []string{permExamReadOwn}},
+		},
+		sessions:      map[string]*memorySession{},
+		refreshTokens: map[string]*memoryRefreshToken{},
+		throttles:     map[string]*memoryThrottle{},
+	}, nil
+}
+
+// personEmailCheck is the check constraint of person.email.
+var personEmailCheck = regexp.MustCompile(`^[A-Za-z0-9._%-]+@[A-Za-z0-9.-]+[.][A-Za-z]+$`)
+
+// uniqueViolation, foreignKeyViolation and checkViolation return the errors
+// Postgres returns for violated constraints, so that they are answered the same.
+// Only constraints the migrations declare are emulated, which
+// Test_memoryStore_uniqueConstraints checks for the unique ones.
+func uniqueViolation(columns, values string) error {
+	return &pq.Error{Code: "23505", Detail: fmt.Sprintf("Key (%s)=(%s) already exists.", columns, values)}
+}
+
+func foreignKeyViolation(column, value, table string) error {
+	return &pq.Error{Code: "23503", Detail: fmt.Sprintf("Key (%s)=(%s) is not present in table %q.", column, value, table)}
+}
+
+func checkViolation(table, column string) error {
+	return &pq.Error{Code: "23514", Table: table, Constraint: table + "_" + column + "_check"}
+}
+
+// newUUID returns a random UUID like gen_random_uuid does.
+func newUUID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// The helpers below expect s.mu to be held.
+
+func (s *memoryStore) personByID(id string) *memoryPerson {
+	for _, v := range s.people {
+		if v.id == id {
+			return v
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) personByEmail(email string) *memoryPerson {
+	for _, v := range s.people {
+		if v.email == email {
+			return v
+		}
+	}
+	return nil
+}
+
+func memberOf(members []*memoryMember, personID string) *memoryMember {
+	for _, v := range members {
+		if v.personID == personID {
+			return v
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) teacherByID(id string) *memoryMember {
+	for _, v := range s.teachers {
+		if v.id == id {
+			return v
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) studentByFacultyNumber(facultyNumber string) *memoryMember {
+	for _, v := range s.students {
+		if v.facultyNumber == facultyNumber {
+			return v
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) courseByID(id string) *memoryCourse {
+	for _, v := range s.courses {
+		if v.Id == id {
+			return v
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) enqueueEmail(m Message) {
+	s.outbox = append(s.outbox, &memoryEmail{
+		OutboxEmail: OutboxEmail{ID: int64(len(s.outbox) + 1), Recipient: m.To, Subject: m.Subject, CreatedAt: time.Now()},
+		body:        m.Body,
+	})
+}
+
+func (s *memoryStore) validateUserLogin(email string, password []byte) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := s.personByEmail(email)
+	if p == nil {
+		return "", false
+	}
+
+	ok, rehash := s.passwords.verify(p.password, string(password))
+	if !ok {
+		return "", false
+	}
+
+	if rehash {
+		hashedPassword, err := s.passwords.hash(string(password))
+		if err != nil {
+			log.Printf("Failed to rehash password \n%v", err)
+		} else {
+			p.password = hashedPassword
+		}
+	}
+	return p.id, true
+}
+
+func (s *memoryStore) getUserRoles(personID string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.userRoles(personID)
+}
+
+func (s *memoryStore) userRoles(personID string) (roles []string) {
+	if m := memberOf(s.admins, personID); m != nil && m.active {
+		roles = append(roles, "Admin")
+	}
+	if m := memberOf(s.students, personID); m != nil && m.active {
+		roles = append(roles, "Student")
+	}
+	if m := memberOf(s.teachers, personID); m != nil && m.active {
+		roles = append(roles, "Teacher")
+	}
+
+	if p := s.personByID(personID); p != nil {
+		roles = append(roles, p.roles...)
+	}
+	return roles
+}
+
+func (s *memoryStore) getExams(sc scope) (exams []Exam, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, e := range s.exams {
+		c := s.courseByID(e.courseID)
+		student := s.studentByFacultyNumber(e.facultyNumber)
+		if e.deleted || c.deleted ||
+			(sc.studentID != "" && student.personID != sc.studentID) ||
+			(sc.teacherID != "" && s.teacherByID(c.TeacherId).personID != sc.teacherID) ||
+			(sc.facultyNumber != "" && e.facultyNumber != sc.facultyNumber) {
+			continue
+		}
+
+		exams = append(exams, Exam{
+			StudentName:          s.personByID(student.personID).name,
+			StudentFacultyNumber: e.facultyNumber,
+			CourseName:           c.Name,
+			Points:               e.points,
+		})
+	}
+	return exams, nil
+}
+
+func (s *memoryStore) insertExam(sc scope, e Exam) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var course *memoryCourse
+	for _, v := range s.courses {
+		if v.Name == e.CourseName && !v.deleted && (sc.teacherID == "" || s.teacherByID(v.TeacherId).personID == sc.teacherID) {
+			course = v
+			break
+		}
+	}
+	if course == nil {
+		return errCourseNotInScope
+	}
+
+	if e.Points <= 0 {
+		return checkViolation("exam", "points")
+	}
+	if s.studentByFacultyNumber(e.StudentFacultyNumber) == nil {
+		return foreignKeyViolation("student_faculty_number", e.StudentFacultyNumber, "student")
+	}
+
+	s.exams = append(s.exams, &memoryExam{courseID: course.Id, facultyNumber: e.StudentFacultyNumber, points: e.Points})
+	return nil
+}
+
+func (s *memoryStore) delete(table, uuid string) error {
+	if table != "course" {
+		return fmt.Errorf("unknown table")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := s.courseByID(uuid)
+	if c == nil || c.deleted {
+		return errCourseNotFound
+	}
+	c.deleted = true
+	return nil
+}
+
+func (s *memoryStore) getCourses(sc scope) (courses []Course, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, v := range s.courses {
+		teacher := s.teacherByID(v.TeacherId)
+		if v.deleted || (sc.teacherID != "" && teacher.personID != sc.teacherID) {
+			continue
+		}
+
+		c := v.Course
+		c.TeacherName = s.personByID(teacher.personID).name
+		courses = append(courses, c)
+	}
+	return courses, nil
+}
+
+// checkCourse checks the constraints of the course table for c. The course with
+// the id is the one being updated.
+func (s *memoryStore) checkCourse(c Course, id string) error {
+	if c.Name == "" {
+		return checkViolation("course", "name")
+	}
+	if c.NumberOfSeats <= 0 {
+		return checkViolation("course", "number_of_seats")
+	}
+
+	// Deleted courses still hold their name.
+	for _, v := range s.courses {
+		if v.Id != id && v.Name == c.Name && v.TeacherId == c.TeacherId {
+			return uniqueViolation("name, teacher_id", c.Name+", "+c.TeacherId)
+		}
+	}
+
+	if s.teacherByID(c.TeacherId) == nil {
+		return foreignKeyViolation("teacher_id", c.TeacherId, "teacher")
+	}
+	return nil
+}
+
+func (s *memoryStore) insertCourse(c Course) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkCourse(c, ""); err != nil {
+		return err
+	}
+
+	s.courses = append(s.courses, &memoryCourse{Course: Course{Id: newUUID(), TeacherId: c.TeacherId, Name: c.Name, NumberOfSeats: c.NumberOfSeats}})
+	return nil
+}
+
+func (s *memoryStore) updateCourse(c Course) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	course := s.courseByID(c.Id)
+	if course == nil || course.deleted {
+		return errCourseNotFound
+	}
+
+	if err := s.checkCourse(c, c.Id); err != nil {
+		return err
+	}
+
+	course.TeacherId, course.Name, course.NumberOfSeats = c.TeacherId, c.Name, c.NumberOfSeats
+	return nil
+}
+
+func (s *memoryStore) getAllStudents() (students []Student, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, v := range s.students {
+		if !v.active {
+			continue
+		}
+		p := s.personByID(v.personID)
+		students = append(students, Student{ID: p.id, FacultyNumber: v.facultyNumber, Name: p.name, Phone: p.phone, Email: p.email})
+	}
+	return students, nil
+}
+
+func (s *memoryStore) insertStudent(st Student) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	facultyNumber := generateFacultyNumber()
+	if s.studentByFacultyNumber(facultyNumber) != nil {
+		return uniqueViolation("faculty_number", facultyNumber)
+	}
+
+	p, err := s.insertPerson(person{st.Name, st.Email, st.Phone})
+	if err != nil {
+		return err
+	}
+
+	s.students = append(s.students, &memoryMember{id: newUUID(), personID: p.id, facultyNumber: facultyNumber, active: true})
+	return nil
+}
+
+func (s *memoryStore) updateStudent(st Student) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m := s.studentByFacultyNumber(st.FacultyNumber)
+	if m == nil {
+		return errPersonNotFound
+	}
+	return s.updatePerson(s.personByID(m.personID), st.Name, st.Phone, st.Email)
+}
+
+func (s *memoryStore) getAllTeachers() (teachers []Teacher, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, v := range s.teachers {
+		if !v.active {
+			continue
+		}
+		p := s.personByID(v.personID)
+		teachers = append(teachers, Teacher{ID: p.id, Name: p.name, Phone: p.phone, Email: p.email})
+	}
+	return teachers, nil
+}
+
+func (s *memoryStore) insertTeacher(t Teacher) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, err := s.insertPerson(person{t.Name, t.Email, t.Phone})
+	if err != nil {
+		return err
+	}
+
+	s.teachers = append(s.teachers, &memoryMember{id: newUUID(), personID: p.id, active: true})
+	return nil
+}
+
+func (s *memoryStore) updateTeacher(t Teacher) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if memberOf(s.teachers, t.ID) == nil {
+		return errPersonNotFound
+	}
+	return s.updatePerson(s.personByID(t.ID), t.Name, t.Phone, t.Email)
+}
+
+// insertPerson adds the person and emails them a code to create their password.
+func (s *memoryStore) insertPerson(p person) (*memoryPerson, error) {
+	if p.Name == "" {
+		return nil, checkViolation("person", "name")
+	}
+	if !personEmailCheck.MatchString(p.Email) {
+		return nil, checkViolation("person", "email")
+	}
+	if s.personByEmail(p.Email) != nil {
+		return nil, uniqueViolation("email", p.Email)
+	}
+
+	added := &memoryPerson{id: newUUID(), name: p.Name, email: p.Email, phone: p.Phone}
+	code, err := s.issueCode(purposePasswordCreate, added.id, passwordCodeTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	s.people = append(s.people, added)
+	s.enqueueEmail(passwordCodeMessage(s.frontendURL, purposePasswordCreate, code, p.Email))
+	return added, nil
+}
+
+// updatePerson changes the name and phone of the person. A new email is only
+// taken over once it is verified.
+func (s *memoryStore) updatePerson(p *memoryPerson, name, phone, email string) error {
+	if name == "" {
+		return checkViolation("person", "name")
+	}
+
+	if email != "" {
+		if err := s.requestEmailChange(p, email); err != nil {
+			return err
+		}
+	}
+
+	p.name, p.phone = name, phone
+	return nil
+}
+
+// archiveStudent deactivates the student and ends their sessions.
+func (s *memoryStore) archiveStudent(facultyNumber string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m := s.studentByFacultyNumber(facultyNumber)
+	if m == nil || !m.active {
+		return errPersonNotFound
+	}
+
+	m.active = false
+	s.revokePersonSessions(m.personID)
+	return nil
+}
+
+// archiveTeacher deactivates the teacher and ends their sessions.
+func (s *memoryStore) archiveTeacher(personID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m := memberOf(s.teachers, personID)
+	if m == nil || !m.active {
+		return errPersonNotFound
+	}
+
+	m.active = false
+	s.revokePersonSessions(personID)
+	return nil
+}
+
+// resendPassword sends a reset code to the email. Unknown emails are ignored.
+func (s *memoryStore) resendPassword(email string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := s.personByEmail(email)
+	if p == nil {
+		return nil
+	}
+
+	code, err := s.issueCode(purposePasswordReset, p.id, passwordCodeTTL)
+	if err != nil {
+		return err
+	}
+
+	s.enqueueEmail(passwordCodeMessage(s.frontendURL, purposePasswordReset, code, email))
+	return nil
+}
+
+// changePassword sets the new password and ends the person's other sessions.
+func (s *memoryStore) changePassword(personID, sessionID, oldPassword, newPassword string) error {
+	email, err := s.getPersonEmail(personID)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := s.validateUserLogin(email, []byte(oldPassword)); !ok {
+		return errOldPasswordMismatch
+	}
+
+	if err = s.savePassword(personID, newPassword); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, v := range s.sessions {
+		if v.personID == personID && id != sessionID {
+			v.revoked = true
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) createPassword(code, password string) error {
+	_, err := s.usePasswordCode(purposePasswordCreate, code, password)
+	return err
+}
+
+// resetPassword sets the password of the person the code was sent to and ends
+// all their sessions.
+func (s *memoryStore) resetPassword(code, password string) error {
+	personID, err := s.usePasswordCode(purposePasswordReset, code, password)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.revokePersonSessions(personID)
+	return nil
+}
+
+// usePasswordCode sets the password of the person the code was sent to. The
+// password is checked before the code is used up.
+func (s *memoryStore) usePasswordCode(purpose codePurpose, code, password string) (string, error) {
+	personID, err := s.codes.Peek(purpose, code)
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := s.personByID(personID)
+	if p == nil {
+		return "", foreignKeyViolation("person_id", personID, "person")
+	}
+	if err = s.checkNewPassword(p, password); err != nil {
+		return "", err
+	}
+
+	if _, err = s.codes.Consume(purpose, code); err != nil {
+		return "", err
+	}
+	return personID, s.storePassword(p, password)
+}
+
+// savePassword checks the new password of the person, then hashes and saves it.
+func (s *memoryStore) savePassword(personID, password string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := s.personByID(personID)
+	if p == nil {
+		return foreignKeyViolation("person_id", personID, "person")
+	}
+	if err := s.checkNewPassword(p, password); err != nil {
+		return err
+	}
+	return s.storePassword(p, password)
+}
+
+// checkNewPassword checks the password against the policy, the breached
+// passwords and the person's recent passwords.
+func (s *memoryStore) checkNewPassword(p *memoryPerson, password string) error {
+	if err := s.passwords.check(password); err != nil {
+		return err
+	}
+
+	for _, v := range s.recentPasswords(p) {
+		if ok, _ := s.passwords.verify(v, password); ok {
+			return errPasswordReused
+		}
+	}
+	return nil
+}
+
+// recentPasswords returns the hashes of the person's passwords that can't be
+// used again.
+func (s *memoryStore) recentPasswords(p *memoryPerson) []string {
+	if size := s.passwords.cfg.HistorySize; len(p.passwordHistory) > size {
+		return p.passwordHistory[len(p.passwordHistory)-size:]
+	}
+	return p.passwordHistory
+}
+
+// storePassword hashes and saves a checked password and keeps it in the history.
+func (s *memoryStore) storePassword(p *memoryPerson, password string) error {
+	hashedPassword, err := s.passwords.hash(password)
+	if err != nil {
+		return err
+	}
+
+	p.password = hashedPassword
+	p.passwordHistory = append(s.recentPasswords(p), hashedPassword)
+	if size := s.passwords.cfg.HistorySize; len(p.passwordHistory) > size {
+		p.passwordHistory = p.passwordHistory[len(p.passwordHistory)-size:]
+	}
+	return nil
+}
+
+// createSession starts a new login session for the person and returns its id
+// together with the first refresh token of the chain.
+func (s *memoryStore) createSession(personID string) (sessionID, refreshToken string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.personByID(personID) == nil {
+		return "", "", foreignKeyViolation("person_id", personID, "person")
+	}
+
+	if refreshToken, err = newOpaqueToken(); err != nil {
+		return "", "", err
+	}
+
+	sessionID = newUUID()
+	s.sessions[sessionID] = &memorySession{personID: personID}
+	s.refreshTokens[hashToken(refreshToken)] = &memoryRefreshToken{sessionID: sessionID, expiresAt: time.Now().Add(refreshTokenTTL)}
+	return sessionID, refreshToken, nil
+}
+
+// rotateRefreshToken exchanges a refresh token for a new one in the same session.
+// Presenting a token that was already exchanged revokes the whole session.
+func (s *memoryStore) rotateRefreshToken(refreshToken string) (personID, sessionID, newRefreshToken string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rt := s.refreshTokens[hashToken(refreshToken)]
+	if rt == nil {
+		return "", "", "", errInvalidRefreshToken
+	}
+
+	session := s.sessions[rt.sessionID]
+	if session.revoked || time.Now().After(rt.expiresAt) {
+		return "", "", "", errInvalidRefreshToken
+	}
+
+	if rt.used {
+		log.Printf("Refresh token reuse detected, revoking session %s", rt.sessionID)
+		session.revoked = true
+		return "", "", "", errRefreshTokenReused
+	}
+
+	if newRefreshToken, err = newOpaqueToken(); err != nil {
+		return "", "", "", err
+	}
+
+	rt.used = true
+	s.refreshTokens[hashToken(newRefreshToken)] = &memoryRefreshToken{sessionID: rt.sessionID, expiresAt: time.Now().Add(refreshTokenTTL)}
+	return session.personID, rt.sessionID, newRefreshToken, nil
+}
+
+func (s *memoryStore) revokeSessionByRefreshToken(refreshToken string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rt := s.refreshTokens[hashToken(refreshToken)]
+	if rt == nil {
+		return errInvalidRefreshToken
+	}
+	s.sessions[rt.sessionID].revoked = true
+	return nil
+}
+
+func (s *memoryStore) revokePersonSessions(personID string) {
+	for _, v := range s.sessions {
+		if v.personID == personID {
+			v.revoked = true
+		}
+	}
+}
+
+func (s *memoryStore) isSessionActive(sessionID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session := s.sessions[sessionID]
+	return session != nil && !session.revoked
+}
+
+func (s *memoryStore) getUserPermissions(personID string) permissionList {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var permissions permissionList
+	for _, name := range s.userRoles(personID) {
+		r := s.roles[name]
+		if r == nil {
+			continue
+		}
+		for _, v := range r.Permissions {
+			if !permissions.contains(v) {
+				permissions = append(permissions, v)
+			}
+		}
+	}
+	return permissions
+}
+
+func (s *memoryStore) getRoles() ([]Role, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var roles []Role
+	for _, v := range s.roles {
+		r := *v
+		r.Permissions = append([]string{}, v.Permissions...)
+		sort.Strings(r.Permissions)
+		roles = append(roles, r)
+	}
+	sort.Slice(roles, func(i, j int) bool {
+		return roles[i].Name < roles[j].Name
+	})
+	return roles, nil
+}
+
+// rolePermissions returns the permissions once each, as role_permission keeps them.
+func rolePermissions(permissions []string) ([]string, error) {
+	var distinct permissionList
+	for _, v := range permissions {
+		if v == "" {
+			return nil, checkViolation("role_permission", "permission")
+		}
+		if !distinct.contains(v) {
+			distinct = append(distinct, v)
+		}
+	}
+	return distinct, nil
+}
+
+func (s *memoryStore) insertRole(r Role) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r.Name == "" {
+		return checkViolation("role", "name")
+	}
+	if s.roles[r.Name] != nil {
+		return uniqueViolation("name", r.Name)
+	}
+
+	permissions, err := rolePermissions(r.Permissions)
+	if err != nil {
+		return err
+	}
+
+	s.roles[r.Name] = &Role{Name: r.Name, Require2FA: r.Require2FA, AllowMagicLink: r.AllowMagicLink, Permissions: permissions}
+	return nil
+}
+
+// updateRole replaces the permissions and the login settings of the role.
+func (s *memoryStore) updateRole(r Role) error {
+	if err := checkRoleUpdate(r); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	role := s.roles[r.Name]
+	if role == nil {
+		return errRoleNotFound
+	}
+
+	permissions, err := rolePermissions(r.Permissions)
+	if err != nil {
+		return err
+	}
+
+	role.Require2FA, role.AllowMagicLink, role.Permissions = r.Require2FA, r.AllowMagicLink, permissions
+	return nil
+}
+
+func (s *memoryStore) deleteRole(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	role := s.roles[name]
+	if role == nil {
+		return errRoleNotFound
+	}
+	if role.Builtin {
+		return errBuiltinRole
+	}
+
+	delete(s.roles, name)
+	for _, p := range s.people {
+		p.roles = withoutRole(p.roles, name)
+	}
+	return nil
+}
+
+// assignRole gives the person a custom role.
+func (s *memoryStore) assignRole(personID, role string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := s.roles[role]
+	if r == nil {
+		return errRoleNotFound
+	}
+	if r.Builtin {
+		return errBuiltinRole
+	}
+
+	p := s.personByID(personID)
+	if p == nil {
+		return errPersonNotFound
+	}
+
+	for _, v := range p.roles {
+		if v == role {
+			return nil
+		}
+	}
+	p.roles = append(p.roles, role)
+	return nil
+}
+
+func (s *memoryStore) unassignRole(personID, role string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if p := s.personByID(personID); p != nil {
+		p.roles = withoutRole(p.roles, role)
+	}
+	return nil
+}
+
+func withoutRole(roles []string, role string) []string {
+	var kept []string
+	for _, v := range roles {
+		if v != role {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
+
+func (s *memoryStore) getDeadEmails() ([]OutboxEmail, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	emails := []OutboxEmail{}
+	for _, v := range s.outbox {
+		if v.DeadAt != nil {
+			emails = append(emails, v.OutboxEmail)
+		}
+	}
+	sort.SliceStable(emails, func(i, j int) bool {
+		return emails[i].DeadAt.After(*emails[j].DeadAt)
+	})
+	return emails, nil
+}
+
+// retryEmail moves a dead email back to the outbox with fresh attempts.
+func (s *memoryStore) retryEmail(id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, v := range s.outbox {
+		if v.ID == id && v.DeadAt != nil {
+			v.DeadAt, v.Attempts = nil, 0
+			return nil
+		}
+	}
+	return errEmailNotFound
+}
+
+// checkLogin returns errLoginThrottled and how long to wait when the account or
+// the IP has to wait after failed attempts.
+func (s *memoryStore) checkLogin(email, ip string) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.blockedFor(throttleAccount+":"+email, throttleIP+":"+ip)
+}
+
+// attemptLogin runs the attempt and records it, unless the account or the IP
+// has to wait. The attempt is counted as a failure of both before it runs, so
+// parallel attempts are counted one after the other. A success takes the
+// failures back.
+func (s *memoryStore) attemptLogin(email, ip string, attempt func() error) (time.Duration, error) {
+	s.mu.Lock()
+	if wait, err := s.blockedFor(throttleAccount+":"+email, throttleIP+":"+ip); err != nil {
+		s.mu.Unlock()
+		return wait, err
+	}
+	charges := []memoryCharge{
+		s.chargeFailure(throttleAccount, email, s.login.AccountLockoutAttempts),
+		s.chargeFailure(throttleIP, ip, s.login.IPLockoutAttempts),
+	}
+	s.mu.Unlock()
+
+	err := attempt()
+	if err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, c := range charges {
+		s.refundFailure(c)
+	}
+	return 0, nil
+}
+
+// clearLoginFailures clears the account's failures once a login completed.
+func (s *memoryStore) clearLoginFailures(email string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.throttles, throttleAccount+":"+email)
+	return nil
+}
+
+// memoryCharge is a failure counted against a throttle before the attempt ran,
+// with the throttle's state from before, nil if it had none, and the count the
+// charge left it at.
+type memoryCharge struct {
+	key      string
+	before   *memoryThrottle
+	failures int
+}
+
+// chargeFailure counts a failure of the throttle like recordFailure and returns
+// the charge to take it back with.
+func (s *memoryStore) chargeFailure(kind, key string, lockoutAttempts int) memoryCharge {
+	c := memoryCharge{key: kind + ":" + key}
+	if t := s.throttles[c.key]; t != nil {
+		before := *t
+		c.before = &before
+	}
+
+	s.recordFailure(kind, key, lockoutAttempts)
+	c.failures = s.throttles[c.key].Failures
+	return c
+}
+
+// refundFailure takes back a charged failure. The throttle gets its state from
+// before the charge when nothing was counted against it since, otherwise only
+// the count goes down.
+func (s *memoryStore) refundFailure(c memoryCharge) {
+	t := s.throttles[c.key]
+	switch {
+	case t == nil:
+		// It was unlocked in the meantime.
+	case t.Failures != c.failures:
+		if t.Failures > 0 {
+			t.Failures--
+		}
+	case c.before == nil:
+		delete(s.throttles, c.key)
+	default:
+		*t = *c.before
+	}
+}
+
+// throttleRequest counts a request against the throttle of the key like a
+// failed login.
+func (s *memoryStore) throttleRequest(kind, key string) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if wait, err := s.blockedFor(kind + ":" + key); err != nil {
+		return wait, errRequestThrottled
+	}
+
+	s.recordFailure(kind, key, s.login.IPLockoutAttempts)
+	return 0, nil
+}
+
+// blockedFor returns errLoginThrottled and how long to wait when one of the
+// throttles is blocked.
+func (s *memoryStore) blockedFor(keys ...string) (time.Duration, error) {
+	var blockedUntil time.Time
+	for _, k := range keys {
+		if t := s.throttles[k]; t != nil && t.BlockedUntil.After(blockedUntil) {
+			blockedUntil = t.BlockedUntil
+		}
+	}
+
+	if wait := time.Until(blockedUntil); wait > 0 {
+		return wait, errLoginThrottled
+	}
+	return 0, nil
+}
+
+// recordFailure counts a failure of the throttle and blocks it for the delay the
+// count calls for. Failures older than the window are forgotten.
+func (s *memoryStore) recordFailure(kind, key string, lockoutAttempts int) {
+	now := time.Now()
+	t := s.throttles[kind+":"+key]
+	if t == nil {
+		t = &memoryThrottle{Lockout: Lockout{Kind: kind, Key: key}}
+		s.throttles[kind+":"+key] = t
+	}
+
+	if t.lastFailureAt.Before(now.Add(-time.Duration(s.login.Window))) {
+		t.Failures = 1
+	} else {
+		t.Failures++
+	}
+	t.lastFailureAt = now
+
+	delay := s.login.delay(t.Failures)
+	if t.Failures >= lockoutAttempts {
+		delay = time.Duration(s.login.LockoutDuration)
+	}
+	if delay > 0 {
+		t.BlockedUntil = now.Add(delay)
+	}
+}
+
+// getLockouts returns the accounts and IPs that currently can't log in.
+func (s *memoryStore) getLockouts() ([]Lockout, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lockouts := []Lockout{}
+	for _, v := range s.throttles {
+		if v.BlockedUntil.After(time.Now()) {
+			lockouts = append(lockouts, v.Lockout)
+		}
+	}
+	sort.Slice(lockouts, func(i, j int) bool {
+		return lockouts[i].BlockedUntil.After(lockouts[j].BlockedUntil)
+	})
+	return lockouts, nil
+}
+
+// unlockLogin clears the failures of an account or IP.
+func (s *memoryStore) unlockLogin(kind, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.throttles[kind+":"+key] == nil {
+		return errLockoutNotFound
+	}
+	delete(s.throttles, kind+":"+key)
+	return nil
+}
+
+// issueCode creates and stores a new code for the subject.
+func (s *memoryStore) issueCode(purpose codePurpose, subject string, ttl time.Duration) (string, error) {
+	code := uniuri.NewLen(codeLength)
+	return code, s.codes.Save(purpose, code, subject, ttl)
+}
+
+// peekCode returns the subject of a code without using it up.
+func (s *memoryStore) peekCode(purpose codePurpose, code string) (string, error) {
+	return s.codes.Peek(purpose, code)
+}
+
+// consumeCode returns the subject of a code and uses it up.
+func (s *memoryStore) consumeCode(purpose codePurpose, code string) (string, error) {
+	return s.codes.Consume(purpose, code)
+}
+
+// twoFactorStatus reports whether the person has TOTP enabled and whether one of
+// their roles requires it.
+func (s *memoryStore) twoFactorStatus(personID string) (enabled, required bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := s.personByID(personID)
+	if p == nil {
+		return false, false, errPersonNotFound
+	}
+	return p.totpEnabled, s.twoFactorRequired(personID), nil
+}
+
+func (s *memoryStore) twoFactorRequired(personID string) bool {
+	for _, v := range s.userRoles(personID) {
+		if r := s.roles[v]; r != nil && r.Require2FA {
+			return true
+		}
+	}
+	return false
+}
+
+// startTOTPEnrollment stores a new secret that is only enabled once a code of it
+// is confirmed.
+func (s *memoryStore) startTOTPEnrollment(personID string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := s.personByID(personID)
+	if p == nil || p.totpEnabled {
+		return "", errTOTPAlreadyEnabled
+	}
+
+	p.totpSecret = newTOTPSecret()
+	return p.totpSecret, nil
+}
+
+// confirmTOTP enables the pending secret when the code matches it and returns a
+// fresh set of recovery codes.
+func (s *memoryStore) confirmTOTP(personID, code string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := s.personByID(personID)
+	if p == nil || p.totpEnabled || p.totpSecret == "" {
+		return nil, errTOTPNotEnrolled
+	}
+
+	step, ok := verifyTOTP(p.totpSecret, code, time.Now())
+	if !ok {
+		return nil, errInvalidSecondFactor
+	}
+
+	p.totpEnabled, p.totpLastStep = true, step
+	return p.replaceRecoveryCodes(), nil
+}
+
+// verifySecondFactor accepts a TOTP code or an unused recovery code. A TOTP
+// code is only accepted once.
+func (s *memoryStore) verifySecondFactor(personID, code string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.checkSecondFactor(personID, code)
+}
+
+func (s *memoryStore) checkSecondFactor(personID, code string) error {
+	p := s.personByID(personID)
+	if p == nil || !p.totpEnabled || p.totpSecret == "" {
+		return errTOTPNotEnrolled
+	}
+
+	if step, ok := verifyTOTP(p.totpSecret, code, time.Now()); ok {
+		if p.totpLastStep >= step {
+			return errInvalidSecondFactor
+		}
+		p.totpLastStep = step
+		return nil
+	}
+
+	hash := hashToken(normalizeRecoveryCode(code))
+	if used, ok := p.recoveryCodes[hash]; !ok || used {
+		return errInvalidSecondFactor
+	}
+	p.recoveryCodes[hash] = true
+	return nil
+}
+
+// regenerateRecoveryCodes replaces the recovery codes after checking a second factor.
+func (s *memoryStore) regenerateRecoveryCodes(personID, code string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkSecondFactor(personID, code); err != nil {
+		return nil, err
+	}
+	return s.personByID(personID).replaceRecoveryCodes(), nil
+}
+
+// disableTOTP turns TOTP off after checking a second factor, unless a role of
+// the person requires it.
+func (s *memoryStore) disableTOTP(personID, code string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.personByID(personID) == nil {
+		return errPersonNotFound
+	}
+	if s.twoFactorRequired(personID) {
+		return errTwoFactorRequired
+	}
+
+	if err := s.checkSecondFactor(personID, code); err != nil {
+		return err
+	}
+
+	p := s.personByID(personID)
+	p.totpEnabled, p.totpSecret, p.totpLastStep, p.recoveryCodes = false, "", 0, nil
+	return nil
+}
+
+func (p *memoryPerson) replaceRecoveryCodes() []string {
+	codes := make([]string, recoveryCodeCount)
+	p.recoveryCodes = map[string]bool{}
+	for i := range codes {
+		codes[i] = newRecoveryCode()
+		p.recoveryCodes[hashToken(normalizeRecoveryCode(codes[i]))] = false
+	}
+	return codes
+}
+
+// getPersonEmail returns the current email of the person, or errPersonNotFound.
+func (s *memoryStore) getPersonEmail(personID string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := s.personByID(personID)
+	if p == nil {
+		return "", errPersonNotFound
+	}
+	return p.email, nil
+}
+
+// personIDByEmail returns the id of the person with the email, or errPersonNotFound.
+func (s *memoryStore) personIDByEmail(email string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := s.personByEmail(email)
+	if p == nil {
+		return "", errPersonNotFound
+	}
+	return p.id, nil
+}
+
+// changeEmail starts the change of the person's email, see requestEmailChange.
+func (s *memoryStore) changeEmail(personID, newEmail string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := s.personByID(personID)
+	if p == nil {
+		return errPersonNotFound
+	}
+	return s.requestEmailChange(p, newEmail)
+}
+
+// requestEmailChange sends a code to the new address and tells the old one about
+// the change.
+func (s *memoryStore) requestEmailChange(p *memoryPerson, newEmail string) error {
+	if _, err := mail.ParseAddress(newEmail); err != nil {
+		return errInvalidEmail
+	}
+
+	if p.email == newEmail {
+		return nil
+	}
+	if s.personByEmail(newEmail) != nil {
+		return errEmailTaken
+	}
+
+	code, err := s.issueCode(purposeEmailVerify, emailChangeSubject(p.id, newEmail), emailChangeTTL)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range emailChangeMessages(s.frontendURL, p.email, newEmail, code) {
+		s.enqueueEmail(m)
+	}
+	return nil
+}
+
+// verifyEmailChange uses the code sent to a new address and moves the person to it.
+func (s *memoryStore) verifyEmailChange(code string) error {
+	subject, err := s.consumeCode(purposeEmailVerify, code)
+	if err != nil {
+		return err
+	}
+
+	personID, newEmail, ok := parseEmailChangeSubject(subject)
+	if !ok {
+		return errCodeNotFound
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if taken := s.personByEmail(newEmail); taken != nil && taken.id != personID {
+		return errEmailTaken
+	}
+
+	p := s.personByID(personID)
+	if p == nil {
+		return errPersonNotFound
+	}
+	p.email = newEmail
+	return nil
+}
+
+// magicLinkAllowed reports whether one of the person's roles allows logging in
+// with a magic link.
+func (s *memoryStore) magicLinkAllowed(personID string) bool {
+	for _, v := range s.userRoles(personID) {
+		if r := s.roles[v]; r != nil && r.AllowMagicLink {
+			return true
+		}
+	}
+	return false
+}
+
+// sendMagicLink emails a single-use login link to the person. Unknown emails and
+// people whose roles don't allow magic links are ignored.
+func (s *memoryStore) sendMagicLink(email string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := s.personByEmail(email)
+	if p == nil || !s.magicLinkAllowed(p.id) {
+		return nil
+	}
+
+	code, err := s.issueCode(purposeMagicLink, p.id, magicLinkTTL)
+	if err != nil {
+		return err
+	}
+
+	s.enqueueEmail(magicLinkMessage(s.frontendURL, email, code))
+	return nil
+}
+
+// consumeMagicLink uses up the code of a magic link and returns the person it
+// was sent to. The role is checked again, it may have been changed since.
+func (s *memoryStore) consumeMagicLink(code string) (string, error) {
+	personID, err := s.consumeCode(purposeMagicLink, code)
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.magicLinkAllowed(personID) {
+		return "", errMagicLinkNotAllowed
+	}
+	return personID, nil
+}
+
+// startImpersonation records that the actor impersonates the subject and returns
+// the id of the impersonation.
+func (s *memoryStore) startImpersonation(actorID, subjectID, reason string, allowWrites bool) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	actor, subject := s.personByID(actorID), s.personByID(subjectID)
+	if actor == nil {
+		return "", foreignKeyViolation("actor_id", actorID, "person")
+	}
+	if subject == nil {
+		return "", foreignKeyViolation("subject_id", subjectID, "person")
+	}
+
+	now := time.Now()
+	i := &memoryImpersonation{
+		Impersonation: Impersonation{ID: newUUID(), Reason: reason, AllowWrites: allowWrites, CreatedAt: now, ExpiresAt: now.Add(impersonationTTL)},
+		actorID:       actorID,
+		subjectID:     subjectID,
+	}
+	s.impersonations = append(s.impersonations, i)
+	return i.ID, nil
+}
+
+// activeImpersonation returns the impersonation with the id unless it expired.
+func (s *memoryStore) activeImpersonation(id string) *memoryImpersonation {
+	for _, v := range s.impersonations {
+		if v.ID == id && v.ExpiresAt.After(time.Now()) {
+			return v
+		}
+	}
+	return nil
+}
+
+// recordImpersonatedRequest logs a request made with an impersonation token.
+// Expired impersonations are refused.
+func (s *memoryStore) recordImpersonatedRequest(impersonationID, method, path string, blocked bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.activeImpersonation(impersonationID)
+	if i == nil {
+		return errImpersonationNotFound
+	}
+
+	i.requests = append(i.requests, ImpersonatedRequest{Method: method, Path: path, Blocked: blocked, CreatedAt: time.Now()})
+	return nil
+}
+
+// impersonationAllowsWrites reports whether the impersonation was started with writes allowed.
+func (s *memoryStore) impersonationAllowsWrites(impersonationID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.activeImpersonation(impersonationID)
+	if i == nil {
+		return false, errImpersonationNotFound
+	}
+	return i.AllowWrites, nil
+}
+
+// getImpersonations returns every impersonation, the latest first.
+func (s *memoryStore) getImpersonations() ([]Impersonation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	impersonations := []Impersonation{}
+	for i := len(s.impersonations) - 1; i >= 0; i-- {
+		v := s.impersonations[i]
+		imp := v.Impersonation
+		imp.ActorEmail, imp.SubjectEmail = s.personByID(v.actorID).email, s.personByID(v.subjectID).email
+		impersonations = append(impersonations, imp)
+	}
+	return impersonations, nil
+}
+
+// getImpersonatedRequests returns the requests made during an impersonation in order.
+func (s *memoryStore) getImpersonatedRequests(impersonationID string) ([]ImpersonatedRequest, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	requests := []ImpersonatedRequest{}
+	for _, v := range s.impersonations {
+		if v.ID == impersonationID {
+			requests = append(requests, v.requests...)
+		}
+	}
+	return requests, nil
+}
+
+func (s *memoryStore) serviceAccountByID(id string) *memoryServiceAccount {
+	for _, v := range s.serviceAccounts {
+		if v.ID == id {
+			return v
+		}
+	}
+	return nil
+}
+
+// authenticateAPIKey returns the service account and the scopes of a valid key
+// and records that it was used.
+func (s *memoryStore) authenticateAPIKey(key string) (serviceAccountID string, scopes permissionList, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for _, a := range s.serviceAccounts {
+		for _, k := range a.keys {
+			if k.hash == hashToken(key) && !k.Revoked && k.ExpiresAt.After(now) {
+				k.LastUsedAt = &now
+				return a.ID, append(permissionList{}, k.Scopes...), nil
+			}
+		}
+	}
+	return "", nil, errInvalidAPIKey
+}
+
+func (s *memoryStore) getServiceAccounts() ([]ServiceAccount, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	accounts := []ServiceAccount{}
+	for _, v := range s.serviceAccounts {
+		a := v.ServiceAccount
+		a.Keys = []APIKey{}
+		for _, k := range v.keys {
+			key := k.APIKey
+			key.Scopes = append(pq.StringArray{}, k.Scopes...)
+			a.Keys = append(a.Keys, key)
+		}
+		accounts = append(accounts, a)
+	}
+	sort.Slice(accounts, func(i, j int) bool {
+		return accounts[i].Name < accounts[j].Name
+	})
+	return accounts, nil
+}
+
+func (s *memoryStore) insertServiceAccount(name string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if name == "" {
+		return "", checkViolation("service_account", "name")
+	}
+	for _, v := range s.serviceAccounts {
+		if v.Name == name {
+			return "", uniqueViolation("name", name)
+		}
+	}
+
+	a := &memoryServiceAccount{ServiceAccount: ServiceAccount{ID: newUUID(), Name: name, CreatedAt: time.Now()}}
+	s.serviceAccounts = append(s.serviceAccounts, a)
+	return a.ID, nil
+}
+
+// deleteServiceAccount deletes the account together with its keys.
+func (s *memoryStore) deleteServiceAccount(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, v := range s.serviceAccounts {
+		if v.ID == id {
+			s.serviceAccounts = append(s.serviceAccounts[:i], s.serviceAccounts[i+1:]...)
+			return nil
+		}
+	}
+	return errServiceAccountNotFound
+}
+
+// createAPIKey creates a key for the service account and returns it. Only its
+// hash is kept.
+func (s *memoryStore) createAPIKey(serviceAccountID string, scopes []string, expiresAt time.Time) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a := s.serviceAccountByID(serviceAccountID)
+	if a == nil {
+		return "", errServiceAccountNotFound
+	}
+
+	key, prefix, err := newAPIKey()
+	if err != nil {
+		return "", err
+	}
+
+	a.keys = append(a.keys, &memoryAPIKey{
+		APIKey: APIKey{ID: newUUID(), Prefix: prefix, Scopes: append(pq.StringArray{}, scopes...), ExpiresAt: expiresAt, CreatedAt: time.Now()},
+		hash:   hashToken(key),
+	})
+	return key, nil
+}
+
+func (s *memoryStore) revokeAPIKey(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, a := range s.serviceAccounts {
+		for _, k := range a.keys {
+			if k.ID == id {
+				k.Revoked = true
+				return nil
+			}
+		}
+	}
+	return errAPIKeyNotFound
+}
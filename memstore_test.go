@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func Test_memoryStore_softDelete(t *testing.T) {
+	s := newDemoStore(t, testConfig())
+	math := "00000000-0000-0000-0000-00000000d001"
+
+	if err := s.delete("course", math); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.delete("course", math); !errors.Is(err, errCourseNotFound) {
+		t.Fatalf("Expected a deleted course to not be found, but got %v", err)
+	}
+	if err := s.updateCourse(Course{Id: math, TeacherId: "00000000-0000-0000-0000-00000000c001", Name: "Math", NumberOfSeats: 10}); !errors.Is(err, errCourseNotFound) {
+		t.Fatalf("Expected a deleted course to not be updated, but got %v", err)
+	}
+
+	courses, _ := s.getCourses(scope{})
+	exams, _ := s.getExams(scope{})
+	if len(courses) != 2 || len(exams) != 2 {
+		t.Fatalf("Expected the course and its exams to be hidden, but got %d courses and %d exams", len(courses), len(exams))
+	}
+
+	if err := s.insertExam(scope{}, Exam{StudentFacultyNumber: "12312312", CourseName: "Math", Points: 50}); !errors.Is(err, errCourseNotInScope) {
+		t.Fatalf("Expected no exams in a deleted course, but got %v", err)
+	}
+
+	// The deleted course still holds its name, as the unique key covers it.
+	p, _ := knownProblem(s.insertCourse(Course{TeacherId: "00000000-0000-0000-0000-00000000c001", Name: "Math", NumberOfSeats: 10}))
+	if p.Code != "already_exists" || p.Field != "Name, TeacherId" {
+		t.Fatalf("Expected the name to be taken, but got %+v", p)
+	}
+}
+
+func Test_memoryStore_archive(t *testing.T) {
+	s := newDemoStore(t, testConfig())
+	sessionID, _, err := s.createSession(demoTeacherID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = s.archiveTeacher(demoTeacherID); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.archiveTeacher(demoTeacherID); !errors.Is(err, errPersonNotFound) {
+		t.Fatalf("Expected an archived teacher to not be found, but got %v", err)
+	}
+
+	if s.isSessionActive(sessionID) {
+		t.Fatal("Expected the sessions to be revoked")
+	}
+	if roles := s.getUserRoles(demoTeacherID); len(roles) != 0 {
+		t.Fatalf("Expected the role to be gone, but got %v", roles)
+	}
+	if teachers, _ := s.getAllTeachers(); len(teachers) != 0 {
+		t.Fatalf("Expected no active teachers, but got %v", teachers)
+	}
+
+	// Their courses stay, with their name.
+	if courses, _ := s.getCourses(scope{teacherID: demoTeacherID}); len(courses) != 3 || courses[0].TeacherName != "ivan2" {
+		t.Fatalf("Expected the courses of the archived teacher, but got %v", courses)
+	}
+}
+
+func Test_memoryStore_roles(t *testing.T) {
+	s := newDemoStore(t, testConfig())
+
+	if err := s.insertRole(Role{Name: "Auditor", Permissions: []string{permAuditRead, permAuditRead}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.assignRole(demoStudentID, "Auditor"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.assignRole(demoStudentID, "Admin"); !errors.Is(err, errBuiltinRole) {
+		t.Fatalf("Expected built-in roles to not be assigned, but got %v", err)
+	}
+	if err := s.assignRole("00000000-0000-0000-0000-000000000000", "Auditor"); !errors.Is(err, errPersonNotFound) {
+		t.Fatalf("Expected an unknown person, but got %v", err)
+	}
+
+	if permissions := s.getUserPermissions(demoStudentID); len(permissions) != 2 || !permissions.contains(permExamReadOwn) || !permissions.contains(permAuditRead) {
+		t.Fatalf("Expected the permissions of both roles, but got %v", permissions)
+	}
+
+	if err := s.deleteRole("Auditor"); err != nil {
+		t.Fatal(err)
+	}
+	if roles := s.getUserRoles(demoStudentID); len(roles) != 1 || roles[0] != "Student" {
+		t.Fatalf("Expected the deleted role to be unassigned, but got %v", roles)
+	}
+}
+
+func Test_memoryStore_constraints(t *testing.T) {
+	s := newDemoStore(t, testConfig())
+
+	tests := []struct {
+		name  string
+		err   error
+		code  string
+		field string
+	}{
+		{"Taken email", s.insertTeacher(Teacher{Name: "ivan", Email: "test1@test.com"}), "already_exists", "Email"},
+		{"Unknown teacher", s.insertCourse(Course{TeacherId: "00000000-0000-0000-0000-000000000000", Name: "Art", NumberOfSeats: 10}), "unknown_reference", "TeacherId"},
+		{"Unknown student", s.insertExam(scope{}, Exam{StudentFacultyNumber: "99999999", CourseName: "Math", Points: 10}), "unknown_reference", "StudentFacultyNumber"},
+		{"No seats", s.insertCourse(Course{TeacherId: "00000000-0000-0000-0000-00000000c001", Name: "Art"}), "invalid_field", "NumberOfSeats"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p, ok := knownProblem(test.err)
+			if !ok || p.Code != test.code || p.Field != test.field {
+				t.Fatalf("Expected %s of %s, but got %+v from %v", test.code, test.field, p, test.err)
+			}
+		})
+	}
+}
+
+// Test_memoryStore_uniqueConstraints checks that the unique constraints the
+// memory store emulates are declared by the migrations too, and never dropped
+// again, so that the handler tests don't rely on a constraint Postgres lacks.
+func Test_memoryStore_uniqueConstraints(t *testing.T) {
+	migrations, err := loadMigrations(migrationFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var schema strings.Builder
+	for _, v := range migrations {
+		schema.WriteString(v.up)
+	}
+
+	tests := []struct {
+		columns     string
+		constraint  string
+		declaration string
+	}{
+		{"person(email)", "person_email_key", `ALTER TABLE person ADD CONSTRAINT person_email_key UNIQUE \(email\)`},
+		{"student(faculty_number)", "student_faculty_number_key", `CREATE TABLE student \([^;]*faculty_number TEXT UNIQUE`},
+		{"course(name, teacher_id)", "course_name_teacher_id_key", `CREATE TABLE course \([^;]*UNIQUE\(name, teacher_id\)`},
+		{"role(name)", "role_pkey", `CREATE TABLE role \(\s*name TEXT NOT NULL PRIMARY KEY`},
+		{"service_account(name)", "service_account_name_key", `CREATE TABLE service_account \([^;]*name TEXT UNIQUE`},
+	}
+	for _, test := range tests {
+		t.Run(test.columns, func(t *testing.T) {
+			if !regexp.MustCompile(test.declaration).MatchString(schema.String()) {
+				t.Fatalf("Expected the migrations to declare %s unique", test.columns)
+			}
+			if strings.Contains(schema.String(), "DROP CONSTRAINT "+test.constraint) {
+				t.Fatalf("Expected the migrations to keep %s", test.constraint)
+			}
+		})
+	}
+}
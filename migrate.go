@@ -0,0 +1,420 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// noTransactionDirective marks migrations that can't run inside a transaction,
+// e.g. CREATE INDEX CONCURRENTLY. Such a migration leaves its version dirty when
+// it fails half way, and the server refuses to start until it is resolved.
+const noTransactionDirective = "-- migrate:no-transaction"
+
+// migrationLockID is the advisory lock held while migrating, so that several
+// instances starting at once don't run the same migration twice.
+const migrationLockID = 7245019
+
+const migrationsTable = `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+    version BIGINT PRIMARY KEY,
+    name TEXT NOT NULL,
+    dirty BOOL NOT NULL DEFAULT FALSE,
+    applied_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);`
+
+// baselineTables are the tables of 0001_initial. Databases created before the
+// migrations existed already have them, and are adopted at that version.
+var baselineTables = []string{"person", "admin", "student", "teacher", "course", "exam"}
+
+var (
+	errPartialBaseline  = errors.New("database has only some of the baseline tables, create the rest or drop them before migrating")
+	errDirtyMigration   = errors.New("database has a dirty migration, fix it and run migrate force")
+	errUnknownMigration = errors.New("database has migrations applied that this binary doesn't know about")
+)
+
+var migrationFileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+type migration struct {
+	version int64
+	name    string
+	up      string
+	down    string
+}
+
+type appliedMigration struct {
+	Version int64
+	Name    string
+	Dirty   bool
+}
+
+func loadMigrations(files fs.FS) ([]migration, error) {
+	names, err := fs.Glob(files, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int64]*migration{}
+	for _, n := range names {
+		m := migrationFileName.FindStringSubmatch(path.Base(n))
+		if m == nil {
+			return nil, fmt.Errorf("invalid migration file name %s", n)
+		}
+
+		version, _ := strconv.ParseInt(m[1], 10, 64)
+		b, err := fs.ReadFile(files, n)
+		if err != nil {
+			return nil, err
+		}
+
+		mig, ok := byVersion[version]
+		if !ok {
+			mig = &migration{version: version, name: m[2]}
+			byVersion[version] = mig
+		} else if mig.name != m[2] {
+			return nil, fmt.Errorf("migration %d has two names, %s and %s", version, mig.name, m[2])
+		}
+
+		if m[3] == "up" {
+			mig.up = string(b)
+		} else {
+			mig.down = string(b)
+		}
+	}
+
+	var migrations []migration
+	for _, m := range byVersion {
+		if m.up == "" || m.down == "" {
+			return nil, fmt.Errorf("migration %d_%s needs both an up and a down file", m.version, m.name)
+		}
+		migrations = append(migrations, *m)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].version < migrations[j].version
+	})
+	return migrations, nil
+}
+
+// migrator applies and rolls back migrations. Every method holds the migration
+// lock on a dedicated connection for its whole run.
+type migrator struct {
+	db         *sqlx.DB
+	migrations []migration
+}
+
+func newMigrator(db *sqlx.DB) (migrator, error) {
+	migrations, err := loadMigrations(migrationFiles)
+	if err != nil {
+		return migrator{}, err
+	}
+
+	if _, err = db.Exec(migrationsTable); err != nil {
+		return migrator{}, err
+	}
+
+	return migrator{db: db, migrations: migrations}, nil
+}
+
+func (m migrator) withLock(fn func(conn *sqlx.Conn) error) error {
+	ctx := context.Background()
+
+	conn, err := m.db.Connx(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	if _, err = conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockID); err != nil {
+		return err
+	}
+	defer func() {
+		_, _ = conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", migrationLockID)
+	}()
+
+	if err = m.adoptBaseline(conn); err != nil {
+		return err
+	}
+
+	return fn(conn)
+}
+
+// adoptBaseline records 0001_initial as applied when the database has no
+// migrations yet but already has the baseline tables, instead of failing to
+// create them again.
+func (m migrator) adoptBaseline(conn *sqlx.Conn) error {
+	ctx := context.Background()
+
+	var applied int
+	if err := conn.GetContext(ctx, &applied, "SELECT COUNT(*) FROM schema_migrations"); err != nil || applied > 0 {
+		return err
+	}
+
+	var existing int
+	if err := conn.GetContext(ctx, &existing, "SELECT COUNT(*) FROM unnest($1::text[]) AS t(name) WHERE to_regclass(t.name) IS NOT NULL", pq.Array(baselineTables)); err != nil {
+		return err
+	}
+
+	switch existing {
+	case 0:
+		return nil
+	case len(baselineTables):
+		baseline := m.migrations[0]
+		if _, err := conn.ExecContext(ctx, "INSERT INTO schema_migrations(version, name) VALUES ($1, $2)", baseline.version, baseline.name); err != nil {
+			return err
+		}
+		log.Printf("Adopted the existing schema as migration %d_%s", baseline.version, baseline.name)
+		return nil
+	default:
+		return errPartialBaseline
+	}
+}
+
+func (m migrator) applied(conn *sqlx.Conn) ([]appliedMigration, error) {
+	var applied []appliedMigration
+	if err := conn.SelectContext(context.Background(), &applied, "SELECT version, name, dirty FROM schema_migrations ORDER BY version"); err != nil {
+		return nil, err
+	}
+	return applied, nil
+}
+
+// check returns the migrations that still need to be applied. It fails when the
+// database is dirty or ahead of the migrations known to this binary.
+func (m migrator) check(conn *sqlx.Conn) ([]migration, error) {
+	applied, err := m.applied(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	known := map[int64]bool{}
+	for _, v := range m.migrations {
+		known[v.version] = true
+	}
+
+	done := map[int64]bool{}
+	for _, v := range applied {
+		if v.Dirty {
+			return nil, fmt.Errorf("%w (version %d)", errDirtyMigration, v.Version)
+		}
+		if !known[v.Version] {
+			return nil, fmt.Errorf("%w (version %d)", errUnknownMigration, v.Version)
+		}
+		done[v.Version] = true
+	}
+
+	var pending []migration
+	for _, v := range m.migrations {
+		if !done[v.version] {
+			pending = append(pending, v)
+		}
+	}
+	return pending, nil
+}
+
+// pending returns the migrations that still need to be applied.
+func (m migrator) pending() (pending []migration, err error) {
+	err = m.withLock(func(conn *sqlx.Conn) error {
+		pending, err = m.check(conn)
+		return err
+	})
+	return pending, err
+}
+
+// up applies at most n pending migrations, or all of them when n is negative.
+func (m migrator) up(n int) error {
+	return m.withLock(func(conn *sqlx.Conn) error {
+		pending, err := m.check(conn)
+		if err != nil {
+			return err
+		}
+
+		for i, v := range pending {
+			if n >= 0 && i >= n {
+				break
+			}
+
+			if err = m.run(conn, v, true); err != nil {
+				return fmt.Errorf("migration %d_%s failed: %w", v.version, v.name, err)
+			}
+			log.Printf("Applied migration %d_%s", v.version, v.name)
+		}
+		return nil
+	})
+}
+
+// down rolls back the last n applied migrations.
+func (m migrator) down(n int) error {
+	return m.withLock(func(conn *sqlx.Conn) error {
+		if _, err := m.check(conn); err != nil {
+			return err
+		}
+
+		applied, err := m.applied(conn)
+		if err != nil {
+			return err
+		}
+
+		for i := len(applied) - 1; i >= 0 && len(applied)-i <= n; i-- {
+			v := m.find(applied[i].Version)
+
+			if err = m.run(conn, v, false); err != nil {
+				return fmt.Errorf("rollback of %d_%s failed: %w", v.version, v.name, err)
+			}
+			log.Printf("Rolled back migration %d_%s", v.version, v.name)
+		}
+		return nil
+	})
+}
+
+func (m migrator) find(version int64) migration {
+	for _, v := range m.migrations {
+		if v.version == version {
+			return v
+		}
+	}
+	return migration{}
+}
+
+// run applies or rolls back one migration and records the new version state.
+func (m migrator) run(conn *sqlx.Conn, v migration, up bool) error {
+	ctx := context.Background()
+
+	query, record, args := v.down, "DELETE FROM schema_migrations WHERE version=$1", []any{v.version}
+	if up {
+		query, record, args = v.up, "INSERT INTO schema_migrations(version, name) VALUES ($1, $2)", []any{v.version, v.name}
+	}
+
+	if strings.Contains(query, noTransactionDirective) {
+		if _, err := conn.ExecContext(ctx, "INSERT INTO schema_migrations(version, name, dirty) VALUES ($1, $2, TRUE) ON CONFLICT (version) DO UPDATE SET dirty=TRUE", v.version, v.name); err != nil {
+			return err
+		}
+
+		if _, err := conn.ExecContext(ctx, query); err != nil {
+			return err
+		}
+
+		if up {
+			record = "UPDATE schema_migrations SET dirty=FALSE, applied_at=NOW() WHERE version=$1"
+			args = args[:1]
+		}
+		_, err := conn.ExecContext(ctx, record, args...)
+		return err
+	}
+
+	tx, err := conn.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if _, err = tx.Exec(query); err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec(record, args...); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// force marks the version as cleanly applied, after a dirty migration was fixed by hand.
+func (m migrator) force(version int64) error {
+	return m.withLock(func(conn *sqlx.Conn) error {
+		_, err := conn.ExecContext(context.Background(), "UPDATE schema_migrations SET dirty=FALSE WHERE version=$1", version)
+		return err
+	})
+}
+
+func (m migrator) status() error {
+	return m.withLock(func(conn *sqlx.Conn) error {
+		applied, err := m.applied(conn)
+		if err != nil {
+			return err
+		}
+
+		state := map[int64]string{}
+		for _, v := range applied {
+			state[v.Version] = "applied"
+			if v.Dirty {
+				state[v.Version] = "dirty"
+			}
+			if m.find(v.Version).name == "" {
+				fmt.Printf("%-6d %-30s %s\n", v.Version, v.Name, "unknown")
+			}
+		}
+
+		for _, v := range m.migrations {
+			s, ok := state[v.version]
+			if !ok {
+				s = "pending"
+			}
+			fmt.Printf("%-6d %-30s %s\n", v.version, v.name, s)
+		}
+		return nil
+	})
+}
+
+func runMigrateCommand(db *sqlx.DB, args []string) error {
+	m, err := newMigrator(db)
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 0 {
+		return fmt.Errorf("usage: migrate up [n] | down [n] | status | force <version>")
+	}
+
+	count := func(def int) (int, error) {
+		if len(args) < 2 {
+			return def, nil
+		}
+		return strconv.Atoi(args[1])
+	}
+
+	switch args[0] {
+	case "up":
+		n, err := count(-1)
+		if err != nil {
+			return err
+		}
+		return m.up(n)
+	case "down":
+		n, err := count(1)
+		if err != nil {
+			return err
+		}
+		return m.down(n)
+	case "status":
+		return m.status()
+	case "force":
+		if len(args) < 2 {
+			return fmt.Errorf("usage: migrate force <version>")
+		}
+		version, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return err
+		}
+		return m.force(version)
+	default:
+		return fmt.Errorf("unknown migrate command %q", args[0])
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+	"testing/fstest"
+)
+
+func Test_loadMigrations(t *testing.T) {
+	migrations, err := loadMigrations(migrationFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, v := range migrations {
+		if v.version != int64(i+1) {
+			t.Fatalf("Expected migration versions without gaps, but got %d at position %d", v.version, i+1)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		files fstest.MapFS
+	}{
+		{
+			"Missing down migration",
+			fstest.MapFS{"migrations/0001_a.up.sql": {Data: []byte("SELECT 1;")}},
+		},
+		{
+			"Invalid file name",
+			fstest.MapFS{"migrations/a.up.sql": {Data: []byte("SELECT 1;")}},
+		},
+		{
+			"Version with two names",
+			fstest.MapFS{
+				"migrations/0001_a.up.sql":   {Data: []byte("SELECT 1;")},
+				"migrations/0001_b.down.sql": {Data: []byte("SELECT 1;")},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := loadMigrations(test.files); err == nil {
+				t.Fatalf("Expected an error")
+			}
+		})
+	}
+}
+
+func Test_baselineTables(t *testing.T) {
+	migrations, err := loadMigrations(migrationFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	created := regexp.MustCompile(`(?m)^CREATE TABLE (\w+)`).FindAllStringSubmatch(migrations[0].up, -1)
+	if len(created) != len(baselineTables) {
+		t.Fatalf("Expected %s to create %v, but got %v", migrations[0].name, baselineTables, created)
+	}
+	for i, v := range created {
+		if v[1] != baselineTables[i] {
+			t.Fatalf("Expected %s to create %v, but got %v", migrations[0].name, baselineTables, created)
+		}
+	}
+}
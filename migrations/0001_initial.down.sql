@@ -0,0 +1,6 @@
+DROP TABLE exam;
+DROP TABLE course;
+DROP TABLE admin;
+DROP TABLE student;
+DROP TABLE teacher;
+DROP TABLE person;
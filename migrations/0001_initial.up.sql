@@ -0,0 +1,44 @@
+CREATE TABLE person (
+    email TEXT NOT NULL PRIMARY KEY UNIQUE CHECK (email ~ '^[A-Za-z0-9._%-]+@[A-Za-z0-9.-]+[.][A-Za-z]+$'),
+    name TEXT NOT NULL CHECK (name <> ''),
+    phone TEXT,
+    password TEXT
+);
+
+CREATE TABLE admin (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    person_id TEXT UNIQUE REFERENCES person(email) NOT NULL,
+    active BOOLEAN DEFAULT TRUE
+);
+
+CREATE TABLE student (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    faculty_number TEXT UNIQUE NOT NULL CHECK ( faculty_number ~ '^\d{8}$'),
+    person_id TEXT UNIQUE REFERENCES person(email) NOT NULL,
+    active BOOLEAN DEFAULT TRUE
+);
+
+CREATE TABLE teacher (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    person_id TEXT UNIQUE REFERENCES person(email) NOT NULL,
+    active BOOLEAN DEFAULT TRUE
+);
+
+-- Given subject of study e.g. math
+CREATE TABLE course (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    teacher_id UUID REFERENCES teacher(id) NOT NULL,
+    name TEXT NOT NULL CHECK (name <> ''),
+    number_of_seats INT DEFAULT 50 CHECK (number_of_seats > 0),
+    deleted BOOL DEFAULT FALSE,
+    UNIQUE(name, teacher_id)
+);
+
+CREATE TABLE exam (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    course_id UUID REFERENCES course(id) NOT NULL,
+    student_faculty_number TEXT REFERENCES student(faculty_number) NOT NULL,
+    points INT CHECK (points > 0),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    deleted BOOL DEFAULT FALSE
+);
@@ -0,0 +1,16 @@
+-- A login session; every refresh token issued for it belongs to the same chain
+CREATE TABLE session (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    person_id TEXT REFERENCES person(email) NOT NULL,
+    revoked BOOL DEFAULT FALSE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE refresh_token (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    session_id UUID REFERENCES session(id) NOT NULL,
+    token_hash TEXT UNIQUE NOT NULL,
+    used BOOL DEFAULT FALSE,
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
@@ -0,0 +1,3 @@
+DROP TABLE person_role;
+DROP TABLE role_permission;
+DROP TABLE role;
@@ -0,0 +1,35 @@
+-- Built-in roles are held by having an active admin, student or teacher row,
+-- every other role is assigned through person_role
+CREATE TABLE role (
+    name TEXT NOT NULL PRIMARY KEY CHECK (name <> ''),
+    builtin BOOL DEFAULT FALSE
+);
+
+CREATE TABLE role_permission (
+    role_name TEXT REFERENCES role(name) ON DELETE CASCADE NOT NULL,
+    permission TEXT NOT NULL CHECK (permission <> ''),
+    PRIMARY KEY (role_name, permission)
+);
+
+CREATE TABLE person_role (
+    person_id TEXT REFERENCES person(email) NOT NULL,
+    role_name TEXT REFERENCES role(name) ON DELETE CASCADE NOT NULL,
+    PRIMARY KEY (person_id, role_name)
+);
+
+INSERT INTO role(name, builtin) VALUES ('Admin', TRUE), ('Teacher', TRUE), ('Student', TRUE);
+
+INSERT INTO role_permission(role_name, permission) VALUES
+    ('Admin', 'exam:read'),
+    ('Admin', 'course:manage'),
+    ('Admin', 'student:read'),
+    ('Admin', 'student:manage'),
+    ('Admin', 'teacher:manage'),
+    ('Admin', 'user:read'),
+    ('Admin', 'user:archive'),
+    ('Admin', 'role:manage'),
+    ('Teacher', 'exam:read-led'),
+    ('Teacher', 'exam:write'),
+    ('Teacher', 'course:read-own'),
+    ('Teacher', 'student:read'),
+    ('Student', 'exam:read-own');
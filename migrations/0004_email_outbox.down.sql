@@ -0,0 +1,2 @@
+DELETE FROM role_permission WHERE permission = 'mail:manage';
+DROP TABLE email_outbox;
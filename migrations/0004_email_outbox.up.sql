@@ -0,0 +1,18 @@
+-- Emails are written here in the transaction that causes them and delivered by the
+-- outbox dispatcher. An email is pending until sent_at or dead_at is set.
+CREATE TABLE email_outbox (
+    id BIGSERIAL PRIMARY KEY,
+    recipient TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    body TEXT NOT NULL,
+    attempts INT NOT NULL DEFAULT 0,
+    last_error TEXT,
+    next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    sent_at TIMESTAMPTZ,
+    dead_at TIMESTAMPTZ
+);
+
+CREATE INDEX email_outbox_pending ON email_outbox(next_attempt_at) WHERE sent_at IS NULL AND dead_at IS NULL;
+
+INSERT INTO role_permission(role_name, permission) VALUES ('Admin', 'mail:manage');
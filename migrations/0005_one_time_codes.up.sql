@@ -0,0 +1,10 @@
+-- One-time codes of the postgres code store, only the sha256 of a code is kept
+CREATE TABLE one_time_code (
+    purpose TEXT NOT NULL,
+    code_hash TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (purpose, code_hash)
+);
+
+CREATE INDEX one_time_code_expires_at ON one_time_code(expires_at);
@@ -0,0 +1,3 @@
+DELETE FROM role_permission WHERE permission = 'login:unlock';
+DROP TABLE login_throttle;
+DROP TABLE login_attempt;
@@ -0,0 +1,24 @@
+-- Every login attempt, kept for auditing
+CREATE TABLE login_attempt (
+    id BIGSERIAL PRIMARY KEY,
+    email TEXT NOT NULL,
+    ip TEXT NOT NULL,
+    success BOOL NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX login_attempt_email ON login_attempt(email, created_at);
+CREATE INDEX login_attempt_ip ON login_attempt(ip, created_at);
+
+-- Recent failures of an account or IP, and the password resets requested from an
+-- IP, and until when it has to wait
+CREATE TABLE login_throttle (
+    kind TEXT NOT NULL CHECK (kind IN ('account', 'ip', 'password_reset')),
+    key TEXT NOT NULL,
+    failures INT NOT NULL,
+    last_failure_at TIMESTAMPTZ NOT NULL,
+    blocked_until TIMESTAMPTZ,
+    PRIMARY KEY (kind, key)
+);
+
+INSERT INTO role_permission(role_name, permission) VALUES ('Admin', 'login:unlock');
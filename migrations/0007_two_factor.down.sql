@@ -0,0 +1,6 @@
+ALTER TABLE role DROP COLUMN require_2fa;
+DROP TABLE recovery_code;
+ALTER TABLE person
+    DROP COLUMN totp_secret,
+    DROP COLUMN totp_enabled,
+    DROP COLUMN totp_last_step;
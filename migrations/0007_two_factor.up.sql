@@ -0,0 +1,14 @@
+ALTER TABLE person
+    ADD COLUMN totp_secret TEXT,
+    ADD COLUMN totp_enabled BOOL NOT NULL DEFAULT FALSE,
+    -- The time step of the last accepted code, so that a code can't be replayed
+    ADD COLUMN totp_last_step BIGINT NOT NULL DEFAULT 0;
+
+CREATE TABLE recovery_code (
+    person_id TEXT REFERENCES person(email) NOT NULL,
+    code_hash TEXT NOT NULL,
+    used_at TIMESTAMPTZ,
+    PRIMARY KEY (person_id, code_hash)
+);
+
+ALTER TABLE role ADD COLUMN require_2fa BOOL NOT NULL DEFAULT FALSE;
@@ -0,0 +1,11 @@
+-- The last password hashes of every person, so that recent passwords aren't reused
+CREATE TABLE password_history (
+    id BIGSERIAL PRIMARY KEY,
+    person_id TEXT REFERENCES person(email) NOT NULL,
+    password_hash TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX password_history_person ON password_history(person_id, id);
+
+INSERT INTO password_history(person_id, password_hash) SELECT email, password FROM person WHERE password IS NOT NULL;
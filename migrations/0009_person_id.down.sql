@@ -0,0 +1,60 @@
+ALTER TABLE admin ADD COLUMN person_email TEXT;
+UPDATE admin x SET person_email = p.email FROM person p WHERE p.id = x.person_id;
+ALTER TABLE admin DROP COLUMN person_id;
+ALTER TABLE admin RENAME COLUMN person_email TO person_id;
+ALTER TABLE admin ALTER COLUMN person_id SET NOT NULL;
+ALTER TABLE admin ADD CONSTRAINT admin_person_id_key UNIQUE (person_id);
+
+ALTER TABLE student ADD COLUMN person_email TEXT;
+UPDATE student x SET person_email = p.email FROM person p WHERE p.id = x.person_id;
+ALTER TABLE student DROP COLUMN person_id;
+ALTER TABLE student RENAME COLUMN person_email TO person_id;
+ALTER TABLE student ALTER COLUMN person_id SET NOT NULL;
+ALTER TABLE student ADD CONSTRAINT student_person_id_key UNIQUE (person_id);
+
+ALTER TABLE teacher ADD COLUMN person_email TEXT;
+UPDATE teacher x SET person_email = p.email FROM person p WHERE p.id = x.person_id;
+ALTER TABLE teacher DROP COLUMN person_id;
+ALTER TABLE teacher RENAME COLUMN person_email TO person_id;
+ALTER TABLE teacher ALTER COLUMN person_id SET NOT NULL;
+ALTER TABLE teacher ADD CONSTRAINT teacher_person_id_key UNIQUE (person_id);
+
+ALTER TABLE session ADD COLUMN person_email TEXT;
+UPDATE session x SET person_email = p.email FROM person p WHERE p.id = x.person_id;
+ALTER TABLE session DROP COLUMN person_id;
+ALTER TABLE session RENAME COLUMN person_email TO person_id;
+ALTER TABLE session ALTER COLUMN person_id SET NOT NULL;
+
+ALTER TABLE person_role ADD COLUMN person_email TEXT;
+UPDATE person_role x SET person_email = p.email FROM person p WHERE p.id = x.person_id;
+ALTER TABLE person_role DROP COLUMN person_id;
+ALTER TABLE person_role RENAME COLUMN person_email TO person_id;
+ALTER TABLE person_role ALTER COLUMN person_id SET NOT NULL;
+ALTER TABLE person_role ADD PRIMARY KEY (person_id, role_name);
+
+ALTER TABLE recovery_code ADD COLUMN person_email TEXT;
+UPDATE recovery_code x SET person_email = p.email FROM person p WHERE p.id = x.person_id;
+ALTER TABLE recovery_code DROP COLUMN person_id;
+ALTER TABLE recovery_code RENAME COLUMN person_email TO person_id;
+ALTER TABLE recovery_code ALTER COLUMN person_id SET NOT NULL;
+ALTER TABLE recovery_code ADD PRIMARY KEY (person_id, code_hash);
+
+ALTER TABLE password_history ADD COLUMN person_email TEXT;
+UPDATE password_history x SET person_email = p.email FROM person p WHERE p.id = x.person_id;
+ALTER TABLE password_history DROP COLUMN person_id;
+ALTER TABLE password_history RENAME COLUMN person_email TO person_id;
+ALTER TABLE password_history ALTER COLUMN person_id SET NOT NULL;
+CREATE INDEX password_history_person ON password_history(person_id, id);
+
+ALTER TABLE person DROP CONSTRAINT person_email_key;
+ALTER TABLE person DROP CONSTRAINT person_pkey;
+ALTER TABLE person DROP COLUMN id;
+ALTER TABLE person ADD PRIMARY KEY (email);
+
+ALTER TABLE admin ADD FOREIGN KEY (person_id) REFERENCES person(email);
+ALTER TABLE student ADD FOREIGN KEY (person_id) REFERENCES person(email);
+ALTER TABLE teacher ADD FOREIGN KEY (person_id) REFERENCES person(email);
+ALTER TABLE session ADD FOREIGN KEY (person_id) REFERENCES person(email);
+ALTER TABLE person_role ADD FOREIGN KEY (person_id) REFERENCES person(email);
+ALTER TABLE recovery_code ADD FOREIGN KEY (person_id) REFERENCES person(email);
+ALTER TABLE password_history ADD FOREIGN KEY (person_id) REFERENCES person(email);
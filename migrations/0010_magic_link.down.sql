@@ -0,0 +1 @@
+ALTER TABLE role DROP COLUMN allow_magic_link;
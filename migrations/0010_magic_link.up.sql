@@ -0,0 +1,2 @@
+-- Members of roles with allow_magic_link can log in with an emailed link instead of a password
+ALTER TABLE role ADD COLUMN allow_magic_link BOOL NOT NULL DEFAULT FALSE;
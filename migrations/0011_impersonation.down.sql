@@ -0,0 +1,3 @@
+DELETE FROM role_permission WHERE permission IN ('user:impersonate', 'audit:read');
+DROP TABLE impersonation_request;
+DROP TABLE impersonation;
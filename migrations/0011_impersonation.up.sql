@@ -0,0 +1,25 @@
+-- Every impersonation an admin started and every request made with it, kept for auditing
+CREATE TABLE impersonation (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    actor_id UUID REFERENCES person(id) NOT NULL,
+    subject_id UUID REFERENCES person(id) NOT NULL,
+    reason TEXT NOT NULL CHECK (reason <> ''),
+    allow_writes BOOL NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE impersonation_request (
+    id BIGSERIAL PRIMARY KEY,
+    impersonation_id UUID REFERENCES impersonation(id) NOT NULL,
+    method TEXT NOT NULL,
+    path TEXT NOT NULL,
+    blocked BOOL NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX impersonation_request_impersonation ON impersonation_request(impersonation_id, id);
+
+INSERT INTO role_permission(role_name, permission) VALUES
+    ('Admin', 'user:impersonate'),
+    ('Admin', 'audit:read');
@@ -0,0 +1,3 @@
+DELETE FROM role_permission WHERE permission IN ('service-account:manage', 'exam:write-any');
+DROP TABLE api_key;
+DROP TABLE service_account;
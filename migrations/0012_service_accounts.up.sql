@@ -0,0 +1,25 @@
+-- Accounts of machine integrations, which authenticate with API keys instead of logging in
+CREATE TABLE service_account (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    name TEXT UNIQUE NOT NULL CHECK (name <> ''),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Only the hash of a key is stored, the prefix identifies it in listings
+CREATE TABLE api_key (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    service_account_id UUID REFERENCES service_account(id) ON DELETE CASCADE NOT NULL,
+    prefix TEXT NOT NULL,
+    key_hash TEXT UNIQUE NOT NULL,
+    scopes TEXT[] NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    last_used_at TIMESTAMPTZ,
+    revoked BOOL NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+INSERT INTO role_permission(role_name, permission) VALUES ('Admin', 'service-account:manage');
+
+-- Admins and API keys record exams of any course, exam:write is limited to the
+-- courses the teacher leads
+INSERT INTO role_permission(role_name, permission) VALUES ('Admin', 'exam:write-any');
@@ -1,8 +1,14 @@
 package main
 
+import (
+	"time"
+
+	"github.com/lib/pq"
+)
+
 type User struct {
-	Email    string
-	Password string
+	Email    string `json:"Email"`
+	Password string `json:"Password"`
 }
 
 type person struct {
@@ -12,24 +18,32 @@ type person struct {
 }
 
 type Student struct {
-	FacultyNumber string
-	Name          string
-	Phone         string
-	Email         string
+	// ID is the id of the person.
+	ID string `json:"ID"`
+	// FacultyNumber is generated when the student is created, and taken from
+	// the path when it is updated.
+	FacultyNumber string `json:"FacultyNumber"`
+	Name          string `json:"Name" validate:"required,max=100"`
+	Phone         string `json:"Phone" validate:"max=20,format=phone"`
+	// Email is only changed once the new address is verified.
+	Email string `json:"Email" validate:"required_on_create,max=254,format=email"`
 }
 
 type Teacher struct {
-	Name  string
-	Phone string
-	Email string
+	// ID is the id of the person.
+	ID    string `json:"ID"`
+	Name  string `json:"Name" validate:"required,max=100"`
+	Phone string `json:"Phone" validate:"max=20,format=phone"`
+	// Email is only changed once the new address is verified.
+	Email string `json:"Email" validate:"required_on_create,max=254,format=email"`
 }
 
 type Course struct {
-	Id            string
-	TeacherId     string
-	TeacherName   string
-	Name          string
-	NumberOfSeats int
+	Id            string `json:"Id"`
+	TeacherId     string `json:"TeacherId" validate:"required,format=uuid"`
+	TeacherName   string `json:"TeacherName"`
+	Name          string `json:"Name" validate:"required,max=100"`
+	NumberOfSeats int    `json:"NumberOfSeats" validate:"min=1,max=1000"`
 }
 
 type exam struct {
@@ -40,8 +54,73 @@ type exam struct {
 }
 
 type Exam struct {
-	StudentName          string
-	StudentFacultyNumber string
-	CourseName           string
-	Points               int
+	StudentName          string `json:"StudentName"`
+	StudentFacultyNumber string `json:"StudentFacultyNumber" validate:"required,format=facultyNumber"`
+	CourseName           string `json:"CourseName" validate:"required,max=100"`
+	Points               int    `json:"Points" validate:"min=1,max=100"`
+}
+
+type Role struct {
+	Name           string   `json:"Name"`
+	Builtin        bool     `json:"Builtin"`
+	Require2FA     bool     `json:"Require2FA"`
+	AllowMagicLink bool     `json:"AllowMagicLink"`
+	Permissions    []string `json:"Permissions"`
+}
+
+// OutboxEmail is an email in the outbox, without its body.
+type OutboxEmail struct {
+	ID        int64      `json:"ID"`
+	Recipient string     `json:"Recipient"`
+	Subject   string     `json:"Subject"`
+	Attempts  int        `json:"Attempts"`
+	LastError *string    `json:"LastError" db:"last_error"`
+	CreatedAt time.Time  `json:"CreatedAt" db:"created_at"`
+	DeadAt    *time.Time `json:"DeadAt" db:"dead_at"`
+}
+
+// Lockout is an account or IP that has to wait before logging in again.
+type Lockout struct {
+	Kind         string    `json:"Kind"`
+	Key          string    `json:"Key"`
+	Failures     int       `json:"Failures"`
+	BlockedUntil time.Time `json:"BlockedUntil" db:"blocked_until"`
+}
+
+// Impersonation is a time-limited token an admin was issued to act as another person.
+type Impersonation struct {
+	ID           string    `json:"ID"`
+	ActorEmail   string    `json:"ActorEmail" db:"actor_email"`
+	SubjectEmail string    `json:"SubjectEmail" db:"subject_email"`
+	Reason       string    `json:"Reason"`
+	AllowWrites  bool      `json:"AllowWrites" db:"allow_writes"`
+	CreatedAt    time.Time `json:"CreatedAt" db:"created_at"`
+	ExpiresAt    time.Time `json:"ExpiresAt" db:"expires_at"`
+}
+
+// ImpersonatedRequest is a request made with an impersonation token.
+type ImpersonatedRequest struct {
+	Method    string    `json:"Method"`
+	Path      string    `json:"Path"`
+	Blocked   bool      `json:"Blocked"`
+	CreatedAt time.Time `json:"CreatedAt" db:"created_at"`
+}
+
+// ServiceAccount is a machine integration that authenticates with API keys.
+type ServiceAccount struct {
+	ID        string    `json:"ID"`
+	Name      string    `json:"Name"`
+	CreatedAt time.Time `json:"CreatedAt" db:"created_at"`
+	Keys      []APIKey  `json:"Keys"`
+}
+
+// APIKey is a key of a service account, identified by its prefix.
+type APIKey struct {
+	ID         string         `json:"ID"`
+	Prefix     string         `json:"Prefix"`
+	Scopes     pq.StringArray `json:"Scopes"`
+	ExpiresAt  time.Time      `json:"ExpiresAt" db:"expires_at"`
+	LastUsedAt *time.Time     `json:"LastUsedAt" db:"last_used_at"`
+	Revoked    bool           `json:"Revoked"`
+	CreatedAt  time.Time      `json:"CreatedAt" db:"created_at"`
 }
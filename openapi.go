@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// openAPISpec documents the routes of handler.routes and the models they take
+// and return. Test_openAPI fails when it falls behind.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// docsMethods orders the operations of a path on the docs page.
+var docsMethods = []string{"get", "post", "put", "patch", "delete"}
+
+type docsOperation struct {
+	Method      string
+	Path        string
+	ID          string   `json:"operationId"`
+	Summary     string   `json:"summary"`
+	Description string   `json:"description"`
+	Permissions []string `json:"x-permissions"`
+	Details     string
+}
+
+type docsSchema struct {
+	Name    string
+	Details string
+}
+
+// docsPage renders openAPISpec as HTML. It is rendered from the spec alone, so
+// the page loads no scripts or styles from elsewhere.
+var docsPage = template.Must(template.New("docs").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>{{.Title}}</title>
+  <style>
+    body { font-family: sans-serif; max-width: 60rem; margin: 2rem auto; padding: 0 1rem; }
+    section { border-top: 1px solid #ddd; padding: 0.5rem 0; }
+    .method { display: inline-block; min-width: 4rem; font-weight: bold; text-transform: uppercase; }
+    pre { background: #f6f6f6; padding: 0.5rem; overflow-x: auto; }
+  </style>
+</head>
+<body>
+  <h1>{{.Title}} {{.Version}}</h1>
+  <p>{{.Description}}</p>
+  <p>The machine-readable document is at <a href="openapi.json">openapi.json</a>.</p>
+  <h2>Endpoints</h2>
+  {{range .Operations}}
+  <section id="{{.ID}}">
+    <h3><span class="method">{{.Method}}</span> <code>{{.Path}}</code></h3>
+    <p>{{.Summary}}</p>
+    {{if .Description}}<p>{{.Description}}</p>{{end}}
+    {{if .Permissions}}<p>Permissions: {{range $i, $p := .Permissions}}{{if $i}}, {{end}}<code>{{$p}}</code>{{end}}</p>{{end}}
+    <details><summary>Parameters, body and responses</summary><pre>{{.Details}}</pre></details>
+  </section>
+  {{end}}
+  <h2>Schemas</h2>
+  {{range .Schemas}}
+  <details id="{{.Name}}"><summary>{{.Name}}</summary><pre>{{.Details}}</pre></details>
+  {{end}}
+</body>
+</html>
+`))
+
+// renderDocs renders the docs page of the spec.
+func renderDocs(spec []byte) ([]byte, error) {
+	var doc struct {
+		Info struct {
+			Title       string `json:"title"`
+			Version     string `json:"version"`
+			Description string `json:"description"`
+		} `json:"info"`
+		Paths      map[string]map[string]json.RawMessage `json:"paths"`
+		Components struct {
+			Schemas map[string]json.RawMessage `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(spec, &doc); err != nil {
+		return nil, err
+	}
+
+	page := struct {
+		Title, Version, Description string
+		Operations                  []docsOperation
+		Schemas                     []docsSchema
+	}{Title: doc.Info.Title, Version: doc.Info.Version, Description: doc.Info.Description}
+
+	paths := make([]string, 0, len(doc.Paths))
+	for path := range doc.Paths {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		for _, method := range docsMethods {
+			raw, ok := doc.Paths[path][method]
+			if !ok {
+				continue
+			}
+
+			op := docsOperation{Method: method, Path: path}
+			if err := json.Unmarshal(raw, &op); err != nil {
+				return nil, err
+			}
+
+			var details map[string]json.RawMessage
+			if err := json.Unmarshal(raw, &details); err != nil {
+				return nil, err
+			}
+			for _, v := range []string{"operationId", "summary", "description", "x-permissions", "tags"} {
+				delete(details, v)
+			}
+			b, err := json.MarshalIndent(details, "", "  ")
+			if err != nil {
+				return nil, err
+			}
+			op.Details = string(b)
+			page.Operations = append(page.Operations, op)
+		}
+	}
+
+	for name, raw := range doc.Components.Schemas {
+		var b bytes.Buffer
+		if err := json.Indent(&b, raw, "", "  "); err != nil {
+			return nil, err
+		}
+		page.Schemas = append(page.Schemas, docsSchema{name, b.String()})
+	}
+	sort.Slice(page.Schemas, func(i, j int) bool {
+		return strings.ToLower(page.Schemas[i].Name) < strings.ToLower(page.Schemas[j].Name)
+	})
+
+	var b bytes.Buffer
+	if err := docsPage.Execute(&b, page); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func serveOpenAPI(w http.ResponseWriter, _ *http.Request) error {
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(openAPISpec)
+	return nil
+}
+
+func serveDocs(w http.ResponseWriter, _ *http.Request) error {
+	page, err := renderDocs(openAPISpec)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'")
+	_, _ = w.Write(page)
+	return nil
+}
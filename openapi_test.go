@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openAPIDoc is the part of openapi.json the tests compare with the code.
+type openAPIDoc struct {
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components struct {
+		Schemas map[string]openAPISchema `json:"schemas"`
+	} `json:"components"`
+}
+
+type openAPISchema struct {
+	Type       string                   `json:"type"`
+	Properties map[string]openAPISchema `json:"properties"`
+	Required   []string                 `json:"required"`
+	MinLength  *int                     `json:"minLength"`
+	MaxLength  *int                     `json:"maxLength"`
+	Minimum    *int                     `json:"minimum"`
+	Maximum    *int                     `json:"maximum"`
+	Pattern    string                   `json:"pattern"`
+}
+
+func loadOpenAPI(t *testing.T) openAPIDoc {
+	t.Helper()
+
+	var doc openAPIDoc
+	if err := json.Unmarshal(openAPISpec, &doc); err != nil {
+		t.Fatalf("openapi.json is invalid: %v", err)
+	}
+	return doc
+}
+
+func Test_openAPIRoutes(t *testing.T) {
+	doc := loadOpenAPI(t)
+
+	var documented []string
+	for path, operations := range doc.Paths {
+		for method := range operations {
+			documented = append(documented, strings.ToUpper(method)+" "+path)
+		}
+	}
+	registered := handler{}.routes().patterns()
+
+	if missing := difference(registered, documented); len(missing) > 0 {
+		t.Errorf("Routes missing from openapi.json: %s", strings.Join(missing, ", "))
+	}
+	if removed := difference(documented, registered); len(removed) > 0 {
+		t.Errorf("openapi.json documents routes that don't exist: %s", strings.Join(removed, ", "))
+	}
+}
+
+func Test_openAPISchemas(t *testing.T) {
+	models := map[string]any{
+		"User":                User{},
+		"Student":             Student{},
+		"Teacher":             Teacher{},
+		"Course":              Course{},
+		"Exam":                Exam{},
+		"Role":                Role{},
+		"OutboxEmail":         OutboxEmail{},
+		"Lockout":             Lockout{},
+		"Impersonation":       Impersonation{},
+		"ImpersonatedRequest": ImpersonatedRequest{},
+		"ServiceAccount":      ServiceAccount{},
+		"APIKey":              APIKey{},
+		"Problem":             problem{},
+		"FieldError":          fieldError{},
+		"JWK":                 jwk{},
+	}
+
+	doc := loadOpenAPI(t)
+	for name, model := range models {
+		t.Run(name, func(t *testing.T) {
+			schema, ok := doc.Components.Schemas[name]
+			if !ok {
+				t.Fatalf("openapi.json has no %s schema", name)
+			}
+
+			rt := reflect.TypeOf(model)
+			var fields []string
+			for i := 0; i < rt.NumField(); i++ {
+				f := rt.Field(i)
+				field := jsonName(f)
+				fields = append(fields, field)
+
+				property, ok := schema.Properties[field]
+				if !ok {
+					continue
+				}
+				if typ := openAPIType(f.Type); property.Type != typ {
+					t.Errorf("Expected %s to be %s, but the spec has %s", field, typ, property.Type)
+				}
+
+				want, required := validationSchema(f)
+				if constraints(property) != constraints(want) {
+					t.Errorf("Expected %s to be constrained by %s, but the spec has %s", field, constraints(want), constraints(property))
+				}
+				if _, ok := f.Tag.Lookup("validate"); ok && required != contains(schema.Required, field) {
+					t.Errorf("Expected %s to be required %v in the spec", field, required)
+				}
+			}
+
+			var properties []string
+			for k := range schema.Properties {
+				properties = append(properties, k)
+			}
+			if missing := difference(fields, properties); len(missing) > 0 {
+				t.Errorf("Fields missing from the schema: %s", strings.Join(missing, ", "))
+			}
+			if removed := difference(properties, fields); len(removed) > 0 {
+				t.Errorf("The schema has fields that don't exist: %s", strings.Join(removed, ", "))
+			}
+		})
+	}
+}
+
+func Test_serveDocs(t *testing.T) {
+	rt := handler{}.routes()
+	for target, contentType := range map[string]string{"/openapi.json": "application/json", "/docs": "text/html; charset=utf-8"} {
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != contentType {
+			t.Fatalf("Expected %s to be served as %s, but got %d %s", target, contentType, w.Code, w.Header().Get("Content-Type"))
+		}
+	}
+}
+
+// Test_renderDocs checks that every operation is on the docs page, which loads
+// nothing from other origins.
+func Test_renderDocs(t *testing.T) {
+	page, err := renderDocs(openAPISpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var doc struct {
+		Paths map[string]map[string]struct {
+			OperationID string `json:"operationId"`
+		} `json:"paths"`
+	}
+	if err = json.Unmarshal(openAPISpec, &doc); err != nil {
+		t.Fatal(err)
+	}
+	for path, operations := range doc.Paths {
+		for method, op := range operations {
+			if !strings.Contains(string(page), `id="`+op.OperationID+`"`) {
+				t.Fatalf("Expected %s %s on the docs page", method, path)
+			}
+		}
+	}
+
+	for _, v := range []string{"<script", "src=", "<link"} {
+		if strings.Contains(string(page), v) {
+			t.Fatalf("Expected the docs page to load no assets, but it has %s", v)
+		}
+	}
+}
+
+// openAPIType is the schema type a Go type is encoded as.
+func openAPIType(t reflect.Type) string {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch {
+	case t == reflect.TypeOf(time.Time{}) || t.Kind() == reflect.String:
+		return "string"
+	case t.Kind() == reflect.Bool:
+		return "boolean"
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		return "integer"
+	case t.Kind() == reflect.Slice:
+		return "array"
+	}
+	return "object"
+}
+
+// validationSchema is what the validate tag of the field says about it in the spec.
+func validationSchema(f reflect.StructField) (schema openAPISchema, required bool) {
+	rules, ok := f.Tag.Lookup("validate")
+	if !ok {
+		return schema, false
+	}
+
+	isString := f.Type.Kind() == reflect.String
+	for _, rule := range strings.Split(rules, ",") {
+		name, arg, _ := strings.Cut(rule, "=")
+		n, _ := strconv.Atoi(arg)
+
+		switch {
+		case name == "required":
+			required = true
+		case name == "min" && isString:
+			schema.MinLength = &n
+		case name == "min":
+			schema.Minimum = &n
+		case name == "max" && isString:
+			schema.MaxLength = &n
+		case name == "max":
+			schema.Maximum = &n
+		case name == "format":
+			schema.Pattern = formats[arg].String()
+		}
+	}
+	return schema, required
+}
+
+func constraints(s openAPISchema) string {
+	var c []string
+	for name, v := range map[string]*int{"minLength": s.MinLength, "maxLength": s.MaxLength, "minimum": s.Minimum, "maximum": s.Maximum} {
+		if v != nil {
+			c = append(c, name+"="+strconv.Itoa(*v))
+		}
+	}
+	if s.Pattern != "" {
+		c = append(c, "pattern="+s.Pattern)
+	}
+	sort.Strings(c)
+	return "[" + strings.Join(c, " ") + "]"
+}
+
+// difference returns the values of a that aren't in b.
+func difference(a, b []string) []string {
+	var diff []string
+	for _, v := range a {
+		if !contains(b, v) {
+			diff = append(diff, v)
+		}
+	}
+	sort.Strings(diff)
+	return diff
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// claimTimeout is how long a claimed email is hidden from other dispatchers. If
+// the dispatcher dies while sending, the email is retried after it.
+const claimTimeout = 5 * time.Minute
+
+const outboxBatchSize = 20
+
+var errEmailNotFound = errors.New("dead email not found")
+
+// enqueueEmail writes the message to the outbox in tx, so it is only sent when
+// tx commits and never holds tx open while talking to the mail server.
+func enqueueEmail(tx *sql.Tx, m Message) error {
+	_, err := tx.Exec("INSERT INTO email_outbox(recipient, subject, body) VALUES ($1, $2, $3)", m.To, m.Subject, m.Body)
+	return err
+}
+
+// outboxDispatcher delivers the emails in the outbox. Failed emails are retried
+// with exponential backoff and moved to the dead letters after the last attempt.
+type outboxDispatcher struct {
+	db     *sqlx.DB
+	mailer Mailer
+	cfg    outboxConfig
+}
+
+func (d outboxDispatcher) start() {
+	go func() {
+		ticker := time.NewTicker(time.Duration(d.cfg.PollInterval))
+		for range ticker.C {
+			if _, err := d.dispatch(); err != nil {
+				log.Printf("Failed to dispatch emails \n%v", err)
+			}
+		}
+	}()
+}
+
+// dispatch sends the emails that are due and returns how many were sent.
+// Several instances can run it at once, every email is claimed by one of them.
+func (d outboxDispatcher) dispatch() (int, error) {
+	var emails []struct {
+		ID        int64
+		Recipient string
+		Subject   string
+		Body      string
+		Attempts  int
+	}
+	if err := d.db.Select(&emails, `
+		UPDATE email_outbox SET attempts = attempts + 1, next_attempt_at = NOW() + make_interval(secs => $1)
+		WHERE id IN (
+			SELECT id FROM email_outbox
+			WHERE sent_at IS NULL AND dead_at IS NULL AND next_attempt_at <= NOW()
+			ORDER BY next_attempt_at
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, recipient, subject, body, attempts`, claimTimeout.Seconds(), outboxBatchSize); err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, e := range emails {
+		sendErr := d.mailer.Send(Message{To: e.Recipient, Subject: e.Subject, Body: e.Body})
+
+		var err error
+		switch {
+		case sendErr == nil:
+			sent++
+			_, err = d.db.Exec("UPDATE email_outbox SET sent_at=NOW(), last_error=NULL WHERE id=$1", e.ID)
+		case e.Attempts >= d.cfg.MaxAttempts:
+			log.Printf("Giving up on email %d to %s after %d attempts \n%v", e.ID, e.Recipient, e.Attempts, sendErr)
+			_, err = d.db.Exec("UPDATE email_outbox SET dead_at=NOW(), last_error=$2 WHERE id=$1", e.ID, sendErr.Error())
+		default:
+			_, err = d.db.Exec("UPDATE email_outbox SET next_attempt_at=NOW() + make_interval(secs => $2), last_error=$3 WHERE id=$1",
+				e.ID, d.backoff(e.Attempts).Seconds(), sendErr.Error())
+		}
+		if err != nil {
+			return sent, err
+		}
+	}
+	return sent, nil
+}
+
+// backoff returns the delay before the next attempt after the given number of
+// failed ones: the base delay doubled for every attempt, up to the max delay.
+func (d outboxDispatcher) backoff(attempts int) time.Duration {
+	delay, maxDelay := time.Duration(d.cfg.BaseDelay), time.Duration(d.cfg.MaxDelay)
+	for i := 1; i < attempts && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		return maxDelay
+	}
+	return delay
+}
+
+// getDeadEmails returns the emails that ran out of attempts. Bodies hold
+// password codes, so they are left out.
+func (conn dbConnection) getDeadEmails() ([]OutboxEmail, error) {
+	emails := []OutboxEmail{}
+	if err := conn.db.Select(&emails, "SELECT id, recipient, subject, attempts, last_error, created_at, dead_at FROM email_outbox WHERE dead_at IS NOT NULL ORDER BY dead_at DESC"); err != nil {
+		return nil, err
+	}
+	return emails, nil
+}
+
+// retryEmail moves a dead email back to the outbox with fresh attempts.
+func (conn dbConnection) retryEmail(id int64) error {
+	res, err := conn.db.Exec("UPDATE email_outbox SET dead_at=NULL, attempts=0, next_attempt_at=NOW() WHERE id=$1 AND dead_at IS NOT NULL", id)
+	if err != nil {
+		return err
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errEmailNotFound
+	}
+	return nil
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func Test_outboxDispatcher_backoff(t *testing.T) {
+	d := outboxDispatcher{cfg: outboxConfig{BaseDelay: duration(30 * time.Second), MaxDelay: duration(5 * time.Minute)}}
+
+	tests := []struct {
+		attempts int
+		expected time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{4, 4 * time.Minute},
+		{5, 5 * time.Minute},
+		{50, 5 * time.Minute},
+	}
+	for _, test := range tests {
+		if got := d.backoff(test.attempts); got != test.expected {
+			t.Fatalf("Expected a delay of %s after %d attempts, but got %s", test.expected, test.attempts, got)
+		}
+	}
+}
+
+// testDatabase returns a connection to a new, migrated schema of the Postgres
+// database at the URL in TEST_DATABASE_URL. The test is skipped without it.
+func testDatabase(t *testing.T) *sqlx.DB {
+	t.Helper()
+
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	admin, err := sqlx.Connect("postgres", url)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	schema := fmt.Sprintf("test_%d", time.Now().UnixNano())
+	if _, err = admin.Exec("CREATE SCHEMA " + schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_, _ = admin.Exec("DROP SCHEMA " + schema + " CASCADE")
+		_ = admin.Close()
+	})
+
+	separator := "?"
+	if strings.Contains(url, "?") {
+		separator = "&"
+	}
+	db, err := sqlx.Connect("postgres", url+separator+"search_path="+schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	m, err := newMigrator(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.up(-1); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func enqueueTestEmails(t *testing.T, db *sqlx.DB, recipients ...string) {
+	t.Helper()
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range recipients {
+		if err = enqueueEmail(tx, Message{To: v, Subject: "Test", Body: "Test"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testOutboxConfig() outboxConfig {
+	return outboxConfig{MaxAttempts: 3, BaseDelay: duration(30 * time.Second), MaxDelay: duration(5 * time.Minute)}
+}
+
+// Test_outboxDispatcher_claim checks that dispatchers running at once each claim
+// other emails, so every email is sent exactly once.
+func Test_outboxDispatcher_claim(t *testing.T) {
+	db := testDatabase(t)
+
+	var recipients []string
+	for i := 0; i < 3*outboxBatchSize; i++ {
+		recipients = append(recipients, fmt.Sprintf("student%d@example.com", i))
+	}
+	enqueueTestEmails(t, db, recipients...)
+
+	mailers := make([]*memoryMailer, 4)
+	var wg sync.WaitGroup
+	for i := range mailers {
+		mailers[i] = &memoryMailer{}
+		d := outboxDispatcher{db: db, mailer: mailers[i], cfg: testOutboxConfig()}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				if sent, err := d.dispatch(); err != nil {
+					t.Error(err)
+					return
+				} else if sent == 0 {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	sent := map[string]int{}
+	for _, mm := range mailers {
+		for _, m := range mm.sent() {
+			sent[m.To]++
+		}
+	}
+	for _, v := range recipients {
+		if sent[v] != 1 {
+			t.Fatalf("Expected the email to %s to be sent once, but it was sent %d times", v, sent[v])
+		}
+	}
+}
+
+// blockingMailer sends messages once release is closed, and closes sending when
+// the first one arrives.
+type blockingMailer struct {
+	memoryMailer
+	once    sync.Once
+	sending chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingMailer) Send(m Message) error {
+	b.once.Do(func() {
+		close(b.sending)
+	})
+	<-b.release
+	return b.memoryMailer.Send(m)
+}
+
+// Test_outboxDispatcher_claimTimeout checks that an email being sent isn't
+// claimed again by another dispatcher.
+func Test_outboxDispatcher_claimTimeout(t *testing.T) {
+	db := testDatabase(t)
+	enqueueTestEmails(t, db, "student@example.com")
+
+	blocking := &blockingMailer{sending: make(chan struct{}), release: make(chan struct{})}
+	done := make(chan error)
+	go func() {
+		_, err := outboxDispatcher{db: db, mailer: blocking, cfg: testOutboxConfig()}.dispatch()
+		done <- err
+	}()
+	<-blocking.sending
+
+	other := &memoryMailer{}
+	if sent, err := (outboxDispatcher{db: db, mailer: other, cfg: testOutboxConfig()}).dispatch(); err != nil || sent != 0 {
+		t.Fatalf("Expected the claimed email to be skipped, but %d were sent, %v", sent, err)
+	}
+
+	close(blocking.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if n := len(blocking.sent()); n != 1 {
+		t.Fatalf("Expected the email to be sent by the dispatcher that claimed it, but it sent %d", n)
+	}
+}
+
+// Test_outboxDispatcher_retry checks that failed emails are retried after the
+// backoff and dead-lettered after the last attempt.
+func Test_outboxDispatcher_retry(t *testing.T) {
+	db := testDatabase(t)
+	// memoryMailer refuses recipients that aren't an address.
+	enqueueTestEmails(t, db, "not an address")
+
+	cfg := testOutboxConfig()
+	d := outboxDispatcher{db: db, mailer: &memoryMailer{}, cfg: cfg}
+	if _, err := d.dispatch(); err != nil {
+		t.Fatal(err)
+	}
+
+	var e struct {
+		Attempts  int
+		LastError *string `db:"last_error"`
+		Delay     float64
+		Dead      bool
+	}
+	query := "SELECT attempts, last_error, EXTRACT(EPOCH FROM next_attempt_at - NOW()) AS delay, dead_at IS NOT NULL AS dead FROM email_outbox"
+	if err := db.Get(&e, query); err != nil {
+		t.Fatal(err)
+	}
+	if e.Attempts != 1 || e.LastError == nil || e.Dead {
+		t.Fatalf("Expected a failed attempt with its error, but got %+v", e)
+	}
+	if backoff := d.backoff(1).Seconds(); e.Delay < backoff-5 || e.Delay > backoff {
+		t.Fatalf("Expected the next attempt in %.0fs, but got %.0fs", backoff, e.Delay)
+	}
+
+	// The email isn't due until the backoff passed.
+	if _, err := d.dispatch(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Get(&e, query); err != nil || e.Attempts != 1 {
+		t.Fatalf("Expected the email to wait for the backoff, but got %+v, %v", e, err)
+	}
+
+	for i := 1; i < cfg.MaxAttempts; i++ {
+		if _, err := db.Exec("UPDATE email_outbox SET next_attempt_at=NOW()"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := d.dispatch(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := db.Get(&e, query); err != nil {
+		t.Fatal(err)
+	}
+	if e.Attempts != cfg.MaxAttempts || !e.Dead {
+		t.Fatalf("Expected the email to be dead after %d attempts, but got %+v", cfg.MaxAttempts, e)
+	}
+
+	conn := dbConnection{db: db}
+	dead, err := conn.getDeadEmails()
+	if err != nil || len(dead) != 1 {
+		t.Fatalf("Expected the email in the dead letters, but got %+v, %v", dead, err)
+	}
+	if err = conn.retryEmail(dead[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Get(&e, query); err != nil || e.Attempts != 0 || e.Dead {
+		t.Fatalf("Expected the retried email to be pending again, but got %+v, %v", e, err)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	errWeakPassword        = errors.New("password does not meet the password policy")
+	errPasswordReused      = errors.New("password was used recently, choose another one")
+	errPasswordBreached    = errors.New("password appears in a list of breached passwords, choose another one")
+	errOldPasswordMismatch = errors.New("old password doesn't match")
+)
+
+// passwordPolicy checks new passwords and hashes them with the configured
+// algorithm.
+type passwordPolicy struct {
+	cfg passwordConfig
+	// breached holds the SHA-1 sums of the breached passwords.
+	breached map[[sha1.Size]byte]struct{}
+}
+
+// newPasswordPolicy loads the breached password list. Every line of it is either
+// a password or, as in the Have I Been Pwned downloads, its hex SHA-1 sum
+// optionally followed by a colon and a count.
+func newPasswordPolicy(cfg passwordConfig) (passwordPolicy, error) {
+	p := passwordPolicy{cfg: cfg, breached: map[[sha1.Size]byte]struct{}{}}
+	if cfg.BreachedListFile == "" {
+		return p, nil
+	}
+
+	f, err := os.Open(cfg.BreachedListFile)
+	if err != nil {
+		return passwordPolicy{}, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		var sum [sha1.Size]byte
+		hexSum, _, _ := strings.Cut(line, ":")
+		if b, err := hex.DecodeString(hexSum); err == nil && len(b) == sha1.Size {
+			copy(sum[:], b)
+		} else {
+			sum = sha1.Sum([]byte(line))
+		}
+		p.breached[sum] = struct{}{}
+	}
+	return p, scanner.Err()
+}
+
+// check returns why the password can't be used, if it can't.
+func (p passwordPolicy) check(password string) error {
+	length := len([]rune(password))
+	if length < p.cfg.MinLength {
+		return fmt.Errorf("%w: it must be at least %d characters long", errWeakPassword, p.cfg.MinLength)
+	}
+	if p.cfg.Algorithm == "bcrypt" && len(password) > 72 {
+		return fmt.Errorf("%w: it must be at most 72 bytes long", errWeakPassword)
+	}
+
+	var lower, upper, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+
+	classes := 0
+	for _, v := range []bool{lower, upper, digit, symbol} {
+		if v {
+			classes++
+		}
+	}
+	if classes < p.cfg.MinClasses {
+		return fmt.Errorf("%w: it must contain %d of lowercase letters, uppercase letters, digits and symbols", errWeakPassword, p.cfg.MinClasses)
+	}
+
+	if _, ok := p.breached[sha1.Sum([]byte(password))]; ok {
+		return errPasswordBreached
+	}
+	return nil
+}
+
+// hash hashes the password with the configured algorithm.
+func (p passwordPolicy) hash(password string) (string, error) {
+	if p.cfg.Algorithm == "argon2id" {
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+
+		a := p.cfg.Argon2
+		key := argon2.IDKey([]byte(password), salt, a.Iterations, a.MemoryKiB, a.Parallelism, 32)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, a.MemoryKiB, a.Iterations, a.Parallelism,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+	}
+
+	b, err := bcrypt.GenerateFromPassword([]byte(password), p.cfg.BcryptCost)
+	return string(b), err
+}
+
+// verify reports whether the password matches the hash, and whether the hash
+// should be replaced because the algorithm or its parameters changed.
+func (p passwordPolicy) verify(hash, password string) (ok, rehash bool) {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		var version int
+		var a argon2Config
+		parts := strings.Split(hash, "$")
+		if len(parts) != 6 {
+			return false, false
+		}
+		if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+			return false, false
+		}
+		if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &a.MemoryKiB, &a.Iterations, &a.Parallelism); err != nil {
+			return false, false
+		}
+		saltBytes, err := base64.RawStdEncoding.DecodeString(parts[4])
+		if err != nil {
+			return false, false
+		}
+		keyBytes, err := base64.RawStdEncoding.DecodeString(parts[5])
+		if err != nil {
+			return false, false
+		}
+
+		actual := argon2.IDKey([]byte(password), saltBytes, a.Iterations, a.MemoryKiB, a.Parallelism, uint32(len(keyBytes)))
+		if subtle.ConstantTimeCompare(actual, keyBytes) != 1 {
+			return false, false
+		}
+		return true, p.cfg.Algorithm != "argon2id" || version != argon2.Version || a != p.cfg.Argon2
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+		return false, false
+	}
+	cost, err := bcrypt.Cost([]byte(hash))
+	return true, p.cfg.Algorithm != "bcrypt" || err != nil || cost != p.cfg.BcryptCost
+}
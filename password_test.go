@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func Test_passwordPolicy_check(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "breached.txt")
+	sum := sha1.Sum([]byte("Summer2023!!"))
+	list := "Password123!\n" + strings.ToUpper(hex.EncodeToString(sum[:])) + ":42\n"
+	if err := os.WriteFile(file, []byte(list), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := defaultConfig().Password
+	cfg.BreachedListFile = file
+	p, err := newPasswordPolicy(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		password string
+		expected error
+	}{
+		{"", errWeakPassword},
+		{"Sh0rt!", errWeakPassword},
+		{"onlylowercaseletters", errWeakPassword},
+		{"lowercase and 123", nil},
+		{"Password123!", errPasswordBreached},
+		{"Summer2023!!", errPasswordBreached},
+		{"correct horse Battery staple", nil},
+	}
+	for _, test := range tests {
+		if err := p.check(test.password); !errors.Is(err, test.expected) {
+			t.Fatalf("Expected %v for %q, but got %v", test.expected, test.password, err)
+		}
+	}
+}
+
+func Test_passwordPolicy_rehash(t *testing.T) {
+	cfg := defaultConfig().Password
+	cfg.BcryptCost = bcrypt.MinCost
+	cfg.Argon2 = argon2Config{MemoryKiB: 64, Iterations: 1, Parallelism: 1}
+	p := passwordPolicy{cfg: cfg}
+
+	bcryptHash, err := p.hash("test_pas_123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, rehash := p.verify(bcryptHash, "test_pas_123"); !ok || rehash {
+		t.Fatalf("Expected a current bcrypt hash to match without rehash, but got %v, %v", ok, rehash)
+	}
+	if ok, _ := p.verify(bcryptHash, "wrong"); ok {
+		t.Fatal("Expected a wrong password not to match")
+	}
+
+	p.cfg.Algorithm = "argon2id"
+	if ok, rehash := p.verify(bcryptHash, "test_pas_123"); !ok || !rehash {
+		t.Fatalf("Expected a bcrypt hash to need a rehash to argon2id, but got %v, %v", ok, rehash)
+	}
+
+	argonHash, err := p.hash("test_pas_123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(argonHash, "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Fatalf("Unexpected argon2id hash %s", argonHash)
+	}
+	if ok, rehash := p.verify(argonHash, "test_pas_123"); !ok || rehash {
+		t.Fatalf("Expected a current argon2id hash to match without rehash, but got %v, %v", ok, rehash)
+	}
+
+	p.cfg.Argon2.Iterations = 2
+	if ok, rehash := p.verify(argonHash, "test_pas_123"); !ok || !rehash {
+		t.Fatalf("Expected changed argon2id parameters to need a rehash, but got %v, %v", ok, rehash)
+	}
+}
+
+// Test_resetPassword_rejected checks that a password the policy or the history
+// rejects doesn't use up the reset code.
+func Test_resetPassword_rejected(t *testing.T) {
+	s := newTestServer(t, testConfig())
+
+	if status := s.do(http.MethodPost, "/forgotten-password", `{"Email":"test1@test.com"}`, "", nil); status != http.StatusOK {
+		t.Fatalf("Expected a reset code to be sent, but got %d", status)
+	}
+	code := emailedCode(t, s.db, "test1@test.com")
+
+	tests := []struct {
+		name     string
+		password string
+		status   int
+		code     string
+	}{
+		{"Weak password", "short", http.StatusBadRequest, "weak_password"},
+		{"Reused password", "test_pas_123", http.StatusBadRequest, "password_reused"},
+		{"New password", "new_test_pas_123", http.StatusOK, ""},
+		{"Used code", "other_test_pas_123", http.StatusBadRequest, "invalid_code"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var p problem
+			body := `{"Code":"` + code + `","Password":"` + test.password + `"}`
+			if status := s.do(http.MethodPost, "/reset-password", body, "", &p); status != test.status || p.Code != test.code {
+				t.Fatalf("Expected %d %s, but got %d %s", test.status, test.code, status, p.Code)
+			}
+		})
+	}
+}
+
+func Test_changePassword_rejected(t *testing.T) {
+	s := newTestServer(t, testConfig())
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		code   string
+	}{
+		{"Wrong old password", `{"OldPassword":"wrong_pas_123","NewPassword":"new_test_pas_123"}`, http.StatusBadRequest, "old_password_mismatch"},
+		{"Weak password", `{"OldPassword":"test_pas_123","NewPassword":"short"}`, http.StatusBadRequest, "weak_password"},
+		{"New password", `{"OldPassword":"test_pas_123","NewPassword":"new_test_pas_123"}`, http.StatusOK, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var p problem
+			if status := s.do(http.MethodPost, "/change-password", test.body, demoStudentID, &p); status != test.status || p.Code != test.code {
+				t.Fatalf("Expected %d %s, but got %d %s", test.status, test.code, status, p.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+const (
+	permExamReadOwn   = "exam:read-own"
+	permExamRead      = "exam:read"
+	permExamReadLed   = "exam:read-led"
+	permExamWrite     = "exam:write"
+	permExamWriteAny  = "exam:write-any"
+	permCourseReadOwn = "course:read-own"
+	permCourseManage  = "course:manage"
+	permStudentRead   = "student:read"
+	permStudentManage = "student:manage"
+	permTeacherManage = "teacher:manage"
+	permUserRead      = "user:read"
+	permUserArchive   = "user:archive"
+	permRoleManage    = "role:manage"
+	permMailManage    = "mail:manage"
+	permLoginUnlock   = "login:unlock"
+	permImpersonate   = "user:impersonate"
+	permAuditRead     = "audit:read"
+	permServiceManage = "service-account:manage"
+)
+
+// knownPermissions are all permissions that are checked somewhere, roles can only be
+// granted these.
+var knownPermissions = permissionList{
+	permExamReadOwn,
+	permExamRead,
+	permExamReadLed,
+	permExamWrite,
+	permExamWriteAny,
+	permCourseReadOwn,
+	permCourseManage,
+	permStudentRead,
+	permStudentManage,
+	permTeacherManage,
+	permUserRead,
+	permUserArchive,
+	permRoleManage,
+	permMailManage,
+	permLoginUnlock,
+	permImpersonate,
+	permAuditRead,
+	permServiceManage,
+}
+
+var (
+	errRoleNotFound      = errors.New("role not found")
+	errBuiltinRole       = errors.New("built-in roles can not be changed this way")
+	errUnknownPermission = errors.New("unknown permission")
+)
+
+type permissionList []string
+
+func (p permissionList) contains(s string) bool {
+	for _, v := range p {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// adminRole always keeps role:manage, so that nobody can lock the admins out of
+// managing roles.
+const adminRole = "Admin"
+
+// checkRoleUpdate returns why the permissions of the role can't be replaced, if
+// they can't.
+func checkRoleUpdate(r Role) error {
+	if r.Name == adminRole && !permissionList(r.Permissions).contains(permRoleManage) {
+		return fmt.Errorf("%w: %s must keep %s", errBuiltinRole, adminRole, permRoleManage)
+	}
+	return nil
+}
+
+func validatePermissions(permissions []string) error {
+	for _, v := range permissions {
+		if !knownPermissions.contains(v) {
+			return fmt.Errorf("%w %q", errUnknownPermission, v)
+		}
+	}
+	return nil
+}
+
+func (conn dbConnection) getUserPermissions(personID string) permissionList {
+	var permissions permissionList
+	if err := conn.db.Select(&permissions, "SELECT DISTINCT permission FROM role_permission WHERE role_name = ANY($1)", pq.Array(conn.getUserRoles(personID))); err != nil {
+		return nil
+	}
+	return permissions
+}
+
+func (conn dbConnection) getRoles() ([]Role, error) {
+	var rows []struct {
+		Name           string
+		Builtin        bool
+		Require2FA     bool `db:"require_2fa"`
+		AllowMagicLink bool `db:"allow_magic_link"`
+		Permission     *string
+	}
+	if err := conn.db.Select(&rows, "SELECT name, builtin, require_2fa, allow_magic_link, permission FROM role LEFT JOIN role_permission rp ON rp.role_name = role.name ORDER BY name, permission"); err != nil {
+		return nil, err
+	}
+
+	var roles []Role
+	for _, v := range rows {
+		if len(roles) == 0 || roles[len(roles)-1].Name != v.Name {
+			roles = append(roles, Role{Name: v.Name, Builtin: v.Builtin, Require2FA: v.Require2FA, AllowMagicLink: v.AllowMagicLink, Permissions: []string{}})
+		}
+		if v.Permission != nil {
+			roles[len(roles)-1].Permissions = append(roles[len(roles)-1].Permissions, *v.Permission)
+		}
+	}
+	return roles, nil
+}
+
+func (conn dbConnection) insertRole(r Role) error {
+	tx, err := conn.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if _, err = tx.Exec("INSERT INTO role(name, require_2fa, allow_magic_link) VALUES ($1, $2, $3)", r.Name, r.Require2FA, r.AllowMagicLink); err != nil {
+		return err
+	}
+
+	for _, v := range r.Permissions {
+		if _, err = tx.Exec("INSERT INTO role_permission(role_name, permission) VALUES ($1, $2) ON CONFLICT DO NOTHING", r.Name, v); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// updateRole replaces the permissions and the login settings of the role. Built-in
+// roles can be updated too, as only their membership is fixed, but Admin keeps
+// role:manage.
+func (conn dbConnection) updateRole(r Role) error {
+	if err := checkRoleUpdate(r); err != nil {
+		return err
+	}
+
+	var name string
+	if err := conn.db.Get(&name, "SELECT name FROM role WHERE name=$1", r.Name); errors.Is(err, sql.ErrNoRows) {
+		return errRoleNotFound
+	} else if err != nil {
+		return err
+	}
+
+	tx, err := conn.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if _, err = tx.Exec("UPDATE role SET require_2fa=$2, allow_magic_link=$3 WHERE name=$1", r.Name, r.Require2FA, r.AllowMagicLink); err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec("DELETE FROM role_permission WHERE role_name=$1", r.Name); err != nil {
+		return err
+	}
+
+	for _, v := range r.Permissions {
+		if _, err = tx.Exec("INSERT INTO role_permission(role_name, permission) VALUES ($1, $2) ON CONFLICT DO NOTHING", r.Name, v); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (conn dbConnection) deleteRole(name string) error {
+	var builtin bool
+	if err := conn.db.Get(&builtin, "SELECT builtin FROM role WHERE name=$1", name); errors.Is(err, sql.ErrNoRows) {
+		return errRoleNotFound
+	} else if err != nil {
+		return err
+	}
+
+	if builtin {
+		return errBuiltinRole
+	}
+
+	if _, err := conn.db.Exec("DELETE FROM role WHERE name=$1", name); err != nil {
+		return err
+	}
+	return nil
+}
+
+// assignRole gives the person a custom role.
+func (conn dbConnection) assignRole(personID, role string) error {
+	var builtin bool
+	if err := conn.db.Get(&builtin, "SELECT builtin FROM role WHERE name=$1", role); errors.Is(err, sql.ErrNoRows) {
+		return errRoleNotFound
+	} else if err != nil {
+		return err
+	}
+
+	if builtin {
+		return errBuiltinRole
+	}
+
+	res, err := conn.db.Exec("INSERT INTO person_role(person_id, role_name) SELECT id, $2 FROM person WHERE id::text=$1 ON CONFLICT DO NOTHING", personID, role)
+	if err != nil {
+		return err
+	}
+
+	// Nothing is inserted for an unknown person, nor for an existing assignment.
+	if n, _ := res.RowsAffected(); n == 0 {
+		var exists bool
+		if err = conn.db.Get(&exists, "SELECT EXISTS(SELECT 1 FROM person WHERE id::text=$1)", personID); err != nil {
+			return err
+		}
+		if !exists {
+			return errPersonNotFound
+		}
+	}
+	return nil
+}
+
+func (conn dbConnection) unassignRole(personID, role string) error {
+	if _, err := conn.db.Exec("DELETE FROM person_role WHERE person_id::text=$1 AND role_name=$2", personID, role); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_requirePermission(t *testing.T) {
+	cfg := testConfig()
+	keys, err := loadKeySet(t.TempDir(), cfg.Auth.JWTAlgorithm, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := handler{keys: keys, db: newDemoStore(t, cfg)}
+
+	tests := []struct {
+		name        string
+		personID    string
+		permissions []string
+		err         error
+		permission  string
+	}{
+		{"No token", "", []string{permExamRead}, errValidatingJWT, ""},
+		{"Missing permission", demoStudentID, []string{permStudentRead}, errMissingPermission, ""},
+		{"Held permission", demoTeacherID, []string{permStudentRead}, nil, permStudentRead},
+		{"Broadest held permission", demoAdminID, []string{permExamRead, permExamReadLed, permExamReadOwn}, nil, permExamRead},
+		{"Narrower permission", demoTeacherID, []string{permExamRead, permExamReadLed, permExamReadOwn}, nil, permExamReadLed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if test.personID != "" {
+				authenticate(t, h, r, test.personID)
+			}
+
+			var got principal
+			err := h.requirePermission(test.permissions...)(func(w http.ResponseWriter, r *http.Request) error {
+				got = requestPrincipal(r)
+				return nil
+			})(httptest.NewRecorder(), r)
+
+			if !errors.Is(err, test.err) {
+				t.Fatalf("Expected %v, but got %v", test.err, err)
+			}
+			if got.id != test.personID && test.err == nil || got.permission != test.permission {
+				t.Fatalf("Expected %s authorized by %q, but got %+v", test.personID, test.permission, got)
+			}
+		})
+	}
+}
+
+func Test_getUserPermissions(t *testing.T) {
+	s := newDemoStore(t, testConfig())
+
+	if p := s.getUserPermissions(demoAdminID); !p.contains(permRoleManage) || p.contains(permExamReadOwn) {
+		t.Fatalf("Expected the permissions of the Admin role, but got %v", p)
+	}
+	if p := s.getUserPermissions(demoTeacherID); !p.contains(permExamWrite) || p.contains(permStudentManage) {
+		t.Fatalf("Expected the permissions of the Teacher role, but got %v", p)
+	}
+
+	// Roles of archived members are gone along with their permissions.
+	if err := s.archiveTeacher(demoTeacherID); err != nil {
+		t.Fatal(err)
+	}
+	if p := s.getUserPermissions(demoTeacherID); len(p) != 0 {
+		t.Fatalf("Expected no permissions after archiving, but got %v", p)
+	}
+}
+
+func Test_customRoles(t *testing.T) {
+	s := newTestServer(t, testConfig())
+
+	if status := s.do(http.MethodGet, "/students", "", demoStudentID, nil); status != http.StatusForbidden {
+		t.Fatalf("Expected the student to not list students, but got %d", status)
+	}
+
+	if status := s.do(http.MethodPost, "/roles", `{"Name":"Registrar","Permissions":["student:read"]}`, demoAdminID, nil); status != http.StatusOK {
+		t.Fatalf("Expected the role to be created, but got %d", status)
+	}
+	if status := s.do(http.MethodPut, "/people/"+demoStudentID+"/roles/Registrar", "", demoAdminID, nil); status != http.StatusOK {
+		t.Fatalf("Expected the role to be assigned, but got %d", status)
+	}
+	if status := s.do(http.MethodGet, "/students", "", demoStudentID, nil); status != http.StatusOK {
+		t.Fatalf("Expected the assigned role to grant student:read, but got %d", status)
+	}
+
+	if status := s.do(http.MethodDelete, "/people/"+demoStudentID+"/roles/Registrar", "", demoAdminID, nil); status != http.StatusOK {
+		t.Fatalf("Expected the role to be removed, but got %d", status)
+	}
+	if status := s.do(http.MethodGet, "/students", "", demoStudentID, nil); status != http.StatusForbidden {
+		t.Fatalf("Expected the permission to be gone with the role, but got %d", status)
+	}
+}
+
+func Test_updateRole(t *testing.T) {
+	tests := []struct {
+		name   string
+		role   string
+		body   string
+		status int
+		code   string
+	}{
+		{"Admin without role:manage", "Admin", `{"Permissions":["exam:read"]}`, http.StatusBadRequest, "builtin_role"},
+		{"Admin with role:manage", "Admin", `{"Permissions":["exam:read","role:manage"]}`, http.StatusOK, ""},
+		{"Other built-in role", "Teacher", `{"Permissions":["exam:read-led"]}`, http.StatusOK, ""},
+		{"Unknown role", "Registrar", `{"Permissions":["exam:read"]}`, http.StatusNotFound, "role_not_found"},
+		{"Unknown permission", "Teacher", `{"Permissions":["exam:delete"]}`, http.StatusBadRequest, "unknown_permission"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestServer(t, testConfig())
+
+			var p problem
+			if status := s.do(http.MethodPatch, "/roles/"+test.role, test.body, demoAdminID, &p); status != test.status || p.Code != test.code {
+				t.Fatalf("Expected %d %s, but got %d %s", test.status, test.code, status, p.Code)
+			}
+
+			// The admin can still manage roles either way.
+			if status := s.do(http.MethodGet, "/roles", "", demoAdminID, nil); status != http.StatusOK {
+				t.Fatalf("Expected the admin to keep role:manage, but got %d", status)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// emailChangeTTL is how long the link to confirm a new email address is valid.
+const emailChangeTTL = 24 * time.Hour
+
+var (
+	errPersonNotFound = errors.New("person not found")
+	errInvalidEmail   = errors.New("invalid email address")
+	errEmailTaken     = errors.New("email address is already in use")
+)
+
+// personIDByEmail returns the id of the person with the email, or errPersonNotFound.
+func (conn dbConnection) personIDByEmail(email string) (string, error) {
+	var id string
+	err := conn.db.Get(&id, "SELECT id FROM person WHERE email=$1", email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", errPersonNotFound
+	}
+	return id, err
+}
+
+// getPersonEmail returns the current email of the person, or errPersonNotFound.
+func (conn dbConnection) getPersonEmail(personID string) (string, error) {
+	var email string
+	err := conn.db.Get(&email, "SELECT email FROM person WHERE id=$1", personID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", errPersonNotFound
+	}
+	return email, err
+}
+
+// changeEmail starts the change of the person's email, see requestEmailChange.
+func (conn dbConnection) changeEmail(personID, newEmail string) error {
+	tx, err := conn.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if err = conn.requestEmailChange(tx, personID, newEmail); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// requestEmailChange sends a code to the new address and tells the old one about
+// the change. The email is only changed once the code is used at verifyEmailChange,
+// so nobody can take over an address they can't read.
+func (conn dbConnection) requestEmailChange(tx *sql.Tx, personID, newEmail string) error {
+	if _, err := mail.ParseAddress(newEmail); err != nil {
+		return errInvalidEmail
+	}
+
+	var oldEmail string
+	if err := tx.QueryRow("SELECT email FROM person WHERE id=$1", personID).Scan(&oldEmail); errors.Is(err, sql.ErrNoRows) {
+		return errPersonNotFound
+	} else if err != nil {
+		return err
+	}
+
+	if oldEmail == newEmail {
+		return nil
+	}
+
+	var taken bool
+	if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM person WHERE email=$1)", newEmail).Scan(&taken); err != nil {
+		return err
+	}
+	if taken {
+		return errEmailTaken
+	}
+
+	code, err := conn.issueCode(purposeEmailVerify, emailChangeSubject(personID, newEmail), emailChangeTTL)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range emailChangeMessages(conn.frontendURL, oldEmail, newEmail, code) {
+		if err = enqueueEmail(tx, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// emailChangeMessages are the emails with the code to the new address and the
+// notice to the old one.
+func emailChangeMessages(frontendURL, oldEmail, newEmail, code string) []Message {
+	return []Message{{
+		To:      newEmail,
+		Subject: "Technical university email change",
+		Body:    fmt.Sprintf("Please confirm your new email address at: %s/verify-email?code=%s\n", frontendURL, code),
+	}, {
+		To:      oldEmail,
+		Subject: "Technical university email change",
+		Body:    fmt.Sprintf("A change of your email address to %s was requested. It only takes effect once it is confirmed from the new address.\n", newEmail),
+	}}
+}
+
+// verifyEmailChange uses the code sent to a new address and moves the person to it.
+func (conn dbConnection) verifyEmailChange(code string) error {
+	subject, err := conn.consumeCode(purposeEmailVerify, code)
+	if err != nil {
+		return err
+	}
+
+	personID, newEmail, ok := parseEmailChangeSubject(subject)
+	if !ok {
+		return errCodeNotFound
+	}
+
+	res, err := conn.db.Exec("UPDATE person SET email=$2 WHERE id=$1", personID, newEmail)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return errEmailTaken
+	} else if err != nil {
+		return err
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errPersonNotFound
+	}
+	return nil
+}
+
+// emailChangeSubject packs the person and the new address into the subject of an
+// email-verify code. Person ids are UUIDs, so they never contain the colon.
+func emailChangeSubject(personID, newEmail string) string {
+	return personID + ":" + newEmail
+}
+
+func parseEmailChangeSubject(subject string) (personID, newEmail string, ok bool) {
+	personID, newEmail, ok = strings.Cut(subject, ":")
+	return personID, newEmail, ok && personID != "" && newEmail != ""
+}
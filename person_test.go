@@ -0,0 +1,18 @@
+package main
+
+import "testing"
+
+func Test_emailChangeSubject(t *testing.T) {
+	subject := emailChangeSubject("00000000-0000-0000-0000-00000000f001", "new:name@example.com")
+
+	personID, email, ok := parseEmailChangeSubject(subject)
+	if !ok || personID != "00000000-0000-0000-0000-00000000f001" || email != "new:name@example.com" {
+		t.Fatalf("Expected the person and email back, but got %q, %q, %v", personID, email, ok)
+	}
+
+	for _, v := range []string{"", "no-separator", ":new@example.com", "00000000-0000-0000-0000-00000000f001:"} {
+		if _, _, ok = parseEmailChangeSubject(v); ok {
+			t.Fatalf("Expected %q to be rejected", v)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+// principal is the authenticated caller of a request.
+type principal struct {
+	// id is the id of the person.
+	id        string
+	sessionID string
+	// actorID is the admin impersonating the person, if any.
+	actorID     string
+	permissions permissionList
+	// permission is the one that authorized the current request. It decides which
+	// records the request may touch.
+	permission string
+}
+
+// scope narrows a query down to the records a caller may access. Empty fields
+// don't restrict anything, so the zero value gives access to all records.
+type scope struct {
+	studentID string
+	teacherID string
+	// facultyNumber narrows the exams down to one student's.
+	facultyNumber string
+}
+
+// examScope returns the exams the caller may read or write: teachers only get
+// the exams of courses they lead and students only their own exams.
+func examScope(p principal) (scope, error) {
+	switch p.permission {
+	case permExamRead, permExamWriteAny:
+		return scope{}, nil
+	case permExamReadLed, permExamWrite:
+		return scope{teacherID: p.id}, nil
+	case permExamReadOwn:
+		return scope{studentID: p.id}, nil
+	}
+	return scope{}, errMissingPermission
+}
+
+// courseScope returns the courses the caller may read or change.
+func courseScope(p principal) (scope, error) {
+	switch p.permission {
+	case permCourseManage:
+		return scope{}, nil
+	case permCourseReadOwn:
+		return scope{teacherID: p.id}, nil
+	}
+	return scope{}, errMissingPermission
+}
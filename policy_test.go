@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// Test_examScope_teacher checks that teachers only get the exams of the
+// courses they lead, even when they are teachers of another course.
+func Test_examScope_teacher(t *testing.T) {
+	s := newTestServer(t, testConfig())
+
+	const otherTeacherID = "00000000-0000-0000-0000-00000000f004"
+	s.db.people = append(s.db.people, &memoryPerson{id: otherTeacherID, name: "ivan3", email: "test3@test.com"})
+	s.db.teachers = append(s.db.teachers, &memoryMember{id: "00000000-0000-0000-0000-00000000c002", personID: otherTeacherID, active: true})
+
+	tests := []struct {
+		name   string
+		target string
+	}{
+		{"All exams", "/exams"},
+		{"Exams of a student", "/students/12312312/exams"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var exams []Exam
+			if status := s.do(http.MethodGet, test.target, "", otherTeacherID, &exams); status != http.StatusOK {
+				t.Fatalf("Expected %d, but got %d", http.StatusOK, status)
+			}
+			if len(exams) != 0 {
+				t.Fatalf("Expected no exams of courses led by others, but got %v", exams)
+			}
+
+			if status := s.do(http.MethodGet, test.target, "", demoTeacherID, &exams); status != http.StatusOK || len(exams) != 3 {
+				t.Fatalf("Expected the 3 exams of the courses the teacher leads, but got %d %v", status, exams)
+			}
+		})
+	}
+
+	var p problem
+	body := `{"CourseName":"Math","StudentFacultyNumber":"12312312","Points":34}`
+	if status := s.do(http.MethodPost, "/exams", body, otherTeacherID, &p); status != http.StatusForbidden || p.Code != "course_not_in_scope" {
+		t.Fatalf("Expected the exam to be refused, but got %d %s", status, p.Code)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// apiFunc handles a request and returns the error to answer it with, see
+// respondWithError. Handlers write the response themselves when they succeed.
+type apiFunc func(w http.ResponseWriter, r *http.Request) error
+
+// middleware wraps a handler to run before it, and may answer the request itself
+// by returning an error.
+type middleware func(next apiFunc) apiFunc
+
+// router dispatches requests by method and path. A pattern segment written as
+// {name} matches any single path segment, which the handler reads with pathParam.
+type router struct {
+	routes []*route
+}
+
+type route struct {
+	segments []string
+	handlers map[string]apiFunc
+}
+
+type pathParamsKey struct{}
+
+var (
+	errRouteNotFound    = errors.New("not found")
+	errMethodNotAllowed = errors.New("method not allowed")
+)
+
+func newRouter() *router {
+	return &router{}
+}
+
+// handle registers the handler for the method and pattern. The middleware runs
+// in the order it is given.
+func (rt *router) handle(method, pattern string, fn apiFunc, mw ...middleware) {
+	for i := len(mw) - 1; i >= 0; i-- {
+		fn = mw[i](fn)
+	}
+
+	segments := splitPath(pattern)
+	for _, v := range rt.routes {
+		if strings.Join(v.segments, "/") == strings.Join(segments, "/") {
+			if _, ok := v.handlers[method]; ok {
+				panic(fmt.Sprintf("route %s %s registered twice", method, pattern))
+			}
+			v.handlers[method] = fn
+			return
+		}
+	}
+	rt.routes = append(rt.routes, &route{segments: segments, handlers: map[string]apiFunc{method: fn}})
+}
+
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	segments := splitPath(r.URL.EscapedPath())
+
+	for _, v := range rt.routes {
+		params, ok := v.match(segments)
+		if !ok {
+			continue
+		}
+
+		fn, ok := v.handlers[r.Method]
+		if !ok {
+			methods := v.methods()
+			w.Header().Set("Allow", strings.Join(methods, ", "))
+			respondWithError(w, r, fmt.Errorf("%w, only %s", errMethodNotAllowed, strings.Join(methods, ", ")))
+			return
+		}
+
+		r = r.WithContext(context.WithValue(r.Context(), pathParamsKey{}, params))
+		if err := fn(w, r); err != nil {
+			respondWithError(w, r, err)
+		}
+		return
+	}
+
+	respondWithError(w, r, errRouteNotFound)
+}
+
+// match reports whether the path matches the route and returns its parameters.
+func (rt *route) match(segments []string) (map[string]string, bool) {
+	if len(segments) != len(rt.segments) {
+		return nil, false
+	}
+
+	params := map[string]string{}
+	for i, v := range rt.segments {
+		if strings.HasPrefix(v, "{") && strings.HasSuffix(v, "}") {
+			value, err := url.PathUnescape(segments[i])
+			if err != nil || value == "" {
+				return nil, false
+			}
+			params[v[1:len(v)-1]] = value
+		} else if v != segments[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+func (rt *route) methods() []string {
+	methods := make([]string, 0, len(rt.handlers))
+	for k := range rt.handlers {
+		methods = append(methods, k)
+	}
+	sort.Strings(methods)
+	return methods
+}
+
+// methods lists every method a route is registered for.
+func (rt *router) methods() []string {
+	seen := map[string]bool{}
+	var methods []string
+	for _, v := range rt.routes {
+		for _, method := range v.methods() {
+			if !seen[method] {
+				seen[method] = true
+				methods = append(methods, method)
+			}
+		}
+	}
+	sort.Strings(methods)
+	return methods
+}
+
+// patterns lists the registered routes as "METHOD /pattern".
+func (rt *router) patterns() []string {
+	var patterns []string
+	for _, v := range rt.routes {
+		for _, method := range v.methods() {
+			patterns = append(patterns, method+" /"+strings.Join(v.segments, "/"))
+		}
+	}
+	return patterns
+}
+
+func splitPath(path string) []string {
+	return strings.Split(strings.Trim(path, "/"), "/")
+}
+
+// pathParam returns the value of the {name} segment of the route.
+func pathParam(r *http.Request, name string) string {
+	params, _ := r.Context().Value(pathParamsKey{}).(map[string]string)
+	return params[name]
+}
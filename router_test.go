@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_router(t *testing.T) {
+	var order []string
+	trace := func(name string) middleware {
+		return func(next apiFunc) apiFunc {
+			return func(w http.ResponseWriter, r *http.Request) error {
+				order = append(order, name)
+				return next(w, r)
+			}
+		}
+	}
+
+	rt := newRouter()
+	rt.handle(http.MethodGet, "/students/{facultyNumber}/exams", func(w http.ResponseWriter, r *http.Request) error {
+		respondWithMessage(w, pathParam(r, "facultyNumber"), http.StatusOK)
+		return nil
+	}, trace("first"), trace("second"))
+	rt.handle(http.MethodDelete, "/courses/{id}", func(w http.ResponseWriter, r *http.Request) error {
+		return fmt.Errorf("deleting %s: %w", pathParam(r, "id"), errCourseNotFound)
+	})
+	rt.handle(http.MethodPatch, "/courses/{id}", func(w http.ResponseWriter, r *http.Request) error {
+		return errors.New("connection refused")
+	})
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		status int
+		body   string
+	}{
+		{"Path parameter", http.MethodGet, "/students/12312312/exams", http.StatusOK, `{"message":"12312312"}`},
+		{"Escaped path parameter", http.MethodGet, "/students/a%2Fb/exams/", http.StatusOK, `{"message":"a/b"}`},
+		{"Unknown path", http.MethodGet, "/students/12312312", http.StatusNotFound, `{"type":"about:blank","title":"Not Found","status":404,"detail":"not found","instance":"/students/12312312","code":"not_found"}`},
+		{"Other method", http.MethodPost, "/courses/1", http.StatusMethodNotAllowed, `{"type":"about:blank","title":"Method Not Allowed","status":405,"detail":"method not allowed, only DELETE, PATCH","instance":"/courses/1","code":"method_not_allowed"}`},
+		{"Mapped error", http.MethodDelete, "/courses/1", http.StatusNotFound, `{"type":"about:blank","title":"Not Found","status":404,"detail":"deleting 1: course not found","instance":"/courses/1","code":"course_not_found"}`},
+		{"Unknown error", http.MethodPatch, "/courses/1", http.StatusInternalServerError, `{"type":"about:blank","title":"Internal Server Error","status":500,"detail":"something went wrong","instance":"/courses/1","code":"internal_error"}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			rt.ServeHTTP(w, httptest.NewRequest(test.method, test.target, nil))
+
+			if w.Code != test.status {
+				t.Fatalf("Expected status %d, but got %d", test.status, w.Code)
+			}
+			if body := strings.TrimSpace(w.Body.String()); body != test.body {
+				t.Fatalf("Expected body %s, but got %s", test.body, body)
+			}
+		})
+	}
+
+	if strings.Join(order, ",") != "first,second,first,second" {
+		t.Fatalf("Expected the middleware to run in order, but got %v", order)
+	}
+	if methods := strings.Join(rt.methods(), ", "); methods != "DELETE, GET, PATCH" {
+		t.Fatalf("Expected every registered method once, but got %s", methods)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+//go:embed fixtures/*.sql
+var fixtureFiles embed.FS
+
+var errSeedInProduction = errors.New("refusing to load fixtures unless APP_ENV is development or staging")
+
+// fixtureSets returns the names of the embedded fixture sets.
+func fixtureSets() []string {
+	names, _ := fs.Glob(fixtureFiles, "fixtures/*.sql")
+
+	var sets []string
+	for _, n := range names {
+		sets = append(sets, strings.TrimSuffix(path.Base(n), ".sql"))
+	}
+	sort.Strings(sets)
+	return sets
+}
+
+// readFixture returns the SQL of an embedded fixture set, or of a file on disk
+// when the name ends in .sql.
+func readFixture(name string) (string, error) {
+	if strings.HasSuffix(name, ".sql") {
+		b, err := os.ReadFile(name)
+		return string(b), err
+	}
+
+	b, err := fixtureFiles.ReadFile("fixtures/" + name + ".sql")
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", fmt.Errorf("unknown fixture set %q, available sets are %s", name, strings.Join(fixtureSets(), ", "))
+	}
+	return string(b), err
+}
+
+// seed loads a fixture set in a single transaction. Fixtures only insert rows
+// with fixed keys and skip conflicting ones, so seeding twice changes nothing.
+func seed(db *sqlx.DB, env, name string) error {
+	// Fixtures are only loaded where it was asked for explicitly, the default
+	// environment is production.
+	if env != "development" && env != "staging" {
+		return errSeedInProduction
+	}
+
+	query, err := readFixture(name)
+	if err != nil {
+		return err
+	}
+
+	m, err := newMigrator(db)
+	if err != nil {
+		return err
+	}
+
+	pending, err := m.pending()
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("database schema is not up to date, run migrate up first")
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if _, err = tx.Exec(query); err != nil {
+		return fmt.Errorf("fixture set %s failed: %w", name, err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	log.Printf("Loaded fixture set %s", name)
+	return nil
+}
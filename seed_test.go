@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func Test_seed_env(t *testing.T) {
+	tests := []struct {
+		name string
+		env  string
+	}{
+		{"Production", "production"},
+		{"Default", defaultConfig().Env},
+		{"Unset", ""},
+		{"Unknown", "test"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// The guard comes before the database is touched, so there is none.
+			if err := seed(nil, test.env, "demo"); !errors.Is(err, errSeedInProduction) {
+				t.Fatalf("Expected %v, but got %v", errSeedInProduction, err)
+			}
+		})
+	}
+}
+
+// Test_fixtures checks that every fixture set only inserts rows with fixed ids
+// and skips the existing ones, so that seeding twice changes nothing.
+func Test_fixtures(t *testing.T) {
+	comment := regexp.MustCompile(`(?m)^--.*$`)
+	insert := regexp.MustCompile(`^INSERT INTO \w+\(id, `)
+
+	for _, set := range fixtureSets() {
+		t.Run(set, func(t *testing.T) {
+			query, err := readFixture(set)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, v := range strings.Split(comment.ReplaceAllString(query, ""), ";") {
+				if v = strings.TrimSpace(v); v == "" {
+					continue
+				}
+				if !insert.MatchString(v) || !strings.HasSuffix(v, "ON CONFLICT DO NOTHING") {
+					t.Fatalf("Expected an INSERT with a fixed id skipping conflicts, but got %s", v)
+				}
+				if strings.Contains(v, "gen_random_uuid") || strings.Contains(v, "random()") {
+					t.Fatalf("Expected fixed values, but got %s", v)
+				}
+			}
+		})
+	}
+}
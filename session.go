@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"time"
+)
+
+const (
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 30 * 24 * time.Hour
+)
+
+var (
+	errInvalidRefreshToken = errors.New("refresh token is invalid or expired")
+	errRefreshTokenReused  = errors.New("refresh token was already used")
+)
+
+// newOpaqueToken returns a random url safe token. Only its hash is ever stored.
+func newOpaqueToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// createSession starts a new login session for the person and returns its id
+// together with the first refresh token of the chain.
+func (conn dbConnection) createSession(personID string) (sessionID, refreshToken string, err error) {
+	tx, err := conn.db.Beginx()
+	if err != nil {
+		return "", "", err
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if err = tx.Get(&sessionID, "INSERT INTO session(person_id) VALUES ($1) RETURNING id", personID); err != nil {
+		return "", "", err
+	}
+
+	if refreshToken, err = newOpaqueToken(); err != nil {
+		return "", "", err
+	}
+
+	if _, err = tx.Exec("INSERT INTO refresh_token(session_id, token_hash, expires_at) VALUES ($1, $2, $3)", sessionID, hashToken(refreshToken), time.Now().Add(refreshTokenTTL)); err != nil {
+		return "", "", err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return "", "", err
+	}
+
+	return sessionID, refreshToken, nil
+}
+
+// rotateRefreshToken exchanges a refresh token for a new one in the same session.
+// Presenting a token that was already exchanged revokes the whole session, as it
+// means the token has leaked.
+func (conn dbConnection) rotateRefreshToken(refreshToken string) (personID, sessionID, newRefreshToken string, err error) {
+	tx, err := conn.db.Beginx()
+	if err != nil {
+		return "", "", "", err
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	var rt struct {
+		Id        string
+		SessionId string
+		PersonId  string
+		Used      bool
+		Revoked   bool
+		ExpiresAt time.Time
+	}
+	err = tx.Get(&rt, "SELECT rt.id, rt.session_id as SessionId, s.person_id as PersonId, rt.used, s.revoked, rt.expires_at as ExpiresAt FROM refresh_token rt JOIN session s ON s.id = rt.session_id WHERE rt.token_hash=$1 FOR UPDATE", hashToken(refreshToken))
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", "", "", errInvalidRefreshToken
+	} else if err != nil {
+		return "", "", "", err
+	}
+
+	if rt.Revoked || time.Now().After(rt.ExpiresAt) {
+		return "", "", "", errInvalidRefreshToken
+	}
+
+	if rt.Used {
+		log.Printf("Refresh token reuse detected, revoking session %s", rt.SessionId)
+		if _, err = tx.Exec("UPDATE session SET revoked=TRUE WHERE id=$1", rt.SessionId); err != nil {
+			return "", "", "", err
+		}
+		if err = tx.Commit(); err != nil {
+			return "", "", "", err
+		}
+		return "", "", "", errRefreshTokenReused
+	}
+
+	if newRefreshToken, err = newOpaqueToken(); err != nil {
+		return "", "", "", err
+	}
+
+	if _, err = tx.Exec("UPDATE refresh_token SET used=TRUE WHERE id=$1", rt.Id); err != nil {
+		return "", "", "", err
+	}
+
+	if _, err = tx.Exec("INSERT INTO refresh_token(session_id, token_hash, expires_at) VALUES ($1, $2, $3)", rt.SessionId, hashToken(newRefreshToken), time.Now().Add(refreshTokenTTL)); err != nil {
+		return "", "", "", err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return "", "", "", err
+	}
+
+	return rt.PersonId, rt.SessionId, newRefreshToken, nil
+}
+
+func (conn dbConnection) revokeSessionByRefreshToken(refreshToken string) error {
+	res, err := conn.db.Exec("UPDATE session SET revoked=TRUE WHERE id=(SELECT session_id FROM refresh_token WHERE token_hash=$1)", hashToken(refreshToken))
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return errInvalidRefreshToken
+	}
+	return nil
+}
+
+func (conn dbConnection) revokePersonSessions(personID string) error {
+	if _, err := conn.db.Exec("UPDATE session SET revoked=TRUE WHERE person_id=$1", personID); err != nil {
+		return err
+	}
+	return nil
+}
+
+// revokeOtherSessions ends every session of the person but the given one.
+func (conn dbConnection) revokeOtherSessions(personID, sessionID string) error {
+	if _, err := conn.db.Exec("UPDATE session SET revoked=TRUE WHERE person_id=$1 AND id::text<>$2", personID, sessionID); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (conn dbConnection) isSessionActive(sessionID string) bool {
+	var revoked bool
+	if err := conn.db.Get(&revoked, "SELECT revoked FROM session WHERE id=$1", sessionID); err != nil {
+		return false
+	}
+	return !revoked
+}
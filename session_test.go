@@ -0,0 +1,153 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+type tokenPair struct {
+	Token        string
+	RefreshToken string
+}
+
+// login logs the person in with the demo password.
+func login(t *testing.T, s testServer, email string) tokenPair {
+	t.Helper()
+
+	var tokens tokenPair
+	if status := s.do(http.MethodPost, "/login", `{"Email":"`+email+`","Password":"test_pas_123"}`, "", &tokens); status != http.StatusOK || tokens.RefreshToken == "" {
+		t.Fatalf("Expected a login, but got %d %+v", status, tokens)
+	}
+	return tokens
+}
+
+// refresh exchanges the refresh token and returns the status and the problem
+// code, if any.
+func refresh(s testServer, refreshToken string) (tokenPair, int, string) {
+	var body struct {
+		tokenPair
+		Code string `json:"code"`
+	}
+	status := s.do(http.MethodPost, "/token/refresh", `{"RefreshToken":"`+refreshToken+`"}`, "", &body)
+	return body.tokenPair, status, body.Code
+}
+
+// authorized reports whether the access token is still accepted.
+func authorized(s testServer, token string) bool {
+	return s.withToken(http.MethodGet, "/exams", "", token, nil) == http.StatusOK
+}
+
+func Test_refreshTokenRotation(t *testing.T) {
+	s := newTestServer(t, testConfig())
+	first := login(t, s, "test@test.com")
+
+	second, status, _ := refresh(s, first.RefreshToken)
+	if status != http.StatusOK || second.RefreshToken == first.RefreshToken || !authorized(s, second.Token) {
+		t.Fatalf("Expected a new token pair, but got %d %+v", status, second)
+	}
+
+	third, status, _ := refresh(s, second.RefreshToken)
+	if status != http.StatusOK {
+		t.Fatalf("Expected the new refresh token to work, but got %d", status)
+	}
+
+	// Using a token twice means it leaked, which ends the whole session.
+	if _, status, code := refresh(s, first.RefreshToken); status != http.StatusUnauthorized || code != "invalid_refresh_token" {
+		t.Fatalf("Expected a reused refresh token to be rejected, but got %d %s", status, code)
+	}
+	if _, status, _ = refresh(s, third.RefreshToken); status != http.StatusUnauthorized {
+		t.Fatalf("Expected the session to be revoked, but its latest refresh token got %d", status)
+	}
+	if authorized(s, third.Token) {
+		t.Fatal("Expected the access tokens of the revoked session to be rejected")
+	}
+
+	// Other sessions aren't affected.
+	if other := login(t, s, "test@test.com"); !authorized(s, other.Token) {
+		t.Fatal("Expected a new session to work")
+	}
+}
+
+func Test_logout(t *testing.T) {
+	s := newTestServer(t, testConfig())
+	tokens := login(t, s, "test@test.com")
+	other := login(t, s, "test@test.com")
+
+	if status := s.do(http.MethodPost, "/logout", `{"RefreshToken":"`+tokens.RefreshToken+`"}`, "", nil); status != http.StatusOK {
+		t.Fatalf("Expected a logout, but got %d", status)
+	}
+
+	if _, status, _ := refresh(s, tokens.RefreshToken); status != http.StatusUnauthorized {
+		t.Fatalf("Expected the refresh token to be revoked, but got %d", status)
+	}
+	if authorized(s, tokens.Token) {
+		t.Fatal("Expected the access token to be revoked")
+	}
+	if !authorized(s, other.Token) {
+		t.Fatal("Expected the other session to stay")
+	}
+
+	if status := s.do(http.MethodPost, "/logout", `{"RefreshToken":"unknown"}`, "", nil); status != http.StatusUnauthorized {
+		t.Fatalf("Expected an unknown refresh token to be rejected, but got %d", status)
+	}
+}
+
+func Test_passwordChangeRevokesSessions(t *testing.T) {
+	s := newTestServer(t, testConfig())
+	current := login(t, s, "test@test.com")
+	other := login(t, s, "test@test.com")
+
+	if status := s.withToken(http.MethodPost, "/change-password", `{"OldPassword":"test_pas_123","NewPassword":"new_test_pas_123"}`, current.Token, nil); status != http.StatusOK {
+		t.Fatalf("Expected the password to change, but got %d", status)
+	}
+
+	if !authorized(s, current.Token) {
+		t.Fatal("Expected the session the password was changed in to stay")
+	}
+	if authorized(s, other.Token) {
+		t.Fatal("Expected the other sessions to be revoked")
+	}
+	if _, status, _ := refresh(s, other.RefreshToken); status != http.StatusUnauthorized {
+		t.Fatalf("Expected the refresh token of another session to be revoked, but got %d", status)
+	}
+}
+
+func Test_passwordResetRevokesSessions(t *testing.T) {
+	s := newTestServer(t, testConfig())
+	tokens := login(t, s, "test@test.com")
+
+	if status := s.do(http.MethodPost, "/forgotten-password", `{"Email":"test@test.com"}`, "", nil); status != http.StatusOK {
+		t.Fatalf("Expected a reset code, but got %d", status)
+	}
+	code := emailedCode(t, s.db, "test@test.com")
+
+	if status := s.do(http.MethodPost, "/reset-password", `{"Code":"`+code+`","Password":"new_test_pas_123"}`, "", nil); status != http.StatusOK {
+		t.Fatalf("Expected the password to be reset, but got %d", status)
+	}
+
+	if authorized(s, tokens.Token) {
+		t.Fatal("Expected every session to be revoked")
+	}
+	if _, status, _ := refresh(s, tokens.RefreshToken); status != http.StatusUnauthorized {
+		t.Fatalf("Expected the refresh token to be revoked, but got %d", status)
+	}
+}
+
+// emailedCode returns the code of the last email the store queued for the recipient.
+func emailedCode(t *testing.T, s *memoryStore, recipient string) string {
+	t.Helper()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := len(s.outbox) - 1; i >= 0; i-- {
+		if v := s.outbox[i]; v.Recipient == recipient {
+			if _, code, ok := strings.Cut(v.body, "code="); ok {
+				return strings.Fields(code)[0]
+			}
+		}
+	}
+	t.Fatalf("No code was emailed to %s", recipient)
+	return ""
+}
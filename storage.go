@@ -0,0 +1,73 @@
+package main
+
+import "time"
+
+// storage is everything the handler reads and writes. dbConnection keeps it in
+// Postgres and memoryStore in memory, for tests.
+type storage interface {
+	validateUserLogin(email string, password []byte) (string, bool)
+	getUserRoles(personID string) []string
+	getExams(s scope) ([]Exam, error)
+	insertExam(s scope, e Exam) error
+	delete(table, uuid string) error
+	getCourses(s scope) ([]Course, error)
+	insertCourse(Course) error
+	updateCourse(Course) error
+	getAllStudents() ([]Student, error)
+	insertStudent(Student) error
+	updateStudent(Student) error
+	getAllTeachers() ([]Teacher, error)
+	insertTeacher(Teacher) error
+	updateTeacher(Teacher) error
+	archiveStudent(facultyNumber string) error
+	archiveTeacher(personID string) error
+	resendPassword(email string) error
+	changePassword(personID, sessionID, oldPassword, newPassword string) error
+	createPassword(code, password string) error
+	resetPassword(code, password string) error
+	createSession(personID string) (sessionID, refreshToken string, err error)
+	rotateRefreshToken(refreshToken string) (personID, sessionID, newRefreshToken string, err error)
+	revokeSessionByRefreshToken(refreshToken string) error
+	isSessionActive(sessionID string) bool
+	getUserPermissions(personID string) permissionList
+	getRoles() ([]Role, error)
+	insertRole(Role) error
+	updateRole(Role) error
+	deleteRole(name string) error
+	assignRole(personID, role string) error
+	unassignRole(personID, role string) error
+	getDeadEmails() ([]OutboxEmail, error)
+	retryEmail(id int64) error
+	checkLogin(email, ip string) (time.Duration, error)
+	attemptLogin(email, ip string, attempt func() error) (time.Duration, error)
+	clearLoginFailures(email string) error
+	throttleRequest(kind, key string) (time.Duration, error)
+	getLockouts() ([]Lockout, error)
+	unlockLogin(kind, key string) error
+	issueCode(purpose codePurpose, subject string, ttl time.Duration) (string, error)
+	peekCode(purpose codePurpose, code string) (string, error)
+	consumeCode(purpose codePurpose, code string) (string, error)
+	twoFactorStatus(personID string) (enabled, required bool, err error)
+	startTOTPEnrollment(personID string) (string, error)
+	confirmTOTP(personID, code string) ([]string, error)
+	verifySecondFactor(personID, code string) error
+	regenerateRecoveryCodes(personID, code string) ([]string, error)
+	disableTOTP(personID, code string) error
+	getPersonEmail(personID string) (string, error)
+	changeEmail(personID, newEmail string) error
+	verifyEmailChange(code string) error
+	sendMagicLink(email string) error
+	consumeMagicLink(code string) (string, error)
+	personIDByEmail(email string) (string, error)
+	startImpersonation(actorID, subjectID, reason string, allowWrites bool) (string, error)
+	impersonationAllowsWrites(impersonationID string) (bool, error)
+	recordImpersonatedRequest(impersonationID, method, path string, blocked bool) error
+	getImpersonations() ([]Impersonation, error)
+	getImpersonatedRequests(impersonationID string) ([]ImpersonatedRequest, error)
+	authenticateAPIKey(key string) (serviceAccountID string, scopes permissionList, err error)
+	getServiceAccounts() ([]ServiceAccount, error)
+	insertServiceAccount(name string) (string, error)
+	deleteServiceAccount(id string) error
+	createAPIKey(serviceAccountID string, scopes []string, expiresAt time.Time) (string, error)
+	revokeAPIKey(id string) error
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+const (
+	throttleAccount = "account"
+	throttleIP      = "ip"
+	// throttlePasswordReset counts the password resets requested from an IP.
+	throttlePasswordReset = "password_reset"
+)
+
+// throttleLockClass namespaces the advisory locks of the throttles, which are
+// keyed by the hash of their kind and key.
+const throttleLockClass = 6481
+
+var (
+	errLoginThrottled   = errors.New("too many failed login attempts, try again later")
+	errRequestThrottled = errors.New("too many requests, try again later")
+	errLockoutNotFound  = errors.New("no lockout found")
+)
+
+// checkLogin returns errLoginThrottled and how long to wait when the account or
+// the IP has to wait after failed attempts.
+func (conn dbConnection) checkLogin(email, ip string) (time.Duration, error) {
+	return blockedFor(conn.db, throttleKey{throttleAccount, email}, throttleKey{throttleIP, ip})
+}
+
+// attemptLogin runs the attempt and records it, unless the account or the IP has
+// to wait. The attempt is counted as a failure of both before it runs, while the
+// transaction holds their throttles, so parallel attempts are counted one after
+// the other without a connection being held while the password is checked. A
+// success takes the failures back, the account's earlier ones stay until the
+// login completes, see clearLoginFailures.
+func (conn dbConnection) attemptLogin(email, ip string, attempt func() error) (time.Duration, error) {
+	charges, wait, err := conn.chargeLogin(email, ip)
+	if err != nil {
+		return wait, err
+	}
+
+	err = attempt()
+	if recordErr := conn.recordLoginAttempt(email, ip, charges, err == nil); recordErr != nil {
+		log.Printf("Failed recording login attempt, \n%v", recordErr)
+	}
+	return 0, err
+}
+
+// chargeLogin counts a failure of the account and the IP, unless either has to
+// wait, and returns how to take them back.
+func (conn dbConnection) chargeLogin(email, ip string) ([]throttleCharge, time.Duration, error) {
+	tx, err := conn.db.Beginx()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	keys := []throttleKey{{throttleAccount, email}, {throttleIP, ip}}
+	if err = lockThrottles(tx, keys...); err != nil {
+		return nil, 0, err
+	}
+	if wait, err := blockedFor(tx, keys...); err != nil {
+		return nil, wait, err
+	}
+
+	var charges []throttleCharge
+	for _, k := range keys {
+		lockoutAttempts := conn.login.AccountLockoutAttempts
+		if k.kind == throttleIP {
+			lockoutAttempts = conn.login.IPLockoutAttempts
+		}
+
+		c, err := conn.chargeFailure(tx, k, lockoutAttempts)
+		if err != nil {
+			return nil, 0, err
+		}
+		charges = append(charges, c)
+	}
+	return charges, 0, tx.Commit()
+}
+
+// throttleRequest counts a request against the throttle of the key, e.g. the
+// password resets requested from an IP, like a failed login. It returns
+// errRequestThrottled and how long to wait when the key already has to wait.
+func (conn dbConnection) throttleRequest(kind, key string) (time.Duration, error) {
+	tx, err := conn.db.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if err = lockThrottles(tx, throttleKey{kind, key}); err != nil {
+		return 0, err
+	}
+	if wait, err := blockedFor(tx, throttleKey{kind, key}); errors.Is(err, errLoginThrottled) {
+		return wait, errRequestThrottled
+	} else if err != nil {
+		return 0, err
+	}
+
+	if _, err = conn.recordFailure(tx, kind, key, conn.login.IPLockoutAttempts); err != nil {
+		return 0, err
+	}
+	return 0, tx.Commit()
+}
+
+type throttleKey struct {
+	kind, key string
+}
+
+// lockThrottles takes the throttles of the keys until the transaction ends. Keys
+// are always taken in the same order, the account before the IP.
+func lockThrottles(tx *sqlx.Tx, keys ...throttleKey) error {
+	for _, k := range keys {
+		if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1, hashtext($2))", throttleLockClass, k.kind+":"+k.key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// blockedFor returns errLoginThrottled and how long to wait when one of the
+// throttles of the keys is blocked.
+func blockedFor(q sqlx.Queryer, keys ...throttleKey) (time.Duration, error) {
+	var kinds, values []string
+	for _, k := range keys {
+		kinds, values = append(kinds, k.kind), append(values, k.key)
+	}
+
+	var blockedUntil sql.NullTime
+	err := sqlx.Get(q, &blockedUntil, "SELECT MAX(blocked_until) FROM login_throttle WHERE (kind, key) IN (SELECT * FROM unnest($1::text[], $2::text[]))",
+		pq.Array(kinds), pq.Array(values))
+	if err != nil {
+		return 0, err
+	}
+
+	if wait := time.Until(blockedUntil.Time); blockedUntil.Valid && wait > 0 {
+		return wait, errLoginThrottled
+	}
+	return 0, nil
+}
+
+// throttleState is a row of login_throttle.
+type throttleState struct {
+	Failures      int
+	LastFailureAt time.Time    `db:"last_failure_at"`
+	BlockedUntil  sql.NullTime `db:"blocked_until"`
+}
+
+// throttleCharge is a failure counted against a throttle before the attempt ran.
+// It keeps the throttle's state from before, nil if it had none, and the count
+// the charge left it at.
+type throttleCharge struct {
+	throttleKey
+	before   *throttleState
+	failures int
+}
+
+// chargeFailure counts a failure of the throttle like recordFailure and returns
+// the charge to take it back with.
+func (conn dbConnection) chargeFailure(tx *sqlx.Tx, k throttleKey, lockoutAttempts int) (throttleCharge, error) {
+	c := throttleCharge{throttleKey: k}
+
+	var before throttleState
+	err := tx.Get(&before, "SELECT failures, last_failure_at, blocked_until FROM login_throttle WHERE kind=$1 AND key=$2", k.kind, k.key)
+	if err == nil {
+		c.before = &before
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return c, err
+	}
+
+	c.failures, err = conn.recordFailure(tx, k.kind, k.key, lockoutAttempts)
+	return c, err
+}
+
+// refundFailure takes back a charged failure. The throttle gets its state from
+// before the charge when nothing was counted against it since, otherwise only
+// the count goes down.
+func refundFailure(tx *sqlx.Tx, c throttleCharge) error {
+	var failures int
+	err := tx.Get(&failures, "SELECT failures FROM login_throttle WHERE kind=$1 AND key=$2", c.kind, c.key)
+	if errors.Is(err, sql.ErrNoRows) {
+		// It was unlocked in the meantime.
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	switch {
+	case failures != c.failures:
+		_, err = tx.Exec("UPDATE login_throttle SET failures=GREATEST(failures - 1, 0) WHERE kind=$1 AND key=$2", c.kind, c.key)
+	case c.before == nil:
+		_, err = tx.Exec("DELETE FROM login_throttle WHERE kind=$1 AND key=$2", c.kind, c.key)
+	default:
+		_, err = tx.Exec("UPDATE login_throttle SET failures=$3, last_failure_at=$4, blocked_until=$5 WHERE kind=$1 AND key=$2",
+			c.kind, c.key, c.before.Failures, c.before.LastFailureAt, c.before.BlockedUntil)
+	}
+	return err
+}
+
+// recordLoginAttempt logs the attempt. A success takes back the failures it was
+// charged with.
+func (conn dbConnection) recordLoginAttempt(email, ip string, charges []throttleCharge, success bool) error {
+	tx, err := conn.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if _, err = tx.Exec("INSERT INTO login_attempt(email, ip, success) VALUES ($1, $2, $3)", email, ip, success); err != nil {
+		return err
+	}
+
+	if success {
+		if err = lockThrottles(tx, throttleKey{throttleAccount, email}, throttleKey{throttleIP, ip}); err != nil {
+			return err
+		}
+		for _, c := range charges {
+			if err = refundFailure(tx, c); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// clearLoginFailures clears the account's failures once a login completed, after
+// the second factor for accounts with 2FA, so that knowing the password doesn't
+// reset the throttle of the second factor. The IP's failures stay, so an attacker
+// can't reset them by logging into their own account.
+func (conn dbConnection) clearLoginFailures(email string) error {
+	_, err := conn.db.Exec("DELETE FROM login_throttle WHERE kind=$1 AND key=$2", throttleAccount, email)
+	return err
+}
+
+// recordFailure counts a failure of the throttle, blocks it for the delay the
+// count calls for and returns the count. Failures older than the window are
+// forgotten.
+func (conn dbConnection) recordFailure(tx *sqlx.Tx, kind, key string, lockoutAttempts int) (int, error) {
+	var failures int
+	err := tx.Get(&failures, `
+		INSERT INTO login_throttle(kind, key, failures, last_failure_at) VALUES ($1, $2, 1, NOW())
+		ON CONFLICT (kind, key) DO UPDATE SET
+			failures = CASE WHEN login_throttle.last_failure_at < NOW() - make_interval(secs => $3) THEN 1 ELSE login_throttle.failures + 1 END,
+			last_failure_at = NOW()
+		RETURNING failures`, kind, key, time.Duration(conn.login.Window).Seconds())
+	if err != nil {
+		return 0, err
+	}
+
+	delay := conn.login.delay(failures)
+	if failures >= lockoutAttempts {
+		delay = time.Duration(conn.login.LockoutDuration)
+	}
+	if delay == 0 {
+		return failures, nil
+	}
+
+	_, err = tx.Exec("UPDATE login_throttle SET blocked_until=NOW() + make_interval(secs => $3) WHERE kind=$1 AND key=$2", kind, key, delay.Seconds())
+	return failures, err
+}
+
+// delay returns how long to wait after the given number of failures. The first
+// free attempts aren't delayed, every further one doubles the delay.
+func (c loginConfig) delay(failures int) time.Duration {
+	if failures <= c.FreeAttempts {
+		return 0
+	}
+
+	delay, maxDelay := time.Duration(c.BaseDelay), time.Duration(c.MaxDelay)
+	for i := c.FreeAttempts + 1; i < failures && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		return maxDelay
+	}
+	return delay
+}
+
+// getLockouts returns the accounts and IPs that currently can't log in.
+func (conn dbConnection) getLockouts() ([]Lockout, error) {
+	lockouts := []Lockout{}
+	if err := conn.db.Select(&lockouts, "SELECT kind, key, failures, blocked_until FROM login_throttle WHERE blocked_until > NOW() ORDER BY blocked_until DESC"); err != nil {
+		return nil, err
+	}
+	return lockouts, nil
+}
+
+// unlockLogin clears the failures of an account or IP.
+func (conn dbConnection) unlockLogin(kind, key string) error {
+	res, err := conn.db.Exec("DELETE FROM login_throttle WHERE kind=$1 AND key=$2", kind, key)
+	if err != nil {
+		return err
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errLockoutNotFound
+	}
+	return nil
+}
+
+// clientIP returns the IP of the caller. Behind a trusted proxy it is the last
+// address the proxy added to X-Forwarded-For, earlier ones can be forged.
+func clientIP(r *http.Request, trustProxy bool) string {
+	if trustProxy {
+		if values := r.Header.Values("X-Forwarded-For"); len(values) > 0 {
+			addresses := strings.Split(values[len(values)-1], ",")
+			return strings.TrimSpace(addresses[len(addresses)-1])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_loginConfig_delay(t *testing.T) {
+	c := defaultConfig().Login
+
+	tests := []struct {
+		failures int
+		expected time.Duration
+	}{
+		{1, 0},
+		{3, 0},
+		{4, time.Second},
+		{5, 2 * time.Second},
+		{6, 4 * time.Second},
+		{20, time.Minute},
+	}
+	for _, test := range tests {
+		if got := c.delay(test.failures); got != test.expected {
+			t.Fatalf("Expected a delay of %s after %d failures, but got %s", test.expected, test.failures, got)
+		}
+	}
+}
+
+func Test_clientIP(t *testing.T) {
+	r := httptest.NewRequest("POST", "/login", nil)
+	r.RemoteAddr = "10.0.0.1:51234"
+	r.Header.Add("X-Forwarded-For", "1.1.1.1, 2.2.2.2")
+	r.Header.Add("X-Forwarded-For", "3.3.3.3")
+
+	if ip := clientIP(r, false); ip != "10.0.0.1" {
+		t.Fatalf("Expected the remote address without a trusted proxy, but got %s", ip)
+	}
+	if ip := clientIP(r, true); ip != "3.3.3.3" {
+		t.Fatalf("Expected the address added by the proxy, but got %s", ip)
+	}
+}
+
+// Test_login_parallel checks that a burst of parallel attempts is counted one
+// after the other, so only the free attempts and the one that starts the delay
+// get to check the password.
+func Test_login_parallel(t *testing.T) {
+	cfg := testConfig()
+	s := newTestServer(t, cfg)
+
+	const attempts = 20
+	codes := make(chan string, attempts)
+	var wg sync.WaitGroup
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			var p problem
+			s.do(http.MethodPost, "/login", `{"Email":"test1@test.com","Password":"wrong_pas_123"}`, "", &p)
+			codes <- p.Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	count := map[string]int{}
+	for c := range codes {
+		count[c]++
+	}
+	if count["login_failed"] != cfg.Login.FreeAttempts+1 || count["login_throttled"] != attempts-cfg.Login.FreeAttempts-1 {
+		t.Fatalf("Expected %d failed and the rest throttled attempts, but got %v", cfg.Login.FreeAttempts+1, count)
+	}
+
+	var p problem
+	if status := s.do(http.MethodPost, "/login", `{"Email":"test1@test.com","Password":"test_pas_123"}`, "", &p); status != http.StatusTooManyRequests {
+		t.Fatalf("Expected the right password to wait too, but got %d %s", status, p.Code)
+	}
+}
+
+// Test_login_success checks that a successful login isn't counted against the
+// IP, which every attempt is charged with up front.
+func Test_login_success(t *testing.T) {
+	cfg := testConfig()
+	s := newTestServer(t, cfg)
+
+	for i := 0; i < cfg.Login.FreeAttempts; i++ {
+		if status := s.do(http.MethodPost, "/login", `{"Email":"test1@test.com","Password":"wrong_pas_123"}`, "", nil); status != http.StatusUnauthorized {
+			t.Fatalf("Expected attempt %d to fail, but got %d", i+1, status)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		var p problem
+		if status := s.do(http.MethodPost, "/login", `{"Email":"test@test.com","Password":"test_pas_123"}`, "", &p); status != http.StatusOK {
+			t.Fatalf("Expected login %d from the IP to pass, but got %d %s", i+1, status, p.Code)
+		}
+	}
+}
+
+func Test_forgottenPassword_throttle(t *testing.T) {
+	cfg := testConfig()
+	s := newTestServer(t, cfg)
+
+	for i := 0; i <= cfg.Login.FreeAttempts; i++ {
+		if status := s.do(http.MethodPost, "/forgotten-password", `{"Email":"test1@test.com"}`, "", nil); status != http.StatusOK {
+			t.Fatalf("Expected request %d to pass, but got %d", i+1, status)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/forgotten-password", strings.NewReader(`{"Email":"test1@test.com"}`))
+	w := httptest.NewRecorder()
+	s.http.ServeHTTP(w, r)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("Expected the IP to wait, but got %d %s", w.Code, w.Body)
+	}
+
+	// Other IPs and logins from the same IP aren't affected.
+	r = httptest.NewRequest(http.MethodPost, "/forgotten-password", strings.NewReader(`{"Email":"test1@test.com"}`))
+	r.RemoteAddr = "10.0.0.2:1234"
+	if status := s.serve(r, nil); status != http.StatusOK {
+		t.Fatalf("Expected another IP to pass, but got %d", status)
+	}
+	if status := s.do(http.MethodPost, "/login", `{"Email":"test1@test.com","Password":"test_pas_123"}`, "", nil); status != http.StatusOK {
+		t.Fatalf("Expected the login to pass, but got %d", status)
+	}
+}
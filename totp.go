@@ -0,0 +1,247 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/lib/pq"
+)
+
+// TOTP as in RFC 6238 with the parameters every authenticator app supports.
+const (
+	totpDigits = 6
+	totpPeriod = 30
+	// totpSkew is how many periods a code may be off, for clocks that drift.
+	totpSkew = 1
+
+	recoveryCodeCount = 10
+	loginChallengeTTL = 5 * time.Minute
+)
+
+var (
+	errInvalidSecondFactor = errors.New("invalid two-factor code")
+	errTOTPNotEnrolled     = errors.New("two-factor authentication is not enrolled")
+	errTOTPAlreadyEnabled  = errors.New("two-factor authentication is already enabled")
+	errTwoFactorRequired   = errors.New("two-factor authentication is required for one of your roles")
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func newTOTPSecret() string {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return totpEncoding.EncodeToString(b)
+}
+
+// totpCode returns the code of the secret for the given time step.
+func totpCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000), nil
+}
+
+// verifyTOTP returns the time step the code belongs to when it is valid now.
+func verifyTOTP(secret, code string, now time.Time) (int64, bool) {
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		expected, err := totpCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpURI returns the otpauth URI authenticator apps read from a QR code.
+func totpURI(issuer, email, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(totpPeriod))
+
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(email)
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+// twoFactorStatus reports whether the person has TOTP enabled and whether one of
+// their roles requires it.
+func (conn dbConnection) twoFactorStatus(personID string) (enabled, required bool, err error) {
+	if err = conn.db.Get(&enabled, "SELECT totp_enabled FROM person WHERE id=$1", personID); err != nil {
+		return false, false, err
+	}
+
+	err = conn.db.Get(&required, "SELECT EXISTS(SELECT 1 FROM role WHERE name = ANY($1) AND require_2fa)", pq.Array(conn.getUserRoles(personID)))
+	return enabled, required, err
+}
+
+// startTOTPEnrollment stores a new secret that is only enabled once a code of it
+// is confirmed.
+func (conn dbConnection) startTOTPEnrollment(personID string) (string, error) {
+	secret := newTOTPSecret()
+
+	res, err := conn.db.Exec("UPDATE person SET totp_secret=$2 WHERE id=$1 AND NOT totp_enabled", personID, secret)
+	if err != nil {
+		return "", err
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return "", errTOTPAlreadyEnabled
+	}
+	return secret, nil
+}
+
+// confirmTOTP enables the pending secret when the code matches it and returns a
+// fresh set of recovery codes.
+func (conn dbConnection) confirmTOTP(personID, code string) ([]string, error) {
+	var secret sql.NullString
+	if err := conn.db.Get(&secret, "SELECT totp_secret FROM person WHERE id=$1 AND NOT totp_enabled", personID); err != nil || !secret.Valid {
+		return nil, errTOTPNotEnrolled
+	}
+
+	step, ok := verifyTOTP(secret.String, code, time.Now())
+	if !ok {
+		return nil, errInvalidSecondFactor
+	}
+
+	if _, err := conn.db.Exec("UPDATE person SET totp_enabled=TRUE, totp_last_step=$2 WHERE id=$1", personID, step); err != nil {
+		return nil, err
+	}
+	return conn.replaceRecoveryCodes(personID)
+}
+
+// verifySecondFactor accepts a TOTP code or an unused recovery code. A TOTP
+// code is only accepted once.
+func (conn dbConnection) verifySecondFactor(personID, code string) error {
+	var secret sql.NullString
+	if err := conn.db.Get(&secret, "SELECT totp_secret FROM person WHERE id=$1 AND totp_enabled", personID); err != nil || !secret.Valid {
+		return errTOTPNotEnrolled
+	}
+
+	if step, ok := verifyTOTP(secret.String, code, time.Now()); ok {
+		res, err := conn.db.Exec("UPDATE person SET totp_last_step=$2 WHERE id=$1 AND totp_last_step < $2", personID, step)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return errInvalidSecondFactor
+		}
+		return nil
+	}
+
+	res, err := conn.db.Exec("UPDATE recovery_code SET used_at=NOW() WHERE person_id=$1 AND code_hash=$2 AND used_at IS NULL",
+		personID, hashToken(normalizeRecoveryCode(code)))
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errInvalidSecondFactor
+	}
+	return nil
+}
+
+// regenerateRecoveryCodes replaces the recovery codes after checking a second factor.
+func (conn dbConnection) regenerateRecoveryCodes(personID, code string) ([]string, error) {
+	if err := conn.verifySecondFactor(personID, code); err != nil {
+		return nil, err
+	}
+	return conn.replaceRecoveryCodes(personID)
+}
+
+// disableTOTP turns TOTP off after checking a second factor, unless a role of
+// the person requires it.
+func (conn dbConnection) disableTOTP(personID, code string) error {
+	if _, required, err := conn.twoFactorStatus(personID); err != nil {
+		return err
+	} else if required {
+		return errTwoFactorRequired
+	}
+
+	if err := conn.verifySecondFactor(personID, code); err != nil {
+		return err
+	}
+
+	// The recovery codes go along with the secret, so that none of them works once
+	// 2FA is off.
+	tx, err := conn.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if _, err = tx.Exec("UPDATE person SET totp_enabled=FALSE, totp_secret=NULL, totp_last_step=0 WHERE id=$1", personID); err != nil {
+		return err
+	}
+	if _, err = tx.Exec("DELETE FROM recovery_code WHERE person_id=$1", personID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (conn dbConnection) replaceRecoveryCodes(personID string) ([]string, error) {
+	tx, err := conn.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if _, err = tx.Exec("DELETE FROM recovery_code WHERE person_id=$1", personID); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		codes[i] = newRecoveryCode()
+
+		if _, err = tx.Exec("INSERT INTO recovery_code(person_id, code_hash) VALUES ($1, $2)", personID, hashToken(normalizeRecoveryCode(codes[i]))); err != nil {
+			return nil, err
+		}
+	}
+
+	return codes, tx.Commit()
+}
+
+// newRecoveryCode returns a code like "abcde-12345", it is shown to the person once.
+func newRecoveryCode() string {
+	code := strings.ToLower(uniuri.NewLen(10))
+	return code[:5] + "-" + code[5:]
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The SHA1 test vectors of RFC 6238, truncated to six digits.
+func Test_totpCode(t *testing.T) {
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+
+	tests := []struct {
+		unix     int64
+		expected string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{20000000000, "353130"},
+	}
+	for _, test := range tests {
+		code, err := totpCode(secret, test.unix/totpPeriod)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != test.expected {
+			t.Fatalf("Expected %s at %d, but got %s", test.expected, test.unix, code)
+		}
+	}
+}
+
+func Test_verifyTOTP(t *testing.T) {
+	secret := newTOTPSecret()
+	now := time.Unix(1700000000, 0)
+
+	previous, _ := totpCode(secret, now.Unix()/totpPeriod-1)
+	if step, ok := verifyTOTP(secret, previous, now); !ok || step != now.Unix()/totpPeriod-1 {
+		t.Fatalf("Expected the code of the previous period to be accepted")
+	}
+
+	old, _ := totpCode(secret, now.Unix()/totpPeriod-2)
+	if _, ok := verifyTOTP(secret, old, now); ok {
+		t.Fatalf("Expected a code two periods old to be rejected")
+	}
+}
+
+func Test_totpURI(t *testing.T) {
+	u, err := url.Parse(totpURI("Report Card", "admin@example.com", "ABC"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u.Scheme != "otpauth" || u.Host != "totp" || u.Path != "/Report Card:admin@example.com" {
+		t.Fatalf("Unexpected URI %s", u)
+	}
+	if u.Query().Get("secret") != "ABC" || u.Query().Get("issuer") != "Report Card" {
+		t.Fatalf("Unexpected query %s", u.RawQuery)
+	}
+}
+
+// enableTOTP enrolls the person in TOTP and returns the recovery codes.
+func enableTOTP(t *testing.T, s testServer, personID string) []string {
+	t.Helper()
+
+	var enrollment struct{ Secret string }
+	if status := s.do(http.MethodPost, "/2fa/enroll", "", personID, &enrollment); status != http.StatusOK {
+		t.Fatalf("Expected an enrollment, but got %d", status)
+	}
+
+	code, err := totpCode(enrollment.Secret, time.Now().Unix()/totpPeriod)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var confirmed struct{ RecoveryCodes []string }
+	if status := s.do(http.MethodPost, "/2fa/confirm", `{"Code":"`+code+`"}`, personID, &confirmed); status != http.StatusOK {
+		t.Fatalf("Expected the enrollment to be confirmed, but got %d", status)
+	}
+	return confirmed.RecoveryCodes
+}
+
+// Test_loginSecondFactor_throttle checks that failed second factors lock the
+// account even when every guess comes from another IP with a new challenge of the
+// right password, and that a throttled request doesn't use up the challenge.
+func Test_loginSecondFactor_throttle(t *testing.T) {
+	cfg := testConfig()
+	s := newTestServer(t, cfg)
+	recoveryCodes := enableTOTP(t, s, demoStudentID)
+
+	ip := 0
+	fromNewIP := func(path, body string, v any) int {
+		ip++
+		r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		r.RemoteAddr = fmt.Sprintf("10.0.1.%d:1234", ip)
+		return s.serve(r, v)
+	}
+	challenge := func() (string, int) {
+		var body struct{ Challenge string }
+		status := fromNewIP("/login", `{"Email":"test1@test.com","Password":"test_pas_123"}`, &body)
+		return body.Challenge, status
+	}
+
+	kept, status := challenge()
+	if status != http.StatusOK || kept == "" {
+		t.Fatalf("Expected a challenge, but got %d", status)
+	}
+
+	for i := 0; i <= cfg.Login.FreeAttempts; i++ {
+		c, status := challenge()
+		if status != http.StatusOK {
+			t.Fatalf("Expected the password to pass before guess %d, but got %d", i+1, status)
+		}
+
+		var p problem
+		if status = fromNewIP("/login/2fa", `{"Challenge":"`+c+`","Code":"00000-00000"}`, &p); p.Code != "invalid_second_factor" {
+			t.Fatalf("Expected guess %d to fail, but got %d %s", i+1, status, p.Code)
+		}
+	}
+
+	if _, status = challenge(); status != http.StatusTooManyRequests {
+		t.Fatalf("Expected the right password to wait after the failed guesses, but got %d", status)
+	}
+
+	body := `{"Challenge":"` + kept + `","Code":"` + recoveryCodes[0] + `"}`
+	if status = fromNewIP("/login/2fa", body, nil); status != http.StatusTooManyRequests {
+		t.Fatalf("Expected the right code to wait, but got %d", status)
+	}
+
+	if err := s.db.unlockLogin(throttleAccount, "test1@test.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	var tokens tokenPair
+	if status = fromNewIP("/login/2fa", body, &tokens); status != http.StatusOK || tokens.Token == "" {
+		t.Fatalf("Expected the kept challenge to log in, but got %d", status)
+	}
+}
+
+func Test_twoFactorDisable(t *testing.T) {
+	s := newTestServer(t, testConfig())
+	recoveryCodes := enableTOTP(t, s, demoStudentID)
+
+	if status := s.do(http.MethodPost, "/2fa/disable", `{"Code":"`+recoveryCodes[0]+`"}`, demoStudentID, nil); status != http.StatusOK {
+		t.Fatalf("Expected 2FA to be disabled, but got %d", status)
+	}
+
+	login(t, s, "test1@test.com")
+
+	var p problem
+	if status := s.do(http.MethodPost, "/2fa/recovery-codes", `{"Code":"`+recoveryCodes[1]+`"}`, demoStudentID, &p); status != http.StatusBadRequest || p.Code != "totp_not_enrolled" {
+		t.Fatalf("Expected the recovery codes to be gone, but got %d %s", status, p.Code)
+	}
+}
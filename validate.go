@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Models declare their rules in a validate tag, like `validate:"required,max=100"`.
+// The rules are checked in order and the first one a field breaks is reported:
+//
+//	required            the field must not be empty
+//	required_on_create  the field must not be empty when the record is created
+//	min=N, max=N        bounds of a number, or of the length of a string
+//	format=NAME         the string must match the named pattern in formats
+//
+// Empty strings that aren't required skip the other rules, numbers are always
+// checked.
+
+// formats are the patterns of the format rule. They match the checks of the
+// database, so a valid request doesn't fail on a constraint.
+var formats = map[string]*regexp.Regexp{
+	"email":         regexp.MustCompile(`^[A-Za-z0-9._%-]+@[A-Za-z0-9.-]+[.][A-Za-z]+$`),
+	"phone":         regexp.MustCompile(`^\+?[0-9][0-9 -]{4,18}[0-9]$`),
+	"facultyNumber": regexp.MustCompile(`^\d{8}$`),
+	"uuid":          regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`),
+}
+
+// fieldError is a field of the request that breaks one of its rules.
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// validationError lists every invalid field of a request, so the caller can fix
+// them all at once.
+type validationError []fieldError
+
+func (e validationError) Error() string {
+	fields := make([]string, len(e))
+	for i, v := range e {
+		fields[i] = v.Field + " " + v.Message
+	}
+	return strings.Join(fields, ", ")
+}
+
+// validate checks the fields of the struct v points to against their rules.
+// create tells whether the request creates the record, and so has to set the
+// fields that are only required then.
+func validate(v any, create bool) error {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	rt := rv.Type()
+
+	var errs validationError
+	for i := 0; i < rt.NumField(); i++ {
+		f := rt.Field(i)
+		rules, ok := f.Tag.Lookup("validate")
+		if !ok {
+			continue
+		}
+
+		if msg := checkField(rv.Field(i), rules, create); msg != "" {
+			errs = append(errs, fieldError{Field: jsonName(f), Message: msg})
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func checkField(v reflect.Value, rules string, create bool) string {
+	for _, rule := range strings.Split(rules, ",") {
+		name, arg, _ := strings.Cut(rule, "=")
+
+		switch name {
+		case "required":
+			if v.IsZero() {
+				return "is required"
+			}
+		case "required_on_create":
+			if create && v.IsZero() {
+				return "is required"
+			}
+		case "min", "max":
+			if v.Kind() == reflect.String && v.Len() == 0 {
+				return ""
+			}
+
+			bound, err := strconv.Atoi(arg)
+			if err != nil {
+				panic(fmt.Sprintf("invalid validation rule %q", rule))
+			}
+			if n := size(v); name == "min" && n < bound {
+				return fmt.Sprintf("must be at least %d%s", bound, unit(v))
+			} else if name == "max" && n > bound {
+				return fmt.Sprintf("must be at most %d%s", bound, unit(v))
+			}
+		case "format":
+			pattern, ok := formats[arg]
+			if !ok {
+				panic(fmt.Sprintf("unknown format %q", arg))
+			}
+			if s := v.String(); s != "" && !pattern.MatchString(s) {
+				return "must be a valid " + arg
+			}
+		default:
+			panic(fmt.Sprintf("unknown validation rule %q", rule))
+		}
+	}
+	return ""
+}
+
+// size is the value of a number, or the length of a string in characters.
+func size(v reflect.Value) int {
+	if v.Kind() == reflect.String {
+		return utf8.RuneCountInString(v.String())
+	}
+	return int(v.Int())
+}
+
+func unit(v reflect.Value) string {
+	if v.Kind() == reflect.String {
+		return " characters"
+	}
+	return ""
+}
+
+// jsonName is the name of the field in the request body.
+func jsonName(f reflect.StructField) string {
+	if name, _, _ := strings.Cut(f.Tag.Get("json"), ","); name != "" && name != "-" {
+		return name
+	}
+	return f.Name
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_validate(t *testing.T) {
+	tests := []struct {
+		name   string
+		v      any
+		create bool
+		errs   validationError
+	}{
+		{"Valid exam", Exam{StudentFacultyNumber: "12312312", CourseName: "Math", Points: 42}, true, nil},
+		{
+			"Every invalid field",
+			Exam{StudentFacultyNumber: "123", Points: 101},
+			true,
+			validationError{{"StudentFacultyNumber", "must be a valid facultyNumber"}, {"CourseName", "is required"}, {"Points", "must be at most 100"}},
+		},
+		{"Zero points", Exam{StudentFacultyNumber: "12312312", CourseName: "Math"}, true, validationError{{"Points", "must be at least 1"}}},
+		{"Valid student", Student{Name: "Ivan", Phone: "+359 88 123 4567", Email: "ivan@test.com"}, true, nil},
+		{"Optional phone", Student{Name: "Ivan", Email: "ivan@test.com"}, true, nil},
+		{"Invalid phone", Student{Name: "Ivan", Phone: "call me", Email: "ivan@test.com"}, true, validationError{{"Phone", "must be a valid phone"}}},
+		{"Student without email", Student{Name: "Ivan"}, true, validationError{{"Email", "is required"}}},
+		{"Student update without email", Student{Name: "Ivan"}, false, nil},
+		{"Invalid email", Teacher{Name: "Ivan", Email: "ivan@"}, false, validationError{{"Email", "must be a valid email"}}},
+		{"Long name", Teacher{Name: strings.Repeat("a", 101), Email: "ivan@test.com"}, true, validationError{{"Name", "must be at most 100 characters"}}},
+		{
+			"Invalid course",
+			Course{TeacherId: "1", NumberOfSeats: 0},
+			false,
+			validationError{{"TeacherId", "must be a valid uuid"}, {"Name", "is required"}, {"NumberOfSeats", "must be at least 1"}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := validate(test.v, test.create)
+			if test.errs == nil {
+				if err != nil {
+					t.Fatalf("Expected no error, but got %v", err)
+				}
+				return
+			}
+
+			if !reflect.DeepEqual(err, test.errs) {
+				t.Fatalf("Expected %v, but got %v", test.errs, err)
+			}
+		})
+	}
+}